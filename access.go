@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// defaultMaxReaders is how many users may read a secret before `audit
+// --access` flags it.
+const defaultMaxReaders = 10
+
+// accessFinding is access which looks broader than it should be, and how to
+// narrow it.
+type accessFinding struct {
+	Kind    string   `json:"kind"`
+	User    username `json:"user,omitempty"`
+	Secret  string   `json:"secret,omitempty"`
+	Message string   `json:"message"`
+	Fix     string   `json:"fix,omitempty"`
+}
+
+// isMachine reports whether the user is a machine identity, such as a KMS
+// key or an age recipient, which has no password.
+func (s *shh) isMachine(u username) bool {
+	if isKMSKey(u) || isAgeRecipient(u) {
+		return true
+	}
+	block := s.Keys[u]
+	return block != nil && block.Type == kmsBlockType
+}
+
+// denyCommand suggests how to deny the user the secret, or every secret if
+// name is empty. It works outside any environment, since names include
+// theirs. Either may be a placeholder such as $user.
+func denyCommand(u username, name string) string {
+	cmd := "shh deny "
+	if environment != "" {
+		cmd = "shh -e '' deny "
+	}
+	cmd += string(u)
+	switch {
+	case strings.HasPrefix(name, "$"):
+		cmd += " " + name
+	case name != "":
+		cmd += " '" + name + "'"
+	}
+	return cmd
+}
+
+// findOverbroadAccess flags users who can read every secret, secrets read by
+// more than maxReaders users, secrets held for keys which aren't in the
+// project or don't match their pin, and sensitive secrets held by machine
+// identities, which can't be asked for a password.
+func findOverbroadAccess(s *shh, maxReaders int) []accessFinding {
+	var findings []accessFinding
+	access := secretAccess(s)
+	names := make([]string, 0, len(access))
+	for name := range access {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	users := map[username]struct{}{}
+	for u := range s.Secrets {
+		users[u] = struct{}{}
+	}
+	for u := range s.Keys {
+		users[u] = struct{}{}
+	}
+	sorted := sortedUsernames(users)
+
+	for _, u := range sorted {
+		n := len(s.Secrets[u])
+		if n == 0 {
+			continue
+		}
+		block, hasKey := s.Keys[u]
+		switch {
+		case !hasKey && !isAgeRecipient(u):
+			findings = append(findings, accessFinding{
+				Kind:    "unknown-key",
+				User:    u,
+				Message: fmt.Sprintf("%s holds %d secrets but has no key in the project", u, n),
+				Fix:     denyCommand(u, ""),
+			})
+		case hasKey && s.Pins[u] != "" && keyFingerprint(block) != s.Pins[u]:
+			findings = append(findings, accessFinding{
+				Kind:    "revoked-key",
+				User:    u,
+				Message: fmt.Sprintf("%s holds %d secrets for a key other than the one pinned", u, n),
+				Fix:     denyCommand(u, ""),
+			})
+		}
+		if len(sorted) > 1 && len(names) > 1 && n == len(names) {
+			findings = append(findings, accessFinding{
+				Kind:    "every-secret",
+				User:    u,
+				Message: fmt.Sprintf("%s can read every secret (%d)", u, n),
+				Fix:     denyCommand(u, "$secret") + " for those they don't need",
+			})
+		}
+	}
+	for _, name := range names {
+		readers := accessUsers(access[name])
+		if len(readers) > maxReaders {
+			findings = append(findings, accessFinding{
+				Kind:   "many-readers",
+				Secret: name,
+				Message: fmt.Sprintf("%s is readable by %d users, more than %d",
+					name, len(readers), maxReaders),
+				Fix: denyCommand("$user", name) + " for those who don't need it",
+			})
+		}
+		// Copies for age recipients don't record it, so any copy being
+		// sensitive makes the secret so
+		var sensitive bool
+		for _, sec := range access[name] {
+			sensitive = sensitive || sec.Sensitive
+		}
+		for _, u := range readers {
+			if sensitive && s.isMachine(u) {
+				findings = append(findings, accessFinding{
+					Kind:   "machine-sensitive",
+					User:   u,
+					Secret: name,
+					Message: fmt.Sprintf("machine identity %s holds sensitive %s",
+						u, name),
+					Fix: denyCommand(u, name),
+				})
+			}
+		}
+	}
+	return findings
+}
+
+// auditAccess reports access which looks broader than it should be.
+func auditAccess(glob string, maxReaders int) error {
+	const (
+		promises     = "stdio rpath wpath cpath tty inet dns proc exec"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	shh, err := shhFromPath(".shh")
+	if err != nil {
+		return err
+	}
+	var findings []accessFinding
+	for _, f := range findOverbroadAccess(shh, maxReaders) {
+		if f.Secret == "" || globMatch(glob, f.Secret) {
+			findings = append(findings, f)
+		}
+	}
+	if jsonOutput {
+		if err = printJSON(append([]accessFinding{}, findings...)); err != nil {
+			return err
+		}
+	} else {
+		for _, f := range findings {
+			fmt.Println(f.Message)
+			if f.Fix != "" {
+				fmt.Println("  " + f.Fix)
+			}
+		}
+	}
+	if len(findings) > 0 {
+		return fmt.Errorf("access problems: %d", len(findings))
+	}
+	if !jsonOutput {
+		notef(os.Stdout, "no over-broad access found\n")
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// actionsExport makes secrets available to later steps of a GitHub Actions
+// job. Each value is masked in the log with ::add-mask:: and then appended to
+// $GITHUB_ENV and, with --output, to $GITHUB_OUTPUT. This lets self-hosted
+// runners read secrets from the committed .shh with a machine key rather than
+// duplicating them into repository settings.
+func actionsExport(nonInteractive bool, args []string) error {
+	fs := flag.NewFlagSet("actions-export", flag.ContinueOnError)
+	manifest := fs.String("manifest", "", "file listing secrets to export")
+	noEnv := fs.Bool("no-env", false, "don't write to $GITHUB_ENV")
+	output := fs.Bool("output", false, "write to $GITHUB_OUTPUT")
+	var naming envNaming
+	naming.flags(fs)
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 && *manifest == "" {
+		return errors.New("bad args: expected `actions-export $secret...`")
+	}
+
+	// Find the files before decrypting anything
+	var files []string
+	if !*noEnv {
+		files = append(files, "GITHUB_ENV")
+	}
+	if *output {
+		files = append(files, "GITHUB_OUTPUT")
+	}
+	if len(files) == 0 {
+		return errors.New("nothing to export: --no-env without --output")
+	}
+	for _, name := range files {
+		if os.Getenv(name) == "" {
+			return fmt.Errorf("$%s not set. run this in github actions",
+				name)
+		}
+	}
+
+	const (
+		promises     = "stdio rpath wpath cpath tty proc exec inet dns"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	specs, err := envSpecsFromArgs(*manifest, args)
+	if err != nil {
+		return err
+	}
+	vars, err := decryptEnv(nonInteractive, specs, naming)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, v := range vars {
+			v.Value.Destroy()
+		}
+	}()
+
+	// Mask every value before it can appear anywhere in the log. The
+	// runner masks line by line, so multi-line values mask each line.
+	for _, v := range vars {
+		for _, line := range strings.Split(string(v.Value), "\n") {
+			line = strings.TrimSuffix(line, "\r")
+			if line == "" {
+				continue
+			}
+			fmt.Println("::add-mask::" + escapeWorkflowCommand(line))
+		}
+	}
+
+	var buf bytes.Buffer
+	defer func() { wipe(buf.Bytes()) }()
+	for _, v := range vars {
+		delim, err := heredocDelimiter(string(v.Value))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&buf, "%s<<%s\n%s\n%s\n", v.Name, delim, v.Value, delim)
+	}
+	for _, name := range files {
+		if err = appendFile(os.Getenv(name), buf.Bytes()); err != nil {
+			return fmt.Errorf("write $%s: %w", name, err)
+		}
+	}
+	for _, v := range vars {
+		notef(os.Stderr, "exported %s\n", v.Name)
+	}
+	return nil
+}
+
+// escapeWorkflowCommand escapes data for a workflow command, matching
+// @actions/core.
+func escapeWorkflowCommand(s string) string {
+	r := strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A")
+	return r.Replace(s)
+}
+
+// heredocDelimiter returns a random delimiter which doesn't appear in the
+// value, so a value can't inject other variables.
+func heredocDelimiter(val string) (string, error) {
+	byt := make([]byte, 16)
+	if _, err := rand.Read(byt); err != nil {
+		return "", fmt.Errorf("read rand: %w", err)
+	}
+	delim := "ghadelimiter_" + hex.EncodeToString(byt)
+	if strings.Contains(val, delim) {
+		return "", errors.New("value contains the delimiter")
+	}
+	return delim, nil
+}
+
+func appendFile(pth string, data []byte) error {
+	fi, err := os.OpenFile(pth, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = fi.Write(data); err != nil {
+		fi.Close()
+		return err
+	}
+	return fi.Close()
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	ageRecipientPrefix = "age1"
+	ageChunkSize       = 64 * 1024
+
+	bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+)
+
+// isAgeRecipient reports whether the user is an age X25519 public key rather
+// than a project user. Secrets allowed to a recipient are stored as armored
+// age files, which the standard age tool can decrypt.
+func isAgeRecipient(u username) bool {
+	return strings.HasPrefix(string(u), ageRecipientPrefix)
+}
+
+// encryptAgeSecret encrypts the plaintext for an age recipient. The secret
+// has no AES key: its value is the whole armored age file.
+func encryptAgeSecret(recipient string, plaintext []byte) (secret, error) {
+	pubKey, err := parseAgeRecipient(recipient)
+	if err != nil {
+		return secret{}, err
+	}
+	armored, err := ageEncrypt(pubKey, plaintext)
+	if err != nil {
+		return secret{}, err
+	}
+	return secret{Encrypted: armored}, nil
+}
+
+// parseAgeRecipient decodes an age1... recipient to its X25519 public key.
+func parseAgeRecipient(s string) ([]byte, error) {
+	hrp, data, err := bech32Decode(s)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", s, err)
+	}
+	if hrp != "age" || len(data) != curve25519.PointSize {
+		return nil, fmt.Errorf("%s: not an age x25519 recipient", s)
+	}
+	return data, nil
+}
+
+// ageEncrypt encrypts the plaintext in the age v1 format for one X25519
+// recipient, armored so it can be stored as text.
+func ageEncrypt(pubKey, plaintext []byte) (string, error) {
+	fileKey := newSecureBytes(make([]byte, 16))
+	defer fileKey.Destroy()
+	if _, err := rand.Read(fileKey); err != nil {
+		return "", err
+	}
+
+	// Wrap the file key using an ephemeral X25519 key
+	ephemeral := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(ephemeral); err != nil {
+		return "", err
+	}
+	share, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
+	if err != nil {
+		return "", err
+	}
+	shared, err := curve25519.X25519(ephemeral, pubKey)
+	wipe(ephemeral)
+	if err != nil {
+		return "", err
+	}
+	defer wipe(shared)
+	salt := append(append([]byte{}, share...), pubKey...)
+	wrapKey, err := ageHKDF(shared, salt, "age-encryption.org/v1/X25519")
+	if err != nil {
+		return "", err
+	}
+	defer wipe(wrapKey)
+	aead, err := chacha20poly1305.New(wrapKey)
+	if err != nil {
+		return "", err
+	}
+	body := aead.Seal(nil, make([]byte, chacha20poly1305.NonceSize), fileKey, nil)
+
+	// Write the header, authenticated with a key derived from the file key
+	b64 := base64.RawStdEncoding
+	var buf bytes.Buffer
+	buf.WriteString("age-encryption.org/v1\n")
+	buf.WriteString("-> X25519 " + b64.EncodeToString(share) + "\n")
+	buf.WriteString(b64.EncodeToString(body) + "\n")
+	buf.WriteString("---")
+	hmacKey, err := ageHKDF(fileKey, nil, "header")
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, hmacKey)
+	mac.Write(buf.Bytes())
+	buf.WriteString(" " + b64.EncodeToString(mac.Sum(nil)) + "\n")
+
+	// Encrypt the payload in chunks, flagging the last
+	nonce := make([]byte, 16)
+	if _, err = rand.Read(nonce); err != nil {
+		return "", err
+	}
+	buf.Write(nonce)
+	payloadKey, err := ageHKDF(fileKey, nonce, "payload")
+	if err != nil {
+		return "", err
+	}
+	defer wipe(payloadKey)
+	aead, err = chacha20poly1305.New(payloadKey)
+	if err != nil {
+		return "", err
+	}
+	chunkNonce := make([]byte, chacha20poly1305.NonceSize)
+	for i := 0; ; i++ {
+		end := (i + 1) * ageChunkSize
+		if end > len(plaintext) {
+			end = len(plaintext)
+		}
+		binary.BigEndian.PutUint64(chunkNonce[3:11], uint64(i))
+		last := end == len(plaintext)
+		if last {
+			chunkNonce[11] = 1
+		}
+		buf.Write(aead.Seal(nil, chunkNonce, plaintext[i*ageChunkSize:end], nil))
+		if last {
+			break
+		}
+	}
+
+	// Armor the file with 64-column lines
+	enc := base64.StdEncoding.EncodeToString(buf.Bytes())
+	var armored strings.Builder
+	armored.WriteString("-----BEGIN AGE ENCRYPTED FILE-----\n")
+	for len(enc) > 64 {
+		armored.WriteString(enc[:64] + "\n")
+		enc = enc[64:]
+	}
+	armored.WriteString(enc + "\n")
+	armored.WriteString("-----END AGE ENCRYPTED FILE-----\n")
+	return armored.String(), nil
+}
+
+func ageHKDF(secret, salt []byte, info string) ([]byte, error) {
+	key := make([]byte, 32)
+	r := hkdf.New(sha256.New, secret, salt, []byte(info))
+	if _, err := io.ReadFull(r, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// bech32Decode decodes a bech32 string, as used by age keys, into its
+// human-readable part and data.
+func bech32Decode(s string) (string, []byte, error) {
+	if strings.ToLower(s) != s && strings.ToUpper(s) != s {
+		return "", nil, errors.New("mixed case")
+	}
+	s = strings.ToLower(s)
+	sep := strings.LastIndexByte(s, '1')
+	if sep < 1 || sep+7 > len(s) {
+		return "", nil, errors.New("bad bech32 separator")
+	}
+	hrp := s[:sep]
+	values := make([]byte, 0, len(s)-sep-1)
+	for _, c := range s[sep+1:] {
+		i := strings.IndexRune(bech32Charset, c)
+		if i < 0 {
+			return "", nil, fmt.Errorf("bad bech32 character %q", c)
+		}
+		values = append(values, byte(i))
+	}
+	expanded := make([]byte, 0, len(hrp)*2+1+len(values))
+	for _, c := range hrp {
+		expanded = append(expanded, byte(c>>5))
+	}
+	expanded = append(expanded, 0)
+	for _, c := range hrp {
+		expanded = append(expanded, byte(c&31))
+	}
+	if bech32Polymod(append(expanded, values...)) != 1 {
+		return "", nil, errors.New("bad bech32 checksum")
+	}
+
+	// Convert the 5-bit groups, less the checksum, to bytes
+	var data []byte
+	var acc uint32
+	var bits uint
+	for _, v := range values[:len(values)-6] {
+		acc = acc<<5 | uint32(v)
+		bits += 5
+		for bits >= 8 {
+			bits -= 8
+			data = append(data, byte(acc>>bits))
+		}
+	}
+	if bits >= 5 || acc&(1<<bits-1) != 0 {
+		return "", nil, errors.New("bad bech32 padding")
+	}
+	return hrp, data, nil
+}
+
+func bech32Polymod(values []byte) uint32 {
+	gen := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd,
+		0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := uint(0); i < 5; i++ {
+			if (top>>i)&1 == 1 {
+				chk ^= gen[i]
+			}
+		}
+	}
+	return chk
+}
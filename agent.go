@@ -0,0 +1,611 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/awnumar/memguard"
+)
+
+const (
+	// agentTokenFile is written by the server to the runtime directory on
+	// login. Clients prove they're the user by showing they can read it.
+	agentTokenFile = "agent.token"
+
+	// challengeTTL is how long clients have to answer a challenge.
+	challengeTTL = 30 * time.Second
+)
+
+// agent holds users' decrypted private keys in memory for a limited time,
+// decrypting AES keys on behalf of clients. Each identity is keyed by its
+// config directory, so one server can hold keys for several identities at
+// once. Clients must answer a single-use challenge with an HMAC keyed by the
+// identity's token, which only the user can read, before the agent uses,
+// extends, clears, or reports on an identity. Neither the password nor the
+// private key ever leaves the agent.
+type agent struct {
+	port int
+	ttl  time.Duration
+
+	// configBase is the config directory of the agent's own identity. Only
+	// it and its profiles may log in.
+	configBase string
+
+	mu         sync.Mutex
+	identities map[string]*identity
+	challenges map[string]time.Time
+	metrics    agentMetrics
+}
+
+// agentMetrics are counters exposed in the Prometheus text format on
+// /metrics.
+type agentMetrics struct {
+	logins      uint64
+	failedAuths uint64
+	decrypts    uint64
+	resets      uint64
+	expirations uint64
+}
+
+// identity is a private key held by the agent.
+type identity struct {
+	username  username
+	token     []byte
+	key       *memguard.Enclave
+	expiresAt time.Time
+	timer     *time.Timer
+}
+
+// agentLoginReq asks the agent to decrypt and hold a private key.
+type agentLoginReq struct {
+	Config   string `json:"config"`
+	Password []byte `json:"password"`
+}
+
+// agentDecryptReq asks the agent to decrypt an AES key. MAC is the
+// hex-encoded HMAC-SHA256 of the challenge followed by the encrypted key,
+// using the identity's token.
+type agentDecryptReq struct {
+	Config    string `json:"config"`
+	Challenge string `json:"challenge"`
+	MAC       string `json:"mac"`
+	Key       string `json:"key"`
+}
+
+type agentDecryptResp struct {
+	Key string `json:"key"`
+}
+
+func newAgent(configBase string, port int, ttl time.Duration) *agent {
+	return &agent{
+		port:       port,
+		ttl:        ttl,
+		configBase: configBase,
+		identities: map[string]*identity{},
+		challenges: map[string]time.Time{},
+	}
+}
+
+func (a *agent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	debug("agent request", "method", r.Method, "path", r.URL.Path)
+	if r.URL.Path == "/ping" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	switch {
+	case r.URL.Path == "/status" && r.Method != "POST":
+		a.liveness(w)
+	case r.URL.Path == "/challenge":
+		a.challenge(w)
+	case r.URL.Path == "/metrics":
+		a.writeMetrics(w)
+	case r.Method != "POST":
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	case r.URL.Path == "/status":
+		a.status(w, r)
+	case r.URL.Path == "/login":
+		a.login(w, r)
+	case r.URL.Path == "/logout", r.URL.Path == "/logout-all":
+		a.logout(w, r)
+	case r.URL.Path == "/reset-timer":
+		a.resetTimer(w, r)
+	case r.URL.Path == "/decrypt":
+		a.decrypt(w, r)
+	case r.URL.Path == "/sign":
+		a.sign(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// liveness reports only that the agent is running, for clients which can't
+// authenticate.
+func (a *agent) liveness(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(agentStatus{Port: a.port})
+}
+
+// status reports the identities held to an authenticated client.
+func (a *agent) status(w http.ResponseWriter, r *http.Request) {
+	_, id, ok := a.authenticateControl(w, r)
+	if !ok {
+		return
+	}
+	stat := agentStatus{
+		Port:      a.port,
+		Username:  id.username,
+		LoggedIn:  true,
+		ExpiresIn: int(time.Until(id.expiresAt).Seconds()),
+	}
+	for _, other := range a.identities {
+		stat.Identities = append(stat.Identities, other.username)
+	}
+	sort.Slice(stat.Identities, func(i, j int) bool {
+		return stat.Identities[i] < stat.Identities[j]
+	})
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(stat)
+}
+
+// login decrypts the private key in the config directory using the password
+// and holds it in memory. A new token for the identity is written to the
+// runtime directory with 0600 permissions. Only the agent's own config
+// directory and its profiles are accepted, so other users can't have the
+// agent read or write directories they choose.
+func (a *agent) login(w http.ResponseWriter, r *http.Request) {
+	req := agentLoginReq{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err == nil && (req.Config == "" || len(req.Password) == 0) {
+		err = errors.New("missing config or password")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	a.metrics.logins++
+	configPath := filepath.Clean(req.Config)
+	if err = a.allowed(configPath); err != nil {
+		wipe(req.Password)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	keys, err := getKeys(configPath, req.Password)
+	wipe(req.Password)
+	if err != nil {
+		a.metrics.failedAuths++
+	}
+	if errors.Is(err, errLockedOut) {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	conf, err := configFromPath(configPath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	token := make([]byte, 32)
+	if _, err = rand.Read(token); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	pth := filepath.Join(runtimePath(configPath), agentTokenFile)
+	if err = writeAgentToken(pth, token); err != nil {
+		http.Error(w, fmt.Sprintf("write token: %s", err),
+			http.StatusInternalServerError)
+		return
+	}
+	if id, ok := a.identities[configPath]; ok && id.timer != nil {
+		id.timer.Stop()
+	}
+	der := x509.MarshalPKCS1PrivateKey(keys.PrivateKey)
+	id := &identity{
+		username: conf.Username,
+		token:    token,
+		key:      memguard.NewEnclave(der),
+	}
+	wipe(der)
+	a.identities[configPath] = id
+	a.extend(configPath, id)
+	w.WriteHeader(http.StatusOK)
+}
+
+// allowed reports an error unless the config directory is the agent's own or
+// one of its profiles.
+func (a *agent) allowed(configPath string) error {
+	if configPath == a.configBase {
+		return nil
+	}
+	dir, name := filepath.Split(configPath)
+	if filepath.Clean(dir) == filepath.Join(a.configBase, "profiles") &&
+		name != "" && validateProfile(name) == nil {
+		return nil
+	}
+	return fmt.Errorf("%s is not a config directory of this server", configPath)
+}
+
+// writeAgentToken replaces the identity's token. The file is created anew
+// and never through a link, so nothing planted in its place is written.
+func writeAgentToken(pth string, token []byte) error {
+	if err := os.MkdirAll(filepath.Dir(pth), 0700); err != nil {
+		return err
+	}
+	if err := os.Remove(pth); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	fi, err := os.OpenFile(pth, os.O_WRONLY|os.O_CREATE|os.O_EXCL|oNoFollow,
+		0600)
+	if err != nil {
+		return err
+	}
+	_, err = fi.Write([]byte(hex.EncodeToString(token)))
+	if cerr := fi.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// logout clears the identity's private key from memory. /logout-all clears
+// every identity, but still requires the client to authenticate as one of
+// them.
+func (a *agent) logout(w http.ResponseWriter, r *http.Request) {
+	configPath, _, ok := a.authenticateControl(w, r)
+	if !ok {
+		return
+	}
+	if r.URL.Path == "/logout-all" {
+		configPath = ""
+	}
+	a.clear(configPath)
+	w.WriteHeader(http.StatusOK)
+}
+
+// clear the identity's private key from memory, or all identities if
+// configPath is empty. The caller must hold the lock.
+func (a *agent) clear(configPath string) {
+	for pth, id := range a.identities {
+		if configPath != "" && pth != filepath.Clean(configPath) {
+			continue
+		}
+		if id.timer != nil {
+			id.timer.Stop()
+		}
+		delete(a.identities, pth)
+	}
+}
+
+// lock clears all identities, e.g. when the system sleeps or the screen
+// locks.
+func (a *agent) lock() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.clear("")
+}
+
+func (a *agent) resetTimer(w http.ResponseWriter, r *http.Request) {
+	configPath, id, ok := a.authenticateControl(w, r)
+	if !ok {
+		return
+	}
+	a.metrics.resets++
+	a.extend(configPath, id)
+	w.WriteHeader(http.StatusOK)
+}
+
+// extend how long the identity's key is held. The caller must hold the lock.
+func (a *agent) extend(configPath string, id *identity) {
+	id.expiresAt = time.Now().Add(a.ttl)
+	if id.timer != nil {
+		id.timer.Stop()
+	}
+	id.timer = time.AfterFunc(a.ttl, func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		if a.identities[configPath] != id || time.Now().Before(id.expiresAt) {
+			return
+		}
+		a.metrics.expirations++
+		delete(a.identities, configPath)
+	})
+}
+
+// writeMetrics in the Prometheus text exposition format. The caller must hold
+// the lock.
+func (a *agent) writeMetrics(w http.ResponseWriter) {
+	metrics := []struct {
+		name, help, typ string
+		val             uint64
+	}{
+		{"shh_agent_login_requests_total", "Password logins attempted.",
+			"counter", a.metrics.logins},
+		{"shh_agent_failed_auths_total", "Wrong passwords, challenges, and MACs.",
+			"counter", a.metrics.failedAuths},
+		{"shh_agent_decrypt_requests_total", "AES key decryptions requested.",
+			"counter", a.metrics.decrypts},
+		{"shh_agent_timer_resets_total", "Cache timers reset by login.",
+			"counter", a.metrics.resets},
+		{"shh_agent_expirations_total", "Keys cleared after their TTL.",
+			"counter", a.metrics.expirations},
+		{"shh_agent_identities", "Identities currently held.",
+			"gauge", uint64(len(a.identities))},
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", m.name,
+			m.help, m.name, m.typ, m.name, m.val)
+	}
+}
+
+// challenge issues a random single-use challenge.
+func (a *agent) challenge(w http.ResponseWriter) {
+	byt := make([]byte, 32)
+	if _, err := rand.Read(byt); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	for c, exp := range a.challenges {
+		if now.After(exp) {
+			delete(a.challenges, c)
+		}
+	}
+	c := hex.EncodeToString(byt)
+	a.challenges[c] = now.Add(challengeTTL)
+	_, _ = w.Write([]byte(c))
+}
+
+func (a *agent) decrypt(w http.ResponseWriter, r *http.Request) {
+	a.metrics.decrypts++
+	a.useKey(w, r, func(privKey *rsa.PrivateKey, msg []byte) ([]byte, error) {
+		return rsa.DecryptOAEP(sha256.New(), rand.Reader, privKey, msg, nil)
+	})
+}
+
+// sign signs a SHA-256 digest with RSA-PSS, for the audit log.
+func (a *agent) sign(w http.ResponseWriter, r *http.Request) {
+	a.useKey(w, r, func(privKey *rsa.PrivateKey, msg []byte) ([]byte, error) {
+		if len(msg) != sha256.Size {
+			return nil, errors.New("expected a sha-256 digest")
+		}
+		return rsa.SignPSS(rand.Reader, privKey, crypto.SHA256, msg, nil)
+	})
+}
+
+// useKey authenticates the request, then responds with the result of fn on
+// the identity's private key and the request's key field.
+func (a *agent) useKey(w http.ResponseWriter, r *http.Request, fn func(*rsa.PrivateKey, []byte) ([]byte, error)) {
+	_, id, msg, ok := a.authenticate(w, r)
+	if !ok {
+		return
+	}
+	b, err := id.key.Open()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer b.Destroy()
+	privKey, err := x509.ParsePKCS1PrivateKey(b.Bytes())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	out, err := fn(privKey, msg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer wipe(out)
+	resp := agentDecryptResp{Key: base64.StdEncoding.EncodeToString(out)}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// authenticate checks the request's challenge and MAC against the token of
+// the identity it names, responding with an error if either is wrong. It
+// returns the identity's config directory and the request's decoded key
+// field. The caller must hold the lock.
+func (a *agent) authenticate(w http.ResponseWriter, r *http.Request) (string, *identity, []byte, bool) {
+	req := agentDecryptReq{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", nil, nil, false
+	}
+	exp, ok := a.challenges[req.Challenge]
+	delete(a.challenges, req.Challenge)
+	if !ok || time.Now().After(exp) {
+		a.metrics.failedAuths++
+		http.Error(w, "bad challenge", http.StatusUnauthorized)
+		return "", nil, nil, false
+	}
+	configPath := filepath.Clean(req.Config)
+	id, ok := a.identities[configPath]
+	if !ok {
+		http.Error(w, "not logged in", http.StatusUnauthorized)
+		return "", nil, nil, false
+	}
+	msg, err := base64.StdEncoding.DecodeString(req.Key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", nil, nil, false
+	}
+	mac, err := hex.DecodeString(req.MAC)
+	if err != nil || !hmac.Equal(mac, agentMAC(id.token, req.Challenge, msg)) {
+		a.metrics.failedAuths++
+		http.Error(w, "bad mac", http.StatusUnauthorized)
+		return "", nil, nil, false
+	}
+	return configPath, id, msg, true
+}
+
+// authenticateControl authenticates a request which doesn't use the key,
+// such as a logout. Its key field must be the request's path, so an answered
+// challenge can only be used for the action the client intended.
+func (a *agent) authenticateControl(w http.ResponseWriter, r *http.Request) (string, *identity, bool) {
+	configPath, id, msg, ok := a.authenticate(w, r)
+	if !ok {
+		return "", nil, false
+	}
+	if string(msg) != r.URL.Path {
+		a.metrics.failedAuths++
+		http.Error(w, "bad mac", http.StatusUnauthorized)
+		return "", nil, false
+	}
+	return configPath, id, true
+}
+
+// agentMAC proves knowledge of the token for a specific challenge and key.
+func agentMAC(token []byte, challenge string, encrypted []byte) []byte {
+	h := hmac.New(sha256.New, token)
+	_, _ = h.Write([]byte(challenge))
+	_, _ = h.Write(encrypted)
+	return h.Sum(nil)
+}
+
+// agentDecrypter implements crypto.Decrypter using the server, so commands
+// can decrypt secrets without the password or private key.
+type agentDecrypter struct {
+	url        string
+	configPath string
+	token      []byte
+	pubKey     *rsa.PublicKey
+}
+
+// newAgentDecrypter reports an error if the server isn't running or doesn't
+// hold the private key.
+func newAgentDecrypter(configPath string, u *user) (*agentDecrypter, error) {
+	if u.Port <= 0 {
+		return nil, errors.New("no port set in ~/.config/shh/config")
+	}
+	stat, err := statusFromServer(u.Port, configPath)
+	if err != nil {
+		return nil, err
+	}
+	if !stat.LoggedIn {
+		return nil, errors.New(tr("cached password not available. run `shh login`"))
+	}
+	token, err := readAgentToken(configPath)
+	if err != nil {
+		return nil, err
+	}
+	return &agentDecrypter{
+		url:        fmt.Sprint("http://127.0.0.1:", u.Port),
+		configPath: configPath,
+		token:      token,
+		pubKey:     u.Keys.PublicKey,
+	}, nil
+}
+
+// readAgentToken written by the server when the identity in configPath
+// logged in.
+func readAgentToken(configPath string) ([]byte, error) {
+	byt, err := ioutil.ReadFile(filepath.Join(runtimePath(configPath),
+		agentTokenFile))
+	if err != nil {
+		return nil, fmt.Errorf("read token: %w", err)
+	}
+	token, err := hex.DecodeString(string(bytes.TrimSpace(byt)))
+	if err != nil {
+		return nil, fmt.Errorf("decode token: %w", err)
+	}
+	return token, nil
+}
+
+func (d *agentDecrypter) Public() crypto.PublicKey { return d.pubKey }
+
+// Decrypt the AES key using the server. Only RSA-OAEP with SHA-256 is
+// supported, which is what shh uses for all secrets.
+func (d *agentDecrypter) Decrypt(_ io.Reader, msg []byte, _ crypto.DecrypterOpts) ([]byte, error) {
+	return d.call("/decrypt", msg)
+}
+
+// Sign a SHA-256 digest with RSA-PSS using the server.
+func (d *agentDecrypter) Sign(_ io.Reader, digest []byte, _ crypto.SignerOpts) ([]byte, error) {
+	return d.call("/sign", digest)
+}
+
+// call sends msg to an endpoint which uses the private key, authenticating
+// with a fresh challenge.
+func (d *agentDecrypter) call(path string, msg []byte) ([]byte, error) {
+	name := strings.TrimPrefix(path, "/")
+	resp, err := agentPost(d.url, d.configPath, d.token, path, msg)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%s: expected 200, got %d: %s", name,
+			resp.StatusCode, bytes.TrimSpace(body))
+	}
+	out := agentDecryptResp{}
+	if err = json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+	return base64.StdEncoding.DecodeString(out.Key)
+}
+
+// agentPost sends msg to the server's path as the identity in configPath,
+// answering a fresh challenge with the identity's token. Endpoints which
+// don't use the key, such as /logout, expect msg to be the path itself.
+func agentPost(url, configPath string, token []byte, path string, msg []byte) (*http.Response, error) {
+	resp, err := http.Get(url + "/challenge")
+	if err != nil {
+		return nil, fmt.Errorf("get challenge: %w", err)
+	}
+	challenge, err := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("read challenge: %w", err)
+	}
+	req := agentDecryptReq{
+		Config:    configPath,
+		Challenge: string(challenge),
+		MAC:       hex.EncodeToString(agentMAC(token, string(challenge), msg)),
+		Key:       base64.StdEncoding.EncodeToString(msg),
+	}
+	byt, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err = http.Post(url+path, "application/json", bytes.NewReader(byt))
+	if err != nil {
+		return nil, err
+	}
+	debug("agent call", "path", path, "status", resp.StatusCode)
+	return resp, nil
+}
+
+// agentControl authenticates to an endpoint which doesn't use the key, such
+// as /logout, as the identity in configPath.
+func agentControl(port int, configPath, path string) (*http.Response, error) {
+	token, err := readAgentToken(configPath)
+	if err != nil {
+		return nil, err
+	}
+	return agentPost(fmt.Sprint("http://127.0.0.1:", port), configPath,
+		token, path, []byte(path))
+}
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/awnumar/memguard"
+)
+
+const (
+	// apiTokensFile holds the tokens for `shh serve --api` in the config
+	// directory. Only their hashes are saved.
+	apiTokensFile = "api_tokens"
+
+	// defaultAPIAddr is where `shh serve --api` listens without --socket
+	// or --addr.
+	defaultAPIAddr = "127.0.0.1:8444"
+)
+
+// apiToken lets an application read the secrets matching its scope from
+// `shh serve --api`.
+type apiToken struct {
+	Hash    string    `json:"hash"`
+	Scope   []string  `json:"scope"`
+	Created time.Time `json:"created"`
+}
+
+// allows reports whether the token may read the secret, named as in the
+// served environment.
+func (t apiToken) allows(name string) bool {
+	for _, glob := range t.Scope {
+		if globMatch(glob, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func apiTokenHash(token []byte) string {
+	sum := sha256.Sum256(token)
+	return hex.EncodeToString(sum[:])
+}
+
+func getAPITokens(configPath string) (map[string]apiToken, error) {
+	tokens := map[string]apiToken{}
+	byt, err := ioutil.ReadFile(filepath.Join(configPath, apiTokensFile))
+	switch {
+	case os.IsNotExist(err):
+		return tokens, nil
+	case err != nil:
+		return nil, fmt.Errorf("read api tokens: %w", err)
+	}
+	if err = json.Unmarshal(byt, &tokens); err != nil {
+		return nil, fmt.Errorf("unmarshal api tokens: %w", err)
+	}
+	return tokens, nil
+}
+
+func saveAPITokens(configPath string, tokens map[string]apiToken) error {
+	byt, err := json.MarshalIndent(tokens, "", "\t")
+	if err != nil {
+		return fmt.Errorf("marshal api tokens: %w", err)
+	}
+	return writeFileAtomic(filepath.Join(configPath, apiTokensFile),
+		append(byt, '\n'), 0600)
+}
+
+// apiTokenCmd manages the tokens applications use with `shh serve --api`,
+// e.g. `shh api-token add billing 'billing/*'`.
+func apiTokenCmd(args []string) error {
+	arg, tail := parseArg(args)
+	switch arg {
+	case "add":
+		return apiTokenAdd(tail)
+	case "list":
+		return apiTokenList(tail)
+	case "rm":
+		return apiTokenRm(tail)
+	case "":
+		return errors.New("bad args: expected `add`, `list`, or `rm`")
+	default:
+		return &badArgError{Arg: arg}
+	}
+}
+
+// apiTokenAdd creates a token which can read the secrets matching the globs,
+// printing it once.
+func apiTokenAdd(args []string) error {
+	if len(args) < 2 {
+		return errors.New("bad args: expected `api-token add $name $glob...`")
+	}
+	name, scope := args[0], args[1:]
+	if strings.ContainsAny(name, " \t\n") {
+		return fmt.Errorf("invalid token name %q", name)
+	}
+	for _, glob := range scope {
+		if err := validateGlob(glob); err != nil {
+			return err
+		}
+	}
+
+	const (
+		promises     = "stdio rpath wpath cpath"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	configPath, err := getConfigPath()
+	if err != nil {
+		return err
+	}
+	tokens, err := getAPITokens(configPath)
+	if err != nil {
+		return err
+	}
+	if _, ok := tokens[name]; ok {
+		return fmt.Errorf("token %s exists. remove it with `shh api-token rm %s`",
+			name, name)
+	}
+	token := make([]byte, 32)
+	if _, err = rand.Read(token); err != nil {
+		return err
+	}
+	encoded := []byte(hex.EncodeToString(token))
+	tokens[name] = apiToken{
+		Hash:    apiTokenHash(encoded),
+		Scope:   scope,
+		Created: time.Now().UTC().Truncate(time.Second),
+	}
+	if err = saveAPITokens(configPath, tokens); err != nil {
+		return err
+	}
+	fmt.Printf("%s\n", encoded)
+	notef(os.Stderr, "this token won't be shown again\n")
+	return nil
+}
+
+func apiTokenList(args []string) error {
+	if len(args) != 0 {
+		return errors.New("bad args: expected none")
+	}
+
+	const (
+		promises     = "stdio rpath"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	configPath, err := getConfigPath()
+	if err != nil {
+		return err
+	}
+	tokens, err := getAPITokens(configPath)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(tokens))
+	for name := range tokens {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		tok := tokens[name]
+		fmt.Printf("%s\t%s\tcreated %s\n", name, strings.Join(tok.Scope, " "),
+			tok.Created.Local().Format("2006-01-02"))
+	}
+	return nil
+}
+
+// apiTokenRm revokes a token. A running server refuses it from its next
+// request.
+func apiTokenRm(args []string) error {
+	if len(args) != 1 {
+		return errors.New("bad args: expected `api-token rm $name`")
+	}
+
+	const (
+		promises     = "stdio rpath wpath cpath"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	configPath, err := getConfigPath()
+	if err != nil {
+		return err
+	}
+	tokens, err := getAPITokens(configPath)
+	if err != nil {
+		return err
+	}
+	if _, ok := tokens[args[0]]; !ok {
+		return &notFoundError{"no token found"}
+	}
+	delete(tokens, args[0])
+	return saveAPITokens(configPath, tokens)
+}
+
+// checkLoopback ensures the address is on this machine, so secrets are never
+// served to others.
+func checkLoopback(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if !isLoopbackHost(host) {
+		return fmt.Errorf("%s is not a loopback address", addr)
+	}
+	return nil
+}
+
+// serveAPI serves the project's secrets to local applications over a unix
+// socket or a loopback address. Each request must carry a token from `shh
+// api-token add`, and may only read the secrets in its scope. Sensitive
+// secrets are never served, since they require the password each time.
+func serveAPI(systemd bool, socket, addr string) error {
+	if socket != "" && addr != "" {
+		return errors.New("--socket and --addr can't be used together")
+	}
+	if socket == "" && addr == "" {
+		addr = defaultAPIAddr
+	}
+	if addr != "" {
+		if err := checkLoopback(addr); err != nil {
+			return err
+		}
+	}
+	_, err := findShhRecursive(".shh")
+	if os.IsNotExist(err) {
+		return &noProjectError{}
+	}
+	if err != nil {
+		return err
+	}
+	if err = useDefaultEnv(); err != nil {
+		return err
+	}
+
+	configPath, err := getConfigPath()
+	if err != nil {
+		return err
+	}
+	user, err := getUser(configPath)
+	if err != nil {
+		return fmt.Errorf("get user: %w", err)
+	}
+	tokens, err := getAPITokens(configPath)
+	if err != nil {
+		return err
+	}
+	if len(tokens) == 0 {
+		return errors.New("no api tokens. add one with `shh api-token add`")
+	}
+	shh, err := shhFromPathFor(".shh", user.Username)
+	if err != nil {
+		return err
+	}
+
+	// Clear secrets when exiting
+	memguard.CatchInterrupt()
+	defer memguard.Purge()
+
+	dec, err := user.decrypter(configPath, false)
+	if err != nil {
+		return err
+	}
+	if privKey, ok := dec.(*rsa.PrivateKey); ok {
+		dec = newEnclaveKey(privKey)
+	}
+
+	unveil(configPath, "r")
+	unveil(runtimePath(configPath), "r")
+	unveil(shh.path, "r")
+	if socket != "" {
+		unveil(filepath.Dir(socket), "rwc")
+	}
+	unveilPinentry()
+	shh.unveilNetwork()
+	unveilBlock()
+
+	var l net.Listener
+	if systemd {
+		if l, err = systemdListener(); err != nil {
+			return err
+		}
+	}
+	switch {
+	case l != nil:
+	case socket != "":
+		// Remove the socket left by a server which was killed
+		if fi, err := os.Lstat(socket); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			_ = os.Remove(socket)
+		}
+		if l, err = net.Listen("unix", socket); err != nil {
+			return err
+		}
+		if err = os.Chmod(socket, 0600); err != nil {
+			return err
+		}
+	default:
+		if l, err = net.Listen("tcp", addr); err != nil {
+			return err
+		}
+	}
+	if systemd {
+		if err = sdNotify("READY=1"); err != nil {
+			return err
+		}
+	}
+	srv := &http.Server{
+		Handler: &apiServer{
+			configPath: configPath,
+			path:       shh.path,
+			user:       user.Username,
+			dec:        dec,
+		},
+		ReadTimeout:  30 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	}
+	return srv.Serve(l)
+}
+
+// apiServer serves secrets to applications. The project and tokens are read
+// for each request, so changes to either apply without a restart.
+type apiServer struct {
+	configPath string
+	path       string
+	user       username
+	dec        crypto.Decrypter
+}
+
+func (s *apiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name, tok, err := s.authenticate(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	debug("api request", "token", name, "path", r.URL.Path)
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/v1/secret/"):
+		s.secret(w, tok, strings.TrimPrefix(r.URL.Path, "/v1/secret/"))
+	case r.URL.Path == "/v1/secrets":
+		glob := r.URL.Query().Get("glob")
+		if glob == "" {
+			glob = "*"
+		}
+		s.secrets(w, tok, glob)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// authenticate returns the name of the request's bearer token and the token.
+func (s *apiServer) authenticate(r *http.Request) (string, apiToken, error) {
+	bearer := r.Header.Get("Authorization")
+	if !strings.HasPrefix(bearer, "Bearer ") {
+		return "", apiToken{}, errors.New("unauthorized")
+	}
+	tokens, err := getAPITokens(s.configPath)
+	if err != nil {
+		return "", apiToken{}, err
+	}
+	hash := []byte(apiTokenHash([]byte(strings.TrimPrefix(bearer, "Bearer "))))
+	for name, tok := range tokens {
+		if subtle.ConstantTimeCompare(hash, []byte(tok.Hash)) == 1 {
+			return name, tok, nil
+		}
+	}
+	return "", apiToken{}, errors.New("unauthorized")
+}
+
+func (s *apiServer) secret(w http.ResponseWriter, tok apiToken, name string) {
+	switch {
+	case name == "" || strings.Contains(name, "*"):
+		http.Error(w, "bad name: use /v1/secrets?glob= for globs",
+			http.StatusBadRequest)
+		return
+	case !tok.allows(name):
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	secrets, err := s.load(name)
+	var nf *notFoundError
+	switch {
+	case errors.As(err, &nf):
+		http.NotFound(w, nil)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	case secrets[name].Sensitive:
+		http.Error(w, "sensitive secrets aren't served", http.StatusForbidden)
+		return
+	}
+	values, err := s.decrypt(secrets)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeAPIJSON(w, values[0])
+}
+
+// secrets responds with those matching the glob which the token allows.
+// Sensitive secrets are left out.
+func (s *apiServer) secrets(w http.ResponseWriter, tok apiToken, glob string) {
+	if err := validateGlob(glob); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	secrets, err := s.load(glob)
+	var nf *notFoundError
+	switch {
+	case errors.As(err, &nf):
+		secrets = map[string]secret{}
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for name, sec := range secrets {
+		if sec.Sensitive || !tok.allows(name) {
+			delete(secrets, name)
+		}
+	}
+	values, err := s.decrypt(secrets)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeAPIJSON(w, values)
+}
+
+// load the user's secrets matching the name or glob, named as in the served
+// environment.
+func (s *apiServer) load(glob string) (map[string]secret, error) {
+	shh, err := shhFromPathFor(s.path, s.user)
+	if err != nil {
+		return nil, err
+	}
+	found, err := shh.GetSecretsForUser(inEnv(glob), s.user)
+	if err != nil {
+		return nil, err
+	}
+	secrets := make(map[string]secret, len(found))
+	for name, sec := range found {
+		secrets[strings.TrimPrefix(name, inEnv(""))] = sec
+	}
+	return secrets, nil
+}
+
+// decrypt the secrets, sorted by name.
+func (s *apiServer) decrypt(secrets map[string]secret) ([]secretJSON, error) {
+	values := make([]secretJSON, 0, len(secrets))
+	err := decryptEach(s.dec, secrets, func(name string, plaintext secureBytes) error {
+		values = append(values, newSecretJSON(name, plaintext))
+		return nil
+	})
+	return values, err
+}
+
+func writeAPIJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// enclaveKey is a private key sealed in memory and opened only to decrypt,
+// so it can be held for as long as the server runs.
+type enclaveKey struct {
+	key    *memguard.Enclave
+	pubKey *rsa.PublicKey
+}
+
+func newEnclaveKey(privKey *rsa.PrivateKey) *enclaveKey {
+	der := x509.MarshalPKCS1PrivateKey(privKey)
+	k := &enclaveKey{key: memguard.NewEnclave(der), pubKey: &privKey.PublicKey}
+	wipe(der)
+	return k
+}
+
+func (k *enclaveKey) Public() crypto.PublicKey { return k.pubKey }
+
+func (k *enclaveKey) Decrypt(rand io.Reader, msg []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	b, err := k.key.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer b.Destroy()
+	privKey, err := x509.ParsePKCS1PrivateKey(b.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return privKey.Decrypt(rand, msg, opts)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hibpURL is the Have I Been Pwned range API, or a mirror of it set with
+// $SHH_HIBP_URL.
+func hibpURL() string {
+	if u := os.Getenv("SHH_HIBP_URL"); u != "" {
+		return strings.TrimSuffix(u, "/")
+	}
+	return "https://api.pwnedpasswords.com/range"
+}
+
+// audit checks the secrets you can access for problems, or verifies the
+// project's audit log.
+func audit(nonInteractive bool, args []string) error {
+	if arg, tail := parseArg(args); arg == "verify" {
+		return verifyAudit(tail)
+	}
+	fs := flag.NewFlagSet("audit", flag.ContinueOnError)
+	hibp := fs.Bool("hibp", false, "check values against Have I Been Pwned")
+	stale := fs.Bool("stale", false, "list secrets overdue for rotation")
+	access := fs.Bool("access", false, "flag over-broad access")
+	maxReaders := fs.Int("max-readers", defaultMaxReaders,
+		"flag secrets readable by more users, with --access")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	glob := "*"
+	switch len(args) {
+	case 0:
+	case 1:
+		glob = inEnv(args[0])
+	default:
+		return errors.New("bad args: expected `audit --hibp|--stale|--access [$glob]`")
+	}
+	var modes int
+	for _, set := range []bool{*hibp, *stale, *access} {
+		if set {
+			modes++
+		}
+	}
+	switch {
+	case modes > 1:
+		return errors.New("bad args: --hibp, --stale, and --access can't be combined")
+	case *stale:
+		return auditStale(glob)
+	case *access:
+		return auditAccess(glob, *maxReaders)
+	case !*hibp:
+		return errors.New("bad args: expected --hibp, --stale, --access, or verify")
+	}
+
+	const (
+		promises     = "stdio rpath wpath cpath tty unix inet dns proc exec"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	configPath, err := getConfigPath()
+	if err != nil {
+		return err
+	}
+	user, err := getUser(configPath)
+	if err != nil {
+		return fmt.Errorf("get user: %w", err)
+	}
+	shh, err := shhFromPathFor(".shh", user.Username)
+	if err != nil {
+		return err
+	}
+	secrets, err := shh.GetSecretsForUser(glob, user.Username)
+	if err != nil {
+		return err
+	}
+	if len(secrets) == 0 {
+		return &notFoundError{"no matching secrets which you can access"}
+	}
+	shh.warnStale(secrets)
+	dec, err := user.decrypterFor(configPath, nonInteractive, secrets)
+	if err != nil {
+		return err
+	}
+
+	// Only the hashes are kept, and only their first five characters are
+	// sent
+	hashes := map[string]string{}
+	err = decryptEach(dec, secrets, func(name string, plaintext secureBytes) error {
+		if len(plaintext) == 0 {
+			// Not yet set
+			return nil
+		}
+		sum := sha1.Sum(plaintext)
+		hashes[name] = strings.ToUpper(hex.EncodeToString(sum[:]))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	pwned, err := checkHIBP(hashes)
+	if err != nil {
+		return fmt.Errorf("hibp: %w", err)
+	}
+
+	names := make([]string, 0, len(pwned))
+	for name := range pwned {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if jsonOutput {
+		type breach struct {
+			Name  string `json:"name"`
+			Count int    `json:"count"`
+		}
+		out := make([]breach, 0, len(names))
+		for _, name := range names {
+			out = append(out, breach{Name: name, Count: pwned[name]})
+		}
+		if err = printJSON(out); err != nil {
+			return err
+		}
+	} else {
+		for _, name := range names {
+			fmt.Printf("%s: seen %d times in breaches\n", name, pwned[name])
+		}
+	}
+	if len(names) > 0 {
+		return fmt.Errorf("compromised secrets: %d, rotate them", len(names))
+	}
+	if !jsonOutput {
+		notef(os.Stdout, "checked %d secrets, none compromised\n", len(hashes))
+	}
+	return nil
+}
+
+// checkHIBP looks up SHA-1 hashes with the k-anonymity range API, which
+// only sees their first five characters, returning how often each name's
+// value was seen in a breach.
+func checkHIBP(hashes map[string]string) (map[string]int, error) {
+	byPrefix := map[string][]string{}
+	for name, hash := range hashes {
+		byPrefix[hash[:5]] = append(byPrefix[hash[:5]], name)
+	}
+	prefixes := make([]string, 0, len(byPrefix))
+	for prefix := range byPrefix {
+		prefixes = append(prefixes, prefix)
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	counts := make([]map[string]int, len(prefixes))
+	err := parallel(len(prefixes), func(i int) error {
+		var err error
+		counts[i], err = hibpRange(client, prefixes[i])
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	pwned := map[string]int{}
+	for i, prefix := range prefixes {
+		for _, name := range byPrefix[prefix] {
+			if n := counts[i][hashes[name][5:]]; n > 0 {
+				pwned[name] = n
+			}
+		}
+	}
+	return pwned, nil
+}
+
+// hibpRange fetches the suffixes of breached hashes with the prefix, and how
+// often each was seen. Responses are padded with zero counts so their size
+// doesn't reveal the prefix.
+func hibpRange(client *http.Client, prefix string) (map[string]int, error) {
+	req, err := http.NewRequest(http.MethodGet, hibpURL()+"/"+prefix, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Add-Padding", "true")
+	req.Header.Set("User-Agent", "shh")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", prefix, resp.Status)
+	}
+	counts := map[string]int{}
+	scn := bufio.NewScanner(resp.Body)
+	for scn.Scan() {
+		parts := strings.SplitN(strings.TrimSpace(scn.Text()), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		n, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s: bad count %q", prefix, parts[1])
+		}
+		counts[strings.ToUpper(parts[0])] = n
+	}
+	if err = scn.Err(); err != nil {
+		return nil, fmt.Errorf("scan: %w", err)
+	}
+	return counts, nil
+}
+
+// auditStale lists the secrets whose values are older than the project's max
+// age, so they can be rotated.
+func auditStale(glob string) error {
+	const (
+		promises     = "stdio rpath wpath cpath tty inet dns proc exec"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	shh, err := shhFromPath(".shh")
+	if err != nil {
+		return err
+	}
+	if shh.Settings == nil || shh.Settings.MaxAgeDays == 0 {
+		return errors.New("no max age. use `shh settings set max-age-days $days`")
+	}
+	stale, unknown := staleSecrets(secretAccess(shh), glob,
+		shh.Settings.MaxAgeDays, time.Now())
+	if jsonOutput {
+		if err = printJSON(append([]staleSecret{}, stale...)); err != nil {
+			return err
+		}
+	} else {
+		rows := make([][]cell, 0, len(stale))
+		for _, sec := range stale {
+			rows = append(rows, []cell{
+				{text: sec.Name, style: styleBold},
+				{text: sec.Modified.Format("2006-01-02")},
+				{text: fmt.Sprintf("%d days", sec.Days)},
+			})
+		}
+		printTable(os.Stdout, rows)
+	}
+	if unknown > 0 {
+		notef(os.Stderr, "%d secrets don't record when they were set\n",
+			unknown)
+	}
+	if len(stale) > 0 {
+		return fmt.Errorf("stale secrets: %d, rotate them", len(stale))
+	}
+	if !jsonOutput {
+		notef(os.Stdout, "no secrets older than %d days\n",
+			shh.Settings.MaxAgeDays)
+	}
+	return nil
+}
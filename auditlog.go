@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// auditEntry records one change to the project file. Entries are kept one
+// per line in $project.audit, each holding the hash of the line before it,
+// so removing or rewriting one breaks the chain.
+type auditEntry struct {
+	Seq     int       `json:"seq"`
+	Time    time.Time `json:"time"`
+	User    username  `json:"user"`
+	Command string    `json:"command"`
+
+	// Before and After are the SHA-256 of the project file around the
+	// change, empty when there was no file.
+	Before string `json:"before"`
+	After  string `json:"after"`
+
+	// Prev is the SHA-256 of the previous line, empty for the first.
+	Prev string `json:"prev"`
+
+	// Key is the fingerprint of the key which made Sig, an RSA-PSS
+	// signature of the entry without it. Entries are unsigned when the
+	// user's private key isn't available without a prompt.
+	Key string `json:"key,omitempty"`
+	Sig string `json:"sig,omitempty"`
+}
+
+// runningCommand is the name of the command being run, which is recorded
+// with its changes. Its arguments aren't, since they may include values.
+var runningCommand string
+
+func auditLogPath(shhPath string) string { return shhPath + ".audit" }
+
+// fileDigest returns the SHA-256 of the file, or "" if it's empty or
+// missing.
+func fileDigest(pth string) string {
+	byt, err := ioutil.ReadFile(pth)
+	if err != nil {
+		return ""
+	}
+	return bytesDigest(byt)
+}
+
+func bytesDigest(byt []byte) string {
+	if len(byt) == 0 {
+		return ""
+	}
+	return indexSum(byt)
+}
+
+// digest is the hash the entry's signature covers.
+func (e auditEntry) digest() ([]byte, error) {
+	e.Sig = ""
+	byt, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(byt)
+	return sum[:], nil
+}
+
+func auditPendingPath(shhPath string) string { return shhPath + ".audit.pending" }
+
+// stageAudit writes the entry for a change to the project file at pth to
+// $project.audit.pending, before the change is made, and returns its line.
+// commitAudit moves it into the log once the change is made; if shh stops in
+// between, the next change or `audit verify` finds it there. It never
+// prompts: if the key can't be used without a password, the entry is
+// unsigned, with a warning.
+func stageAudit(pth, before, after string) ([]byte, error) {
+	if before == after {
+		return nil, nil
+	}
+	if err := recoverAudit(pth, before); err != nil {
+		return nil, err
+	}
+	entry := auditEntry{
+		Seq:     1,
+		Time:    time.Now().UTC().Truncate(time.Second),
+		Command: runningCommand,
+		Before:  before,
+		After:   after,
+	}
+	last, n, err := lastAuditLine(auditLogPath(pth))
+	if err != nil {
+		return nil, err
+	}
+	if last != nil {
+		entry.Prev = indexSum(last)
+		entry.Seq = n + 1
+		var prev auditEntry
+		if json.Unmarshal(last, &prev) == nil {
+			entry.Seq = prev.Seq + 1
+		}
+	}
+	if err = signAudit(&entry); err != nil {
+		fmt.Fprintf(os.Stderr, "shh: audit entry %d is unsigned: %v\n",
+			entry.Seq, err)
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	if err = writeFileAtomic(auditPendingPath(pth), append(line, '\n'), 0644); err != nil {
+		return nil, err
+	}
+	return line, nil
+}
+
+// commitAudit appends the line staged by stageAudit to the log, once the
+// change it records has been made.
+func commitAudit(pth string, line []byte) error {
+	if line == nil {
+		return nil
+	}
+	if err := appendAudit(auditLogPath(pth), line); err != nil {
+		return err
+	}
+	return removePendingAudit(pth)
+}
+
+// recoverAudit settles an entry left staged by an earlier change, given the
+// digest of the project file as it is now: if the change was made, the entry
+// is appended to the log, and otherwise it's dropped.
+func recoverAudit(pth, cur string) error {
+	line, err := pendingAuditLine(pth, cur)
+	if err != nil {
+		return err
+	}
+	if line != nil {
+		last, _, err := lastAuditLine(auditLogPath(pth))
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(last, line) {
+			fmt.Fprintf(os.Stderr, "shh: recording the audit entry of an earlier change\n")
+			if err = appendAudit(auditLogPath(pth), line); err != nil {
+				return err
+			}
+		}
+	}
+	return removePendingAudit(pth)
+}
+
+// pendingAuditLine returns the staged entry for the project file at pth if
+// it records the change to cur, the file's digest now, and nil otherwise.
+func pendingAuditLine(pth, cur string) ([]byte, error) {
+	byt, err := ioutil.ReadFile(auditPendingPath(pth))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	line := bytes.TrimSpace(byt)
+	var e auditEntry
+	if json.Unmarshal(line, &e) != nil || e.After != cur {
+		return nil, nil
+	}
+	return line, nil
+}
+
+func removePendingAudit(pth string) error {
+	err := os.Remove(auditPendingPath(pth))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// lastAuditLine returns the last line of the log and the number of lines,
+// or nil if there are none.
+func lastAuditLine(logPath string) ([]byte, int, error) {
+	byt, err := ioutil.ReadFile(logPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, 0, err
+	}
+	if byt = bytes.TrimSpace(byt); len(byt) == 0 {
+		return nil, 0, nil
+	}
+	n := bytes.Count(byt, []byte("\n")) + 1
+	return byt[bytes.LastIndexByte(byt, '\n')+1:], n, nil
+}
+
+func appendAudit(logPath string, line []byte) error {
+	fi, err := os.OpenFile(logPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = fi.Write(append(line, '\n')); err == nil {
+		err = fi.Sync()
+	}
+	if cerr := fi.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// signAudit sets the entry's user and, if their key can sign, its signature.
+func signAudit(entry *auditEntry) error {
+	user, signer, fp, err := localSigner()
+	entry.User = user
+	if err != nil {
+		return err
+	}
+	entry.Key = fp
+	digest, err := entry.digest()
+	if err != nil {
+		return err
+	}
+	sig, err := signer.Sign(rand.Reader, digest,
+		&rsa.PSSOptions{Hash: crypto.SHA256})
+	if err != nil {
+		entry.Key = ""
+		return err
+	}
+	entry.Sig = base64.StdEncoding.EncodeToString(sig)
+	return nil
+}
+
+// localSigner returns the local user and, if their private key can be used
+// without a prompt, a signer for it and its fingerprint. The user is returned
+// even when the key can't be used.
+func localSigner() (username, crypto.Signer, string, error) {
+	configPath, err := getConfigPath()
+	if err != nil {
+		return "", nil, "", err
+	}
+	user, err := getUser(configPath)
+	if err != nil {
+		return "", nil, "", err
+	}
+	if user.Keys == nil {
+		return user.Username, nil, "", errKMSUser
+	}
+	dec, err := user.decrypter(configPath, true)
+	if err != nil {
+		return user.Username, nil, "", err
+	}
+	signer, ok := dec.(crypto.Signer)
+	if !ok {
+		return user.Username, nil, "", errors.New("key can't sign")
+	}
+	return user.Username, signer, keyFingerprint(user.Keys.PublicKeyBlock), nil
+}
+
+// verifyAudit checks the audit log for gaps and rewrites: every entry must
+// follow the one before it, every change must start from where the last one
+// left off, and the last must match the project file as it is now.
+func verifyAudit(args []string) error {
+	if len(args) != 0 {
+		return errors.New("bad args: expected `audit verify`")
+	}
+
+	const (
+		promises     = "stdio rpath wpath cpath tty inet dns proc exec"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	shh, err := shhNamesFromPath(".shh")
+	if err != nil {
+		return err
+	}
+	if shh.store != nil {
+		return errors.New("audit logs are kept only for local projects")
+	}
+	// An entry staged for a change which was made, but not yet moved into
+	// the log, is checked as its last
+	cur := fileDigest(shh.path)
+	pending, err := pendingAuditLine(shh.path, cur)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Open(auditLogPath(shh.path))
+	switch {
+	case os.IsNotExist(err) && pending == nil:
+		return &notFoundError{"no audit log"}
+	case os.IsNotExist(err):
+		fi, err = os.Open(os.DevNull)
+	}
+	if err != nil {
+		return err
+	}
+	defer fi.Close()
+
+	var problems []string
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	var (
+		prev       auditEntry
+		prevLine   []byte
+		n          int
+		unsigned   int
+		unverified int
+	)
+	check := func(line []byte) {
+		n++
+		var e auditEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			problem("line %d: bad entry: %v", n, err)
+			prev, prevLine = auditEntry{Seq: n}, append([]byte(nil), line...)
+			return
+		}
+		if e.Seq != prev.Seq+1 {
+			problem("line %d: expected entry %d, got %d", n, prev.Seq+1, e.Seq)
+		}
+		switch {
+		case prevLine == nil && e.Prev != "":
+			problem("line %d: earlier entries are missing", n)
+		case prevLine != nil && e.Prev != indexSum(prevLine):
+			problem("line %d: entry %d was changed", n, prev.Seq)
+		}
+		if prevLine != nil && e.Before != prev.After {
+			problem("line %d: the project was changed outside shh before entry %d",
+				n, e.Seq)
+		}
+		switch err := verifyAuditSig(shh, e); {
+		case e.Sig == "":
+			unsigned++
+		case err == errUnverifiable:
+			unverified++
+		case err != nil:
+			problem("line %d: entry %d by %s: %v", n, e.Seq, e.User, err)
+		}
+		prev, prevLine = e, append([]byte(nil), line...)
+	}
+	scn := bufio.NewScanner(fi)
+	scn.Buffer(nil, 1<<20)
+	for scn.Scan() {
+		check(scn.Bytes())
+	}
+	if err = scn.Err(); err != nil {
+		return fmt.Errorf("scan: %w", err)
+	}
+	if pending != nil && !bytes.Equal(pending, prevLine) {
+		check(pending)
+	} else {
+		pending = nil
+	}
+	if n > 0 && prev.After != cur {
+		problem("the project was changed outside shh after entry %d", prev.Seq)
+	}
+
+	if jsonOutput {
+		type result struct {
+			Entries    int      `json:"entries"`
+			Unsigned   int      `json:"unsigned"`
+			Unverified int      `json:"unverified"`
+			Pending    bool     `json:"pending"`
+			Problems   []string `json:"problems"`
+		}
+		err = printJSON(result{Entries: n, Unsigned: unsigned,
+			Unverified: unverified, Pending: pending != nil,
+			Problems: append([]string{}, problems...)})
+		if err != nil {
+			return err
+		}
+	} else {
+		for _, p := range problems {
+			fmt.Println(p)
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("audit log problems: %d", len(problems))
+	}
+	if jsonOutput {
+		return nil
+	}
+	notef(os.Stdout, "verified %d entries\n", n)
+	if pending != nil {
+		notef(os.Stderr, "entry %d isn't in the log yet, and the next change will add it\n",
+			prev.Seq)
+	}
+	if unsigned > 0 {
+		notef(os.Stderr, "%d entries are unsigned\n", unsigned)
+	}
+	if unverified > 0 {
+		notef(os.Stderr, "%d entries were signed by keys no longer in the project\n",
+			unverified)
+	}
+	return nil
+}
+
+// errUnverifiable is reported for signatures by keys which have since been
+// rotated or removed.
+var errUnverifiable = errors.New("signing key not in the project")
+
+func verifyAuditSig(shh *shh, e auditEntry) error {
+	if e.Sig == "" {
+		return nil
+	}
+	block, ok := shh.Keys[e.User]
+	if !ok || keyFingerprint(block) != e.Key {
+		// A key in the project signed for someone else, so the user
+		// was changed
+		for other, b := range shh.Keys {
+			if keyFingerprint(b) == e.Key {
+				return fmt.Errorf("signed with the key of %s", other)
+			}
+		}
+		return errUnverifiable
+	}
+	pubKey, err := parsePublicKey(block)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(e.Sig)
+	if err != nil {
+		return fmt.Errorf("bad signature: %w", err)
+	}
+	digest, err := e.digest()
+	if err != nil {
+		return err
+	}
+	if err = rsa.VerifyPSS(pubKey, crypto.SHA256, digest, sig, nil); err != nil {
+		return errors.New("bad signature")
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import "time"
+
+const (
+	// sleepCheckInterval is how often the agent checks whether the system
+	// slept.
+	sleepCheckInterval = 5 * time.Second
+
+	// sleepThreshold is how far the wall clock must jump ahead of the
+	// monotonic clock to be considered a sleep.
+	sleepThreshold = 10 * time.Second
+)
+
+// autolock clears the agent's keys when the system sleeps or, where
+// supported, when the screen locks. It runs until the process exits.
+func autolock(a *agent) {
+	go watchLocks(a.lock)
+	watchSleep(a.lock)
+}
+
+// watchSleep calls fn after the system wakes from sleep. The monotonic clock
+// stops while the system is suspended but the wall clock does not, so a gap
+// between them indicates a sleep. This works on every platform without
+// subscribing to OS-specific events.
+func watchSleep(fn func()) {
+	last := time.Now()
+	for range time.Tick(sleepCheckInterval) {
+		now := time.Now()
+		mono := now.Sub(last)
+		wall := now.Round(0).Sub(last.Round(0))
+		last = now
+		if wall-mono > sleepThreshold {
+			fn()
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bufio"
+	"os/exec"
+	"strings"
+)
+
+// watchLocks calls fn whenever logind asks sessions to lock or announces that
+// the system is about to sleep. This uses dbus-monitor to subscribe to the
+// system bus, and it does nothing if dbus-monitor isn't installed.
+func watchLocks(fn func()) {
+	cmd := exec.Command("dbus-monitor", "--system",
+		"type='signal',interface='org.freedesktop.login1.Manager',member='PrepareForSleep'",
+		"type='signal',interface='org.freedesktop.login1.Session',member='Lock'")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return
+	}
+	if err = cmd.Start(); err != nil {
+		return
+	}
+	defer func() { _ = cmd.Wait() }()
+
+	// PrepareForSleep is sent with true before sleeping and false after
+	// waking, so wait for its argument before locking.
+	var sleeping bool
+	scn := bufio.NewScanner(stdout)
+	for scn.Scan() {
+		line := strings.TrimSpace(scn.Text())
+		switch {
+		case strings.Contains(line, "member=Lock"):
+			fn()
+		case strings.Contains(line, "member=PrepareForSleep"):
+			sleeping = true
+		case sleeping && strings.HasPrefix(line, "boolean"):
+			sleeping = false
+			if line == "boolean true" {
+				fn()
+			}
+		}
+	}
+}
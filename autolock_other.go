@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// watchLocks does nothing, since screen lock events are only supported on
+// Linux. Sleep is still detected by watchSleep.
+func watchLocks(fn func()) {}
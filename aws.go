@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// awsRemote syncs with AWS Secrets Manager using the aws CLI, so every
+// credential source it supports works here too. Values are passed on stdin,
+// never as arguments visible to other processes.
+type awsRemote struct {
+	args     []string
+	kmsKeyID string
+
+	// exists records the secrets seen by list, to choose between creating
+	// a secret and adding a version.
+	exists map[string]bool
+}
+
+func awsBackend(fs *flag.FlagSet) func() (syncRemote, error) {
+	region := fs.String("region", "", "aws region")
+	profile := fs.String("profile", "", "aws profile")
+	kmsKeyID := fs.String("kms-key-id", "", "kms key for new secrets")
+	return func() (syncRemote, error) {
+		if _, err := exec.LookPath("aws"); err != nil {
+			return nil, fmt.Errorf("aws cli not found: %w", err)
+		}
+		r := &awsRemote{kmsKeyID: *kmsKeyID, exists: map[string]bool{}}
+		if *region != "" {
+			r.args = append(r.args, "--region", *region)
+		}
+		if *profile != "" {
+			r.args = append(r.args, "--profile", *profile)
+		}
+		return r, nil
+	}
+}
+
+// aws syncs secrets with AWS Secrets Manager.
+func aws(nonInteractive bool, args []string) error {
+	return syncCommand(nonInteractive, "aws", awsBackend, args)
+}
+
+// run an aws secretsmanager command, decoding its JSON output into out if
+// non-nil.
+func (r *awsRemote) run(stdin []byte, out interface{}, args ...string) error {
+	args = append(append([]string{"secretsmanager"}, args...), r.args...)
+	args = append(args, "--output", "json")
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("aws", args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	defer wipe(stdout.Bytes())
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("aws %s: %s", args[1], msg)
+		}
+		return fmt.Errorf("aws %s: %w", args[1], err)
+	}
+	if out == nil {
+		return nil
+	}
+	if err = json.Unmarshal(stdout.Bytes(), out); err != nil {
+		return fmt.Errorf("aws %s: decode: %w", args[1], err)
+	}
+	return nil
+}
+
+func (r *awsRemote) list(prefix string) ([]string, error) {
+	args := []string{"list-secrets"}
+	if prefix != "" {
+		args = append(args, "--filters", "Key=name,Values="+prefix)
+	}
+	var resp struct {
+		SecretList []struct {
+			Name string
+		}
+	}
+	if err := r.run(nil, &resp, args...); err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, s := range resp.SecretList {
+		r.exists[s.Name] = true
+		if strings.HasPrefix(s.Name, prefix) {
+			names = append(names, s.Name)
+		}
+	}
+	return names, nil
+}
+
+func (r *awsRemote) get(name string) ([]byte, error) {
+	var resp struct {
+		SecretString *string
+		SecretBinary *string
+	}
+	if err := r.run(nil, &resp, "get-secret-value", "--secret-id", name); err != nil {
+		return nil, err
+	}
+	if resp.SecretBinary != nil {
+		return base64.StdEncoding.DecodeString(*resp.SecretBinary)
+	}
+	if resp.SecretString == nil {
+		return nil, fmt.Errorf("%s has no value", name)
+	}
+	return []byte(*resp.SecretString), nil
+}
+
+func (r *awsRemote) put(name string, val []byte) error {
+	if err := awsValidName(name); err != nil {
+		return err
+	}
+	if r.exists[name] {
+		return r.run(val, nil, "put-secret-value", "--secret-id", name,
+			"--secret-string", "file:///dev/stdin")
+	}
+	args := []string{"create-secret", "--name", name,
+		"--secret-string", "file:///dev/stdin"}
+	if r.kmsKeyID != "" {
+		args = append(args, "--kms-key-id", r.kmsKeyID)
+	}
+	if err := r.run(val, nil, args...); err != nil {
+		return err
+	}
+	r.exists[name] = true
+	return nil
+}
+
+// awsValidName reports an error for names Secrets Manager rejects.
+func awsValidName(name string) error {
+	if name == "" || len(name) > 512 {
+		return fmt.Errorf("%s: names must be 1-512 characters", name)
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("/_+=.@-", c):
+		default:
+			return fmt.Errorf("%s: aws doesn't allow %q in names", name, c)
+		}
+	}
+	return nil
+}
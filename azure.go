@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	azureAPIVersion = "7.4"
+	azureResource   = "https://vault.azure.net"
+
+	azureIMDSToken = "http://169.254.169.254/metadata/identity/oauth2/token?api-version=2018-02-01&resource="
+)
+
+// azureRemote syncs with an Azure Key Vault using the secrets API. Vault
+// names may only contain letters, digits, and dashes, so names are
+// translated with azureSecretName.
+type azureRemote struct {
+	url    string
+	token  string
+	client *http.Client
+
+	// ids maps names seen by list to their ids, since names created
+	// outside shh may not round-trip through azureSecretName.
+	ids map[string]string
+}
+
+func azureBackend(fs *flag.FlagSet) func() (syncRemote, error) {
+	vault := fs.String("vault", "", "key vault name or url")
+	return func() (syncRemote, error) {
+		if *vault == "" {
+			return nil, errors.New("bad args: missing --vault $name")
+		}
+		r := &azureRemote{
+			url:    strings.TrimSuffix(*vault, "/"),
+			client: &http.Client{Timeout: 30 * time.Second},
+			ids:    map[string]string{},
+		}
+		if !strings.Contains(r.url, "://") {
+			r.url = "https://" + r.url + ".vault.azure.net"
+		}
+		if err := r.authenticate(); err != nil {
+			return nil, fmt.Errorf("azure credentials: %w", err)
+		}
+		return r, nil
+	}
+}
+
+// azure syncs secrets with Azure Key Vault.
+func azure(nonInteractive bool, args []string) error {
+	return syncCommand(nonInteractive, "azure", azureBackend, args)
+}
+
+// authenticate gets a token from a service principal in $AZURE_TENANT_ID,
+// $AZURE_CLIENT_ID, and $AZURE_CLIENT_SECRET, then the az CLI, then a managed
+// identity.
+func (r *azureRemote) authenticate() error {
+	tenant := os.Getenv("AZURE_TENANT_ID")
+	clientID := os.Getenv("AZURE_CLIENT_ID")
+	clientSecret := os.Getenv("AZURE_CLIENT_SECRET")
+	if tenant != "" && clientID != "" && clientSecret != "" {
+		form := url.Values{}
+		form.Set("grant_type", "client_credentials")
+		form.Set("client_id", clientID)
+		form.Set("client_secret", clientSecret)
+		form.Set("scope", azureResource+"/.default")
+		req, err := http.NewRequest(http.MethodPost,
+			"https://login.microsoftonline.com/"+url.PathEscape(tenant)+
+				"/oauth2/v2.0/token", strings.NewReader(form.Encode()))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return r.tokenFrom(req)
+	}
+	if az, err := exec.LookPath("az"); err == nil {
+		var stdout, stderr bytes.Buffer
+		cmd := exec.Command(az, "account", "get-access-token",
+			"--resource", azureResource, "--query", "accessToken",
+			"--output", "tsv")
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		if err = cmd.Run(); err != nil {
+			return fmt.Errorf("az: %s", strings.TrimSpace(stderr.String()))
+		}
+		r.token = strings.TrimSpace(stdout.String())
+		return nil
+	}
+	req, err := http.NewRequest(http.MethodGet,
+		azureIMDSToken+url.QueryEscape(azureResource), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Metadata", "true")
+	if err = r.tokenFrom(req); err != nil {
+		return fmt.Errorf("no service principal or az cli, and managed identity: %w", err)
+	}
+	return nil
+}
+
+// tokenFrom sends an OAuth token request and keeps the access token.
+func (r *azureRemote) tokenFrom(req *http.Request) error {
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return fmt.Errorf("decode token: %w", err)
+	}
+	if tok.AccessToken == "" {
+		return fmt.Errorf("token: %s: %s %s", resp.Status, tok.Error,
+			tok.Description)
+	}
+	r.token = tok.AccessToken
+	return nil
+}
+
+// do sends a request to the vault, decoding the response into out if non-nil.
+// Paths are relative to the vault unless they're a full URL, such as a
+// nextLink.
+func (r *azureRemote) do(method, pth string, body, out interface{}) error {
+	var rdr *bytes.Reader
+	if body != nil {
+		byt, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		defer wipe(byt)
+		rdr = bytes.NewReader(byt)
+	} else {
+		rdr = bytes.NewReader(nil)
+	}
+	u := pth
+	if !strings.HasPrefix(pth, "https://") {
+		sep := "?"
+		if strings.Contains(pth, "?") {
+			sep = "&"
+		}
+		u = r.url + pth + sep + "api-version=" + azureAPIVersion
+	}
+	req, err := http.NewRequest(method, u, rdr)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+r.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	byt, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	defer wipe(byt)
+	if resp.StatusCode >= 300 {
+		var aerr struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		_ = json.Unmarshal(byt, &aerr)
+		return fmt.Errorf("azure: %s: %s", resp.Status, aerr.Error.Message)
+	}
+	if out != nil {
+		if err = json.Unmarshal(byt, out); err != nil {
+			return fmt.Errorf("decode: %w", err)
+		}
+	}
+	return nil
+}
+
+func (r *azureRemote) list(prefix string) ([]string, error) {
+	var names []string
+	pth := "/secrets?maxresults=25"
+	for pth != "" {
+		var resp struct {
+			Value []struct {
+				ID string `json:"id"`
+			} `json:"value"`
+			NextLink string `json:"nextLink"`
+		}
+		if err := r.do(http.MethodGet, pth, nil, &resp); err != nil {
+			return nil, err
+		}
+		for _, s := range resp.Value {
+			id := s.ID[strings.LastIndex(s.ID, "/")+1:]
+			name := shhNameFromAzure(id)
+			r.ids[name] = id
+			if strings.HasPrefix(name, prefix) {
+				names = append(names, name)
+			}
+		}
+		pth = resp.NextLink
+	}
+	return names, nil
+}
+
+// id returns the vault's id for a name.
+func (r *azureRemote) id(name string) (string, error) {
+	if id, ok := r.ids[name]; ok {
+		return id, nil
+	}
+	return azureSecretName(name)
+}
+
+func (r *azureRemote) get(name string) ([]byte, error) {
+	id, err := r.id(name)
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Value string `json:"value"`
+	}
+	if err = r.do(http.MethodGet, "/secrets/"+id, nil, &resp); err != nil {
+		return nil, err
+	}
+	return []byte(resp.Value), nil
+}
+
+func (r *azureRemote) put(name string, val []byte) error {
+	id, err := r.id(name)
+	if err != nil {
+		return err
+	}
+	if !utf8.Valid(val) {
+		return fmt.Errorf("%s: azure can only store text", name)
+	}
+	body := map[string]string{"value": string(val)}
+	return r.do(http.MethodPut, "/secrets/"+id, body, nil)
+}
+
+// azureSecretName translates a name to the letters, digits, and dashes Key
+// Vault allows. Other characters, including dashes, are written as a dash
+// and two hex digits, so prod/db_url becomes prod-2Fdb-5Furl.
+func azureSecretName(name string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "-%02X", c)
+		}
+	}
+	if b.Len() == 0 || b.Len() > 127 {
+		return "", fmt.Errorf("%s: azure names must be 1-127 characters once translated", name)
+	}
+	return b.String(), nil
+}
+
+// shhNameFromAzure reverses azureSecretName. Dashes not followed by two hex
+// digits, as in names created outside shh, are kept.
+func shhNameFromAzure(id string) string {
+	var b strings.Builder
+	for i := 0; i < len(id); i++ {
+		if id[i] == '-' && i+2 < len(id) {
+			if c, err := hex.DecodeString(id[i+1 : i+3]); err == nil &&
+				strings.ToUpper(id[i+1:i+3]) == id[i+1:i+3] {
+				b.WriteByte(c[0])
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(id[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// backupDir holds copies of the project file, beside it.
+	backupDir = ".shh.backup"
+
+	// maxBackups is how many copies are kept.
+	maxBackups = 10
+)
+
+// backupDirFor returns the directory of backups of the project file at
+// shhPath. Project files other than .shh, such as prod.shh, keep theirs in
+// .prod.shh.backup, so stores in the same directory don't share one. When
+// $XDG_DATA_HOME is set, backups are kept under $XDG_DATA_HOME/shh/backups
+// instead of beside the project.
+func backupDirFor(shhPath string) string {
+	if data := os.Getenv("XDG_DATA_HOME"); filepath.IsAbs(data) {
+		if abs, err := filepath.Abs(shhPath); err == nil {
+			return filepath.Join(data, "shh", "backups",
+				stateName(filepath.Dir(abs))+"-"+strings.TrimPrefix(
+					filepath.Base(abs), "."))
+		}
+	}
+	dir, name := filepath.Split(shhPath)
+	if name == ".shh" {
+		return filepath.Join(dir, backupDir)
+	}
+	return filepath.Join(dir, "."+name+".backup")
+}
+
+// backupShh copies the project file at pth into .shh.backup before it's
+// replaced, keeping the newest maxBackups copies. The directory ignores
+// itself in git.
+func backupShh(pth string) error {
+	fi, err := os.Open(pth)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer fi.Close()
+	info, err := fi.Stat()
+	if err != nil || info.Size() == 0 {
+		return err
+	}
+	dir := backupDirFor(pth)
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	ignore := filepath.Join(dir, ".gitignore")
+	if _, err = os.Stat(ignore); os.IsNotExist(err) {
+		if err = ioutil.WriteFile(ignore, []byte("*\n"), 0644); err != nil {
+			return err
+		}
+	}
+	name := time.Now().UTC().Format("20060102T150405.000000000Z") + ".shh"
+	err = writeFileAtomicFunc(filepath.Join(dir, name), 0600,
+		func(w io.Writer) error {
+			_, err := io.Copy(w, fi)
+			return err
+		})
+	if err != nil {
+		return err
+	}
+	backups, err := listBackups(dir)
+	if err != nil {
+		return err
+	}
+	for len(backups) > maxBackups {
+		if err = os.Remove(filepath.Join(dir, backups[0])); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// listBackups in the directory, oldest first.
+func listBackups(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var names []string
+	for _, info := range infos {
+		if strings.HasSuffix(info.Name(), ".shh") {
+			names = append(names, info.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// undo restores the most recent backup of the project file. The backup is
+// consumed, so running undo again restores the one before it.
+func undo(args []string) error {
+	if len(args) != 0 {
+		return errors.New("bad args: expected none")
+	}
+
+	const (
+		promises     = "stdio rpath wpath cpath tty"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	pth, err := findShhRecursive(".shh")
+	if err != nil {
+		return err
+	}
+	dir := backupDirFor(pth)
+	backups, err := listBackups(dir)
+	if err != nil {
+		return err
+	}
+	if len(backups) == 0 {
+		return errors.New("no backups to restore")
+	}
+	latest := filepath.Join(dir, backups[len(backups)-1])
+	restored, err := ioutil.ReadFile(latest)
+	if err != nil {
+		return err
+	}
+	cur, err := ioutil.ReadFile(pth)
+	if err != nil {
+		return err
+	}
+
+	// Show what's being undone, if both versions can be read
+	var passphrase []byte
+	before, err := decodeShhBytes(pth, cur, &passphrase)
+	if err == nil {
+		var after *shh
+		after, err = decodeShhBytes(pth, restored, &passphrase)
+		if err == nil {
+			for _, change := range shhChanges(before, after, "*") {
+				fmt.Println(change)
+			}
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "shh: can't show changes: %v\n", err)
+	}
+
+	entry, err := stageAudit(pth, bytesDigest(cur), bytesDigest(restored))
+	if err != nil {
+		return fmt.Errorf("audit log: %w", err)
+	}
+	if err = writeFileAtomic(pth, restored, 0644); err != nil {
+		_ = removePendingAudit(pth)
+		return err
+	}
+	if err = commitAudit(pth, entry); err != nil {
+		return fmt.Errorf("audit log: %w", err)
+	}
+	if err = os.Remove(latest); err != nil {
+		return err
+	}
+	notef(os.Stdout, "restored %s from %s\n", pth, backupTime(backups[len(backups)-1]))
+	return nil
+}
+
+// backupTime formats the time a backup was taken from its name.
+func backupTime(name string) string {
+	t, err := time.Parse("20060102T150405.000000000Z",
+		strings.TrimSuffix(name, ".shh"))
+	if err != nil {
+		return name
+	}
+	return t.Local().Format("2006-01-02 15:04:05")
+}
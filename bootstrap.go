@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// projectTemplate pre-declares a project's team and secrets, so new projects
+// can be created with `shh init --from-template` rather than adding everyone
+// by hand. Member lists may name users, or groups as @name.
+type projectTemplate struct {
+	// Users maps each username to their public key, either PEM or a path
+	// relative to the template. KMS key ARNs and age1... recipients need
+	// no key, nor does the user running init.
+	Users map[username]string `json:"users"`
+
+	// Groups name lists of users, for use in the other member lists.
+	Groups map[string][]username `json:"groups"`
+
+	// Environments lists the members allowed each environment.
+	Environments map[string][]username `json:"environments"`
+
+	// Secrets are created with empty values for the listed members, as
+	// well as the user running init and the members of the secret's
+	// environment.
+	Secrets map[string][]username `json:"secrets"`
+
+	MinKeyBits int              `json:"min_key_bits"`
+	Settings   *projectSettings `json:"settings"`
+}
+
+// readTemplate reads and validates a project template.
+func readTemplate(pth string) (*projectTemplate, error) {
+	byt, err := ioutil.ReadFile(pth)
+	if err != nil {
+		return nil, err
+	}
+	var tmpl projectTemplate
+	if err = json.Unmarshal(byt, &tmpl); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", pth, err)
+	}
+	if tmpl.MinKeyBits != 0 && tmpl.MinKeyBits < minKeyBits {
+		return nil, fmt.Errorf("min_key_bits must be >= %d", minKeyBits)
+	}
+	if tmpl.Settings != nil {
+		if err = tmpl.Settings.validate(); err != nil {
+			return nil, fmt.Errorf("settings: %w", err)
+		}
+	}
+	for env := range tmpl.Environments {
+		if env == "" {
+			return nil, errors.New("empty environment name")
+		}
+		if err = validateEnvironment(env); err != nil {
+			return nil, err
+		}
+	}
+	for name := range tmpl.Secrets {
+		if name == "" {
+			return nil, errors.New("empty secret name")
+		}
+	}
+
+	// Resolve key paths now, so they're relative to the template rather
+	// than wherever init runs
+	dir := filepath.Dir(pth)
+	for u, key := range tmpl.Users {
+		if key == "" || strings.HasPrefix(key, "-----BEGIN") {
+			continue
+		}
+		if !filepath.IsAbs(key) {
+			key = filepath.Join(dir, key)
+		}
+		byt, err := ioutil.ReadFile(key)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", u, err)
+		}
+		tmpl.Users[u] = string(byt)
+	}
+	return &tmpl, nil
+}
+
+// members expands groups in a member list, reporting an error for unknown
+// users and groups. self is always known.
+func (t *projectTemplate) members(list []username, self username) ([]username, error) {
+	seen := map[username]struct{}{}
+	var add func(u username, depth int) error
+	add = func(u username, depth int) error {
+		if strings.HasPrefix(string(u), "@") {
+			group, ok := t.Groups[string(u[1:])]
+			if !ok {
+				return fmt.Errorf("unknown group %s", u)
+			}
+			if depth > len(t.Groups) {
+				return fmt.Errorf("group %s includes itself", u)
+			}
+			for _, member := range group {
+				if err := add(member, depth+1); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if _, ok := t.Users[u]; !ok && u != self {
+			return fmt.Errorf("unknown user %s", u)
+		}
+		seen[u] = struct{}{}
+		return nil
+	}
+	for _, u := range list {
+		if err := add(u, 0); err != nil {
+			return nil, err
+		}
+	}
+	users := make([]username, 0, len(seen))
+	for u := range seen {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i] < users[j] })
+	return users, nil
+}
+
+// applyTemplate adds the template's users, environments, and empty secrets
+// to a new project created by self.
+func (s *shh) applyTemplate(tmpl *projectTemplate, self *user) error {
+	if tmpl.MinKeyBits != 0 && s.MinKeyBits == 0 {
+		s.MinKeyBits = tmpl.MinKeyBits
+	}
+	s.Settings = tmpl.Settings
+	for u, key := range tmpl.Users {
+		switch {
+		case u == self.Username:
+			if key == "" {
+				continue
+			}
+			block, _ := pem.Decode([]byte(key))
+			if block == nil || keyFingerprint(block) !=
+				keyFingerprint(s.Keys[u]) {
+				return fmt.Errorf("the template's key for %s isn't yours", u)
+			}
+		case isAgeRecipient(u):
+			if _, err := parseAgeRecipient(string(u)); err != nil {
+				return err
+			}
+		case isKMSKey(u):
+			key, err := newKMSKey(string(u))
+			if err != nil {
+				return err
+			}
+			s.Keys[u] = key.kmsBlock()
+		default:
+			block, _ := pem.Decode([]byte(key))
+			if block == nil {
+				return fmt.Errorf("%s: bad public key", u)
+			}
+			s.Keys[u] = block
+		}
+		if _, ok := s.Keys[u]; ok {
+			// Check the key against the project's policy, as add-user
+			// does
+			if _, err := s.wrapperFor(u); err != nil {
+				return err
+			}
+		}
+	}
+	for env, list := range tmpl.Environments {
+		members, err := tmpl.members(list, self.Username)
+		if err != nil {
+			return fmt.Errorf("environment %s: %w", env, err)
+		}
+		if len(members) == 0 {
+			continue
+		}
+		if s.Environments == nil {
+			s.Environments = map[string][]username{}
+		}
+		s.Environments[env] = members
+	}
+
+	names := make([]string, 0, len(tmpl.Secrets))
+	for name := range tmpl.Secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		list := append([]username{self.Username}, tmpl.Secrets[name]...)
+		list = append(list, s.Environments[s.environmentOf(name)]...)
+		users, err := tmpl.members(list, self.Username)
+		if err != nil {
+			return fmt.Errorf("secret %s: %w", name, err)
+		}
+		err = s.encryptForUsers(users, name, []byte{}, func(username) secret {
+			return secret{}
+		})
+		if err != nil {
+			return fmt.Errorf("secret %s: %w", name, err)
+		}
+		s.namespace[name] = struct{}{}
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// serviceManifest declares the secrets a service needs, by default in the
+// service's directory:
+//
+//	identity: deploy@example.com
+//	secrets:
+//	  DATABASE_URL: db/url
+//	  STRIPE_KEY: stripe/key
+//
+// Secrets map variable names to secret names, which are looked up in the
+// current environment. identity is the user which deploys the service.
+const serviceManifest = "shh.yaml"
+
+type manifest struct {
+	Identity username
+	Specs    []envSpec
+}
+
+// isYAMLManifest reports whether a --manifest file is a shh.yaml rather
+// than a list of specs.
+func isYAMLManifest(pth string) bool {
+	ext := filepath.Ext(pth)
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// readManifest reads a shh.yaml, sorting the secrets by variable name.
+func readManifest(pth string) (*manifest, error) {
+	byt, err := ioutil.ReadFile(pth)
+	if err != nil {
+		return nil, err
+	}
+	values, err := parseYAML(byt)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", pth, err)
+	}
+	var m manifest
+	for key, val := range values {
+		switch {
+		case key == "identity":
+			m.Identity = username(val)
+		case strings.HasPrefix(key, "secrets/"):
+			m.Specs = append(m.Specs, envSpec{
+				Var:  strings.TrimPrefix(key, "secrets/"),
+				Name: inEnv(val),
+			})
+		default:
+			return nil, fmt.Errorf("%s: unknown key %s", pth, key)
+		}
+	}
+	if len(m.Specs) == 0 {
+		return nil, fmt.Errorf("%s: no secrets", pth)
+	}
+	sort.Slice(m.Specs, func(i, j int) bool {
+		return m.Specs[i].Var < m.Specs[j].Var
+	})
+	return &m, nil
+}
+
+// check verifies that every secret in a service's manifest exists and that
+// its deploy identity can decrypt it, so builds fail early rather than when
+// the service starts.
+func check(nonInteractive bool, args []string) error {
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	as := fs.String("as", "", "check access for this user, rather than the manifest's identity")
+	decrypt := fs.Bool("decrypt", false, "also decrypt each secret, as yourself")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	pth := serviceManifest
+	switch len(args) {
+	case 0:
+	case 1:
+		pth = args[0]
+	default:
+		return errors.New("bad args: expected `check [--as $user] [--decrypt] [$manifest]`")
+	}
+
+	const (
+		promises     = "stdio rpath wpath cpath tty unix inet dns proc exec"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	m, err := readManifest(pth)
+	if err != nil {
+		return err
+	}
+	configPath, err := getConfigPath()
+	if err != nil {
+		return err
+	}
+	identity := m.Identity
+	if *as != "" {
+		identity = username(*as)
+	}
+	if identity == "" || *decrypt {
+		user, err := getUser(configPath)
+		if err != nil {
+			return fmt.Errorf("get user: %w", err)
+		}
+		if identity == "" {
+			identity = user.Username
+		}
+		if *decrypt && identity != user.Username {
+			return fmt.Errorf("--decrypt must run as %s, not %s", identity,
+				user.Username)
+		}
+	}
+	shh, err := shhFromPathFor(".shh", identity)
+	if err != nil {
+		return err
+	}
+	if _, ok := shh.Keys[identity]; !ok && !isAgeRecipient(identity) {
+		return fmt.Errorf("%q is not a user in the project", identity)
+	}
+
+	var problems int
+	for _, spec := range m.Specs {
+		var found int
+		for name := range shh.namespace {
+			if !globMatch(spec.Name, name) {
+				continue
+			}
+			found++
+			if _, ok := shh.Secrets[identity][name]; !ok {
+				fmt.Printf("%s: %s can't decrypt %s\n", spec.Var, identity, name)
+				problems++
+			}
+		}
+		if found == 0 {
+			fmt.Printf("%s: %s is missing\n", spec.Var, spec.Name)
+			problems++
+		}
+	}
+	if problems > 0 {
+		return fmt.Errorf("problems found: %d", problems)
+	}
+	if *decrypt {
+		vars, err := decryptEnv(nonInteractive, m.Specs, envNaming{})
+		if err != nil {
+			return err
+		}
+		for _, v := range vars {
+			v.Value.Destroy()
+		}
+	}
+	notef(os.Stdout, "%d secrets ok for %s\n", len(m.Specs), identity)
+	return nil
+}
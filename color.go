@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// ANSI styles for terminal output.
+const (
+	styleBold    = "1"
+	styleDim     = "2"
+	styleReverse = "7"
+	styleRed     = "31"
+	styleGreen   = "32"
+	styleYellow  = "33"
+)
+
+// isTerminalOutput reports whether stdout is a terminal, so output may be
+// formatted for people. Otherwise it's kept plain for scripts.
+func isTerminalOutput() bool {
+	return terminal.IsTerminal(int(os.Stdout.Fd()))
+}
+
+// useColor reports whether to color output, which it does only for a
+// terminal, and never when NO_COLOR is set (https://no-color.org).
+func useColor() bool {
+	return isTerminalOutput() && os.Getenv("NO_COLOR") == "" &&
+		os.Getenv("TERM") != "dumb"
+}
+
+// styled wraps s in the style if colors are in use.
+func styled(style, s string) string {
+	if s == "" || !useColor() {
+		return s
+	}
+	return "\x1b[" + style + "m" + s + "\x1b[0m"
+}
+
+// cell is a table cell with an optional style.
+type cell struct {
+	text  string
+	style string
+}
+
+// printTable prints rows in aligned columns, two spaces apart. Widths are
+// measured before styling, so escape codes don't skew them.
+func printTable(w io.Writer, rows [][]cell) {
+	var widths []int
+	for _, row := range rows {
+		for i, c := range row {
+			if i == len(widths) {
+				widths = append(widths, 0)
+			}
+			if n := utf8.RuneCountInString(c.text); n > widths[i] {
+				widths[i] = n
+			}
+		}
+	}
+	for _, row := range rows {
+		var line strings.Builder
+		for i, c := range row {
+			text := c.text
+			if c.style != "" {
+				text = styled(c.style, text)
+			}
+			line.WriteString(text)
+			if i < len(row)-1 {
+				pad := widths[i] - utf8.RuneCountInString(c.text) + 2
+				line.WriteString(strings.Repeat(" ", pad))
+			}
+		}
+		fmt.Fprintln(w, line.String())
+	}
+}
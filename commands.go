@@ -0,0 +1,1285 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// command is a subcommand of shh. Commands parse their own flags, which may
+// appear anywhere after the command name, as may the global flags.
+type command struct {
+	name    string
+	aliases []string
+
+	// usage lists the command's forms, each followed by what it does.
+	usage []string
+
+	// description and examples are shown by `shh help $command` and in the
+	// command's man page.
+	description string
+	examples    []string
+
+	// noProject commands may run without a .shh.
+	noProject bool
+
+	// hidden commands aren't shown in help.
+	hidden bool
+
+	// lock is how the command locks the project file while it runs. It's
+	// exclusive unless the command only reads the project or doesn't use
+	// it.
+	lock lockMode
+
+	// ownFlags share a name with a global flag, such as aws's --profile.
+	// After the command name they're left for the command to parse.
+	ownFlags []string
+
+	run func(nonInteractive bool, args []string) error
+}
+
+// commandFlag describes flags shared by one or more commands.
+type commandFlag struct {
+	commands []string
+	usage    []string
+}
+
+// argsOnly adapts a command which doesn't prompt, so it ignores -n.
+func argsOnly(fn func(args []string) error) func(bool, []string) error {
+	return func(_ bool, args []string) error { return fn(args) }
+}
+
+func findCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+		for _, alias := range cmd.aliases {
+			if alias == name {
+				return cmd
+			}
+		}
+	}
+	return nil
+}
+
+// splitGlobalFlags moves the global flags out of args, wherever they appear
+// before "--", so `shh get -n $name` works like `shh -n get $name`. Flags
+// after the command name which the command defines itself are left alone.
+func splitGlobalFlags(fs *flag.FlagSet, args []string) (global, rest []string) {
+	var cmd *command
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			return global, append(rest, args[i:]...)
+		}
+		name := strings.TrimLeft(arg, "-")
+		if name == arg || name == "" {
+			if cmd == nil && len(rest) == 0 {
+				cmd = findCommand(arg)
+			}
+			rest = append(rest, arg)
+			continue
+		}
+		hasValue := strings.Contains(name, "=")
+		if hasValue {
+			name = name[:strings.Index(name, "=")]
+		}
+		f := fs.Lookup(name)
+		if f != nil && cmd != nil {
+			for _, own := range cmd.ownFlags {
+				if own == name {
+					f = nil
+				}
+			}
+		}
+		if f == nil {
+			rest = append(rest, arg)
+			continue
+		}
+		global = append(global, arg)
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+			continue
+		}
+		if !hasValue && i+1 < len(args) {
+			i++
+			global = append(global, args[i])
+		}
+	}
+	return global, rest
+}
+
+// wantsHelp reports whether the command's args ask for help, before any "--".
+func wantsHelp(args []string) bool {
+	for _, arg := range args {
+		switch arg {
+		case "--":
+			return false
+		case "-h", "-help", "--help":
+			return true
+		}
+	}
+	return false
+}
+
+// help prints usage for all commands, or for the named one.
+func help(args []string) error {
+	if len(args) == 0 {
+		usage()
+		return nil
+	}
+	if len(args) > 1 {
+		return errors.New("bad args: expected `help [$command]`")
+	}
+	cmd := findCommand(args[0])
+	if cmd == nil || cmd.hidden {
+		return &badArgError{Arg: args[0]}
+	}
+	commandUsage(cmd)
+	return nil
+}
+
+// commandUsage prints a command's forms and its flags.
+func commandUsage(cmd *command) {
+	fmt.Println(tr("usage:"))
+	fmt.Println()
+	for _, line := range cmd.usage {
+		if strings.HasPrefix(line, "\t") {
+			fmt.Println("\t" + line)
+		} else {
+			fmt.Println("\tshh " + line)
+		}
+	}
+	if cmd.description != "" {
+		fmt.Println()
+		for _, line := range wrapText(cmd.description, 72) {
+			fmt.Println("\t" + line)
+		}
+	}
+	if flags := flagsFor(cmd); len(flags) > 0 {
+		fmt.Println()
+		fmt.Println(tr("flags:"))
+		for _, line := range flags {
+			fmt.Println("\t" + line)
+		}
+	}
+	if len(cmd.examples) > 0 {
+		fmt.Println()
+		fmt.Println(tr("examples:"))
+		fmt.Println()
+		for _, line := range cmd.examples {
+			fmt.Println("\t" + line)
+		}
+	}
+	fmt.Println()
+	fmt.Println(tr("Global flags such as -n may also be given. See `shh help`."))
+}
+
+// flagsFor returns the usage of the command's flags.
+func flagsFor(cmd *command) []string {
+	var flags []string
+	for _, f := range commandFlags {
+		for _, name := range f.commands {
+			if name == cmd.name {
+				flags = append(flags, f.usage...)
+				break
+			}
+		}
+	}
+	return flags
+}
+
+// wrapText breaks s into lines of at most width characters, at spaces.
+func wrapText(s string, width int) []string {
+	var lines []string
+	line := ""
+	for _, word := range strings.Fields(s) {
+		if line != "" && len(line)+1+len(word) > width {
+			lines = append(lines, line)
+			line = ""
+		}
+		if line != "" {
+			line += " "
+		}
+		line += word
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// usage prints every command and flag.
+func usage() {
+	fmt.Println(tr("usage:"))
+	fmt.Println()
+	fmt.Println("\tshh [flags] [command]")
+	fmt.Println()
+	fmt.Println(tr("global commands:"))
+	for _, cmd := range commands {
+		if cmd.hidden {
+			continue
+		}
+		for _, line := range cmd.usage {
+			fmt.Println("\t" + line)
+		}
+	}
+	fmt.Println()
+	fmt.Println(tr("flags:"))
+	for _, line := range globalFlagUsage {
+		fmt.Println("\t" + line)
+	}
+	fmt.Println()
+	fmt.Println(tr("command flags:"))
+	for _, f := range commandFlags {
+		for _, line := range f.usage {
+			fmt.Println("\t" + line)
+		}
+	}
+}
+
+func init() {
+	// Set here, since the docs refer back to commands
+	findCommand("docs").run = argsOnly(docsCmd)
+	flag.Usage = usage
+	flag.CommandLine.SetOutput(os.Stdout)
+}
+
+var globalFlagUsage = []string{
+	"-n\t\t\tNon-interactive mode. Fail if shh would prompt for the password",
+	"-e, -env $env\t\tUse secrets in an environment, such as prod",
+	"-file $path\t\tUse the project file at $path rather than finding .shh",
+	"-profile $name\t\tUse the keys and config of a profile, such as work",
+	"-password-file $path\tRead the password from a file",
+	"-password-fd $n\t\tRead the password from a file descriptor",
+	"-fix-perms\t\tRemove other users' access to keys, config, and .shh",
+	"-q\t\t\tQuiet mode. Print only requested output, prompts, and errors",
+	"-json\t\t\tPrint JSON from show, get, and status, and for errors",
+	"-verbose\t\tLog what shh is doing to stderr, redacting secrets",
+}
+
+// version of shh.
+const version = "1.5.2"
+
+var commands = []*command{
+	{name: "init",
+		usage: []string{
+			"init [--min-bits $n]\tinitialize store or add self to existing store",
+			"init --remote $url\tkeep the project in a remote store, or join one",
+			"init --git $url\t\tkeep the project in a dedicated git repo, or join one",
+			"init --from-template $file",
+			"\t\t\tcreate a project with a template's users and secrets",
+		},
+		description: "Create a .shh file in the current directory with your public " +
+			"key, or add yourself to the .shh of an existing project. " +
+			"--min-bits rejects users whose keys are smaller. With --remote " +
+			"or --git, the project is kept in object storage (s3://, gs://), " +
+			"a shared file (file://), a serve-remote server (https://), or " +
+			"its own git repo, and the local .shh only points to it. " +
+			"--from-template " +
+			"adds the users, groups, environments, settings, and empty " +
+			"secrets declared in a JSON file.",
+		examples: []string{
+			"shh init",
+			"shh init --min-bits 4096",
+			"shh init --remote s3://bucket/team.shh",
+			"shh init --git git@github.com:team/secrets.git",
+			"shh init --from-template ~/team/shh-template.json",
+		},
+		noProject: true,
+		run:       argsOnly(initShh)},
+	{name: "gen-keys",
+		usage: []string{"gen-keys [--bits $n]\tgenerate keys"},
+		description: "Generate your RSA keys and config in ~/.config/shh, asking for " +
+			"a username and a password to encrypt the private key. Back up " +
+			"id_rsa and remember the password. If either is lost, so are " +
+			"your secrets. With -profile, the keys are generated in " +
+			"~/.config/shh/profiles/$name instead.",
+		examples: []string{
+			"shh gen-keys",
+			"shh gen-keys --bits 4096",
+			"shh -profile work gen-keys",
+		},
+		noProject: true,
+		lock:      lockNone,
+		run:       argsOnly(genKeys)},
+	{name: "profile",
+		usage: []string{
+			"profile [list]\t\tlist profiles, marking the one in use",
+			"profile use $name\tuse a profile for this project by default",
+			"profile use --dir $dir $name",
+			"\t\t\tuse a profile for every project in a directory",
+		},
+		description: "List your profiles, each a separate identity with its own " +
+			"keys and config, such as work and personal. Choose one for a " +
+			"command with -profile, or record one for the project with use, " +
+			"so it's picked automatically. The default profile is " +
+			"~/.config/shh itself.",
+		examples: []string{
+			"shh -profile work gen-keys",
+			"shh profile use work",
+			"shh profile use --dir ~/work work",
+			"shh profile",
+		},
+		noProject: true,
+		lock:      lockNone,
+		run:       argsOnly(profiles)},
+	{name: "get",
+		usage: []string{"get [$name]\t\tget secret, or pick one"},
+		description: "Decrypt and print a secret. A name ending in * prints each " +
+			"matching secret you can access, in order of name. Without a " +
+			"name, or with part of one, you pick the secret from a list.",
+		examples: []string{
+			"shh get staging/env",
+			"shh get 'staging/*'",
+			"shh get",
+			"shh get production/api_key --as-jwe --recipient service.pem",
+		},
+		lock: lockShared,
+		run:  get},
+	{name: "set",
+		usage: []string{"set $name $val\t\tset secret"},
+		description: "Create a secret which only you can access until you allow " +
+			"others. Names are shared by the whole project, so set fails if " +
+			"the name is taken, even by a secret you can't access. Use edit " +
+			"to change a secret.",
+		examples: []string{
+			"shh set staging/env \"$(cat staging.env)\"",
+			"shh set --sensitive prod/db_password \"$(pbpaste)\"",
+		},
+		run: argsOnly(set)},
+	{name: "del",
+		usage: []string{"del $name\t\tdelete a secret"},
+		description: "Move a secret, or every secret matching a glob, to the trash, " +
+			"listing them and asking first. Protected secrets also need " +
+			"--force.",
+		examples: []string{
+			"shh del staging/old_key",
+			"shh del --yes 'tmp/*'",
+		},
+		run: argsOnly(del)},
+	{name: "copy",
+		usage:       []string{"copy $old $new          copy a secret, maintaining the same team access"},
+		description: "Copy a secret to a new name, keeping the same team access.",
+		examples: []string{
+			"shh copy production/env staging/env",
+		},
+		run: argsOnly(copySecret)},
+	{name: "rename",
+		usage:       []string{"rename $old $new        rename a secret"},
+		description: "Rename a secret for everyone who can access it.",
+		examples: []string{
+			"shh rename old-name new-name",
+		},
+		run: argsOnly(rename)},
+	{name: "allow",
+		usage: []string{"allow $user $secret\tallow user or age1... recipient access to a secret"},
+		description: "Give a user access to a secret, or to every secret matching a " +
+			"glob. You can only share secrets you can access. The user may " +
+			"also be an age1... public key. Access lasts for the project's " +
+			"grant-days setting, if any, unless --expires is given.",
+		examples: []string{
+			"shh allow alice@example.com staging/env",
+			"shh allow alice@example.com 'staging/*'",
+			"shh allow --expires 7 bob@example.com prod/db_password",
+		},
+		run: allow},
+	{name: "deny",
+		usage: []string{"deny $user $secret\tdeny user access to a secret"},
+		description: "Remove a user's access to a secret, or to every secret " +
+			"matching a glob, listing them and asking first. Protected " +
+			"secrets also need --force.",
+		examples: []string{
+			"shh deny alice@example.com staging/env",
+		},
+		run: argsOnly(deny)},
+	{name: "envs",
+		usage: []string{"envs\t\t\tlist environments, their members, and secret counts"},
+		description: "List each environment, such as dev, staging, or prod, with " +
+			"how many secrets it has and the users allowed all of it. Secrets " +
+			"are set in an environment with -e, and `shh allow -e $env $user` " +
+			"allows a user every secret in it, including those set later.",
+		examples: []string{
+			"shh envs",
+			"shh set -e prod db/password $value",
+			"shh allow -e staging alice@example.com",
+		},
+		lock: lockShared,
+		run:  argsOnly(environments)},
+	{name: "settings",
+		usage: []string{
+			"settings\t\tshow the project's settings",
+			"settings set $name $val\tchange a project setting",
+			"settings unset $name\treset a project setting",
+		},
+		description: "Show or change the project's settings, which every " +
+			"client reads and enforces: default-env is the environment used " +
+			"without -e, key-algorithms lists the kinds of key (rsa, kms, " +
+			"gpg, age) secrets may be encrypted for, min-key-bits is the smallest " +
+			"rsa key, grant-days ends access given by allow after a number of " +
+			"days, protected lists names or globs which need --force to " +
+			"delete or deny, trash-days is how long deleted secrets are " +
+			"kept, min-password-score rejects new passwords rated below " +
+			"it, from 0 to 4, max-age-days is how old values may get before " +
+			"they're due to be rotated, and webhooks lists urls sent a " +
+			"signed event for each change. Lists are comma-separated.",
+		examples: []string{
+			"shh settings",
+			"shh settings set default-env dev",
+			"shh settings set key-algorithms rsa,kms",
+			"shh settings set protected 'prod:*,root/*'",
+			"shh settings set webhooks https://hooks.example.com/shh",
+			"shh settings unset grant-days",
+		},
+		run: argsOnly(settings)},
+	{name: "notify",
+		usage: []string{"notify test		send a test event to the project's webhooks"},
+		description: "Send a test event to each of the project's webhooks, " +
+			"reporting those which fail. Webhooks on hooks.slack.com or " +
+			"webhook.office.com are sent messages such as \"alice granted " +
+			"bob access to prod/db/url\" rather than JSON events. Prefix a " +
+			"webhook with slack: or teams: to choose the format for another " +
+			"host.",
+		examples: []string{
+			"shh settings set webhooks https://hooks.slack.com/services/T0/B0/x",
+			"shh notify test",
+		},
+		lock: lockShared,
+		run:  argsOnly(notify)},
+	{name: "policy",
+		usage: []string{
+			"policy [list]\t\tlist rules for new secret values",
+			"policy set $glob\tconstrain new values of matching secrets",
+			"policy unset $glob\tremove a policy",
+		},
+		description: "Constrain the values of secrets matching a glob, so weak or " +
+			"malformed credentials can't enter the store. set, edit, import, " +
+			"and pulls from other secret managers reject values shorter than " +
+			"--min-length characters, with fewer than --min-entropy estimated " +
+			"bits of entropy, or not wholly matching the --match regexp. A " +
+			"glob without an environment applies in every environment. " +
+			"Existing values are checked when next changed.",
+		examples: []string{
+			"shh policy set --min-length 32 --min-entropy 128 'prod:*'",
+			"shh policy set --match 'sk_live_[A-Za-z0-9]+' stripe/key",
+			"shh policy unset 'prod:*'",
+		},
+		run: argsOnly(policies)},
+	{name: "add-user",
+		usage: []string{
+			"add-user $user $pubkey  add user to project given their public key",
+			"add-user $kms_arn\tadd an aws kms key as a user",
+		},
+		description: "Add a user to the project with the public key they generated " +
+			"with gen-keys. They can't access any secrets until you allow " +
+			"them. An AWS KMS key ARN may be added as a user instead, whose " +
+			"access is controlled by IAM.",
+		examples: []string{
+			"shh add-user alice@example.com pubkey.pem",
+			"shh add-user arn:aws:kms:us-east-1:111122223333:key/1234abcd",
+		},
+		run: argsOnly(addUser)},
+	{name: "rm-user",
+		usage: []string{"rm-user $user\t\tremove user from project"},
+		description: "Remove a user and their copies of every secret from the " +
+			"project, after asking.",
+		examples: []string{
+			"shh rm-user alice@example.com",
+		},
+		run: argsOnly(rmUser)},
+	{name: "search",
+		usage: []string{"search $regex\t\tlist all secrets containing the regex"},
+		description: "Print the name of each secret you can access whose value " +
+			"matches the regular expression.",
+		examples: []string{
+			"shh search 'AKIA[0-9A-Z]{16}'",
+			"shh search \"\\d{8,}\" | xargs -I % -o shh edit %",
+		},
+		lock: lockShared,
+		run:  argsOnly(search)},
+	{name: "show",
+		usage: []string{"show [$user]\t\tshow user's allowed and denied keys"},
+		description: "List the project's users and the secrets each can access, or " +
+			"the secrets of one user.",
+		examples: []string{
+			"shh show",
+			"shh show alice@example.com",
+		},
+		lock: lockShared,
+		run:  argsOnly(show)},
+	{name: "run",
+		usage: []string{
+			"run [$secret...] -- $cmd",
+			"\t\t\trun a command with secrets as environment variables",
+		},
+		description: "Run a command with secrets as environment variables, exiting " +
+			"with its status. A glob names each variable after the part " +
+			"matched by *, and an exact name uses the whole name, " +
+			"upper-cased, with other characters as _. $VAR=$name names the " +
+			"variable yourself.",
+		examples: []string{
+			"shh run 'staging/*' DB_URL=production/db_url -- ./server",
+			"shh run --manifest secrets.env -- ./server",
+		},
+		lock: lockShared,
+		run:  runCmd},
+	{name: "watch",
+		usage: []string{
+			"watch [$secret...] -- $cmd",
+			"\t\t\trun a command, restarting it when its secrets change",
+		},
+		description: "Run a command like run, but keep checking .shh, and restart " +
+			"the command, or signal it with --signal, when its secrets " +
+			"change.",
+		examples: []string{
+			"shh watch 'db/*' -- ./server",
+			"shh watch --signal HUP 'db/*' -- ./server",
+		},
+		lock: lockShared,
+		run:  watch},
+	{name: "env",
+		usage: []string{"env [$secret...]\tprint secrets as dotenv, shell, or json"},
+		description: "Print secrets as environment variables, named as for run, in " +
+			"dotenv, shell, or JSON format.",
+		examples: []string{
+			"shh env 'staging/*' > .env",
+			"eval \"$(shh env --format shell 'staging/*')\"",
+		},
+		lock: lockShared,
+		run:  env},
+	{name: "docker-env",
+		usage: []string{"docker-env [$secret...]\tprint secrets as a docker --env-file"},
+		description: "Print secrets in the format of docker run --env-file, named as " +
+			"for run.",
+		examples: []string{
+			"docker run --env-file <(shh docker-env 'staging/*') app",
+		},
+		lock: lockShared,
+		run:  dockerEnv},
+	{name: "compose",
+		usage: []string{
+			"compose [$secret...] -- $args",
+			"\t\t\trun docker compose with secrets in its environment",
+		},
+		description: "Run docker compose with secrets in its environment, for the " +
+			"variables in compose.yaml to use.",
+		examples: []string{
+			"shh compose 'staging/*' -- up -d",
+			"shh compose 'staging/*' -- run --rm web",
+		},
+		lock: lockShared,
+		run:  compose},
+	{name: "actions-export",
+		usage: []string{
+			"actions-export [$secret...]",
+			"\t\t\tmask and export secrets in github actions",
+		},
+		description: "Mask secrets in the GitHub Actions log and export them to the " +
+			"following steps as environment variables, on self-hosted " +
+			"runners.",
+		examples: []string{
+			"shh -n --password-file /etc/shh/password actions-export 'ci/*'",
+		},
+		lock: lockShared,
+		run:  actionsExport},
+	{name: "import",
+		usage: []string{"import $file\t\timport secrets from a .env, json, or yaml file"},
+		description: "Import each key of a .env, JSON, or YAML file as a secret, " +
+			"nested keys joined by /, or a password manager's export. " +
+			"Secrets are previewed and confirmed first, and existing " +
+			"secrets are never overwritten.",
+		examples: []string{
+			"shh import --prefix staging/ staging.env",
+			"shh import --whole staging/env staging.env",
+			"shh import --format bitwarden --prefix vault/ bitwarden_export.json",
+		},
+		run: argsOnly(importSecrets)},
+	{name: "import-pass",
+		usage: []string{"import-pass [$dir]\timport secrets from a pass password store"},
+		description: "Import each entry of a pass password store, " +
+			"$PASSWORD_STORE_DIR or ~/.password-store by default, " +
+			"decrypting it with gpg and keeping its path.",
+		examples: []string{
+			"shh import-pass --prefix pass/ ~/.password-store",
+		},
+		run: argsOnly(importPass)},
+	{name: "export",
+		usage: []string{
+			"export --format $fmt [$glob]",
+			"\t\t\texport secrets for 1password, bitwarden, or lastpass",
+		},
+		description: "Export secrets as a CSV for 1Password, Bitwarden, or LastPass. " +
+			"Values are redacted unless --reveal is given, which requires " +
+			"-o.",
+		examples: []string{
+			"shh export --format 1password 'vault/*'",
+			"shh export --format 1password --reveal -o 1password.csv 'vault/*'",
+		},
+		lock: lockShared,
+		run:  exportSecrets},
+	{name: "import-kdbx",
+		usage: []string{"import-kdbx $file\timport secrets from a keepass database"},
+		description: "Import a KeePass database, groups becoming prefixes of secret " +
+			"names. The password is asked for, or read from " +
+			"$SHH_KDBX_PASSWORD.",
+		examples: []string{
+			"shh import-kdbx --prefix team/ vault.kdbx",
+		},
+		run: argsOnly(importKDBX)},
+	{name: "vault",
+		usage: []string{
+			"vault push|pull|diff [$glob]",
+			"\t\t\tsync secrets with a hashicorp vault kv v2 mount",
+		},
+		description: "Compare, push, or pull secrets with a HashiCorp Vault KV v2 " +
+			"mount, using $VAULT_ADDR and $VAULT_TOKEN. Changes are " +
+			"previewed and confirmed first.",
+		examples: []string{
+			"shh vault diff 'prod/*' --prefix myapp/",
+			"shh vault push 'prod/*' --prefix myapp/",
+		},
+		run: vault},
+	{name: "aws",
+		usage: []string{
+			"aws push|pull|diff [$glob]",
+			"\t\t\tsync secrets with aws secrets manager",
+		},
+		description: "Compare, push, or pull secrets with AWS Secrets Manager, using " +
+			"the aws cli's credentials. Changes are previewed and confirmed " +
+			"first.",
+		examples: []string{
+			"shh aws push 'prod/*' --prefix myapp/ --region us-east-1",
+		},
+		ownFlags: []string{"profile"},
+		run:      aws},
+	{name: "gcp",
+		usage: []string{
+			"gcp push|pull|diff [$glob]",
+			"\t\t\tsync secrets with google secret manager",
+		},
+		description: "Compare, push, or pull secrets with Google Secret Manager. " +
+			"Changes are previewed and confirmed first.",
+		examples: []string{
+			"shh gcp push 'prod/*' --project myapp-prod",
+		},
+		run: gcp},
+	{name: "azure",
+		usage: []string{
+			"azure push|pull|diff [$glob]",
+			"\t\t\tsync secrets with azure key vault",
+		},
+		description: "Compare, push, or pull secrets with Azure Key Vault. Changes " +
+			"are previewed and confirmed first.",
+		examples: []string{
+			"shh azure push 'prod/*' --vault myapp-prod",
+		},
+		run: azure},
+	{name: "export-kdbx",
+		usage: []string{
+			"export-kdbx -o $file [$glob]",
+			"\t\t\texport secrets to a new keepass database",
+		},
+		description: "Export secrets to a new KeePass 4 database, encrypted with " +
+			"AES-256 and Argon2id.",
+		examples: []string{
+			"shh export-kdbx -o vault.kdbx 'team/*'",
+		},
+		lock: lockShared,
+		run:  exportKDBX},
+	{name: "template",
+		usage: []string{
+			"template $file [-o $out]",
+			"\t\t\trender a template using {{ secret \"name\" }}",
+		},
+		description: "Render a Go template, replacing {{ secret \"name\" }} with the " +
+			"secret's value, to stdout or a file.",
+		examples: []string{
+			"shh template config.tmpl -o config.toml",
+		},
+		lock: lockShared,
+		run:  renderTemplate},
+	{name: "sops-encrypt",
+		usage: []string{
+			"sops-encrypt $file [-o $out]",
+			"\t\t\tencrypt a json or yaml file with sops for project users",
+		},
+		description: "Encrypt the values of a JSON or YAML file in the SOPS format, " +
+			"for each project user with access to it.",
+		examples: []string{
+			"shh sops-encrypt config.yaml -o config.enc.yaml",
+		},
+		lock: lockShared,
+		run:  argsOnly(sopsEncryptFile)},
+	{name: "sops-decrypt",
+		usage: []string{
+			"sops-decrypt $file [-o $out]",
+			"\t\t\tdecrypt a sops file encrypted for you",
+		},
+		description: "Decrypt a SOPS file which was encrypted for you.",
+		examples: []string{
+			"shh sops-decrypt config.enc.yaml",
+		},
+		lock: lockShared,
+		run:  sopsDecryptFile},
+	{name: "mount",
+		usage: []string{"mount $dir\t\tmount secrets as a read-only filesystem (linux)"},
+		description: "Present your secrets as read-only files under a directory, " +
+			"decrypted on read, until interrupted. Linux only.",
+		examples: []string{
+			"shh mount /run/shh --only 'production/*'",
+		},
+		lock: lockShared,
+		run:  mount},
+	{name: "edit",
+		usage: []string{"edit\t\t\tedit a secret using $EDITOR"},
+		description: "Edit a secret in $EDITOR and re-encrypt it for everyone with " +
+			"access, without writing the plaintext to disk.",
+		examples: []string{
+			"shh edit staging/env",
+		},
+		run: edit},
+	{name: "rotate",
+		usage: []string{
+			"rotate [--bits $n]\trotate key",
+			"rotate --all\t\tre-key every secret you can access, resuming if interrupted",
+		},
+		description: "Generate new keys and re-encrypt your secrets with them, or " +
+			"with --all, re-encrypt every secret you can access with new " +
+			"AES keys.",
+		examples: []string{
+			"shh rotate",
+			"shh rotate --all",
+		},
+		run: rotate},
+	{name: "serve",
+		usage: []string{
+			"serve [--systemd]\tstart server to maintain password in memory",
+			"serve --api [--socket $path]",
+			"\t\t\tserve secrets to local applications",
+		},
+		description: "Run a server which holds your decrypted private key in memory " +
+			"after shh login, so you needn't enter your password each time. " +
+			"With --api, serve the project's secrets to local applications " +
+			"holding a token from `shh api-token add`.",
+		examples: []string{
+			"shh serve",
+			"shh serve --api --socket /run/user/1000/shh.sock",
+		},
+		noProject: true,
+		lock:      lockNone,
+		run:       argsOnly(serve)},
+	{name: "api-token",
+		usage: []string{
+			"api-token add $name $glob...",
+			"\t\t\tadd a token for serve --api which reads matching secrets",
+			"api-token list\t\tlist tokens for serve --api",
+			"api-token rm $name\trevoke a token for serve --api",
+		},
+		description: "Manage the tokens applications use with `shh serve --api`. " +
+			"Each token can only read the secrets matching its globs, and " +
+			"is printed once when added.",
+		examples: []string{
+			"shh api-token add billing 'billing/*' shared/db_url",
+			"shh api-token rm billing",
+		},
+		noProject: true,
+		lock:      lockNone,
+		run:       argsOnly(apiTokenCmd)},
+	{name: "agent",
+		usage:       []string{"agent install\t\tinstall systemd user units for the server"},
+		description: "Install systemd user units which start the server on demand.",
+		examples: []string{
+			"shh agent install",
+		},
+		noProject: true,
+		lock:      lockNone,
+		run:       argsOnly(agentCmd)},
+	{name: "login",
+		usage: []string{"login\t\t\tlogin to server to maintain password in memory"},
+		description: "Send your password to the server, which decrypts your private " +
+			"key and holds it in memory for an hour.",
+		examples: []string{
+			"shh login",
+		},
+		lock: lockNone,
+		run:  argsOnly(login)},
+	{name: "logout",
+		aliases: []string{"lock"},
+		usage:   []string{"logout [--all]\t\tclear the password from the server's memory"},
+		description: "Clear your private key from the server's memory, or every " +
+			"identity's with --all.",
+		examples: []string{
+			"shh logout",
+			"shh lock --all",
+		},
+		noProject: true,
+		lock:      lockNone,
+		run:       argsOnly(logout)},
+	{name: "status",
+		usage: []string{"status\t\t\tshow server, identity, and project file status"},
+		description: "Show your identity, the permissions of your keys and config, " +
+			"the project file and how it was found, and the server's state. " +
+			"Without a project, it shows where the search for .shh stopped: " +
+			"the root of the git repository, or $HOME.",
+		examples: []string{
+			"shh status",
+			"shh status --json",
+		},
+		noProject: true,
+		lock:      lockNone,
+		run:       argsOnly(status)},
+	{name: "seal",
+		usage: []string{"seal\t\t\tencrypt the whole project file with a passphrase"},
+		description: "Encrypt the whole project file with a passphrase, hiding even " +
+			"the names of users and secrets. With --kms, seal it with a key " +
+			"wrapped by AWS KMS instead.",
+		examples: []string{
+			"shh seal",
+			"shh seal --kms arn:aws:kms:us-east-1:111122223333:key/1234abcd",
+		},
+		run: argsOnly(sealShh)},
+	{name: "unseal",
+		usage:       []string{"unseal\t\t\tremove the project passphrase"},
+		description: "Remove the project passphrase.",
+		examples: []string{
+			"shh unseal",
+		},
+		run: argsOnly(unsealShh)},
+	{name: "publish",
+		usage: []string{"publish\t\t\tpublish a read-only mirror for machine keys"},
+		description: "Publish a read-only mirror of the project with only one user's " +
+			"matching secrets, for deploy machines. Saved targets are " +
+			"republished after every change. Without flags, republish every " +
+			"saved target.",
+		examples: []string{
+			"shh publish --to s3://bucket/prod.shh --for deploy@example.com --only 'prod/*' --save",
+			"shh publish",
+		},
+		run: argsOnly(publish)},
+	{name: "push",
+		usage:       []string{"push [$url]\t\tupload the project file to a remote endpoint"},
+		description: "Upload the project file to a server started with serve-remote.",
+		examples: []string{
+			"shh push https://secrets.example.com/",
+		},
+		lock: lockShared,
+		run:  argsOnly(pushShh)},
+	{name: "pull",
+		usage: []string{"pull [$url]\t\tfetch and merge the project file from a remote"},
+		description: "Fetch the project file from the remote and merge it with " +
+			"yours.",
+		examples: []string{
+			"shh pull",
+			"shh pull --theirs",
+		},
+		noProject: true,
+		run:       argsOnly(pullShh)},
+	{name: "serve-remote",
+		usage: []string{
+			"serve-remote --file $path",
+			"\t\t\tserve a project file for push and pull",
+		},
+		description: "Serve a project file for push and pull, authenticating with " +
+			"$SHH_REMOTE_TOKEN. TLS is required unless --addr is a loopback address.",
+		examples: []string{
+			"SHH_REMOTE_TOKEN=... shh serve-remote --file /var/lib/shh/team.shh " +
+				"--tls-cert cert.pem --tls-key key.pem",
+		},
+		noProject: true,
+		lock:      lockNone,
+		run:       argsOnly(serveRemote)},
+	{name: "files",
+		usage: []string{"files install\t\tset up git to encrypt the files listed in .shhfiles"},
+		description: "Set up git to encrypt the files listed in .shhfiles when " +
+			"they're committed, and decrypt them when they're checked out.",
+		examples: []string{
+			"shh files install",
+		},
+		lock: lockShared,
+		run:  argsOnly(filesCmd)},
+	{name: "clean",
+		usage: []string{"clean $path\t\tgit filter to encrypt a file listed in .shhfiles"},
+		description: "The git clean filter, which encrypts a file listed in " +
+			".shhfiles. Run by git.",
+		run: argsOnly(cleanFile)},
+	{name: "smudge",
+		usage: []string{"smudge $path\t\tgit filter to decrypt a file listed in .shhfiles"},
+		description: "The git smudge filter, which decrypts a file listed in " +
+			".shhfiles. Run by git.",
+		lock: lockShared,
+		run:  argsOnly(smudgeFile)},
+	{name: "hook",
+		usage: []string{"hook install\t\tinstall a git pre-commit hook to catch leaked secrets"},
+		description: "Install a git pre-commit hook which stops commits containing " +
+			"the values of secrets you can access.",
+		examples: []string{
+			"shh hook install",
+		},
+		lock: lockShared,
+		run:  hookCmd},
+	{name: "log",
+		usage: []string{"log [$glob]\t\tshow changes to secrets and grants from git history"},
+		description: "Show who changed which secrets and grants in each commit of " +
+			".shh.",
+		examples: []string{
+			"shh log",
+			"shh log 'prod/*'",
+		},
+		lock: lockShared,
+		run:  argsOnly(logShh)},
+	{name: "protect",
+		usage: []string{"protect $secret\t\trequire --force to delete or deny a secret"},
+		description: "Protect a secret, so deleting it or denying access to it " +
+			"requires --force.",
+		examples: []string{
+			"shh protect prod/db_password",
+		},
+		run: func(_ bool, args []string) error {
+			return protect(args, true)
+		}},
+	{name: "unprotect",
+		usage:       []string{"unprotect $secret\tremove a secret's protection"},
+		description: "Remove a secret's protection.",
+		examples: []string{
+			"shh unprotect prod/db_password",
+		},
+		run: func(_ bool, args []string) error {
+			return protect(args, false)
+		}},
+	{name: "pin-key",
+		usage: []string{"pin-key [$user] [$fp]	require user to use the key with the fingerprint"},
+		description: "Pin a user to the key with the fingerprint, defaulting to " +
+			"yourself and your key in the project. Commands then fail if they " +
+			"use another of the user's identities with the project, such as " +
+			"a personal key for the same email. Rotating your key updates " +
+			"your pin.",
+		examples: []string{
+			"shh pin-key",
+			"shh pin-key alice@example.com",
+			"shh pin-key alice@example.com SHA256:...",
+		},
+		run: func(_ bool, args []string) error {
+			return pinKey(args, true)
+		}},
+	{name: "unpin-key",
+		usage:       []string{"unpin-key $user		remove a user's key pin"},
+		description: "Remove a user's key pin.",
+		examples: []string{
+			"shh unpin-key alice@example.com",
+		},
+		run: func(_ bool, args []string) error {
+			return pinKey(args, false)
+		}},
+	{name: "trash",
+		usage: []string{
+			"trash list\t\tlist deleted secrets",
+			"trash restore $secret\trestore a deleted secret",
+			"trash purge [$glob]\tpermanently delete secrets from the trash",
+			"trash retain $days\tkeep deleted secrets for days (default 30)",
+		},
+		description: "Deleted secrets are kept in the trash for 30 days. List them, " +
+			"restore one, purge them now, or change how long they're kept.",
+		examples: []string{
+			"shh trash list",
+			"shh trash restore prod/db_url",
+			"shh trash retain 90",
+		},
+		run: argsOnly(trashCmd)},
+	{name: "tui",
+		usage: []string{"tui\t\t\tbrowse users and secrets, revealing, copying, and sharing them"},
+		description: "Browse the project full-screen, fuzzy-filtering secrets and " +
+			"users, and reveal, copy, allow, or deny the selected secret.",
+		examples: []string{
+			"shh tui",
+		},
+		lock: lockNone,
+		run:  tuiCmd},
+	{name: "undo",
+		usage:       []string{"undo\t\t\trestore .shh from before the last change"},
+		description: "Restore .shh from the backup taken before the last change.",
+		examples: []string{
+			"shh undo",
+		},
+		run: argsOnly(undo)},
+	{name: "merge",
+		usage: []string{"merge [$path]\t\tresolve git conflicts in a .shh file"},
+		description: "Resolve git conflicts in a .shh file, asking which version of " +
+			"each conflicting secret to keep.",
+		examples: []string{
+			"shh merge",
+			"shh merge --theirs",
+		},
+		run: mergeCmd},
+	{name: "diff",
+		usage: []string{"diff $file $file\tcompare users, grants, and secrets in two project files"},
+		description: "Compare the users, grants, and secrets of two project files, " +
+			"which may be git revisions.",
+		examples: []string{
+			"shh diff main:.shh .shh",
+			"shh diff --decrypt main:.shh .shh",
+		},
+		noProject: true,
+		lock:      lockNone,
+		run:       diffShh},
+	{name: "diff-file",
+		usage: []string{"diff-file $path\t\trender a .shh file for git diff, without plaintext"},
+		description: "Render a .shh file as text without plaintext, for git diff's " +
+			"textconv.",
+		examples: []string{
+			"git config diff.shh.textconv \"shh diff-file\"",
+		},
+		noProject: true,
+		lock:      lockNone,
+		run:       argsOnly(diffFile)},
+	{name: "fsck",
+		usage: []string{"fsck [--fix]\t\tcheck .shh for broken or diverged entries"},
+		description: "Check .shh for secrets which can't be decrypted or whose " +
+			"copies diverged, and with --fix, repair them.",
+		examples: []string{
+			"shh fsck",
+			"shh fsck --fix",
+		},
+		run: fsck},
+	{name: "schema",
+		usage: []string{
+			"schema export [-o $file]",
+			"\t\t\tdescribe the project without values or ciphertext",
+			"schema check [$file]\tcheck the project matches a schema",
+		},
+		description: "Export the project's users, environments, settings, and " +
+			"who can access each secret, without any values or ciphertext, " +
+			"for committing to public forks or sharing with auditors. " +
+			"`schema check` compares the project to a schema, by default " +
+			".shh.example, printing what was added (+) or removed (-) and " +
+			"failing if they differ.",
+		examples: []string{
+			"shh schema export -o .shh.example",
+			"shh schema check",
+		},
+		lock: lockShared,
+		run:  argsOnly(schema)},
+	{name: "format",
+		usage:       []string{"format [json|binary]\tshow or change the format of .shh"},
+		description: "Show whether .shh is stored as JSON or binary, or convert it.",
+		examples: []string{
+			"shh format",
+			"shh format binary",
+		},
+		run: argsOnly(formatCmd)},
+	{name: "audit",
+		usage: []string{
+			"audit --hibp [$glob]\tcheck your secrets against breached passwords",
+			"audit --stale [$glob]\tlist secrets overdue for rotation",
+			"audit --access [--max-readers $n] [$glob]",
+			"\t\t\tflag over-broad access, suggesting denies",
+			"audit verify\t\tcheck the audit log for gaps and rewrites",
+		},
+		description: "Check the values of the secrets you can access against Have I " +
+			"Been Pwned's breached passwords, listing those which need " +
+			"rotating. Only the first five characters of each value's SHA-1 " +
+			"hash leave the machine. Set $SHH_HIBP_URL to use a mirror of the " +
+			"range API. --stale lists secrets whose values are older than the " +
+			"project's max-age-days setting, which get also warns about. " +
+			"--access flags users who can read every secret, secrets " +
+			"readable by more than --max-readers users (10), secrets held " +
+			"for keys missing from the project or not matching their pin, " +
+			"and sensitive secrets held by machine identities, suggesting " +
+			"deny commands for each. " +
+			"Every change to the project is recorded in .shh.audit: who made " +
+			"it, with which command, when, and the hashes of the project " +
+			"before and after. Each entry holds the hash of the one before, " +
+			"and is signed by its author when their key is available without " +
+			"a prompt. verify reports missing or rewritten entries, bad " +
+			"signatures, and changes made outside shh.",
+		examples: []string{
+			"shh audit --hibp",
+			"shh audit --hibp 'prod/*'",
+			"shh audit --stale",
+			"shh audit --access --max-readers 5",
+			"shh audit verify",
+		},
+		lock: lockShared,
+		run:  audit},
+	{name: "report",
+		usage: []string{
+			"report access [--format csv|json] [-o $file]",
+			"\t\t\tlist who can read what, for access reviews",
+		},
+		description: "List each user's key fingerprint, the environments " +
+			"they're a member of, and the secrets they can read, with when " +
+			"they were given each and when that access expires. CSV has a " +
+			"row for each user and secret, for spreadsheets; JSON groups " +
+			"secrets by user. Neither includes values. Access given by older " +
+			"versions of shh has no grant date.",
+		examples: []string{
+			"shh report access",
+			"shh report access --format json -o access-review.json",
+		},
+		lock: lockShared,
+		run:  argsOnly(reports)},
+	{name: "check",
+		usage: []string{
+			"check [--as $user] [--decrypt] [$manifest]",
+			"\t\t\tcheck a service's secrets exist and can be decrypted",
+		},
+		description: "Check that every secret declared in a service's shh.yaml " +
+			"exists and that its deploy identity can decrypt it, so CI fails " +
+			"before deploying rather than when the service starts. The " +
+			"identity is the manifest's, --as, or yourself, and --decrypt " +
+			"also decrypts each secret as yourself. shh.yaml may also be " +
+			"given to run, env, and the others with --manifest.",
+		examples: []string{
+			"shh check",
+			"shh check -e prod --as deploy@example.com services/api/shh.yaml",
+			"SHH_KMS_KEY=$arn shh -n check --decrypt",
+		},
+		lock: lockShared,
+		run:  check},
+	{name: "doctor",
+		usage: []string{"doctor\t\t\tcheck your setup and the project, suggesting fixes"},
+		description: "Check your keys, config, permissions, server, and project, " +
+			"suggesting how to fix each problem.",
+		examples: []string{
+			"shh doctor",
+		},
+		noProject: true,
+		lock:      lockNone,
+		run:       doctor},
+	{name: "selftest",
+		usage: []string{"selftest [--full]\tvalidate shh works on this platform"},
+		description: "Check that keys, encryption, and the project file work on this " +
+			"platform, in a temporary directory.",
+		examples: []string{
+			"shh selftest",
+			"shh selftest --full",
+		},
+		noProject: true,
+		lock:      lockNone,
+		run:       argsOnly(selftest)},
+	{name: "completion",
+		usage: []string{
+			"completion bash|zsh|fish",
+			"\t\t\tprint a shell completion script",
+		},
+		description: "Print a completion script for bash, zsh, or fish.",
+		examples: []string{
+			"source <(shh completion bash)",
+			"shh completion fish | source",
+		},
+		noProject: true,
+		lock:      lockNone,
+		run:       argsOnly(completion)},
+	{name: "docs",
+		lock:        lockNone,
+		usage:       []string{"docs man [-o $dir]\tgenerate man pages"},
+		description: "Generate man pages for shh and each command, from the same descriptions as help.",
+		examples: []string{
+			"shh docs man -o /usr/local/share/man/man1",
+		},
+		noProject: true},
+	{name: "version",
+		usage:       []string{"version\t\t\tversion information"},
+		description: "Print the version of shh.",
+		noProject:   true,
+		lock:        lockNone,
+		run: func(_ bool, args []string) error {
+			fmt.Println(version)
+			return nil
+		}},
+	{name: "help",
+		lock:  lockNone,
+		usage: []string{"help [$command]\t\tusage info, or a command's usage and flags"},
+		description: "Print usage for every command, or the usage, flags, and " +
+			"examples of one.",
+		examples: []string{
+			"shh help",
+			"shh help set",
+		}},
+	{name: "__complete",
+		noProject: true,
+		hidden:    true,
+		lock:      lockNone,
+		run:       argsOnly(completeWords)},
+}
+
+var commandFlags = []commandFlag{
+	{[]string{"get"}, []string{
+		"get --as-jwe --recipient $pubkey",
+		"\t\t\toutput the secret as a JWE token for the recipient",
+	}},
+	{[]string{"set"}, []string{"set --sensitive\t\talways require the password to decrypt the secret"}},
+	{[]string{"set"}, []string{"set --age $recipient\talso encrypt for an age public key (repeatable)"}},
+	{[]string{"run", "watch", "env", "docker-env", "compose"}, []string{
+		"run, watch, env, docker-env, compose --manifest $file",
+		"\t\t\tread the secrets from a file",
+	}},
+	{[]string{"run", "watch", "env", "docker-env", "compose"}, []string{
+		"run, watch, env, docker-env, compose --prefix $p [--keep-case]",
+		"\t\t\tprefix variable names and don't upper-case them",
+	}},
+	{[]string{"watch"}, []string{"watch --signal $sig\tsignal the command instead of restarting it"}},
+	{[]string{"watch"}, []string{"watch --interval $d\thow often to check for changes (default 2s)"}},
+	{[]string{"env"}, []string{"env --format $fmt\tdotenv (default), shell, or json"}},
+	{[]string{"mount"}, []string{"mount --only $glob\tonly expose matching secrets"}},
+	{[]string{"actions-export"}, []string{
+		"actions-export --output [--no-env]",
+		"\t\t\talso write to $GITHUB_OUTPUT, or only with --no-env",
+	}},
+	{[]string{"import"}, []string{
+		"import [--prefix $p] [--format $fmt] [--whole $name] [--dry-run] [--yes]",
+		"\t\t\timport each key as a secret, or the whole file",
+	}},
+	{[]string{"import"}, []string{
+		"import --format 1password|bitwarden|lastpass",
+		"\t\t\timport a password manager's csv or json export",
+	}},
+	{[]string{"export"}, []string{
+		"export --reveal -o $file",
+		"\t\t\tinclude plaintext values rather than redacting them",
+	}},
+	{[]string{"import-kdbx", "export-kdbx"}, []string{
+		"import-kdbx, export-kdbx --key-file $file",
+		"\t\t\tuse a keepass key file with the password",
+	}},
+	{[]string{"vault", "aws", "gcp", "azure"}, []string{
+		"vault, aws, gcp, azure ... --prefix $p [--dry-run] [--yes]",
+		"\t\t\tmap $glob to names under $p, previewing changes",
+	}},
+	{[]string{"vault"}, []string{
+		"vault ... --mount $m [--field $f]",
+		"\t\t\tkv v2 mount (default secret/) and field (default value)",
+	}},
+	{[]string{"aws"}, []string{
+		"aws ... [--region $r] [--profile $p] [--kms-key-id $k]",
+		"\t\t\taws cli options, and the kms key for new secrets",
+	}},
+	{[]string{"gcp"}, []string{"gcp ... --project $p\tgcp project (default from credentials)"}},
+	{[]string{"azure"}, []string{"azure ... --vault $v\tkey vault name or url"}},
+	{[]string{"import-pass"}, []string{
+		"import-pass [--prefix $p] [--first-line] [--dry-run] [--yes]",
+		"\t\t\timport each entry, or only its password line",
+	}},
+	{[]string{"allow"}, []string{"allow --expires $days\tend access after days, or 0 for never"}},
+	{[]string{"policy"}, []string{
+		"policy set [--min-length $n] [--min-entropy $bits] [--match $re]",
+		"\t\t\tminimum length, estimated bits of entropy, or regexp",
+	}},
+	{[]string{"merge"}, []string{"merge --ours|--theirs\tresolve conflicts using our or their version"}},
+	{[]string{"del", "deny", "rm-user"}, []string{"del|deny|rm-user --yes\tskip confirmation, alias -f"}},
+	{[]string{"del", "deny"}, []string{"del|deny --force\tdelete or deny protected secrets, after typing each name"}},
+	{[]string{"diff"}, []string{"diff --decrypt\t\tshow old and new values of secrets you can access"}},
+	{[]string{"pull"}, []string{"pull --ours|--theirs\tresolve conflicts using our or the remote version"}},
+	{[]string{"serve-remote"}, []string{
+		"serve-remote [--addr $addr] [--tls-cert $c --tls-key $k]",
+		"\t\t\tlisten address (default :8443) and tls, required off loopback",
+	}},
+	{[]string{"serve"}, []string{"serve --api --addr $addr\tloopback address (default 127.0.0.1:8444)"}},
+	{[]string{"hook"}, []string{"hook install --force\treplace an existing pre-commit hook"}},
+	{[]string{"seal"}, []string{"seal --kms $arn		seal with an aws kms key instead of a passphrase"}},
+	{[]string{"publish"}, []string{
+		"publish --to $dst --for $user [--only $glob] [--save]",
+		"\t\t\tpublish $user's matching secrets to a path or s3://",
+	}},
+}
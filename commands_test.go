@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"reflect"
+	"testing"
+)
+
+func TestSplitGlobalFlags(t *testing.T) {
+	t.Parallel()
+
+	newFlagSet := func() *flag.FlagSet {
+		fs := flag.NewFlagSet("shh", flag.ContinueOnError)
+		fs.Bool("n", false, "")
+		fs.String("profile", "", "")
+		fs.String("e", "", "")
+		return fs
+	}
+	tcs := []struct {
+		name   string
+		args   []string
+		global []string
+		rest   []string
+	}{
+		{
+			name:   "before command",
+			args:   []string{"-profile", "work", "get", "db"},
+			global: []string{"-profile", "work"},
+			rest:   []string{"get", "db"},
+		},
+		{
+			name:   "after command",
+			args:   []string{"get", "-n", "db", "--profile=work"},
+			global: []string{"-n", "--profile=work"},
+			rest:   []string{"get", "db"},
+		},
+		{
+			name:   "after dashes",
+			args:   []string{"run", "db", "--", "env", "-e", "x"},
+			global: nil,
+			rest:   []string{"run", "db", "--", "env", "-e", "x"},
+		},
+		{
+			name:   "command's own flag",
+			args:   []string{"aws", "push", "--profile", "prod", "-n"},
+			global: []string{"-n"},
+			rest:   []string{"aws", "push", "--profile", "prod"},
+		},
+		{
+			name:   "global before command with own flag",
+			args:   []string{"-profile", "work", "aws", "push", "--profile=prod"},
+			global: []string{"-profile", "work"},
+			rest:   []string{"aws", "push", "--profile=prod"},
+		},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			global, rest := splitGlobalFlags(newFlagSet(), tc.args)
+			if !reflect.DeepEqual(global, tc.global) {
+				t.Fatalf("expected global %q, got %q", tc.global, global)
+			}
+			if !reflect.DeepEqual(rest, tc.rest) {
+				t.Fatalf("expected rest %q, got %q", tc.rest, rest)
+			}
+		})
+	}
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// completionArg is the kind of a command's positional argument.
+type completionArg string
+
+const (
+	completeSecret completionArg = "secret"
+	completeUser   completionArg = "user"
+	completeFile   completionArg = "file"
+	completeCmd    completionArg = "command"
+)
+
+// completionCmd describes a command for shell completion. Args lists the
+// kind of each positional argument, or literal choices separated by "|". The
+// last kind repeats when variadic is set. Flags which take a value are listed
+// in values, so their value is completed as a file rather than a flag.
+type completionCmd struct {
+	args     []completionArg
+	variadic bool
+	flags    []string
+	values   []string
+}
+
+var (
+	runFlags  = []string{"--manifest", "--prefix", "--keep-case"}
+	runValues = []string{"--manifest", "--prefix"}
+)
+
+// syncCompletion describes the commands which sync with a secret manager,
+// given the value flags for that manager.
+func syncCompletion(flags ...string) completionCmd {
+	return completionCmd{
+		args:   []completionArg{"push|pull|diff", completeSecret},
+		flags:  append([]string{"--prefix", "--dry-run", "--yes"}, flags...),
+		values: append([]string{"--prefix"}, flags...),
+	}
+}
+
+var completionCmds = map[string]completionCmd{
+	"init": {flags: []string{"--min-bits", "--remote", "--git", "--from-template"},
+		values: []string{"--min-bits", "--remote", "--git", "--from-template"}},
+	"gen-keys": {flags: []string{"--bits"}, values: []string{"--bits"}},
+	"profile": {args: []completionArg{"list|use"}, flags: []string{"--dir"},
+		values: []string{"--dir"}},
+	"get": {args: []completionArg{completeSecret}, variadic: true,
+		flags:  []string{"--as-jwe", "--recipient"},
+		values: []string{"--recipient"}},
+	"set": {args: []completionArg{completeSecret},
+		flags: []string{"--sensitive", "--age"}, values: []string{"--age"}},
+	"del": {args: []completionArg{completeSecret}, variadic: true,
+		flags: []string{"--yes", "-f", "--force"}},
+	"copy":   {args: []completionArg{completeSecret}},
+	"rename": {args: []completionArg{completeSecret}},
+	"allow": {args: []completionArg{completeUser, completeSecret},
+		flags: []string{"--expires"}, values: []string{"--expires"}},
+	"deny": {args: []completionArg{completeUser, completeSecret},
+		flags: []string{"--yes", "-f", "--force"}},
+	"envs":     {},
+	"add-user": {},
+	"rm-user": {args: []completionArg{completeUser},
+		flags: []string{"--yes", "-f"}},
+	"search": {},
+	"show":   {args: []completionArg{completeUser}},
+	"run": {args: []completionArg{completeSecret}, variadic: true,
+		flags: runFlags, values: runValues},
+	"watch": {args: []completionArg{completeSecret}, variadic: true,
+		flags:  append([]string{"--signal", "--interval"}, runFlags...),
+		values: append([]string{"--signal", "--interval"}, runValues...)},
+	"env": {args: []completionArg{completeSecret}, variadic: true,
+		flags:  append([]string{"--format"}, runFlags...),
+		values: append([]string{"--format"}, runValues...)},
+	"docker-env": {args: []completionArg{completeSecret}, variadic: true,
+		flags: runFlags, values: runValues},
+	"compose": {args: []completionArg{completeSecret}, variadic: true,
+		flags: runFlags, values: runValues},
+	"actions-export": {args: []completionArg{completeSecret}, variadic: true,
+		flags:  []string{"--manifest", "--output", "--no-env"},
+		values: []string{"--manifest"}},
+	"import": {args: []completionArg{completeFile},
+		flags:  []string{"--prefix", "--format", "--whole", "--dry-run", "--yes"},
+		values: []string{"--prefix", "--format", "--whole"}},
+	"import-pass": {args: []completionArg{completeFile},
+		flags:  []string{"--prefix", "--first-line", "--dry-run", "--yes"},
+		values: []string{"--prefix"}},
+	"export": {args: []completionArg{completeSecret},
+		flags:  []string{"--format", "--reveal", "-o"},
+		values: []string{"--format", "-o"}},
+	"import-kdbx": {args: []completionArg{completeFile},
+		flags: []string{"--key-file"}, values: []string{"--key-file"}},
+	"export-kdbx": {args: []completionArg{completeSecret},
+		flags:  []string{"-o", "--key-file"},
+		values: []string{"-o", "--key-file"}},
+	"vault": syncCompletion("--mount", "--field"),
+	"aws":   syncCompletion("--region", "--profile", "--kms-key-id"),
+	"gcp":   syncCompletion("--project"),
+	"azure": syncCompletion("--vault"),
+	"template": {args: []completionArg{completeFile},
+		flags: []string{"-o"}, values: []string{"-o"}},
+	"sops-encrypt": {args: []completionArg{completeFile},
+		flags: []string{"-o"}, values: []string{"-o"}},
+	"sops-decrypt": {args: []completionArg{completeFile},
+		flags: []string{"-o"}, values: []string{"-o"}},
+	"mount": {args: []completionArg{completeFile},
+		flags: []string{"--only"}, values: []string{"--only"}},
+	"edit":   {args: []completionArg{completeSecret}},
+	"rotate": {flags: []string{"--bits", "--all"}, values: []string{"--bits"}},
+	"serve": {flags: []string{"--systemd", "--api", "--socket", "--addr"},
+		values: []string{"--socket", "--addr"}},
+	"api-token": {args: []completionArg{"add|list|rm"}},
+	"agent": {args: []completionArg{"install"},
+		flags: []string{"--dir"}, values: []string{"--dir"}},
+	"login":  {},
+	"logout": {flags: []string{"--all"}},
+	"lock":   {flags: []string{"--all"}},
+	"status": {},
+	"seal":   {flags: []string{"--kms"}, values: []string{"--kms"}},
+	"unseal": {},
+	"publish": {flags: []string{"--to", "--for", "--only", "--save"},
+		values: []string{"--to", "--for", "--only"}},
+	"push": {},
+	"pull": {flags: []string{"--ours", "--theirs"}},
+	"serve-remote": {
+		flags:  []string{"--file", "--addr", "--tls-cert", "--tls-key"},
+		values: []string{"--file", "--addr", "--tls-cert", "--tls-key"}},
+	"files":  {args: []completionArg{"install"}},
+	"clean":  {args: []completionArg{completeFile}},
+	"smudge": {args: []completionArg{completeFile}},
+	"hook": {args: []completionArg{"install"},
+		flags: []string{"--force"}},
+	"log":     {args: []completionArg{completeSecret}},
+	"protect": {args: []completionArg{completeSecret}},
+	"unprotect": {args: []completionArg{completeSecret},
+		flags: []string{"--yes"}},
+	"pin-key":  {args: []completionArg{completeUser}},
+	"settings": {args: []completionArg{"set|unset"}},
+	"policy": {args: []completionArg{"list|set|unset"},
+		flags:  []string{"--min-length", "--min-entropy", "--match"},
+		values: []string{"--min-length", "--min-entropy", "--match"}},
+	"notify": {args: []completionArg{"test"}},
+	"report": {args: []completionArg{"access"},
+		flags: []string{"--format", "-o"}, values: []string{"--format", "-o"}},
+	"audit": {args: []completionArg{completeSecret},
+		flags:  []string{"--hibp", "--stale", "--access", "--max-readers"},
+		values: []string{"--max-readers"}},
+	"check": {args: []completionArg{completeFile},
+		flags: []string{"--as", "--decrypt"}, values: []string{"--as"}},
+	"schema": {args: []completionArg{"export|check", completeFile},
+		flags: []string{"-o"}, values: []string{"-o"}},
+	"unpin-key": {args: []completionArg{completeUser}},
+	"trash":     {args: []completionArg{"list|restore|purge|retain"}},
+	"undo":      {},
+	"tui":       {},
+	"merge": {args: []completionArg{completeFile},
+		flags: []string{"--ours", "--theirs"}},
+	"diff": {args: []completionArg{completeFile}, variadic: true,
+		flags: []string{"--decrypt"}},
+	"diff-file": {args: []completionArg{completeFile}},
+	"fsck":      {flags: []string{"--fix"}},
+	"format":    {args: []completionArg{"json|binary"}},
+	"doctor":    {},
+	"selftest":  {flags: []string{"--full"}},
+	"docs": {args: []completionArg{"man"},
+		flags: []string{"-o"}, values: []string{"-o"}},
+	"version":    {},
+	"help":       {args: []completionArg{completeCmd}},
+	"completion": {args: []completionArg{"bash|zsh|fish"}},
+}
+
+// globalFlags precede the command. Those in globalValues take a value.
+var (
+	globalFlags = []string{"-n", "-e", "-env", "-file", "-profile",
+		"-password-file", "-password-fd", "-fix-perms", "-q", "-json",
+		"-verbose"}
+	globalValues = []string{"-e", "-env", "-file", "-profile",
+		"-password-file", "-password-fd"}
+)
+
+// completion prints a completion script for the shell. The script calls
+// `shh __complete` for its candidates, so they stay current with the
+// project.
+func completion(args []string) error {
+	if len(args) != 1 {
+		return errors.New("bad args: expected `completion bash|zsh|fish`")
+	}
+
+	const (
+		promises     = "stdio"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	scripts := map[string]string{
+		"bash": bashCompletion,
+		"zsh":  zshCompletion,
+		"fish": fishCompletion,
+	}
+	script, ok := scripts[args[0]]
+	if !ok {
+		return &badArgError{Arg: args[0]}
+	}
+	_, err := io.WriteString(os.Stdout, script)
+	return err
+}
+
+// completeWords prints the candidates for the last of the words following
+// `shh`, one per line. It's called by the completion scripts, so it never
+// reports errors, and never prompts or reaches the network.
+func completeWords(words []string) error {
+	const (
+		promises     = "stdio rpath wpath cpath flock"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	if len(words) == 0 {
+		return nil
+	}
+	for _, c := range completeCandidates(words[:len(words)-1],
+		words[len(words)-1]) {
+		fmt.Println(c)
+	}
+	return nil
+}
+
+func completeCandidates(prev []string, cur string) []string {
+	// Skip the global flags to find the command
+	for len(prev) > 0 && strings.HasPrefix(prev[0], "-") {
+		if hasFlag(globalValues, prev[0]) && !strings.Contains(prev[0], "=") {
+			if len(prev) == 1 {
+				return nil
+			}
+			prev = prev[1:]
+		}
+		prev = prev[1:]
+	}
+	if len(prev) == 0 {
+		if strings.HasPrefix(cur, "-") {
+			return withPrefix(globalFlags, cur)
+		}
+		return withPrefix(commandNames(), cur)
+	}
+	cmd, ok := completionCmds[prev[0]]
+	if !ok {
+		return nil
+	}
+
+	var positional []string
+	for i := 1; i < len(prev); i++ {
+		switch {
+		case prev[i] == "--":
+			// The rest is a command to run
+			return nil
+		case strings.HasPrefix(prev[i], "-"):
+			if hasFlag(cmd.values, prev[i]) && !strings.Contains(prev[i], "=") {
+				if i == len(prev)-1 {
+					return nil
+				}
+				i++
+			}
+		default:
+			positional = append(positional, prev[i])
+		}
+	}
+	if strings.HasPrefix(cur, "-") {
+		return withPrefix(cmd.flags, cur)
+	}
+	if len(cmd.args) == 0 {
+		return nil
+	}
+	i := len(positional)
+	if i >= len(cmd.args) {
+		if !cmd.variadic {
+			return nil
+		}
+		i = len(cmd.args) - 1
+	}
+	switch kind := cmd.args[i]; kind {
+	case completeSecret:
+		return withPrefix(completeSecretNames(), cur)
+	case completeUser:
+		return withPrefix(completeUsernames(), cur)
+	case completeFile:
+		// Leave files to the shell
+		return nil
+	case completeCmd:
+		return withPrefix(commandNames(), cur)
+	default:
+		return withPrefix(strings.Split(string(kind), "|"), cur)
+	}
+}
+
+// completeProject reads the project's names for completion, unless doing so
+// would prompt for a passphrase or reach the network.
+func completeProject() *shh {
+	pth, err := findShhRecursive(".shh")
+	if err != nil {
+		return nil
+	}
+	byt, err := ioutil.ReadFile(pth)
+	if err != nil || len(byt) == 0 {
+		return nil
+	}
+	outer, err := parseOuterLayer(byt)
+	if err != nil || outer.Sealed != nil || outer.Remote != "" {
+		return nil
+	}
+	shh, err := shhNamesFromPath(pth)
+	if err != nil {
+		return nil
+	}
+	return shh
+}
+
+// commandNames lists the commands which may be completed, sorted.
+func commandNames() []string {
+	names := make([]string, 0, len(completionCmds))
+	for name := range completionCmds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func completeUsernames() []string {
+	shh := completeProject()
+	if shh == nil {
+		return nil
+	}
+	users := map[username]struct{}{}
+	for u := range shh.Keys {
+		users[u] = struct{}{}
+	}
+	for u := range shh.Secrets {
+		users[u] = struct{}{}
+	}
+	for u := range shh.encoded {
+		users[u] = struct{}{}
+	}
+	var names []string
+	for _, u := range sortedUsernames(users) {
+		names = append(names, string(u))
+	}
+	return names
+}
+
+// completeSecretNames lists the secrets the current user can access.
+func completeSecretNames() []string {
+	configPath, err := getConfigPath()
+	if err != nil {
+		return nil
+	}
+	user, err := getUser(configPath)
+	if err != nil {
+		return nil
+	}
+	shh := completeProject()
+	if shh == nil {
+		return nil
+	}
+	return shh.userNames(user.Username)
+}
+
+func withPrefix(words []string, prefix string) []string {
+	var matches []string
+	for _, w := range words {
+		if strings.HasPrefix(w, prefix) {
+			matches = append(matches, w)
+		}
+	}
+	return matches
+}
+
+// hasFlag reports whether arg is one of the flags, which may be written with
+// one or two dashes, as the flag package accepts.
+func hasFlag(flags []string, arg string) bool {
+	name := strings.TrimLeft(arg, "-")
+	for _, f := range flags {
+		if strings.TrimLeft(f, "-") == name {
+			return true
+		}
+	}
+	return false
+}
+
+const bashCompletion = `# shh bash completion. Load it with:
+#	source <(shh completion bash)
+_shh() {
+	local IFS=$'\n'
+	local cur="${COMP_WORDS[COMP_CWORD]}"
+	COMPREPLY=($(compgen -W "$(shh __complete "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null)" -- "$cur"))
+}
+complete -o default -F _shh shh
+`
+
+const zshCompletion = `#compdef shh
+# shh zsh completion. Load it with:
+#	source <(shh completion zsh)
+# or save it as _shh in a directory in your $fpath.
+_shh() {
+	local -a candidates
+	candidates=("${(@f)$(shh __complete "${(@)words[2,CURRENT]}" 2>/dev/null)}")
+	if [[ -n "${candidates[1]}" ]]; then
+		compadd -a candidates
+	else
+		_files
+	fi
+}
+if [[ "$funcstack[1]" == "_shh" ]]; then
+	_shh "$@"
+else
+	compdef _shh shh
+fi
+`
+
+const fishCompletion = `# shh fish completion. Load it with:
+#	shh completion fish | source
+# or save it as ~/.config/fish/completions/shh.fish.
+function __shh_complete
+	set -l prev (commandline -opc)
+	set -e prev[1]
+	set -l cur (commandline -ct)
+	set -l candidates (shh __complete $prev "$cur" 2>/dev/null)
+	if test (count $candidates) -eq 0
+		__fish_complete_path "$cur"
+	else
+		printf '%s\n' $candidates
+	end
+end
+complete -c shh -f -a '(__shh_complete)'
+`
@@ -2,10 +2,13 @@ package main
 
 import (
 	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 )
@@ -13,21 +16,95 @@ import (
 type config struct {
 	Username username
 	Port     int
+
+	// Cache is the backend used to hold the password between commands,
+	// defaulting to the server started by `shh serve`.
+	Cache string
+
+	// Pinentry is a program such as pinentry-gnome3 used to ask for
+	// passwords instead of the terminal.
+	Pinentry string
+
+	// Autolock clears the server's keys when the system sleeps or the
+	// screen locks.
+	Autolock bool
+
+	// Key holds the private key outside of id_rsa, as $provider:$id, such
+	// as gpg:alice@example.com.
+	Key string
 }
 
+const (
+	cacheServer        = "server"
+	cacheKeychain      = "keychain"
+	cacheSecretService = "secret-service"
+	cacheKeyring       = "keyring"
+
+	cacheCredentialManager = "credential-manager"
+)
+
+// getConfigPath returns the directory of the keys and config of the profile
+// in use.
 func getConfigPath() (string, error) {
+	base, err := baseConfigPath()
+	if err != nil {
+		return "", err
+	}
+	name, _ := currentProfile(base)
+	return profilePath(base, name), nil
+}
+
+// baseConfigPath holds the default profile and any others. It's
+// $SHH_CONFIG_DIR if set, otherwise $XDG_CONFIG_HOME/shh, which defaults to
+// ~/.config/shh.
+func baseConfigPath() (string, error) {
+	if dir := os.Getenv("SHH_CONFIG_DIR"); dir != "" {
+		return filepath.Abs(dir)
+	}
+	dir, err := xdgDir("XDG_CONFIG_HOME", ".config")
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "shh"), nil
+}
+
+// xdgDir returns the XDG base directory in $env, or its default under the
+// home directory. Relative paths are ignored, as the spec requires.
+func xdgDir(env string, fallback ...string) (string, error) {
+	if dir := os.Getenv(env); filepath.IsAbs(dir) {
+		return dir, nil
+	}
 	home, err := os.UserHomeDir()
 	if err != nil {
 		return "", err
 	}
-	return filepath.Join(home, ".config", "shh"), nil
+	return filepath.Join(append([]string{home}, fallback...)...), nil
+}
+
+// stateName names a directory kept for pth elsewhere, after its base name and
+// made unique by its full path.
+func stateName(pth string) string {
+	sum := sha256.Sum256([]byte(pth))
+	return filepath.Base(pth) + "-" + hex.EncodeToString(sum[:4])
+}
+
+// runtimePath holds the server's pid and token for the config at configPath.
+// It's under $XDG_RUNTIME_DIR/shh when that's set, which is usually cleared on
+// logout, and otherwise the config directory itself.
+func runtimePath(configPath string) string {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if !filepath.IsAbs(dir) {
+		return configPath
+	}
+	return filepath.Join(dir, "shh", stateName(configPath))
 }
 
 func configFromPath(pth string) (*config, error) {
 	pth = filepath.Join(pth, "config")
+	debug("read config", "path", pth)
 	fi, err := os.Open(pth)
 	if os.IsNotExist(err) {
-		return nil, errors.New("missing keys. run `shh gen-keys`")
+		return nil, &noIdentityError{}
 	}
 	if err != nil {
 		return nil, err
@@ -51,6 +128,38 @@ func configFromPath(pth string) (*config, error) {
 			if err != nil {
 				return nil, fmt.Errorf("invalid port %s: %w", parts[1], err)
 			}
+		case "cache":
+			conf.Cache = parts[1]
+			switch conf.Cache {
+			case cacheServer:
+			case cacheKeychain:
+				if runtime.GOOS != "darwin" {
+					return nil, errors.New("keychain cache is only supported on macOS")
+				}
+			case cacheSecretService:
+			case cacheKeyring:
+				if runtime.GOOS != "linux" {
+					return nil, errors.New("keyring cache is only supported on linux")
+				}
+			case cacheCredentialManager:
+				if runtime.GOOS != "windows" {
+					return nil, errors.New("credential manager cache is only supported on windows")
+				}
+			default:
+				return nil, fmt.Errorf("unknown cache %s", parts[1])
+			}
+		case "pinentry":
+			conf.Pinentry = parts[1]
+		case "key":
+			if _, _, err = parseKeyRef(parts[1]); err != nil {
+				return nil, err
+			}
+			conf.Key = parts[1]
+		case "autolock":
+			conf.Autolock, err = strconv.ParseBool(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid autolock %s: %w", parts[1], err)
+			}
 		default:
 			return nil, fmt.Errorf("unknown part %s", parts[0])
 		}
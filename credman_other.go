@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "errors"
+
+// credentialManagerCache is only supported on Windows.
+type credentialManagerCache struct {
+	account    username
+	configPath string
+}
+
+func (c credentialManagerCache) Get() ([]byte, error) {
+	return nil, errors.New("credential manager cache is only supported on windows")
+}
+
+func (c credentialManagerCache) Set(password []byte) error {
+	return errors.New("credential manager cache is only supported on windows")
+}
+
+func (c credentialManagerCache) Clear() error {
+	return errors.New("credential manager cache is only supported on windows")
+}
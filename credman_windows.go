@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	credTypeGeneric = 1
+
+	// credPersistSession keeps the credential only for the current logon
+	// session, so it's cleared when the user logs out.
+	credPersistSession = 1
+)
+
+var (
+	advapi32       = syscall.NewLazyDLL("advapi32.dll")
+	procCredWrite  = advapi32.NewProc("CredWriteW")
+	procCredRead   = advapi32.NewProc("CredReadW")
+	procCredDelete = advapi32.NewProc("CredDeleteW")
+	procCredFree   = advapi32.NewProc("CredFree")
+)
+
+// winCredential mirrors the CREDENTIALW struct.
+type winCredential struct {
+	Flags              uint32
+	Type               uint32
+	TargetName         *uint16
+	Comment            *uint16
+	LastWritten        syscall.Filetime
+	CredentialBlobSize uint32
+	CredentialBlob     *byte
+	Persist            uint32
+	AttributeCount     uint32
+	Attributes         uintptr
+	TargetAlias        *uint16
+	UserName           *uint16
+}
+
+// credentialManagerCache holds the password in the Windows Credential Manager
+// for the current logon session. Each credential is named for the config
+// directory as well as the account, so profiles with the same username don't
+// share one.
+type credentialManagerCache struct {
+	account    username
+	configPath string
+}
+
+func (c credentialManagerCache) target() (*uint16, error) {
+	return syscall.UTF16PtrFromString("shh:" + string(c.account) + ":" +
+		c.configPath)
+}
+
+func (c credentialManagerCache) Get() ([]byte, error) {
+	target, err := c.target()
+	if err != nil {
+		return nil, err
+	}
+	var cred *winCredential
+	ret, _, _ := procCredRead.Call(uintptr(unsafe.Pointer(target)),
+		credTypeGeneric, 0, uintptr(unsafe.Pointer(&cred)))
+	if ret == 0 {
+		return nil, errors.New(tr("cached password not available. run `shh login`"))
+	}
+	defer procCredFree.Call(uintptr(unsafe.Pointer(cred)))
+	blob := (*[1 << 20]byte)(unsafe.Pointer(cred.CredentialBlob))
+	password := make([]byte, cred.CredentialBlobSize)
+	copy(password, blob[:cred.CredentialBlobSize])
+	return password, nil
+}
+
+func (c credentialManagerCache) Set(password []byte) error {
+	if len(password) == 0 {
+		return errors.New("empty password")
+	}
+	target, err := c.target()
+	if err != nil {
+		return err
+	}
+	user, err := syscall.UTF16PtrFromString(string(c.account))
+	if err != nil {
+		return err
+	}
+	cred := winCredential{
+		Type:               credTypeGeneric,
+		TargetName:         target,
+		CredentialBlobSize: uint32(len(password)),
+		CredentialBlob:     &password[0],
+		Persist:            credPersistSession,
+		UserName:           user,
+	}
+	ret, _, err := procCredWrite.Call(uintptr(unsafe.Pointer(&cred)), 0)
+	if ret == 0 {
+		return fmt.Errorf("write credential: %w", err)
+	}
+	return nil
+}
+
+func (c credentialManagerCache) Clear() error {
+	target, err := c.target()
+	if err != nil {
+		return err
+	}
+	// A failure means nothing is cached, so there's nothing to clear
+	_, _, _ = procCredDelete.Call(uintptr(unsafe.Pointer(target)),
+		credTypeGeneric, 0)
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// serverPidFile is written to the runtime directory when shh starts the server
+// in the background.
+const serverPidFile = "serve.pid"
+
+// offerServer to start in the background and log in when a port is
+// configured but the server isn't running. This is only offered in
+// interactive terminals, and it's skipped if the user declines.
+func offerServer() error {
+	configPath, err := getConfigPath()
+	if err != nil {
+		return err
+	}
+	conf, err := configFromPath(configPath)
+	if err != nil {
+		return err
+	}
+	if conf.Port == 0 || (conf.Cache != "" && conf.Cache != cacheServer) {
+		return nil
+	}
+	url := fmt.Sprint("http://127.0.0.1:", conf.Port)
+	if err = pingServer(url); err == nil {
+		return nil
+	}
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return nil
+	}
+	fmt.Print(tr("server not running. start it in the background?") +
+		tr(" [y/N]: "))
+	var answer string
+	_, _ = fmt.Scanln(&answer)
+	if !isYes(answer) {
+		return nil
+	}
+	if err = startServer(configPath, conf.Port); err != nil {
+		return fmt.Errorf("start server: %w", err)
+	}
+	password, err := requestPassword(nil, defaultPasswordPrompt)
+	if err != nil {
+		return fmt.Errorf("request password: %w", err)
+	}
+
+	// Verify the password before caching it
+	if _, err = getKeys(configPath, password); err != nil {
+		return err
+	}
+	return sendPasswordToServer(conf.Port, configPath, password)
+}
+
+// startServer forks `shh serve` into the background, records its pid, and
+// waits for it to accept connections.
+func startServer(configPath string, port int) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("executable: %w", err)
+	}
+	cmd := exec.Command(exe, "serve")
+	detach(cmd)
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	pid := []byte(strconv.Itoa(cmd.Process.Pid))
+	pidPath := filepath.Join(runtimePath(configPath), serverPidFile)
+	err = os.MkdirAll(filepath.Dir(pidPath), 0700)
+	if err == nil {
+		err = ioutil.WriteFile(pidPath, pid, 0600)
+	}
+	if err != nil {
+		return fmt.Errorf("write pid: %w", err)
+	}
+	if err = cmd.Process.Release(); err != nil {
+		return fmt.Errorf("release: %w", err)
+	}
+	url := fmt.Sprint("http://127.0.0.1:", port)
+	for i := 0; i < 50; i++ {
+		if err = pingServer(url); err == nil {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return err
+}
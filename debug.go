@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// debugEnabled is set by the global -verbose flag or SHH_DEBUG=1. It's passed
+// on to the commands and server shh starts through the environment.
+var debugEnabled = os.Getenv("SHH_DEBUG") == "1"
+
+var debugMu sync.Mutex
+
+// redactedKeys are never logged, whatever their value, in case a caller
+// passes something secret under them.
+var redactedKeys = []string{"password", "passphrase", "plaintext", "value",
+	"token", "private"}
+
+// debug logs what shh is doing to stderr as a logfmt line, e.g.
+//
+//	shh: time=2020-01-02T15:04:05.000Z msg="read project" path=/src/.shh
+//
+// Values are redacted unless they're of a type which can't hold key material
+// or plaintext: strings, usernames, numbers, bools, durations, and errors.
+// Bytes, keys, and anything else print as [redacted].
+func debug(msg string, kv ...interface{}) {
+	if !debugEnabled {
+		return
+	}
+	var b strings.Builder
+	b.WriteString("shh: time=")
+	b.WriteString(time.Now().UTC().Format("2006-01-02T15:04:05.000Z"))
+	b.WriteString(" msg=")
+	b.WriteString(logfmtValue(msg))
+	for i := 0; i+1 < len(kv); i += 2 {
+		k := fmt.Sprint(kv[i])
+		b.WriteString(" " + k + "=")
+		b.WriteString(logfmtValue(debugValue(k, kv[i+1])))
+	}
+	debugMu.Lock()
+	defer debugMu.Unlock()
+	fmt.Fprintln(os.Stderr, b.String())
+}
+
+// debugValue formats v for the log, redacting it unless it's known to be
+// safe.
+func debugValue(k string, v interface{}) string {
+	lower := strings.ToLower(k)
+	for _, r := range redactedKeys {
+		if strings.Contains(lower, r) {
+			return "[redacted]"
+		}
+	}
+	switch v := v.(type) {
+	case nil:
+		return "nil"
+	case string:
+		return v
+	case username:
+		return string(v)
+	case []string:
+		return strings.Join(v, ",")
+	case []username:
+		return joinUsernames(v)
+	case int:
+		return strconv.Itoa(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case bool:
+		return strconv.FormatBool(v)
+	case time.Duration:
+		return v.String()
+	case error:
+		return v.Error()
+	}
+	return "[redacted]"
+}
+
+// logfmtValue quotes s if it's empty or has spaces, quotes, or '='.
+func logfmtValue(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\r\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
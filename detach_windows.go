@@ -0,0 +1,17 @@
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// detachedProcess runs the process without a console.
+const detachedProcess = 0x00000008
+
+// detach the command from the current console, so it keeps running after shh
+// exits.
+func detach(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		CreationFlags: detachedProcess | syscall.CREATE_NEW_PROCESS_GROUP,
+	}
+}
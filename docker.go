@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// dockerEnv prints secrets in the format read by `docker run --env-file`.
+// Docker takes each value literally up to the end of the line, so values
+// aren't quoted and multi-line values are rejected. Use process substitution
+// to avoid writing the file to disk:
+//
+//	docker run --env-file <(shh docker-env 'staging/*') app
+func dockerEnv(nonInteractive bool, args []string) error {
+	fs := flag.NewFlagSet("docker-env", flag.ContinueOnError)
+	manifest := fs.String("manifest", "", "file listing secrets to export")
+	var naming envNaming
+	naming.flags(fs)
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 && *manifest == "" {
+		return errors.New("bad args: expected `docker-env $secret...`")
+	}
+
+	const (
+		promises     = "stdio rpath wpath cpath tty proc exec inet dns"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	specs, err := envSpecsFromArgs(*manifest, args)
+	if err != nil {
+		return err
+	}
+	vars, err := decryptEnv(nonInteractive, specs, naming)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, v := range vars {
+			v.Value.Destroy()
+		}
+	}()
+	for _, v := range vars {
+		if strings.ContainsAny(string(v.Value), "\r\n") {
+			return fmt.Errorf("%s: docker env files can't contain newlines",
+				v.Name)
+		}
+	}
+	for _, v := range vars {
+		fmt.Printf("%s=%s\n", v.Name, v.Value)
+	}
+	return nil
+}
+
+// compose runs docker compose with secrets in its environment, where they're
+// available for ${VAR} interpolation and to services listing them under
+// `environment`. Nothing is written to disk, e.g.
+// `shh compose 'staging/*' -- run --rm web`.
+func compose(nonInteractive bool, args []string) error {
+	args, composeArgs := splitCommand(args)
+	if len(composeArgs) == 0 {
+		return errors.New("bad args: expected `compose [$secret...] -- $args`")
+	}
+
+	fs := flag.NewFlagSet("compose", flag.ContinueOnError)
+	manifest := fs.String("manifest", "", "file listing secrets to inject")
+	var naming envNaming
+	naming.flags(fs)
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	specs, err := envSpecsFromArgs(*manifest, args)
+	if err != nil {
+		return err
+	}
+	cmdArgs, err := composeCommand()
+	if err != nil {
+		return err
+	}
+	cmd, err := startWithEnv(nonInteractive, specs, naming,
+		append(cmdArgs, composeArgs...))
+	if err != nil {
+		return err
+	}
+	return waitWithSignals(cmd)
+}
+
+// composeCommand prefers the `docker compose` plugin and falls back to the
+// standalone docker-compose.
+func composeCommand() ([]string, error) {
+	if pth, err := exec.LookPath("docker"); err == nil {
+		if exec.Command(pth, "compose", "version").Run() == nil {
+			return []string{pth, "compose"}, nil
+		}
+	}
+	if pth, err := exec.LookPath("docker-compose"); err == nil {
+		return []string{pth}, nil
+	}
+	return nil, errors.New("docker compose not found")
+}
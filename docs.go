@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+func docsCmd(args []string) error {
+	arg, tail := parseArg(args)
+	switch arg {
+	case "man":
+		return docsMan(tail)
+	case "":
+		return errors.New("bad args: expected `man`")
+	default:
+		return &badArgError{Arg: arg}
+	}
+}
+
+// docsMan writes shh(1), and a page for each command such as shh-set(1), from
+// the commands' usage, descriptions, and examples.
+func docsMan(args []string) error {
+	fs := flag.NewFlagSet("docs man", flag.ContinueOnError)
+	dir := fs.String("o", "man", "directory to write the pages to")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 0 {
+		return errors.New("bad args: expected `docs man [-o $dir]`")
+	}
+
+	const (
+		promises     = "stdio rpath wpath cpath"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	if err = os.MkdirAll(*dir, 0755); err != nil {
+		return err
+	}
+	pages := map[string]string{"shh.1": manPage()}
+	for _, cmd := range commands {
+		if !cmd.hidden {
+			pages["shh-"+cmd.name+".1"] = commandManPage(cmd)
+		}
+	}
+	for name, page := range pages {
+		pth := filepath.Join(*dir, name)
+		if err = ioutil.WriteFile(pth, []byte(page), 0644); err != nil {
+			return err
+		}
+	}
+	notef(os.Stdout, "generated %d man pages in %s\n", len(pages), *dir)
+	return nil
+}
+
+// manPage is shh(1), listing every command and the global flags.
+func manPage() string {
+	var b strings.Builder
+	manHeader(&b, "shh")
+	b.WriteString(".SH NAME\nshh \\- manage secrets for projects and small teams\n")
+	b.WriteString(".SH SYNOPSIS\n.B shh\n[\\fIflags\\fR] \\fIcommand\\fR [\\fIargs\\fR]\n")
+	b.WriteString(".SH DESCRIPTION\n")
+	b.WriteString(roffText("shh manages secrets for projects and small teams. " +
+		"Secrets are encrypted for each user with access in a .shh file, " +
+		"which is safe to commit to version control such as git. " +
+		"See shh-command(1), or run shh help command, for details of each " +
+		"command."))
+	b.WriteString(".SH COMMANDS\n")
+	var seeAlso []string
+	for _, cmd := range commands {
+		if cmd.hidden {
+			continue
+		}
+		for _, u := range splitUsage(cmd.usage) {
+			fmt.Fprintf(&b, ".TP\n.B %s\n%s", roffEscape("shh "+u.form),
+				roffText(u.text))
+		}
+		seeAlso = append(seeAlso, `.BR shh\-`+roffEscape(cmd.name)+" (1)")
+	}
+	b.WriteString(".SH FLAGS\n")
+	for _, u := range splitUsage(globalFlagUsage) {
+		fmt.Fprintf(&b, ".TP\n.B %s\n%s", roffEscape(u.form), roffText(u.text))
+	}
+	b.WriteString(".SH ENVIRONMENT\n")
+	for _, env := range [][2]string{
+		{"SHH_PASSWORD", "The password for your private key, for scripts."},
+		{"SHH_PASSPHRASE", "The passphrase of a sealed project."},
+		{"SHH_ENV", "The environment to use, as with -e."},
+		{"SHH_FILE", "The project file to use, as with -file."},
+		{"SHH_PROFILE", "The profile to use, as with -profile."},
+		{"SHH_PROJECT_DIR", "The directory holding .shh, rather than " +
+			"searching the current directory and its parents."},
+		{"SHH_CONFIG_DIR", "The directory of your keys, config, and " +
+			"profiles, in place of ~/.config/shh."},
+		{"XDG_CONFIG_HOME", "Keys and config are kept in " +
+			"$XDG_CONFIG_HOME/shh, unless SHH_CONFIG_DIR is set."},
+		{"XDG_DATA_HOME", "When set, backups are kept in " +
+			"$XDG_DATA_HOME/shh/backups rather than beside the project file, " +
+			"and clones of git remotes and push and pull state in " +
+			"$XDG_DATA_HOME/shh."},
+		{"XDG_RUNTIME_DIR", "When set, the server's pid and tokens are kept " +
+			"in $XDG_RUNTIME_DIR/shh rather than the config directory."},
+		{"SHH_DEBUG", "Set to 1 to log what shh is doing, as with -verbose."},
+		{"NO_COLOR", "Disable colored output."},
+	} {
+		fmt.Fprintf(&b, ".TP\n.B %s\n%s", env[0], roffText(env[1]))
+	}
+	b.WriteString(".SH FILES\n")
+	fmt.Fprintf(&b, ".TP\n.B %s\n%s", roffEscape("~/.config/shh"),
+		roffText("Your keys and config, or $SHH_CONFIG_DIR or "+
+			"$XDG_CONFIG_HOME/shh."))
+	fmt.Fprintf(&b, ".TP\n.B .shh\n%s", roffText("The project file, "+
+		"found in the current directory or a parent up to the root of the "+
+		"git repository or $HOME, unless -file or SHH_PROJECT_DIR is given."))
+	b.WriteString(".SH SEE ALSO\n" + strings.Join(seeAlso, ",\n") + "\n")
+	return b.String()
+}
+
+// commandManPage is the page for one command, such as shh-set(1).
+func commandManPage(cmd *command) string {
+	var b strings.Builder
+	usage := splitUsage(cmd.usage)
+	manHeader(&b, "shh-"+cmd.name)
+	summary := cmd.name
+	if len(usage) > 0 && usage[0].text != "" {
+		summary = usage[0].text
+	}
+	fmt.Fprintf(&b, ".SH NAME\n%s \\- %s\n", roffEscape("shh-"+cmd.name),
+		roffEscape(summary))
+	b.WriteString(".SH SYNOPSIS\n.nf\n")
+	for _, u := range usage {
+		b.WriteString(roffLine("shh " + u.form))
+	}
+	for _, alias := range cmd.aliases {
+		b.WriteString(roffLine("shh " + alias))
+	}
+	b.WriteString(".fi\n")
+	b.WriteString(".SH DESCRIPTION\n")
+	if cmd.description != "" {
+		b.WriteString(roffText(cmd.description))
+	} else {
+		b.WriteString(roffText(summary + "."))
+	}
+	if flags := splitUsage(flagsFor(cmd)); len(flags) > 0 {
+		b.WriteString(".SH FLAGS\n")
+		for _, u := range flags {
+			fmt.Fprintf(&b, ".TP\n.B %s\n%s", roffEscape(u.form),
+				roffText(u.text))
+		}
+	}
+	if len(cmd.examples) > 0 {
+		b.WriteString(".SH EXAMPLES\n.nf\n.RS\n")
+		for _, ex := range cmd.examples {
+			b.WriteString(roffLine(ex))
+		}
+		b.WriteString(".RE\n.fi\n")
+	}
+	b.WriteString(".SH SEE ALSO\n.BR shh (1)\n")
+	return b.String()
+}
+
+func manHeader(b *strings.Builder, name string) {
+	fmt.Fprintf(b, ".TH %s 1 \"\" \"shh %s\" \"shh manual\"\n",
+		roffEscape(strings.ToUpper(name)), version)
+}
+
+// usageLine is a form of a command or flag, and what it does.
+type usageLine struct {
+	form string
+	text string
+}
+
+var usageSep = regexp.MustCompile(`\t+| {2,}`)
+
+// splitUsage splits usage lines into their forms and what they do. Lines
+// starting with a tab continue the form before them.
+func splitUsage(lines []string) []usageLine {
+	var usage []usageLine
+	for _, line := range lines {
+		if strings.HasPrefix(line, "\t") && len(usage) > 0 {
+			usage[len(usage)-1].text = strings.TrimSpace(line)
+			continue
+		}
+		parts := usageSep.Split(line, 2)
+		u := usageLine{form: parts[0]}
+		if len(parts) == 2 {
+			u.text = parts[1]
+		}
+		usage = append(usage, u)
+	}
+	return usage
+}
+
+// roffEscape escapes backslashes and hyphens for roff.
+func roffEscape(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\e`)
+	return strings.ReplaceAll(s, "-", `\-`)
+}
+
+// roffLine escapes s as a line of its own, so a leading '.' or "'" isn't
+// taken as a request.
+func roffLine(s string) string {
+	s = roffEscape(s)
+	if strings.HasPrefix(s, ".") || strings.HasPrefix(s, "'") {
+		s = `\&` + s
+	}
+	return s + "\n"
+}
+
+// roffText is a paragraph, filled by the formatter.
+func roffText(s string) string {
+	var b strings.Builder
+	for _, line := range wrapText(s, 72) {
+		b.WriteString(roffLine(line))
+	}
+	return b.String()
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// doctor validates the user's setup and the project, suggesting a fix for
+// each problem found. Unlike other commands, it runs even when permissions
+// are too open, so it can report them.
+func doctor(nonInteractive bool, args []string) error {
+	if len(args) != 0 {
+		return errors.New("bad args: expected none")
+	}
+
+	const (
+		promises     = "stdio rpath tty inet dns proc exec"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	var problems int
+	check := func(name string, err error, fix string) bool {
+		if err == nil {
+			fmt.Printf("ok\t%s\n", name)
+			return true
+		}
+		problems++
+		fmt.Printf("FAIL\t%s: %v\n", name, err)
+		if fix != "" {
+			fmt.Printf("\tfix: %s\n", fix)
+		}
+		return false
+	}
+
+	configPath, err := getConfigPath()
+	if err != nil {
+		return err
+	}
+	conf, err := configFromPath(configPath)
+	if !check("config", err, "run `shh gen-keys`") {
+		return fmt.Errorf("problems found: %d", problems)
+	}
+	if conf.Username == "" {
+		check("config", errors.New("no username"), fmt.Sprintf(
+			"add `username=$email` to %s", filepath.Join(configPath, "config")))
+	}
+
+	// Permissions, as checkPerms enforces them
+	files := []struct {
+		pth     string
+		private bool
+	}{
+		{configPath, false},
+		{filepath.Join(configPath, "config"), false},
+		{filepath.Join(configPath, "id_rsa"), true},
+		{filepath.Join(configPath, "id_rsa.pub"), false},
+	}
+	shhPath, shhErr := findShhRecursive(".shh")
+	if shhErr == nil {
+		files = append(files, struct {
+			pth     string
+			private bool
+		}{shhPath, false})
+	}
+	for _, f := range files {
+		if _, err := os.Stat(f.pth); os.IsNotExist(err) {
+			continue
+		}
+		check("permissions on "+f.pth, checkFilePerms(f.pth, f.private, false),
+			"run `shh --fix-perms doctor`")
+	}
+
+	user, err := getUser(configPath)
+	if !check("public key", err, "run `shh gen-keys`, or restore id_rsa.pub from a backup") {
+		return fmt.Errorf("problems found: %d", problems)
+	}
+	dec, err := user.decrypter(configPath, nonInteractive)
+	if err == nil && user.Keys != nil {
+		err = checkKeyPair(user.Keys.PublicKey, dec)
+	}
+	check("private key", err, "check your password, or that id_rsa and id_rsa.pub are from the same `shh gen-keys`")
+
+	switch {
+	case os.IsNotExist(shhErr):
+		check("project", errors.New("no .shh found"), "run `shh init` in your project")
+	case shhErr != nil:
+		check("project", shhErr, "")
+	default:
+		shh, err := shhFromPath(shhPath)
+		if check("project "+shhPath, err, "restore .shh from git, then run `shh merge` if it has conflicts") {
+			block, ok := shh.Keys[user.Username]
+			switch {
+			case !ok:
+				check("project membership", fmt.Errorf("%s is not in the project", user.Username),
+					"run `shh init` to add yourself, then ask a member to `shh allow` you")
+			case user.Keys != nil && !bytes.Equal(block.Bytes, user.Keys.PublicKeyBlock.Bytes):
+				check("project membership", errors.New("your key in .shh doesn't match id_rsa.pub"),
+					"if you rotated your keys, pull the latest .shh. otherwise ask a member to `shh rm-user` and re-add you")
+			default:
+				check("project membership", nil, "")
+			}
+		}
+	}
+
+	if conf.Port != 0 && (conf.Cache == "" || conf.Cache == cacheServer) {
+		_, err := statusFromServer(conf.Port, configPath)
+		check(fmt.Sprintf("server on port %d", conf.Port), err, "run `shh serve`, then `shh login`")
+	}
+
+	editor := strings.Fields(os.Getenv("EDITOR"))
+	if len(editor) == 0 {
+		check("editor", errors.New("$EDITOR is not set"), "export EDITOR=vi, or your editor of choice")
+	} else {
+		_, err := exec.LookPath(editor[0])
+		check("editor "+editor[0], err, "set $EDITOR to an installed editor, ideally an absolute path")
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("problems found: %d", problems)
+	}
+	return nil
+}
+
+// checkKeyPair verifies the decrypter holds the private key for pub by
+// decrypting a random value encrypted for it.
+func checkKeyPair(pub *rsa.PublicKey, dec crypto.Decrypter) error {
+	want := make([]byte, 32)
+	if _, err := rand.Read(want); err != nil {
+		return err
+	}
+	ciphertext, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, want, nil)
+	if err != nil {
+		return err
+	}
+	got, err := dec.Decrypt(rand.Reader, ciphertext,
+		&rsa.OAEPOptions{Hash: crypto.SHA256})
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, want) {
+		return errors.New("private key doesn't match public key")
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "os/exec"
+
+// editorCommand opens the file using $EDITOR, which may include arguments.
+func editorCommand(pth string) *exec.Cmd {
+	return exec.Command("/bin/sh", "-c", "$EDITOR "+pth)
+}
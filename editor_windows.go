@@ -0,0 +1,36 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// editorCommand opens the file using %EDITOR%, which may include arguments.
+// The editor is run directly rather than through cmd.exe, whose quoting rules
+// differ from those Go escapes arguments with, and its command line is set as
+// given, with only the path escaped.
+func editorCommand(pth string) *exec.Cmd {
+	editor := strings.TrimSpace(os.Getenv("EDITOR"))
+	cmd := exec.Command(editorProgram(editor))
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		CmdLine: editor + " " + syscall.EscapeArg(pth),
+	}
+	return cmd
+}
+
+// editorProgram is the first word of the editor's command line, which may be
+// quoted if it contains spaces, e.g. "C:\Program Files\Notepad++\notepad++.exe".
+func editorProgram(editor string) string {
+	if strings.HasPrefix(editor, `"`) {
+		if i := strings.Index(editor[1:], `"`); i >= 0 {
+			return editor[1 : i+1]
+		}
+		return editor[1:]
+	}
+	if i := strings.IndexAny(editor, " \t"); i >= 0 {
+		return editor[:i]
+	}
+	return editor
+}
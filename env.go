@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+)
+
+const (
+	envFormatDotenv = "dotenv"
+	envFormatShell  = "shell"
+	envFormatJSON   = "json"
+)
+
+// env prints secrets as dotenv lines, shell export statements, or a JSON
+// object, so tools which read .env files can consume shh directly.
+func env(nonInteractive bool, args []string) error {
+	fs := flag.NewFlagSet("env", flag.ContinueOnError)
+	format := fs.String("format", envFormatDotenv, "dotenv, shell, or json")
+	manifest := fs.String("manifest", "", "file listing secrets to export")
+	var naming envNaming
+	naming.flags(fs)
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	switch *format {
+	case envFormatDotenv, envFormatShell, envFormatJSON:
+	default:
+		return fmt.Errorf("unknown format %s", *format)
+	}
+	if len(args) == 0 && *manifest == "" {
+		return errors.New("bad args: expected `env [--format $fmt] $secret...`")
+	}
+
+	const (
+		promises     = "stdio rpath wpath cpath tty proc exec inet dns"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	specs, err := envSpecsFromArgs(*manifest, args)
+	if err != nil {
+		return err
+	}
+	vars, err := decryptEnv(nonInteractive, specs, naming)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, v := range vars {
+			v.Value.Destroy()
+		}
+	}()
+
+	if *format == envFormatJSON {
+		obj := make(map[string]string, len(vars))
+		for _, v := range vars {
+			obj[v.Name] = string(v.Value)
+		}
+		byt, err := json.MarshalIndent(obj, "", "\t")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(byt))
+		return nil
+	}
+	for _, v := range vars {
+		if *format == envFormatShell {
+			fmt.Printf("export %s=%s\n", v.Name, shellQuote(string(v.Value)))
+			continue
+		}
+		fmt.Printf("%s=%s\n", v.Name, dotenvQuote(string(v.Value)))
+	}
+	return nil
+}
+
+// shellQuote wraps s in single quotes, which POSIX shells never interpret.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// dotenvQuote leaves simple values bare and otherwise quotes them. Single
+// quotes are used where possible, since dotenv parsers don't interpret their
+// contents. Values containing single quotes or newlines are double-quoted with
+// escapes.
+func dotenvQuote(s string) string {
+	simple := s != ""
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case strings.ContainsRune("_-./:@+,", r):
+		default:
+			simple = false
+		}
+	}
+	switch {
+	case simple:
+		return s
+	case !strings.ContainsAny(s, "'\n\r"):
+		return "'" + s + "'"
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`,
+		"$", `\$`)
+	return `"` + r.Replace(s) + `"`
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// envSep separates a secret's environment from its name, as in
+// prod:db/password.
+const envSep = ":"
+
+// environment is set by the global -e flag, or $SHH_ENV. Secret names given
+// to commands are looked up in it, so `shh get -e prod db/password` gets
+// prod:db/password.
+var environment = os.Getenv("SHH_ENV")
+
+// validateEnvironment reports an error unless env is a usable name.
+func validateEnvironment(env string) error {
+	if env == "" {
+		return nil
+	}
+	for _, r := range env {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9',
+			r == '-', r == '_', r == '.':
+		default:
+			return fmt.Errorf("invalid environment %q: use letters, digits, '-', '_', or '.'", env)
+		}
+	}
+	return nil
+}
+
+// inEnv returns the name of the secret in the current environment.
+func inEnv(name string) string {
+	if environment == "" {
+		return name
+	}
+	return environment + envSep + name
+}
+
+// envNames returns the names in the current environment, without it.
+// Outside an environment, every name is returned.
+func envNames(names []string) []string {
+	if environment == "" {
+		return names
+	}
+	prefix := inEnv("")
+	var inside []string
+	for _, name := range names {
+		if strings.HasPrefix(name, prefix) {
+			inside = append(inside, strings.TrimPrefix(name, prefix))
+		}
+	}
+	return inside
+}
+
+// environmentOf returns the environment of a secret, if any. Only
+// environments declared in the project count, so a name which merely
+// contains envSep, such as db:url, has none.
+func (s *shh) environmentOf(name string) string {
+	if i := strings.Index(name, envSep); i > 0 {
+		if _, ok := s.Environments[name[:i]]; ok {
+			return name[:i]
+		}
+	}
+	return ""
+}
+
+// envSecretNames returns the names of the project's secrets in the current
+// environment, without it, sorted.
+func (s *shh) envSecretNames() []string {
+	names := make([]string, 0, len(s.namespace))
+	for name := range s.namespace {
+		names = append(names, name)
+	}
+	names = append([]string{}, envNames(names)...)
+	sort.Strings(names)
+	return names
+}
+
+// envUserNames returns the names of the user's secrets in the current
+// environment, without it, sorted.
+func (s *shh) envUserNames(u username) []string {
+	return envNames(s.userNames(u))
+}
+
+// envMembers returns the users granted the current environment, who have
+// access to each of its secrets.
+func (s *shh) envMembers() []username {
+	if environment == "" {
+		return nil
+	}
+	return s.Environments[environment]
+}
+
+// declareEnvironment records env in the project, so names in it are known
+// to be in an environment, without granting it to anyone.
+func (s *shh) declareEnvironment(env string) {
+	if _, ok := s.Environments[env]; ok {
+		return
+	}
+	if s.Environments == nil {
+		s.Environments = map[string][]username{}
+	}
+	s.Environments[env] = []username{}
+}
+
+// isMember reports whether u was granted env.
+func (s *shh) isMember(env string, u username) bool {
+	for _, member := range s.Environments[env] {
+		if member == u {
+			return true
+		}
+	}
+	return false
+}
+
+// joinEnvironment grants u the current environment.
+func (s *shh) joinEnvironment(u username) {
+	if s.isMember(environment, u) {
+		return
+	}
+	s.declareEnvironment(environment)
+	members := append(s.Environments[environment], u)
+	sort.Slice(members, func(i, j int) bool { return members[i] < members[j] })
+	s.Environments[environment] = members
+}
+
+// leaveEnvironment removes u from env, if they were granted it. The
+// environment stays declared.
+func (s *shh) leaveEnvironment(env string, u username) {
+	if !s.isMember(env, u) {
+		return
+	}
+	members := []username{}
+	for _, member := range s.Environments[env] {
+		if member != u {
+			members = append(members, member)
+		}
+	}
+	s.Environments[env] = members
+}
+
+// environments lists each environment, the users granted it, and how many
+// secrets it has.
+func environments(args []string) error {
+	if len(args) != 0 {
+		return errors.New("bad args: expected `envs`")
+	}
+
+	const (
+		promises     = "stdio rpath wpath cpath"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	shh, err := shhNamesFromPath(".shh")
+	if err != nil {
+		return err
+	}
+	counts := map[string]int{}
+	for env := range shh.Environments {
+		counts[env] = 0
+	}
+	for name := range shh.namespace {
+		if env := shh.environmentOf(name); env != "" {
+			counts[env]++
+		}
+	}
+	if len(counts) == 0 {
+		return errors.New("no environments. use `shh set -e $env $name $val`")
+	}
+	envs := make([]string, 0, len(counts))
+	for env := range counts {
+		envs = append(envs, env)
+	}
+	sort.Strings(envs)
+	rows := make([][]cell, 0, len(envs))
+	for _, env := range envs {
+		members := "-"
+		if m := shh.Environments[env]; len(m) > 0 {
+			members = joinUsernames(m)
+		}
+		rows = append(rows, []cell{
+			{text: env, style: styleBold},
+			{text: fmt.Sprintf("%d secrets", counts[env])},
+			{text: members},
+		})
+	}
+	printTable(os.Stdout, rows)
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestEnvironmentOf(t *testing.T) {
+	t.Parallel()
+
+	s := newShh(".shh")
+	s.Environments = map[string][]username{"prod": {"alice@example.com"}}
+	tcs := []struct {
+		name string
+		want string
+	}{
+		{"prod:db/password", "prod"},
+		{"db:url", ""},
+		{"db/password", ""},
+		{":db", ""},
+	}
+	for _, tc := range tcs {
+		if got := s.environmentOf(tc.name); got != tc.want {
+			t.Errorf("%s: expected %q, got %q", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestDenyLeavesEnvironments(t *testing.T) {
+	s, cleanup := testProject(t)
+	defer cleanup()
+	s.Secrets["bob@example.com"] = map[string]secret{
+		"prod:db/password":    {},
+		"staging:db/password": {},
+	}
+	s.Environments = map[string][]username{
+		"prod":    {"alice@example.com", "bob@example.com"},
+		"staging": {"bob@example.com"},
+	}
+	if err := s.EncodeToFile(); err != nil {
+		t.Fatal(err)
+	}
+	defer withEnvironment("")()
+	if err := deny([]string{"--yes", "bob@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := shhFromPath(".shh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]username{
+		"prod":    {"alice@example.com"},
+		"staging": {},
+	}
+	if !reflect.DeepEqual(got.Environments, want) {
+		t.Fatalf("expected %v, got %v", want, got.Environments)
+	}
+	if _, ok := got.Secrets["bob@example.com"]; ok {
+		t.Fatal("expected bob's secrets to be removed")
+	}
+}
+
+func TestShowInEnvironment(t *testing.T) {
+	s, cleanup := testProject(t)
+	defer cleanup()
+	s.Secrets["alice@example.com"] = map[string]secret{
+		"prod:db/password":    {},
+		"staging:db/password": {},
+		"db:url":              {},
+	}
+	s.Environments = map[string][]username{"prod": {}, "staging": {}}
+	if err := s.EncodeToFile(); err != nil {
+		t.Fatal(err)
+	}
+	defer withEnvironment("prod")()
+	jsonOutput = true
+	defer func() { jsonOutput = false }()
+	out := captureStdout(t, func() error {
+		return show([]string{"alice@example.com"})
+	})
+	var u userJSON
+	if err := json.Unmarshal(out, &u); err != nil {
+		t.Fatalf("decode %s: %s", out, err)
+	}
+	if want := []string{"db/password"}; !reflect.DeepEqual(u.Secrets, want) {
+		t.Fatalf("expected %v, got %v", want, u.Secrets)
+	}
+}
+
+// testProject is an empty project in a temporary directory, which is the
+// working directory until cleanup is called.
+func testProject(t *testing.T) (*shh, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "shh-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	config := os.Getenv("SHH_CONFIG_DIR")
+	os.Setenv("SHH_CONFIG_DIR", filepath.Join(dir, "config"))
+	return newShh(filepath.Join(dir, ".shh")), func() {
+		os.Setenv("SHH_CONFIG_DIR", config)
+		_ = os.Chdir(wd)
+		os.RemoveAll(dir)
+	}
+}
+
+// withEnvironment sets the current environment, returning a func to restore
+// it.
+func withEnvironment(env string) func() {
+	old := environment
+	environment = env
+	return func() { environment = old }
+}
+
+// captureStdout returns what fn prints.
+func captureStdout(t *testing.T, fn func() error) []byte {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	err = fn()
+	os.Stdout = stdout
+	w.Close()
+	out, _ := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
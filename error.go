@@ -1,15 +1,110 @@
 package main
 
-import "fmt"
+import (
+	"crypto/x509"
+	"errors"
+	"strings"
+)
 
 type emptyArgError struct{}
 
 func (e *emptyArgError) Error() string {
-	return "bad args"
+	return tr("bad args")
 }
 
 type badArgError struct{ Arg string }
 
 func (e *badArgError) Error() string {
-	return fmt.Sprintf("unknown arg: %s", e.Arg)
+	return trf("unknown arg: %s", e.Arg)
+}
+
+// noProjectError is returned when no .shh is found.
+type noProjectError struct{}
+
+func (e *noProjectError) Error() string {
+	return tr("missing .shh, run `shh init`")
+}
+
+// noIdentityError is returned when there are no keys in the config
+// directory.
+type noIdentityError struct{}
+
+func (e *noIdentityError) Error() string {
+	return tr("missing keys. run `shh gen-keys`")
+}
+
+// notFoundError is returned when a secret or user doesn't exist, or the user
+// can't access it. Its message is translated when shown.
+type notFoundError struct{ msg string }
+
+func (e *notFoundError) Error() string {
+	return tr(e.msg)
+}
+
+// wrongPasswordError is returned when the password or project passphrase is
+// wrong.
+type wrongPasswordError struct{ err error }
+
+func (e *wrongPasswordError) Error() string { return e.err.Error() }
+func (e *wrongPasswordError) Unwrap() error { return e.err }
+
+// wrongIdentityError is returned when the project pins the user to a key
+// other than theirs, such as a personal key used with a work project.
+type wrongIdentityError struct {
+	user    username
+	pin     string
+	profile string
+}
+
+func (e *wrongIdentityError) Error() string {
+	msg := trf("%s must use the key %s with this project", e.user, e.pin)
+	if e.profile != "" {
+		msg += trf(". use `shh -profile %s`, or `shh profile use %s`",
+			e.profile, e.profile)
+	}
+	return msg
+}
+
+// Exit statuses, which are stable so scripts can tell failures apart. With
+// -json, errors include the matching identifier as "code".
+const (
+	exitError         = 1 // error
+	exitBadArgs       = 2 // bad_args
+	exitNoProject     = 3 // no_project
+	exitNoIdentity    = 4 // no_identity
+	exitNotFound      = 5 // not_found
+	exitWrongPassword = 6 // wrong_password
+	exitWrongIdentity = 7 // wrong_identity
+)
+
+// exitCode returns the exit status and identifier for the error. Most
+// commands report bad arguments as plain errors starting "bad args", so
+// those count too.
+func exitCode(err error) (int, string) {
+	var (
+		emptyArg      *emptyArgError
+		badArg        *badArgError
+		noProject     *noProjectError
+		noIdentity    *noIdentityError
+		notFound      *notFoundError
+		wrongPassword *wrongPasswordError
+		wrongIdentity *wrongIdentityError
+	)
+	switch {
+	case errors.As(err, &emptyArg), errors.As(err, &badArg),
+		strings.HasPrefix(err.Error(), "bad args"):
+		return exitBadArgs, "bad_args"
+	case errors.As(err, &noProject):
+		return exitNoProject, "no_project"
+	case errors.As(err, &noIdentity):
+		return exitNoIdentity, "no_identity"
+	case errors.As(err, &notFound):
+		return exitNotFound, "not_found"
+	case errors.As(err, &wrongPassword),
+		errors.Is(err, x509.IncorrectPasswordError):
+		return exitWrongPassword, "wrong_password"
+	case errors.As(err, &wrongIdentity):
+		return exitWrongIdentity, "wrong_identity"
+	}
+	return exitError, "error"
 }
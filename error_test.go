@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestExitCode(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name string
+		err  error
+		exit int
+		code string
+	}{
+		{"unknown command", &badArgError{Arg: "nope"}, exitBadArgs, "bad_args"},
+		{"bad args", errors.New("bad args: expected `get [$name]`"), exitBadArgs, "bad_args"},
+		{"bad flag", mustFlagErr(t), exitBadArgs, "bad_args"},
+		{"no project", fmt.Errorf("open: %w", &noProjectError{}), exitNoProject, "no_project"},
+		{"other", errors.New("bad gateway"), exitError, "error"},
+	}
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			exit, code := exitCode(tc.err)
+			if exit != tc.exit || code != tc.code {
+				t.Fatalf("expected %d %s, got %d %s", tc.exit, tc.code,
+					exit, code)
+			}
+		})
+	}
+}
+
+// TestExitCodeFromRun runs a command with the wrong number of arguments
+// through run, as main does, and checks it exits as bad args.
+func TestExitCodeFromRun(t *testing.T) {
+	args := os.Args
+	defer func() { os.Args = args }()
+	oldFlags := flag.CommandLine
+	defer func() { flag.CommandLine = oldFlags }()
+	flag.CommandLine = flag.NewFlagSet("shh", flag.ContinueOnError)
+
+	os.Args = []string{"shh", "help", "get", "set"}
+	err := run()
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if exit, code := exitCode(err); exit != exitBadArgs || code != "bad_args" {
+		t.Fatalf("expected %d bad_args, got %d %s: %s", exitBadArgs, exit,
+			code, err)
+	}
+}
+
+func mustFlagErr(t *testing.T) error {
+	fs := flag.NewFlagSet("get", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	_, err := parseFlags(fs, []string{"--nope"})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	return err
+}
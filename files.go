@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// shhFilesName lists, one per line, the paths or globs relative to the
+	// repository root which are encrypted by the clean filter.
+	shhFilesName = ".shhfiles"
+
+	// shhFilesPrefix names the secret holding each file's key, so access
+	// is granted with `shh allow $user shhfiles/$path`.
+	shhFilesPrefix = "shhfiles/"
+
+	// shhFileMagic starts every encrypted file which fits in one chunk.
+	// Larger files start with shhFileStreamMagic and are encrypted in
+	// chunks, so they're never held in memory.
+	shhFileMagic       = "\x00SHHFILE1"
+	shhFileStreamMagic = "\x00SHHFILE2"
+
+	// shhFileChunk is the size of each chunk of plaintext.
+	shhFileChunk = 64 << 10
+)
+
+// filesCmd manages transparently encrypted files, e.g. `shh files install`.
+func filesCmd(args []string) error {
+	arg, tail := parseArg(args)
+	switch arg {
+	case "install":
+		return filesInstall(tail)
+	case "":
+		return errors.New("bad args: expected `install`")
+	default:
+		return &badArgError{Arg: arg}
+	}
+}
+
+// filesInstall configures the git filter and adds each path in .shhfiles to
+// .gitattributes.
+func filesInstall(args []string) error {
+	if len(args) != 0 {
+		return errors.New("bad args: expected none")
+	}
+
+	const (
+		promises     = "stdio rpath wpath cpath proc exec"
+		execPromises = "stdio rpath wpath cpath proc exec"
+	)
+	pledge(promises, execPromises)
+
+	out, err := gitOutput(".", "rev-parse", "--show-toplevel")
+	if err != nil {
+		return err
+	}
+	top := strings.TrimSpace(string(out))
+	patterns, err := readShhFiles(top)
+	if err != nil {
+		return err
+	}
+	if len(patterns) == 0 {
+		return fmt.Errorf("no paths in %s", filepath.Join(top, shhFilesName))
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("executable: %w", err)
+	}
+	config := [][2]string{
+		{"filter.shh.clean", fmt.Sprintf("%q clean %%f", exe)},
+		{"filter.shh.smudge", fmt.Sprintf("%q smudge %%f", exe)},
+		{"filter.shh.required", "true"},
+	}
+	for _, kv := range config {
+		if _, err = gitOutput(top, "config", kv[0], kv[1]); err != nil {
+			return err
+		}
+	}
+
+	pth := filepath.Join(top, ".gitattributes")
+	byt, err := ioutil.ReadFile(pth)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	existing := map[string]struct{}{}
+	for _, line := range strings.Split(string(byt), "\n") {
+		existing[strings.TrimSpace(line)] = struct{}{}
+	}
+	var add []string
+	for _, p := range patterns {
+		if strings.HasSuffix(p, "/") {
+			p += "**"
+		}
+		line := p + " filter=shh"
+		if _, ok := existing[line]; !ok {
+			add = append(add, line)
+		}
+	}
+	if len(add) == 0 {
+		return nil
+	}
+	if len(byt) > 0 && !bytes.HasSuffix(byt, []byte("\n")) {
+		byt = append(byt, '\n')
+	}
+	byt = append(byt, strings.Join(add, "\n")+"\n"...)
+	if err = ioutil.WriteFile(pth, byt, 0644); err != nil {
+		return err
+	}
+	for _, line := range add {
+		fmt.Println("+", line)
+	}
+	return nil
+}
+
+// cleanFile is the git clean filter. It encrypts stdin for the file at the
+// path if it's listed in .shhfiles, creating the file's key on first use.
+// Encryption is deterministic, so git doesn't see unchanged files as
+// modified. Files larger than a chunk are streamed.
+func cleanFile(args []string) error {
+	if len(args) != 1 {
+		return errors.New("bad args: expected `clean $path`")
+	}
+
+	const (
+		promises     = "stdio rpath wpath cpath inet dns proc exec"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	r := bufio.NewReaderSize(os.Stdin, shhFileChunk+1)
+	w := bufio.NewWriter(os.Stdout)
+	byt, err := r.Peek(shhFileChunk + 1)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	small := err == io.EOF
+	listed, err := isShhFile(args[0])
+	if err != nil {
+		return err
+	}
+	if !listed || isEncryptedShhFile(byt) {
+		if _, err = io.Copy(w, r); err != nil {
+			return err
+		}
+		return w.Flush()
+	}
+	key, err := shhFileKey(args[0], true)
+	if err != nil {
+		return fmt.Errorf("%s: %w", args[0], err)
+	}
+	defer key.Destroy()
+	if !small {
+		if err = encryptShhFileStream(key, w, r); err != nil {
+			return err
+		}
+		return w.Flush()
+	}
+	defer wipe(byt)
+	encrypted, err := encryptShhFile(key, byt)
+	if err != nil {
+		return err
+	}
+	_, _ = w.Write(encrypted)
+	return w.Flush()
+}
+
+// smudgeFile is the git smudge filter. It decrypts stdin for the file at the
+// path. Users without access to the file get the ciphertext, so checkouts
+// still succeed.
+func smudgeFile(args []string) error {
+	if len(args) != 1 {
+		return errors.New("bad args: expected `smudge $path`")
+	}
+
+	const (
+		promises     = "stdio rpath wpath cpath inet dns proc exec"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	r := bufio.NewReaderSize(os.Stdin, shhFileChunk)
+	w := bufio.NewWriter(os.Stdout)
+	head, err := r.Peek(len(shhFileMagic))
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if !isEncryptedShhFile(head) {
+		if _, err = io.Copy(w, r); err != nil {
+			return err
+		}
+		return w.Flush()
+	}
+	stream := bytes.HasPrefix(head, []byte(shhFileStreamMagic))
+	key, err := shhFileKey(args[0], false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "shh: %s: leaving encrypted: %v\n", args[0], err)
+		if _, err = io.Copy(w, r); err != nil {
+			return err
+		}
+		return w.Flush()
+	}
+	defer key.Destroy()
+	if stream {
+		if err = decryptShhFileStream(key, w, r); err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+		return w.Flush()
+	}
+	byt, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	plaintext, err := decryptShhFile(key, byt)
+	if err != nil {
+		return fmt.Errorf("%s: %w", args[0], err)
+	}
+	defer plaintext.Destroy()
+	_, _ = w.Write(plaintext)
+	return w.Flush()
+}
+
+// shhFileKey decrypts the key for the file at the path, relative to the
+// repository root. If create is set and the file has no key, a new one is
+// encrypted for the user and saved to .shh. Filters can't prompt since stdin
+// holds the file, so the password must come from the server or
+// $SHH_PASSWORD.
+func shhFileKey(pth string, create bool) (secureBytes, error) {
+	configPath, err := getConfigPath()
+	if err != nil {
+		return nil, err
+	}
+	user, err := getUser(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("get user: %w", err)
+	}
+	shh, err := shhFromPathFor(".shh", user.Username)
+	if err != nil {
+		return nil, err
+	}
+	name := shhFilesPrefix + filepath.ToSlash(pth)
+	if _, exists := shh.namespace[name]; !exists {
+		if !create {
+			return nil, fmt.Errorf("missing %s", name)
+		}
+		key := newSecureBytes(make([]byte, 32))
+		if _, err = rand.Read(key); err != nil {
+			return nil, err
+		}
+		hexKey := newSecureBytes([]byte(hex.EncodeToString(key)))
+		defer hexKey.Destroy()
+		enc, err := shh.encryptFor(user.Username, hexKey)
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now().UTC().Truncate(time.Second)
+		enc.Modified, enc.Granted = &now, &now
+		if _, exist := shh.Secrets[user.Username]; !exist {
+			shh.Secrets[user.Username] = map[string]secret{}
+		}
+		shh.Secrets[user.Username][name] = enc
+		if err = shh.EncodeToFile(); err != nil {
+			return nil, err
+		}
+		notef(os.Stderr, "shh: created %s, commit .shh too\n", name)
+		return key, nil
+	}
+	secrets, err := shh.GetSecretsForUser(name, user.Username)
+	if err != nil {
+		return nil, err
+	}
+	sec, ok := secrets[name]
+	if !ok {
+		return nil, fmt.Errorf("no access to %s", name)
+	}
+	dec, err := user.decrypterFor(configPath, true, secrets)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := decryptSecret(dec, sec)
+	if err != nil {
+		return nil, err
+	}
+	defer plaintext.Destroy()
+	key, err := hex.DecodeString(string(plaintext))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("%s is not a file key", name)
+	}
+	return newSecureBytes(key), nil
+}
+
+// encryptShhFile with AES-256-GCM. The nonce is an HMAC of the plaintext, so
+// the same content always encrypts the same way.
+func encryptShhFile(key, plaintext []byte) ([]byte, error) {
+	gcm, nonceKey, err := shhFileCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(nonceKey)
+	mac := hmac.New(sha256.New, nonceKey)
+	mac.Write(plaintext)
+	nonce := mac.Sum(nil)[:gcm.NonceSize()]
+	out := append([]byte(shhFileMagic), nonce...)
+	return gcm.Seal(out, nonce, plaintext, nil), nil
+}
+
+func decryptShhFile(key, byt []byte) (secureBytes, error) {
+	gcm, nonceKey, err := shhFileCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	wipe(nonceKey)
+	byt = byt[len(shhFileMagic):]
+	if len(byt) < gcm.NonceSize() {
+		return nil, errors.New("encrypted file too short")
+	}
+	plaintext, err := gcm.Open(nil, byt[:gcm.NonceSize()],
+		byt[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt: %w", err)
+	}
+	return newSecureBytes(plaintext), nil
+}
+
+// encryptShhFileStream encrypts the plaintext in chunks of shhFileChunk.
+// Each chunk is sealed with its index and whether it's the last, so chunks
+// can't be reordered, dropped, or truncated. Like encryptShhFile, each nonce
+// is an HMAC of the chunk, so the same content always encrypts the same way.
+func encryptShhFileStream(key []byte, w io.Writer, r *bufio.Reader) error {
+	gcm, nonceKey, err := shhFileCipher(key)
+	if err != nil {
+		return err
+	}
+	defer wipe(nonceKey)
+	if _, err = io.WriteString(w, shhFileStreamMagic); err != nil {
+		return err
+	}
+	buf := make([]byte, shhFileChunk)
+	defer wipe(buf)
+	var out []byte
+	for i := uint64(0); ; i++ {
+		n, final, err := readShhFileChunk(r, buf)
+		if err != nil {
+			return err
+		}
+		ad := shhFileChunkAD(i, final)
+		mac := hmac.New(sha256.New, nonceKey)
+		mac.Write(ad)
+		mac.Write(buf[:n])
+		nonce := mac.Sum(nil)[:gcm.NonceSize()]
+		out = gcm.Seal(append(out[:0], nonce...), nonce, buf[:n], ad)
+		if _, err = w.Write(out); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+	}
+}
+
+// decryptShhFileStream decrypts a file from encryptShhFileStream, after its
+// magic, writing each chunk as it's verified.
+func decryptShhFileStream(key []byte, w io.Writer, r *bufio.Reader) error {
+	gcm, nonceKey, err := shhFileCipher(key)
+	if err != nil {
+		return err
+	}
+	wipe(nonceKey)
+	if _, err = r.Discard(len(shhFileStreamMagic)); err != nil {
+		return err
+	}
+	buf := make([]byte, gcm.NonceSize()+shhFileChunk+gcm.Overhead())
+	var plaintext []byte
+	defer func() { wipe(plaintext) }()
+	for i := uint64(0); ; i++ {
+		n, final, err := readShhFileChunk(r, buf)
+		if err != nil {
+			return err
+		}
+		if n < gcm.NonceSize() {
+			return errors.New("encrypted file too short")
+		}
+		plaintext, err = gcm.Open(plaintext[:0], buf[:gcm.NonceSize()],
+			buf[gcm.NonceSize():n], shhFileChunkAD(i, final))
+		if err != nil {
+			return fmt.Errorf("decrypt chunk %d: %w", i, err)
+		}
+		if _, err = w.Write(plaintext); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+	}
+}
+
+// readShhFileChunk fills buf, reporting whether it's the last chunk.
+func readShhFileChunk(r *bufio.Reader, buf []byte) (int, bool, error) {
+	n, err := io.ReadFull(r, buf)
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF:
+		return n, true, nil
+	case nil:
+	default:
+		return 0, false, err
+	}
+	if _, err = r.Peek(1); err == io.EOF {
+		return n, true, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+	return n, false, nil
+}
+
+// shhFileChunkAD is the additional data authenticated with each chunk.
+func shhFileChunkAD(i uint64, final bool) []byte {
+	ad := make([]byte, 9)
+	binary.BigEndian.PutUint64(ad, i)
+	if final {
+		ad[8] = 1
+	}
+	return ad
+}
+
+// isEncryptedShhFile reports whether the content starts with either magic.
+func isEncryptedShhFile(byt []byte) bool {
+	return bytes.HasPrefix(byt, []byte(shhFileMagic)) ||
+		bytes.HasPrefix(byt, []byte(shhFileStreamMagic))
+}
+
+// shhFileCipher derives separate keys for encryption and nonces from the
+// file's key.
+func shhFileCipher(key []byte) (cipher.AEAD, []byte, error) {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("encrypt"))
+	encKey := mac.Sum(nil)
+	defer wipe(encKey)
+	mac.Reset()
+	mac.Write([]byte("nonce"))
+	nonceKey := mac.Sum(nil)
+	aesBlock, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	gcm, err := cipher.NewGCM(aesBlock)
+	if err != nil {
+		return nil, nil, err
+	}
+	return gcm, nonceKey, nil
+}
+
+// isShhFile reports whether the path, relative to the repository root, is
+// listed in .shhfiles. Git runs filters from the root.
+func isShhFile(pth string) (bool, error) {
+	patterns, err := readShhFiles(".")
+	if err != nil {
+		return false, err
+	}
+	pth = filepath.ToSlash(pth)
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, pth); ok {
+			return true, nil
+		}
+		if strings.HasSuffix(p, "/") && strings.HasPrefix(pth, p) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// readShhFiles from the directory, skipping blank lines and comments. A
+// missing file lists nothing.
+func readShhFiles(dir string) ([]string, error) {
+	byt, err := ioutil.ReadFile(filepath.Join(dir, shhFilesName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var patterns []string
+	for _, line := range strings.Split(string(byt), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, strings.TrimPrefix(line, "/"))
+	}
+	return patterns, nil
+}
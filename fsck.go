@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+)
+
+// fsck checks the project file's consistency, reporting entries for users
+// not in the project, entries which don't decode, and secrets whose copies
+// have diverged between users, and a damaged secret index. With --fix,
+// broken entries are removed, diverged copies replaced with the user's own
+// value, and the index rebuilt.
+func fsck(nonInteractive bool, args []string) error {
+	fs := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	fix := fs.Bool("fix", false, "repair problems where possible")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 0 {
+		return errors.New("bad args: expected `fsck [--fix]`")
+	}
+
+	const (
+		promises     = "stdio rpath wpath cpath tty proc exec inet dns"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	shh, err := shhFromPath(".shh")
+	if err != nil {
+		return err
+	}
+	var problems, fixed int
+	report := func(fixable bool, format string, args ...interface{}) {
+		msg := fmt.Sprintf(format, args...)
+		if *fix && fixable {
+			fmt.Println("fixed:", msg)
+			fixed++
+			return
+		}
+		fmt.Println("problem:", msg)
+		problems++
+	}
+
+	users := make(map[username]struct{}, len(shh.Secrets))
+	for u := range shh.Secrets {
+		users[u] = struct{}{}
+	}
+	for _, u := range sortedUsernames(users) {
+		secrets := shh.Secrets[u]
+		_, isUser := shh.Keys[u]
+		if !isUser && !isAgeRecipient(u) {
+			report(true, "%s has %d secrets but no key", u, len(secrets))
+			if *fix {
+				delete(shh.Secrets, u)
+			}
+			continue
+		}
+		for _, name := range sortedSecretNames(secrets) {
+			if err := checkSecretEntry(shh, u, secrets[name]); err != nil {
+				report(true, "%s: %s: %v", u, name, err)
+				if *fix {
+					delete(secrets, name)
+				}
+			}
+		}
+		if len(secrets) == 0 {
+			report(true, "%s has an empty secrets list", u)
+			if *fix {
+				delete(shh.Secrets, u)
+			}
+		}
+	}
+
+	// Users waiting for access are normal, so only note them
+	for u := range shh.Keys {
+		if len(shh.Secrets[u]) == 0 {
+			fmt.Printf("note: %s has no secrets\n", u)
+		}
+	}
+
+	// Every RSA and KMS copy of a secret encrypts the same plaintext, so
+	// their ciphertexts have the same length. Age files vary in length.
+	var diverged []string
+	for name, access := range secretAccess(shh) {
+		lengths := map[int]struct{}{}
+		for u, sec := range access {
+			if isAgeRecipient(u) {
+				continue
+			}
+			byt, err := base64.StdEncoding.DecodeString(sec.Encrypted)
+			if err == nil {
+				lengths[len(byt)] = struct{}{}
+			}
+		}
+		if len(lengths) > 1 {
+			diverged = append(diverged, name)
+		}
+	}
+	sort.Strings(diverged)
+	if len(diverged) > 0 {
+		fixable, err := repairDiverged(shh, nonInteractive, diverged, *fix)
+		if err != nil {
+			return err
+		}
+		for _, name := range diverged {
+			_, ok := fixable[name]
+			report(ok, "%s has different values for different users", name)
+		}
+	}
+
+	// The index is a local cache of names, so it's rebuilt rather than
+	// repaired
+	if shh.indexable() {
+		idx := shh.buildIndex(shh.sum)
+		if shh.index != nil && !sameIndex(idx, shh.index) {
+			report(true, "secret index is out of date")
+		}
+		if *fix && fixed == 0 {
+			if err = idx.save(shh.path); err != nil {
+				return fmt.Errorf("save index: %w", err)
+			}
+		}
+	}
+
+	if fixed > 0 {
+		if err = shh.EncodeToFile(); err != nil {
+			return err
+		}
+	}
+	switch {
+	case problems > 0 && !*fix:
+		return fmt.Errorf("problems found: %d, run `shh fsck --fix` to repair", problems)
+	case problems > 0:
+		return fmt.Errorf("problems left: %d", problems)
+	}
+	return nil
+}
+
+// checkSecretEntry checks one user's copy of a secret decodes, and that its
+// wrapped AES key is the size of their RSA key.
+func checkSecretEntry(shh *shh, u username, sec secret) error {
+	if isAgeRecipient(u) {
+		if sec.AESKey != "" {
+			return errors.New("age secret has an aes key")
+		}
+		return nil
+	}
+	if sec.AESKey == "" {
+		return errors.New("missing aes key")
+	}
+	dec, err := decodeSecret(sec)
+	if err != nil {
+		return err
+	}
+	block := shh.Keys[u]
+	if block == nil {
+		return nil
+	}
+	if _, p := providerForBlock(block.Type); p != nil {
+		return nil
+	}
+	pubKey, err := parsePublicKey(block)
+	if err != nil {
+		return fmt.Errorf("bad public key: %w", err)
+	}
+	if len(dec.AESKey) != pubKey.Size() {
+		return fmt.Errorf("aes key is %d bytes, want %d", len(dec.AESKey),
+			pubKey.Size())
+	}
+	return nil
+}
+
+// repairDiverged re-encrypts the user's own value of each diverged secret for
+// everyone with access, returning the names which can be repaired. Secrets
+// are only decrypted when fix is set.
+func repairDiverged(shh *shh, nonInteractive bool, names []string, fix bool) (map[string]struct{}, error) {
+	configPath, err := getConfigPath()
+	if err != nil {
+		return nil, err
+	}
+	user, err := getUser(configPath)
+	if err != nil {
+		return nil, err
+	}
+	fixable := map[string]struct{}{}
+	secrets := map[string]secret{}
+	for _, name := range names {
+		sec, ok := shh.Secrets[user.Username][name]
+		if !ok {
+			continue
+		}
+		fixable[name] = struct{}{}
+		if sec, err = decodeSecret(sec); err != nil {
+			return nil, err
+		}
+		secrets[name] = sec
+	}
+	if !fix || len(secrets) == 0 {
+		return fixable, nil
+	}
+	dec, err := user.decrypterFor(configPath, nonInteractive, secrets)
+	if err != nil {
+		return nil, err
+	}
+	access := secretAccess(shh)
+	for name, sec := range secrets {
+		plaintext, err := decryptSecret(dec, sec)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		for u, old := range access[name] {
+			if u == user.Username {
+				continue
+			}
+			enc, err := shh.encryptFor(u, plaintext)
+			if err != nil {
+				plaintext.Destroy()
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			enc.Sensitive, enc.Protected = old.Sensitive, old.Protected
+			enc.Expires, enc.Modified = old.Expires, old.Modified
+			enc.Granted = old.Granted
+			shh.Secrets[u][name] = enc
+		}
+		plaintext.Destroy()
+	}
+	return fixable, nil
+}
+
+func sortedSecretNames(secrets map[string]secret) []string {
+	names := make([]string, 0, len(secrets))
+	for name := range secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const (
+	gcpAPI   = "https://secretmanager.googleapis.com/v1"
+	gcpScope = "https://www.googleapis.com/auth/cloud-platform"
+
+	gcpMetadataToken   = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+	gcpMetadataProject = "http://metadata.google.internal/computeMetadata/v1/project/project-id"
+)
+
+// gcpRemote syncs with Google Secret Manager. Secret IDs can't contain /, so
+// it's mapped to __, and names containing __ or other characters Google
+// rejects can't be synced. Changed values are added as new versions and the
+// old versions are disabled.
+type gcpRemote struct {
+	project string
+	token   string
+	client  *http.Client
+
+	// exists records the secrets seen by list, to know when a secret must
+	// be created before adding a version.
+	exists map[string]bool
+}
+
+// gcpCredentials is an application default credentials file, either a
+// service account key or a user's credentials from `gcloud auth
+// application-default login`.
+type gcpCredentials struct {
+	Type           string `json:"type"`
+	ProjectID      string `json:"project_id"`
+	QuotaProjectID string `json:"quota_project_id"`
+
+	// Service accounts
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+
+	// Users
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+func gcpBackend(fs *flag.FlagSet) func() (syncRemote, error) {
+	project := fs.String("project", "", "gcp project (default from credentials)")
+	return func() (syncRemote, error) {
+		r := &gcpRemote{
+			project: *project,
+			client:  &http.Client{Timeout: 30 * time.Second},
+			exists:  map[string]bool{},
+		}
+		if err := r.authenticate(); err != nil {
+			return nil, fmt.Errorf("gcp credentials: %w", err)
+		}
+		if r.project == "" {
+			return nil, errors.New("no gcp project. use --project")
+		}
+		return r, nil
+	}
+}
+
+// gcp syncs secrets with Google Secret Manager.
+func gcp(nonInteractive bool, args []string) error {
+	return syncCommand(nonInteractive, "gcp", gcpBackend, args)
+}
+
+// authenticate gets an access token using application default credentials:
+// $GOOGLE_APPLICATION_CREDENTIALS, then gcloud's well-known file, then the
+// metadata server on Google Cloud.
+func (r *gcpRemote) authenticate() error {
+	if r.project == "" {
+		r.project = os.Getenv("GOOGLE_CLOUD_PROJECT")
+	}
+	pth := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if pth == "" {
+		pth = gcloudCredentialsPath()
+	}
+	byt, err := ioutil.ReadFile(pth)
+	switch {
+	case os.IsNotExist(err) && os.Getenv("GOOGLE_APPLICATION_CREDENTIALS") == "":
+		return r.metadataToken()
+	case err != nil:
+		return err
+	}
+	defer wipe(byt)
+	var creds gcpCredentials
+	if err = json.Unmarshal(byt, &creds); err != nil {
+		return fmt.Errorf("decode %s: %w", pth, err)
+	}
+	if r.project == "" {
+		r.project = creds.ProjectID
+	}
+	if r.project == "" {
+		r.project = creds.QuotaProjectID
+	}
+	if creds.TokenURI == "" {
+		creds.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	form := url.Values{}
+	switch creds.Type {
+	case "service_account":
+		assertion, err := gcpAssertion(creds)
+		if err != nil {
+			return err
+		}
+		form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+		form.Set("assertion", assertion)
+	case "authorized_user":
+		form.Set("grant_type", "refresh_token")
+		form.Set("client_id", creds.ClientID)
+		form.Set("client_secret", creds.ClientSecret)
+		form.Set("refresh_token", creds.RefreshToken)
+	default:
+		return fmt.Errorf("unsupported credentials type %q", creds.Type)
+	}
+	req, err := http.NewRequest(http.MethodPost, creds.TokenURI,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r.tokenFrom(req)
+}
+
+func (r *gcpRemote) metadataToken() error {
+	req, err := http.NewRequest(http.MethodGet, gcpMetadataToken, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	if err = r.tokenFrom(req); err != nil {
+		return fmt.Errorf("no credentials file, and metadata server: %w", err)
+	}
+	if r.project != "" {
+		return nil
+	}
+	req, err = http.NewRequest(http.MethodGet, gcpMetadataProject, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	byt, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	r.project = strings.TrimSpace(string(byt))
+	return nil
+}
+
+// tokenFrom sends an OAuth token request and keeps the access token.
+func (r *gcpRemote) tokenFrom(req *http.Request) error {
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return fmt.Errorf("decode token: %w", err)
+	}
+	if tok.AccessToken == "" {
+		return fmt.Errorf("token: %s: %s %s", resp.Status, tok.Error,
+			tok.Description)
+	}
+	r.token = tok.AccessToken
+	return nil
+}
+
+// gcloudCredentialsPath is where `gcloud auth application-default login`
+// writes credentials.
+func gcloudCredentialsPath() string {
+	if dir := os.Getenv("CLOUDSDK_CONFIG"); dir != "" {
+		return filepath.Join(dir, "application_default_credentials.json")
+	}
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("APPDATA"), "gcloud",
+			"application_default_credentials.json")
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".config", "gcloud",
+		"application_default_credentials.json")
+}
+
+// gcpAssertion signs a JWT for a service account to exchange for a token.
+func gcpAssertion(creds gcpCredentials) (string, error) {
+	block, _ := pem.Decode([]byte(creds.PrivateKey))
+	if block == nil {
+		return "", errors.New("bad private key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("parse private key: %w", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return "", errors.New("private key isn't rsa")
+	}
+	now := time.Now()
+	header := `{"alg":"RS256","typ":"JWT"}`
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   creds.ClientEmail,
+		"scope": gcpScope,
+		"aud":   creds.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	b64 := base64.RawURLEncoding
+	signed := b64.EncodeToString([]byte(header)) + "." + b64.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", fmt.Errorf("sign: %w", err)
+	}
+	return signed + "." + b64.EncodeToString(sig), nil
+}
+
+// do sends a request to the Secret Manager API, decoding the response into
+// out if non-nil.
+func (r *gcpRemote) do(method, pth string, body, out interface{}) error {
+	var rdr *bytes.Reader
+	if body != nil {
+		byt, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		defer wipe(byt)
+		rdr = bytes.NewReader(byt)
+	} else {
+		rdr = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequest(method, gcpAPI+"/projects/"+
+		url.PathEscape(r.project)+pth, rdr)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+r.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	byt, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	defer wipe(byt)
+	if resp.StatusCode >= 300 {
+		var gerr struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		_ = json.Unmarshal(byt, &gerr)
+		return fmt.Errorf("gcp: %s: %s", resp.Status, gerr.Error.Message)
+	}
+	if out != nil {
+		if err = json.Unmarshal(byt, out); err != nil {
+			return fmt.Errorf("decode: %w", err)
+		}
+	}
+	return nil
+}
+
+func (r *gcpRemote) list(prefix string) ([]string, error) {
+	var names []string
+	pageToken := ""
+	for {
+		var resp struct {
+			Secrets []struct {
+				Name string `json:"name"`
+			} `json:"secrets"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		pth := "/secrets?pageSize=250"
+		if pageToken != "" {
+			pth += "&pageToken=" + url.QueryEscape(pageToken)
+		}
+		if err := r.do(http.MethodGet, pth, nil, &resp); err != nil {
+			return nil, err
+		}
+		for _, s := range resp.Secrets {
+			id := s.Name[strings.LastIndex(s.Name, "/")+1:]
+			name := strings.Replace(id, "__", "/", -1)
+			r.exists[name] = true
+			if strings.HasPrefix(name, prefix) {
+				names = append(names, name)
+			}
+		}
+		if resp.NextPageToken == "" {
+			return names, nil
+		}
+		pageToken = resp.NextPageToken
+	}
+}
+
+func (r *gcpRemote) get(name string) ([]byte, error) {
+	id, err := gcpSecretID(name)
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	err = r.do(http.MethodGet, "/secrets/"+id+"/versions/latest:access", nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(resp.Payload.Data)
+}
+
+func (r *gcpRemote) put(name string, val []byte) error {
+	id, err := gcpSecretID(name)
+	if err != nil {
+		return err
+	}
+	if !r.exists[name] {
+		body := map[string]interface{}{
+			"replication": map[string]interface{}{
+				"automatic": map[string]interface{}{},
+			},
+		}
+		if err = r.do(http.MethodPost, "/secrets?secretId="+id, body, nil); err != nil {
+			return err
+		}
+		r.exists[name] = true
+	}
+	var version struct {
+		Name string `json:"name"`
+	}
+	body := map[string]interface{}{
+		"payload": map[string]string{
+			"data": base64.StdEncoding.EncodeToString(val),
+		},
+	}
+	if err = r.do(http.MethodPost, "/secrets/"+id+":addVersion", body, &version); err != nil {
+		return err
+	}
+
+	// Disable every older version, so only the current value is usable
+	var resp struct {
+		Versions []struct {
+			Name string `json:"name"`
+		} `json:"versions"`
+	}
+	pth := "/secrets/" + id + "/versions?filter=" + url.QueryEscape("state:ENABLED")
+	if err = r.do(http.MethodGet, pth, nil, &resp); err != nil {
+		return fmt.Errorf("list versions: %w", err)
+	}
+	for _, v := range resp.Versions {
+		if v.Name == version.Name {
+			continue
+		}
+		num := v.Name[strings.LastIndex(v.Name, "/")+1:]
+		pth := "/secrets/" + id + "/versions/" + num + ":disable"
+		if err = r.do(http.MethodPost, pth, struct{}{}, nil); err != nil {
+			return fmt.Errorf("disable version %s: %w", num, err)
+		}
+	}
+	return nil
+}
+
+// gcpSecretID maps a name to a secret ID, replacing / with __.
+func gcpSecretID(name string) (string, error) {
+	if strings.Contains(name, "__") {
+		return "", fmt.Errorf("%s: names containing __ can't be synced", name)
+	}
+	id := strings.Replace(name, "/", "__", -1)
+	if id == "" || len(id) > 255 {
+		return "", fmt.Errorf("%s: ids must be 1-255 characters", name)
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '_' || c == '-':
+		default:
+			return "", fmt.Errorf("%s: gcp doesn't allow %q in names", name, c)
+		}
+	}
+	return id, nil
+}
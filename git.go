@@ -0,0 +1,563 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// diffFile renders a .shh file as text for `git diff`, configured as a
+// textconv. It shows users, their keys' fingerprints, and who can access each
+// secret alongside a short hash of the ciphertext, so changed values stand
+// out. Plaintext is never shown, and no identity is needed.
+func diffFile(args []string) error {
+	if len(args) != 1 {
+		return errors.New("bad args: expected `diff-file $path`")
+	}
+
+	const (
+		promises     = "stdio rpath"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	byt, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(os.Stdout)
+	if len(bytes.TrimSpace(byt)) == 0 {
+		return w.Flush()
+	}
+	outer, err := parseOuterLayer(byt)
+	if err != nil {
+		return fmt.Errorf("decode: %w", err)
+	}
+	if outer.Sealed != nil {
+		// Never prompt, since git runs textconv without a terminal
+		pass := os.Getenv("SHH_PASSPHRASE")
+		if pass == "" || outer.Sealed.KMS != "" {
+			fmt.Fprintf(w, "sealed %s\n", shortHash(outer.Sealed.Data))
+			return w.Flush()
+		}
+		_, _, byt, err = unsealData([]byte(pass), outer.Sealed)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, "sealed")
+	}
+	shh := newShh(args[0])
+	if err = unmarshalShh(byt, shh); err != nil {
+		return fmt.Errorf("decode: %w", err)
+	}
+	writeShhText(w, shh)
+	return w.Flush()
+}
+
+// writeShhText writes the deterministic, plaintext-free rendering of the
+// project used by diff-file.
+func writeShhText(w *bufio.Writer, shh *shh) {
+	if shh.MinKeyBits != 0 {
+		fmt.Fprintf(w, "min_key_bits %d\n", shh.MinKeyBits)
+	}
+	if set := shh.Settings; set != nil {
+		if set.DefaultEnv != "" {
+			fmt.Fprintf(w, "default_env %s\n", set.DefaultEnv)
+		}
+		if len(set.KeyAlgorithms) > 0 {
+			fmt.Fprintf(w, "key_algorithms %s\n",
+				strings.Join(set.KeyAlgorithms, ","))
+		}
+		if set.GrantDays != 0 {
+			fmt.Fprintf(w, "grant_days %d\n", set.GrantDays)
+		}
+		if set.MinPasswordScore != 0 {
+			fmt.Fprintf(w, "min_password_score %d\n", set.MinPasswordScore)
+		}
+		if set.MaxAgeDays != 0 {
+			fmt.Fprintf(w, "max_age_days %d\n", set.MaxAgeDays)
+		}
+		if len(set.Protected) > 0 {
+			fmt.Fprintf(w, "protected %s\n", strings.Join(set.Protected, ","))
+		}
+		for _, p := range set.Policies {
+			fmt.Fprintf(w, "policy %s min_length %d min_entropy %d match %q\n",
+				p.Glob, p.MinLength, p.MinEntropy, p.Match)
+		}
+		for _, u := range set.Webhooks {
+			fmt.Fprintf(w, "webhook %s\n", u)
+		}
+	}
+	for _, p := range shh.Publish {
+		fmt.Fprintf(w, "publish %s %s for %s\n", p.To, p.Only,
+			joinUsernames(p.For))
+	}
+
+	users := map[username]struct{}{}
+	for u := range shh.Keys {
+		users[u] = struct{}{}
+	}
+	for u := range shh.Secrets {
+		users[u] = struct{}{}
+	}
+	fmt.Fprintln(w, "users:")
+	for _, u := range sortedUsernames(users) {
+		fmt.Fprintf(w, "  %s %s\n", u, describeKey(u, shh.Keys[u]))
+	}
+
+	// Group by secret rather than user, so granting access to a secret
+	// reads as one added line beneath it
+	access := secretAccess(shh)
+	names := make([]string, 0, len(access))
+	for name := range access {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(w, "secrets:")
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s\n", name)
+		for _, u := range accessUsers(access[name]) {
+			sec := access[name][u]
+			line := fmt.Sprintf("    %s %s", u,
+				shortHash(sec.AESKey+sec.Encrypted))
+			if sec.Sensitive {
+				line += " sensitive"
+			}
+			if sec.Protected {
+				line += " protected"
+			}
+			if sec.Expires != nil {
+				line += " expires " + sec.Expires.Format("2006-01-02")
+			}
+			fmt.Fprintln(w, line)
+		}
+	}
+	if len(shh.Trash) == 0 {
+		return
+	}
+	names = names[:0]
+	for name := range shh.Trash {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(w, "trash:")
+	for _, name := range names {
+		trashed := shh.Trash[name]
+		fmt.Fprintf(w, "  %s deleted %s by %s\n", name,
+			trashed.Deleted.Format("2006-01-02"), trashed.By)
+	}
+}
+
+// describeKey gives the user's key type and fingerprint.
+func describeKey(u username, block *pem.Block) string {
+	switch {
+	case block == nil && isAgeRecipient(u):
+		return "age"
+	case block == nil:
+		return "no key"
+	case block.Type == kmsBlockType:
+		return "aws-kms"
+	case block.Type == gpgBlockType:
+		return "gpg " + block.Headers["Fingerprint"]
+	}
+	sum := sha256.Sum256(block.Bytes)
+	fp := "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+	pubKey, err := parsePublicKey(block)
+	if err != nil {
+		return "invalid " + fp
+	}
+	return fmt.Sprintf("rsa-%d %s", pubKey.N.BitLen(), fp)
+}
+
+// shortHash identifies ciphertext without revealing anything about it.
+func shortHash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:6])
+}
+
+func sortedUsernames(set map[username]struct{}) []username {
+	users := make([]username, 0, len(set))
+	for u := range set {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i] < users[j] })
+	return users
+}
+
+func joinUsernames(users []username) string {
+	strs := make([]string, len(users))
+	for i, u := range users {
+		strs[i] = string(u)
+	}
+	return strings.Join(strs, ",")
+}
+
+// logShh walks the git history of .shh, reporting per commit which users,
+// secrets, and grants changed. With a glob, only matching secrets are shown.
+func logShh(args []string) error {
+	if len(args) > 1 {
+		return errors.New("bad args: expected `log [$glob]`")
+	}
+	glob := "*"
+	if len(args) == 1 {
+		glob = args[0]
+		if err := validateGlob(glob); err != nil {
+			return err
+		}
+	}
+
+	const (
+		promises     = "stdio rpath tty proc exec"
+		execPromises = "stdio rpath wpath cpath tty proc exec"
+	)
+	pledge(promises, execPromises)
+
+	pth, err := findShhRecursive(".shh")
+	if err != nil {
+		return err
+	}
+	abs, err := filepath.Abs(pth)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(abs)
+	out, err := gitOutput(dir, "log", "--format=%H%x00%an <%ae>%x00%ad%x00%s",
+		"--date=short", "--reverse", "--", filepath.Base(abs))
+	if err != nil {
+		return err
+	}
+
+	// Walk oldest to newest so each commit is compared to its parent,
+	// then print newest first as git does
+	var entries []string
+	var passphrase []byte
+	prev := newShh(abs)
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, "\x00", 4)
+		if len(parts) != 4 {
+			return fmt.Errorf("unexpected git log output: %q", line)
+		}
+		byt, err := gitOutput(dir, "show", parts[0]+":./.shh")
+		if err != nil {
+			// Deleted in this commit
+			byt = nil
+		}
+		cur, err := decodeShhBytes(abs, byt, &passphrase)
+		if err != nil {
+			return fmt.Errorf("%s: %w", parts[0][:8], err)
+		}
+		changes := shhChanges(prev, cur, glob)
+		prev = cur
+		if len(changes) == 0 {
+			continue
+		}
+		entry := fmt.Sprintf("commit %s %s %s\n    %s\n\n  %s\n",
+			parts[0][:8], parts[2], parts[1], parts[3],
+			strings.Join(changes, "\n  "))
+		entries = append(entries, entry)
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		fmt.Print(entries[i])
+		if i > 0 {
+			fmt.Println()
+		}
+	}
+	return nil
+}
+
+// decodeShhBytes parses a .shh file's content, such as from a past commit,
+// requesting the project passphrase once if any revision is sealed.
+func decodeShhBytes(pth string, byt []byte, passphrase *[]byte) (*shh, error) {
+	shh := newShh(pth)
+	if len(bytes.TrimSpace(byt)) == 0 {
+		return shh, nil
+	}
+	outer, err := parseOuterLayer(byt)
+	if err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+	if outer.Sealed != nil {
+		// Ask once, reusing the passphrase for every revision
+		byt, err = shh.unseal(outer.Sealed, func() ([]byte, error) {
+			if *passphrase == nil {
+				pass, err := requestProjectPassphrase()
+				if err != nil {
+					return nil, err
+				}
+				*passphrase = pass
+			}
+			return *passphrase, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := unmarshalShh(byt, shh); err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+	return shh, nil
+}
+
+// shhChanges between two versions of the project. A secret is changed when
+// it was re-encrypted for everyone with access both before and after, which
+// happens when its value is set. Re-encryption for only some users, as after
+// a rotate, is reported separately.
+func shhChanges(old, cur *shh, glob string) []string {
+	var changes []string
+	if glob == "*" {
+		users := map[username]struct{}{}
+		for u := range old.Keys {
+			users[u] = struct{}{}
+		}
+		for u := range cur.Keys {
+			users[u] = struct{}{}
+		}
+		for _, u := range sortedUsernames(users) {
+			before, after := old.Keys[u], cur.Keys[u]
+			switch {
+			case before == nil:
+				changes = append(changes, "+ user "+string(u))
+			case after == nil:
+				changes = append(changes, "- user "+string(u))
+			case !bytes.Equal(before.Bytes, after.Bytes):
+				changes = append(changes, "~ user "+string(u)+" key")
+			}
+		}
+	}
+
+	oldAccess, curAccess := secretAccess(old), secretAccess(cur)
+	names := map[string]struct{}{}
+	for name := range oldAccess {
+		names[name] = struct{}{}
+	}
+	for name := range curAccess {
+		names[name] = struct{}{}
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		if globMatch(glob, name) {
+			sorted = append(sorted, name)
+		}
+	}
+	sort.Strings(sorted)
+	for _, name := range sorted {
+		before, after := oldAccess[name], curAccess[name]
+		if before == nil {
+			changes = append(changes, fmt.Sprintf("+ secret %s for %s",
+				name, joinUsernames(accessUsers(after))))
+			continue
+		}
+		if after == nil {
+			changes = append(changes, "- secret "+name)
+			continue
+		}
+		var kept, reencrypted []username
+		for u, sec := range after {
+			if prev, ok := before[u]; ok {
+				kept = append(kept, u)
+				if prev.Encrypted != sec.Encrypted {
+					reencrypted = append(reencrypted, u)
+				}
+			}
+		}
+		switch {
+		case len(reencrypted) == 0:
+		case len(reencrypted) == len(kept):
+			changes = append(changes, "~ secret "+name)
+		default:
+			sort.Slice(reencrypted, func(i, j int) bool {
+				return reencrypted[i] < reencrypted[j]
+			})
+			changes = append(changes, fmt.Sprintf(
+				"~ secret %s re-encrypted for %s", name,
+				joinUsernames(reencrypted)))
+		}
+		grantees := map[username]secret{}
+		for u, sec := range before {
+			grantees[u] = sec
+		}
+		for u, sec := range after {
+			grantees[u] = sec
+		}
+		for _, u := range accessUsers(grantees) {
+			_, had := before[u]
+			_, has := after[u]
+			switch {
+			case has && !had:
+				changes = append(changes, fmt.Sprintf("+ grant %s %s", u, name))
+			case had && !has:
+				changes = append(changes, fmt.Sprintf("- grant %s %s", u, name))
+			}
+		}
+	}
+	return changes
+}
+
+// accessUsers sorts the users with access to a secret.
+func accessUsers(access map[username]secret) []username {
+	users := map[username]struct{}{}
+	for u := range access {
+		users[u] = struct{}{}
+	}
+	return sortedUsernames(users)
+}
+
+// secretAccess maps each secret to the users who can access it.
+func secretAccess(shh *shh) map[string]map[username]secret {
+	access := map[string]map[username]secret{}
+	for u, secrets := range shh.Secrets {
+		for name, sec := range secrets {
+			if access[name] == nil {
+				access[name] = map[username]secret{}
+			}
+			access[name][u] = sec
+		}
+	}
+	return access
+}
+
+// gitOutput runs git in the directory, returning its stdout.
+func gitOutput(dir string, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("git %s: %s", args[0], msg)
+		}
+		return nil, fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return stdout.Bytes(), nil
+}
+
+// diffShh compares two project files, reporting users added or removed,
+// grant changes, and secrets whose ciphertext changed. Files may be paths or
+// git revisions such as main:.shh. With --decrypt, changed secrets the user
+// can access are decrypted to show their old and new values.
+func diffShh(nonInteractive bool, args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ContinueOnError)
+	decrypt := fs.Bool("decrypt", false, "show old and new values you can access")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 2 {
+		return errors.New("bad args: expected `diff $file $file`")
+	}
+
+	const (
+		promises     = "stdio rpath wpath cpath tty proc exec inet dns"
+		execPromises = "stdio rpath proc exec"
+	)
+	pledge(promises, execPromises)
+
+	var passphrase []byte
+	versions := make([]*shh, 2)
+	for i, arg := range args {
+		byt, err := ioutil.ReadFile(arg)
+		if os.IsNotExist(err) && strings.Contains(arg, ":") {
+			byt, err = gitOutput(".", "show", arg)
+		}
+		if err != nil {
+			return err
+		}
+		versions[i], err = decodeShhBytes(arg, byt, &passphrase)
+		if err != nil {
+			return fmt.Errorf("%s: %w", arg, err)
+		}
+	}
+	old, cur := versions[0], versions[1]
+	changes := shhChanges(old, cur, "*")
+	if !*decrypt {
+		for _, change := range changes {
+			fmt.Println(change)
+		}
+		return nil
+	}
+
+	configPath, err := getConfigPath()
+	if err != nil {
+		return err
+	}
+	user, err := getUser(configPath)
+	if err != nil {
+		return fmt.Errorf("get user: %w", err)
+	}
+	oldSecrets, curSecrets := old.Secrets[user.Username], cur.Secrets[user.Username]
+	all := map[string]secret{}
+	for name, sec := range oldSecrets {
+		all["old "+name] = sec
+	}
+	for name, sec := range curSecrets {
+		all["new "+name] = sec
+	}
+	dec, err := user.decrypterFor(configPath, nonInteractive, all)
+	if err != nil {
+		return err
+	}
+	value := func(sec secret) (secureBytes, error) {
+		sec, err := decodeSecret(sec)
+		if err != nil {
+			return nil, err
+		}
+		return decryptSecret(dec, sec)
+	}
+	for _, change := range changes {
+		if !strings.HasPrefix(change, "~ secret ") {
+			fmt.Println(change)
+			continue
+		}
+		name := strings.Fields(change)[2]
+		oldSec, okOld := oldSecrets[name]
+		curSec, okCur := curSecrets[name]
+		if !okOld || !okCur {
+			fmt.Println(change)
+			continue
+		}
+		// Values encrypted for a since rotated key can't be decrypted
+		before, err := value(oldSec)
+		if err != nil {
+			fmt.Printf("%s (old value: %v)\n", change, err)
+			continue
+		}
+		after, err := value(curSec)
+		if err != nil {
+			before.Destroy()
+			fmt.Printf("%s (new value: %v)\n", change, err)
+			continue
+		}
+		if bytes.Equal(before, after) {
+			fmt.Printf("~ secret %s re-encrypted, value unchanged\n", name)
+		} else {
+			fmt.Printf("~ secret %s\n", name)
+			printValueLines("-", before)
+			printValueLines("+", after)
+		}
+		before.Destroy()
+		after.Destroy()
+	}
+	return nil
+}
+
+func printValueLines(prefix string, val []byte) {
+	for _, line := range strings.Split(strings.TrimSuffix(string(val), "\n"), "\n") {
+		fmt.Printf("    %s %s\n", prefix, line)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// hookMarker identifies a pre-commit hook written by shh, so it can be
+	// safely replaced.
+	hookMarker = "# Installed by `shh hook install`"
+
+	// minLeakLen is the shortest secret value scanned for. Shorter values
+	// such as ports or booleans would match too many files.
+	minLeakLen = 8
+)
+
+// hookCmd manages the git pre-commit hook, e.g. `shh hook install`.
+func hookCmd(nonInteractive bool, args []string) error {
+	arg, tail := parseArg(args)
+	switch arg {
+	case "install":
+		return hookInstall(tail)
+	case "pre-commit":
+		return preCommit(nonInteractive, tail)
+	case "":
+		return errors.New("bad args: expected `install` or `pre-commit`")
+	default:
+		return &badArgError{Arg: arg}
+	}
+}
+
+// hookInstall writes a git pre-commit hook which runs `shh hook pre-commit`.
+// An existing hook not written by shh is kept unless --force is given.
+func hookInstall(args []string) error {
+	fs := flag.NewFlagSet("hook install", flag.ContinueOnError)
+	force := fs.Bool("force", false, "replace an existing pre-commit hook")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 0 {
+		return errors.New("bad args: expected none")
+	}
+
+	const (
+		promises     = "stdio rpath wpath cpath proc exec"
+		execPromises = "stdio rpath proc exec"
+	)
+	pledge(promises, execPromises)
+
+	out, err := gitOutput(".", "rev-parse", "--git-path", "hooks/pre-commit")
+	if err != nil {
+		return err
+	}
+	pth := strings.TrimSpace(string(out))
+	if byt, err := ioutil.ReadFile(pth); err == nil && !*force &&
+		!bytes.Contains(byt, []byte(hookMarker)) {
+		return fmt.Errorf("%s exists, use --force to replace it", pth)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("executable: %w", err)
+	}
+
+	// Git hooks don't get a terminal on stdin, so give shh one if we can
+	// to ask for the password. Otherwise the server must be running.
+	hook := fmt.Sprintf(`#!/bin/sh
+%s
+if (exec < /dev/tty) 2>/dev/null; then
+	exec %q hook pre-commit < /dev/tty
+fi
+exec %q -n hook pre-commit
+`, hookMarker, exe, exe)
+	if err = os.MkdirAll(filepath.Dir(pth), 0755); err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(pth, []byte(hook), 0755); err != nil {
+		return err
+	}
+	notef(os.Stdout, "installed %s\n", pth)
+	return nil
+}
+
+// preCommit refuses a commit which stages a malformed .shh file or a file
+// containing the plaintext value of any secret the user can decrypt.
+func preCommit(nonInteractive bool, args []string) error {
+	if len(args) != 0 {
+		return errors.New("bad args: expected none")
+	}
+
+	const (
+		promises     = "stdio rpath wpath cpath tty proc exec inet dns"
+		execPromises = "stdio rpath proc exec"
+	)
+	pledge(promises, execPromises)
+
+	out, err := gitOutput(".", "rev-parse", "--show-toplevel")
+	if err != nil {
+		return err
+	}
+	top := strings.TrimSpace(string(out))
+	out, err = gitOutput(top, "diff", "--cached", "--name-only",
+		"--diff-filter=ACMR", "-z")
+	if err != nil {
+		return err
+	}
+	staged := map[string][]byte{}
+	for _, pth := range strings.Split(string(out), "\x00") {
+		if pth == "" {
+			continue
+		}
+		byt, err := gitOutput(top, "show", ":"+pth)
+		if err != nil {
+			return err
+		}
+		staged[pth] = byt
+		if !strings.HasSuffix(pth, ".shh") {
+			continue
+		}
+		if err = validateShhFile(byt); err != nil {
+			return fmt.Errorf("%s is malformed: %w", pth, err)
+		}
+	}
+	if len(staged) == 0 {
+		return nil
+	}
+
+	configPath, err := getConfigPath()
+	if err != nil {
+		return err
+	}
+	user, err := getUser(configPath)
+	if err != nil {
+		// Contributors without an identity can't have leaked secrets
+		notef(os.Stderr, "shh: no identity, skipping leak scan\n")
+		return nil
+	}
+	shh, err := shhFromPathFor(".shh", user.Username)
+	if err != nil {
+		return err
+	}
+	secrets, err := shh.GetSecretsForUser("*", user.Username)
+	if err != nil || len(secrets) == 0 {
+		return nil
+	}
+	dec, err := user.decrypterFor(configPath, nonInteractive, secrets)
+	if err != nil {
+		return fmt.Errorf("%w (skip the scan with `git commit --no-verify`)", err)
+	}
+	var leaks []string
+	for name, sec := range secrets {
+		plaintext, err := decryptSecret(dec, sec)
+		if err != nil {
+			return err
+		}
+		val := bytes.TrimSpace(plaintext)
+		if len(val) >= minLeakLen {
+			for pth, byt := range staged {
+				if !strings.HasSuffix(pth, ".shh") && bytes.Contains(byt, val) {
+					leaks = append(leaks, fmt.Sprintf(
+						"%s contains the value of %s", pth, name))
+				}
+			}
+		}
+		plaintext.Destroy()
+	}
+	for _, byt := range staged {
+		wipe(byt)
+	}
+	if len(leaks) > 0 {
+		sort.Strings(leaks)
+		return fmt.Errorf("refusing to commit plaintext secrets:\n\t%s",
+			strings.Join(leaks, "\n\t"))
+	}
+	return nil
+}
+
+// validateShhFile checks the structure of a .shh file without decrypting it:
+// keys must parse, every user with secrets must have a key or be an age
+// recipient, and every secret must be well-formed.
+func validateShhFile(byt []byte) error {
+	outer, err := parseOuterLayer(byt)
+	if err != nil {
+		return fmt.Errorf("decode: %w", err)
+	}
+	if outer.Sealed != nil {
+		for _, s := range []string{outer.Sealed.Salt, outer.Sealed.Nonce,
+			outer.Sealed.Data} {
+			if _, err := base64.StdEncoding.DecodeString(s); err != nil {
+				return fmt.Errorf("decode sealed: %w", err)
+			}
+		}
+		return nil
+	}
+	shh := newShh(".shh")
+	if err := unmarshalShh(byt, shh); err != nil {
+		return fmt.Errorf("decode: %w", err)
+	}
+	for u, block := range shh.Keys {
+		if block == nil {
+			return fmt.Errorf("%s: missing key", u)
+		}
+		var err error
+		if _, p := providerForBlock(block.Type); p != nil {
+			_, err = p.wrapper(block)
+		} else {
+			_, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", u, err)
+		}
+	}
+	for u, secrets := range shh.Secrets {
+		_, hasKey := shh.Keys[u]
+		if isAgeRecipient(u) {
+			if _, err := parseAgeRecipient(string(u)); err != nil {
+				return err
+			}
+		} else if !hasKey {
+			return fmt.Errorf("%s has secrets but is not a user", u)
+		}
+		for name, sec := range secrets {
+			if sec.AESKey == "" {
+				if !isAgeRecipient(u) {
+					return fmt.Errorf("%s: %s has no key", u, name)
+				}
+				continue
+			}
+			if _, err := decodeSecret(sec); err != nil {
+				return fmt.Errorf("%s: %s: %w", u, name, err)
+			}
+		}
+	}
+	return nil
+}
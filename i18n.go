@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// catalogs translate shh's messages from English, keyed by language.
+// Messages without a translation are shown in English.
+var catalogs = map[string]map[string]string{
+	"es": messagesES,
+}
+
+var (
+	catalogOnce sync.Once
+	catalog     map[string]string
+)
+
+// language is the user's language from $LC_ALL, $LC_MESSAGES, or $LANG, such
+// as "es" for es_ES.UTF-8, or "" for the C locale.
+func language() string {
+	for _, env := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		lang := os.Getenv(env)
+		if lang == "" {
+			continue
+		}
+		if i := strings.IndexAny(lang, "_.@"); i >= 0 {
+			lang = lang[:i]
+		}
+		if lang == "C" || lang == "POSIX" {
+			return ""
+		}
+		return strings.ToLower(lang)
+	}
+	return ""
+}
+
+// tr translates an English message into the user's language.
+func tr(s string) string {
+	catalogOnce.Do(func() { catalog = catalogs[language()] })
+	if t, ok := catalog[s]; ok {
+		return t
+	}
+	return s
+}
+
+// trf translates the format, then formats it like fmt.Sprintf.
+func trf(format string, args ...interface{}) string {
+	return fmt.Sprintf(tr(format), args...)
+}
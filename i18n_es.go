@@ -0,0 +1,74 @@
+package main
+
+// messagesES are the Spanish translations.
+var messagesES = map[string]string{
+	// Help
+	"usage:":           "uso:",
+	"flags:":           "opciones:",
+	"examples:":        "ejemplos:",
+	"global commands:": "comandos:",
+	"command flags:":   "opciones de los comandos:",
+	"Global flags such as -n may also be given. See `shh help`.": "También se aceptan opciones globales como -n. Consulta `shh help`.",
+
+	// Errors
+	"error: ":                                          "error: ",
+	"bad args":                                         "argumentos incorrectos",
+	"unknown arg: %s":                                  "argumento desconocido: %s",
+	"missing .shh, run `shh init`":                     "falta .shh, ejecuta `shh init`",
+	"missing keys. run `shh gen-keys`":                 "faltan las claves. ejecuta `shh gen-keys`",
+	"no secret found":                                  "no se encontró el secreto",
+	"no secret found, did you mean %s?":                "no se encontró el secreto, ¿quisiste decir %s?",
+	"no secrets which you can access":                  "no hay secretos a los que tengas acceso",
+	"secret does not exist":                            "el secreto no existe",
+	"no matching secrets":                              "ningún secreto coincide",
+	"no matching secrets which you can access":         "ningún secreto al que tengas acceso coincide",
+	"%s has no matching secrets":                       "ningún secreto de %s coincide",
+	"user not found":                                   "no se encontró el usuario",
+	"key exists":                                       "el secreto ya existe",
+	"no secret chosen":                                 "no se eligió ningún secreto",
+	"wrong project passphrase":                         "frase de contraseña del proyecto incorrecta",
+	"decrypt private key":                              "descifrar la clave privada",
+	"password must be >= 24 chars":                     "la contraseña debe tener al menos 24 caracteres",
+	"passwords do not match":                           "las contraseñas no coinciden",
+	"cached password not available. run `shh login`":   "la contraseña no está en caché. ejecuta `shh login`",
+	"not a terminal, pass --yes to confirm":            "no es una terminal, pasa --yes para confirmar",
+	"cancelled":                                        "cancelado",
+	"%s must use the key %s with this project":         "%s debe usar la clave %s con este proyecto",
+	". use `shh -profile %s`, or `shh profile use %s`": ". usa `shh -profile %s` o `shh profile use %s`",
+	"password is too guessable: scored %d of 4, the project requires %d": "la contraseña es demasiado fácil de adivinar: obtuvo %d de 4, el proyecto requiere %d",
+
+	// Prompts
+	"password":                      "contraseña",
+	"confirm password":              "confirma la contraseña",
+	"project passphrase":            "frase de contraseña del proyecto",
+	"username (usually email): ":    "usuario (normalmente el email): ",
+	" [y/N]: ":                      " [s/N]: ",
+	"y":                             "s",
+	"yes":                           "sí",
+	"import %d secrets?":            "¿importar %d secretos?",
+	"move %d secrets to the trash?": "¿mover %d secretos a la papelera?",
+	"deny %s access to %d secrets?": "¿quitar a %s el acceso a %d secretos?",
+	"remove %s from the project?":   "¿quitar a %s del proyecto?",
+	"unprotect %d secrets?":         "¿desproteger %d secretos?",
+	"%s %d secrets?":                "¿%s %d secretos?",
+	"server not running. start it in the background?": "el servidor no está en marcha. ¿iniciarlo en segundo plano?",
+	"keepass password":         "contraseña de keepass",
+	"confirm keepass password": "confirma la contraseña de keepass",
+
+	// Notes
+	"strength: [%s] %s, about 10^%.0f guesses\n": "seguridad: [%s] %s, unos 10^%.0f intentos\n",
+	"very weak":    "muy débil",
+	"weak":         "débil",
+	"fair":         "aceptable",
+	"good":         "buena",
+	"strong":       "fuerte",
+	"up to date\n": "actualizado\n",
+	"run `shh push` to upload your changes\n": "ejecuta `shh push` para subir tus cambios\n",
+	"rotated %d secrets\n":                    "se rotaron %d secretos\n",
+	"restored %s from %s\n":                   "se restauró %s de %s\n",
+	"> purged %d secrets\n":                   "> se purgaron %d secretos\n",
+	"> generated ~/.config/shh/config\n":      "> se generó ~/.config/shh/config\n",
+	"> generated ~/.config/shh/id_rsa\n":      "> se generó ~/.config/shh/id_rsa\n",
+	"> generated ~/.config/shh/id_rsa.pub\n":  "> se generó ~/.config/shh/id_rsa.pub\n",
+	"> be sure to back up your ~/.config/shh/id_rsa and\n> remember your password, or you may lose access to your\n> secrets!\n": "> haz una copia de seguridad de ~/.config/shh/id_rsa y\n> recuerda tu contraseña, o podrías perder el acceso a\n> tus secretos.\n",
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	importFormatDotenv = "dotenv"
+	importFormatJSON   = "json"
+	importFormatYAML   = "yaml"
+)
+
+// importSecrets creates secrets from a plaintext .env, JSON, or YAML file.
+// By default each key becomes a secret, with nested keys joined by /. With
+// --whole, the entire file becomes a single secret. A preview is shown and
+// confirmed before anything is written.
+func importSecrets(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := fs.String("format", "",
+		"dotenv, json, yaml, 1password, bitwarden, or lastpass (default from extension)")
+	whole := fs.String("whole", "", "import the file as a single secret with this name")
+	var opts importOptions
+	opts.flags(fs)
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return errors.New("bad args: expected `import $file`")
+	}
+
+	const (
+		promises     = "stdio rpath wpath cpath tty inet dns proc exec unveil"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	configPath, err := getConfigPath()
+	if err != nil {
+		return err
+	}
+	user, err := getUser(configPath)
+	if err != nil {
+		return fmt.Errorf("get user: %w", err)
+	}
+	shh, err := shhFromPath(".shh")
+	if err != nil {
+		return err
+	}
+	byt, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	defer wipe(byt)
+
+	// Now that we have our files, restrict further access
+	shh.unveilWrite()
+	shh.unveilNetwork()
+	unveilBlock()
+
+	var values map[string]string
+	if *whole != "" {
+		values = map[string]string{*whole: string(byt)}
+	} else {
+		if *format == "" {
+			*format = importFormatFromPath(args[0])
+		}
+		switch *format {
+		case importFormatDotenv:
+			values, err = parseDotenv(byt)
+		case importFormatJSON:
+			values, err = parseJSONSecrets(byt)
+		case importFormatYAML:
+			values, err = parseYAML(byt)
+		case formatOnePassword, formatBitwarden, formatLastPass:
+			values, err = parseManagerExport(*format, byt)
+		default:
+			return fmt.Errorf("unknown format %q, use --format", *format)
+		}
+		if err != nil {
+			return fmt.Errorf("parse %s: %w", args[0], err)
+		}
+	}
+	return addImported(shh, user.Username, values, opts)
+}
+
+// importOptions are shared by the import commands.
+type importOptions struct {
+	// Prefix is prepended to every secret name, e.g. staging/.
+	Prefix string
+
+	// DryRun previews the secrets without importing them.
+	DryRun bool
+
+	// Yes skips confirmation.
+	Yes bool
+}
+
+// flags registers the import flags on the flag set.
+func (o *importOptions) flags(fs *flag.FlagSet) {
+	fs.StringVar(&o.Prefix, "prefix", "", "prefix for secret names, e.g. staging/")
+	fs.BoolVar(&o.DryRun, "dry-run", false, "preview without importing")
+	fs.BoolVar(&o.Yes, "yes", false, "import without confirmation")
+}
+
+// addImported previews the secrets to be created, confirms, and encrypts
+// each value for the user. It refuses to overwrite existing secrets.
+func addImported(shh *shh, username username, values map[string]string, opts importOptions) error {
+	if len(values) == 0 {
+		return errors.New("nothing to import")
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var exists []string
+	for i, name := range names {
+		names[i] = opts.Prefix + name
+		if _, ok := shh.namespace[names[i]]; ok {
+			exists = append(exists, names[i])
+		}
+	}
+	if len(exists) > 0 {
+		return fmt.Errorf("secrets already exist: %s", strings.Join(exists, ", "))
+	}
+	for _, name := range names {
+		val := values[strings.TrimPrefix(name, opts.Prefix)]
+		if err := shh.checkValue(name, []byte(val)); err != nil {
+			return err
+		}
+	}
+	for _, name := range names {
+		fmt.Println("+", name)
+	}
+	if opts.DryRun {
+		return nil
+	}
+	if err := confirm(opts.Yes, "import %d secrets?", len(names)); err != nil {
+		return err
+	}
+
+	if _, ok := shh.Secrets[username]; !ok {
+		shh.Secrets[username] = map[string]secret{}
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	for _, name := range names {
+		plaintext := newSecureBytes([]byte(values[strings.TrimPrefix(name, opts.Prefix)]))
+		enc, err := shh.encryptFor(username, plaintext)
+		plaintext.Destroy()
+		if err != nil {
+			return err
+		}
+		enc.Modified, enc.Granted = &now, &now
+		shh.Secrets[username][name] = enc
+	}
+	return shh.EncodeToFile()
+}
+
+func importFormatFromPath(pth string) string {
+	base := filepath.Base(pth)
+	switch ext := filepath.Ext(base); {
+	case ext == ".json":
+		return importFormatJSON
+	case ext == ".yaml" || ext == ".yml":
+		return importFormatYAML
+	case ext == ".env" || strings.HasPrefix(base, ".env"):
+		return importFormatDotenv
+	}
+	return ""
+}
+
+// parseDotenv parses KEY=value lines, optionally prefixed by `export`.
+// Single-quoted values are literal, and double-quoted values may contain
+// escapes such as \n.
+func parseDotenv(byt []byte) (map[string]string, error) {
+	values := map[string]string{}
+	scn := bufio.NewScanner(bytes.NewReader(byt))
+	for n := 1; scn.Scan(); n++ {
+		line := strings.TrimSpace(scn.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("line %d: expected KEY=value", n)
+		}
+		key := strings.TrimSpace(parts[0])
+		val := strings.TrimSpace(parts[1])
+		switch {
+		case len(val) >= 2 && val[0] == '\'' && val[len(val)-1] == '\'':
+			val = val[1 : len(val)-1]
+		case len(val) >= 2 && val[0] == '"' && val[len(val)-1] == '"':
+			r := strings.NewReplacer(`\\`, `\`, `\"`, `"`, `\n`, "\n",
+				`\r`, "\r", `\$`, "$")
+			val = r.Replace(val[1 : len(val)-1])
+		default:
+			if i := strings.Index(val, " #"); i >= 0 {
+				val = strings.TrimSpace(val[:i])
+			}
+		}
+		values[key] = val
+	}
+	if err := scn.Err(); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// parseJSONSecrets flattens a JSON object, joining nested keys with /.
+// Strings are imported as-is, while numbers, booleans, and arrays are imported
+// as JSON. Nulls are skipped.
+func parseJSONSecrets(byt []byte) (map[string]string, error) {
+	var obj map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(byt))
+	dec.UseNumber()
+	if err := dec.Decode(&obj); err != nil {
+		return nil, err
+	}
+	values := map[string]string{}
+	var flatten func(prefix string, obj map[string]interface{}) error
+	flatten = func(prefix string, obj map[string]interface{}) error {
+		for k, v := range obj {
+			switch v := v.(type) {
+			case nil:
+			case string:
+				values[prefix+k] = v
+			case map[string]interface{}:
+				if err := flatten(prefix+k+"/", v); err != nil {
+					return err
+				}
+			default:
+				b, err := json.Marshal(v)
+				if err != nil {
+					return err
+				}
+				values[prefix+k] = string(b)
+			}
+		}
+		return nil
+	}
+	if err := flatten("", obj); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// parseYAML flattens the common subset of YAML used for config files:
+// nested mappings of scalars, quoted strings, comments, and literal (|) or
+// folded (>) block scalars. Nested keys are joined by /. Lists, anchors, and
+// flow collections aren't supported.
+func parseYAML(byt []byte) (map[string]string, error) {
+	type parent struct {
+		indent int
+		key    string
+	}
+	var stack []parent
+	values := map[string]string{}
+	lines := strings.Split(strings.Replace(string(byt), "\r\n", "\n", -1), "\n")
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") ||
+			trimmed == "---" {
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		if strings.HasPrefix(line[indent:], "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed", i+1)
+		}
+		if strings.HasPrefix(trimmed, "- ") || trimmed == "-" {
+			return nil, fmt.Errorf("line %d: lists are not supported", i+1)
+		}
+		key, val, err := splitYAMLLine(trimmed)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		for len(stack) > 0 && stack[len(stack)-1].indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+		var path string
+		for _, p := range stack {
+			path += p.key + "/"
+		}
+		path += key
+
+		switch {
+		case val == "":
+			stack = append(stack, parent{indent: indent, key: key})
+		case val == "~" || val == "null":
+			// Skip nulls, as with JSON
+		case val[0] == '|' || val[0] == '>':
+			var block []string
+			blockIndent := -1
+			for i+1 < len(lines) {
+				next := lines[i+1]
+				nextIndent := len(next) - len(strings.TrimLeft(next, " "))
+				if strings.TrimSpace(next) != "" && nextIndent <= indent {
+					break
+				}
+				i++
+				if blockIndent == -1 && strings.TrimSpace(next) != "" {
+					blockIndent = nextIndent
+				}
+				if len(next) >= blockIndent && blockIndent >= 0 {
+					next = next[blockIndent:]
+				} else {
+					next = strings.TrimSpace(next)
+				}
+				block = append(block, next)
+			}
+			for len(block) > 0 && block[len(block)-1] == "" {
+				block = block[:len(block)-1]
+			}
+			sep := "\n"
+			if val[0] == '>' {
+				sep = " "
+			}
+			s := strings.Join(block, sep)
+			if !strings.HasSuffix(val, "-") {
+				s += "\n"
+			}
+			values[path] = s
+		default:
+			values[path], err = yamlScalar(val)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", i+1, err)
+			}
+		}
+	}
+	return values, nil
+}
+
+// splitYAMLLine splits `key: value` into its unquoted key and raw value.
+func splitYAMLLine(line string) (string, string, error) {
+	var key string
+	if line[0] == '"' || line[0] == '\'' {
+		end := strings.IndexByte(line[1:], line[0])
+		if end == -1 {
+			return "", "", errors.New("unterminated key")
+		}
+		key, line = line[1:end+1], line[end+2:]
+		if !strings.HasPrefix(line, ":") {
+			return "", "", errors.New("expected key: value")
+		}
+		return key, strings.TrimSpace(line[1:]), nil
+	}
+	i := strings.Index(line, ": ")
+	switch {
+	case i >= 0:
+		return line[:i], strings.TrimSpace(line[i+2:]), nil
+	case strings.HasSuffix(line, ":"):
+		return line[:len(line)-1], "", nil
+	}
+	return "", "", errors.New("expected key: value")
+}
+
+// yamlScalar unquotes a scalar value and strips trailing comments.
+func yamlScalar(val string) (string, error) {
+	switch val[0] {
+	case '"':
+		end := strings.LastIndexByte(val, '"')
+		if end == 0 {
+			return "", errors.New("unterminated string")
+		}
+		return strconv.Unquote(val[:end+1])
+	case '\'':
+		end := strings.LastIndexByte(val, '\'')
+		if end == 0 {
+			return "", errors.New("unterminated string")
+		}
+		return strings.Replace(val[1:end], "''", "'", -1), nil
+	case '[', '{', '&', '*':
+		return "", errors.New("flow collections, anchors, and aliases are not supported")
+	}
+	if i := strings.Index(val, " #"); i >= 0 {
+		val = strings.TrimSpace(val[:i])
+	}
+	return val, nil
+}
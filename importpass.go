@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// importPass creates secrets from a pass password store, decrypting each
+// .gpg file with gpg. Directories become path prefixes, so
+// `work/github.gpg` becomes the secret `work/github`.
+func importPass(args []string) error {
+	fs := flag.NewFlagSet("import-pass", flag.ContinueOnError)
+	firstLine := fs.Bool("first-line", false,
+		"import only the first line, which pass treats as the password")
+	var opts importOptions
+	opts.flags(fs)
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	var dir string
+	switch len(args) {
+	case 0:
+		dir = os.Getenv("PASSWORD_STORE_DIR")
+		if dir == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return fmt.Errorf("home dir: %w", err)
+			}
+			dir = filepath.Join(home, ".password-store")
+		}
+	case 1:
+		dir = args[0]
+	default:
+		return errors.New("bad args: expected `import-pass [$dir]`")
+	}
+
+	const (
+		promises     = "stdio rpath wpath cpath tty proc exec inet dns"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	configPath, err := getConfigPath()
+	if err != nil {
+		return err
+	}
+	user, err := getUser(configPath)
+	if err != nil {
+		return fmt.Errorf("get user: %w", err)
+	}
+	shh, err := shhFromPath(".shh")
+	if err != nil {
+		return err
+	}
+	gpg, err := exec.LookPath("gpg")
+	if err != nil {
+		return errors.New("gpg not found")
+	}
+
+	files, err := passFiles(dir)
+	if err != nil {
+		return err
+	}
+
+	// Preview before decrypting anything, since gpg may prompt
+	values := make(map[string]string, len(files))
+	for name := range files {
+		values[name] = ""
+	}
+	if opts.DryRun {
+		return addImported(shh, user.Username, values, opts)
+	}
+	for name, pth := range files {
+		plaintext, err := gpgDecrypt(gpg, pth)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if *firstLine {
+			if i := bytes.IndexByte(plaintext, '\n'); i >= 0 {
+				plaintext = plaintext[:i]
+			}
+		}
+		values[name] = string(plaintext)
+		wipe(plaintext)
+	}
+	return addImported(shh, user.Username, values, opts)
+}
+
+// passFiles maps secret names to the .gpg files in a password store,
+// skipping hidden files and directories such as .git.
+func passFiles(dir string) (map[string]string, error) {
+	files := map[string]string{}
+	err := filepath.Walk(dir, func(pth string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if pth != dir && strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() || filepath.Ext(pth) != ".gpg" {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, pth)
+		if err != nil {
+			return err
+		}
+		files[strings.TrimSuffix(filepath.ToSlash(rel), ".gpg")] = pth
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("walk %s: %w", dir, err)
+	}
+	return files, nil
+}
+
+func gpgDecrypt(gpg, pth string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(gpg, "--quiet", "--decrypt", pth)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("gpg: %s", msg)
+		}
+		return nil, fmt.Errorf("gpg: %w", err)
+	}
+	return stdout.Bytes(), nil
+}
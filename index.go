@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// secretIndex lists each user's secret names, so commands which only need
+// names, such as show, don't decode every secret. It's a local cache kept
+// with the backups, never committed, and only used while Sum matches the
+// project file. Sealed projects aren't indexed, since that would reveal their
+// secret names.
+type secretIndex struct {
+	Sum   string                `json:"sum"`
+	Users map[username][]string `json:"users"`
+}
+
+func indexPath(shhPath string) string {
+	return filepath.Join(backupDirFor(shhPath), "index.json")
+}
+
+func indexSum(byt []byte) string {
+	sum := sha256.Sum256(byt)
+	return hex.EncodeToString(sum[:])
+}
+
+// loadIndex for the project file with the given sum, or nil if there's none
+// or it's out of date.
+func loadIndex(shhPath, sum string) *secretIndex {
+	byt, err := ioutil.ReadFile(indexPath(shhPath))
+	if err != nil {
+		return nil
+	}
+	idx := &secretIndex{}
+	if err = json.Unmarshal(byt, idx); err != nil || idx.Sum != sum {
+		return nil
+	}
+	return idx
+}
+
+// save the index. It's only a cache, so callers may ignore errors.
+func (idx *secretIndex) save(shhPath string) error {
+	pth := indexPath(shhPath)
+	if err := os.MkdirAll(filepath.Dir(pth), 0700); err != nil {
+		return err
+	}
+	byt, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(pth, byt, 0600)
+}
+
+// indexable reports whether the project's names may be cached on disk.
+func (s *shh) indexable() bool {
+	return s.sealKey == nil && s.store == nil && !s.binary
+}
+
+// userNames returns the user's sorted secret names, whether or not their
+// secrets were decoded.
+func (s *shh) userNames(u username) []string {
+	if secrets, ok := s.Secrets[u]; ok {
+		return sortedSecretNames(secrets)
+	}
+	return s.encodedNames[u]
+}
+
+// buildIndex from the project as it is now.
+func (s *shh) buildIndex(sum string) *secretIndex {
+	idx := &secretIndex{Sum: sum, Users: map[username][]string{}}
+	for u := range s.Secrets {
+		idx.Users[u] = s.userNames(u)
+	}
+	for u := range s.encoded {
+		idx.Users[u] = s.userNames(u)
+	}
+	return idx
+}
+
+// sameIndex reports whether two indexes list the same names.
+func sameIndex(a, b *secretIndex) bool {
+	if len(a.Users) != len(b.Users) {
+		return false
+	}
+	for u, names := range a.Users {
+		other, ok := b.Users[u]
+		if !ok || len(names) != len(other) {
+			return false
+		}
+		sorted := append([]string(nil), other...)
+		sort.Strings(sorted)
+		for i := range names {
+			if names[i] != sorted[i] {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// jweHeader is the protected header of a JWE compact token. shh only emits
+// RSA-OAEP-256 key wrapping with A256GCM content encryption, which is
+// supported by every mainstream JOSE library.
+type jweHeader struct {
+	Alg string `json:"alg"`
+	Enc string `json:"enc"`
+}
+
+// encodeJWE encrypts plaintext to the recipient's public key, returning a JWE
+// compact serialization as described in RFC 7516.
+func encodeJWE(pubKey *rsa.PublicKey, plaintext []byte) (string, error) {
+	hdr, err := json.Marshal(jweHeader{Alg: "RSA-OAEP-256", Enc: "A256GCM"})
+	if err != nil {
+		return "", fmt.Errorf("marshal header: %w", err)
+	}
+	b64 := base64.RawURLEncoding
+	protected := b64.EncodeToString(hdr)
+
+	// Generate a content encryption key and wrap it for the recipient
+	cek := make([]byte, 32)
+	if _, err = rand.Read(cek); err != nil {
+		return "", err
+	}
+	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader,
+		pubKey, cek, nil)
+	if err != nil {
+		return "", fmt.Errorf("wrap key: %w", err)
+	}
+
+	// Encrypt the content. The protected header is authenticated as
+	// additional data
+	aesBlock, err := aes.NewCipher(cek)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(aesBlock)
+	if err != nil {
+		return "", err
+	}
+	iv := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, iv); err != nil {
+		return "", fmt.Errorf("read iv: %w", err)
+	}
+	sealed := gcm.Seal(nil, iv, plaintext, []byte(protected))
+	ciphertext := sealed[:len(sealed)-gcm.Overhead()]
+	tag := sealed[len(sealed)-gcm.Overhead():]
+
+	return strings.Join([]string{
+		protected,
+		b64.EncodeToString(encryptedKey),
+		b64.EncodeToString(iv),
+		b64.EncodeToString(ciphertext),
+		b64.EncodeToString(tag),
+	}, "."), nil
+}
+
+// publicKeyFromFile reads an RSA public key in either PKCS#1 ("RSA PUBLIC
+// KEY", as generated by shh) or PKIX ("PUBLIC KEY") PEM format.
+func publicKeyFromFile(pth string) (*rsa.PublicKey, error) {
+	byt, err := ioutil.ReadFile(pth)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(byt)
+	if block == nil {
+		return nil, errors.New("failed to decode pem block for public key")
+	}
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse public key: %w", err)
+		}
+		pubKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.New("public key is not rsa")
+		}
+		return pubKey, nil
+	default:
+		return nil, fmt.Errorf("unsupported pem block type %q", block.Type)
+	}
+}
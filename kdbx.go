@@ -0,0 +1,1192 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/salsa20/salsa"
+)
+
+// KeePass database format. KDBX 3.1 and 4 are read, and KDBX 4 is written.
+// See https://keepass.info/help/kb/kdbx_4.html.
+const (
+	kdbxSignature1 = 0x9AA2D903
+	kdbxSignature2 = 0xB54BFB67
+
+	// Outer header fields
+	kdbxEndOfHeader         = 0
+	kdbxCipherID            = 2
+	kdbxCompressionFlags    = 3
+	kdbxMasterSeed          = 4
+	kdbxTransformSeed       = 5
+	kdbxTransformRounds     = 6
+	kdbxEncryptionIV        = 7
+	kdbxProtectedStreamKey  = 8
+	kdbxStreamStartBytes    = 9
+	kdbxInnerRandomStreamID = 10
+	kdbxKDFParameters       = 11
+
+	// Inner header fields, KDBX 4 only
+	kdbxInnerEnd       = 0
+	kdbxInnerStreamID  = 1
+	kdbxInnerStreamKey = 2
+
+	// Inner random streams, which encrypt protected values in the XML
+	kdbxStreamSalsa20  = 2
+	kdbxStreamChaCha20 = 3
+
+	// Variant dictionary value types
+	kdbxVariantUint32    = 0x04
+	kdbxVariantUint64    = 0x05
+	kdbxVariantByteArray = 0x42
+
+	// kdbxBlockSize is the size of HMAC blocks written.
+	kdbxBlockSize = 1 << 20
+)
+
+var (
+	kdbxCipherAES      = mustDecodeHex("31c1f2e6bf714350be5805216afc5aff")
+	kdbxCipherChaCha20 = mustDecodeHex("d6038a2b8b6f4cb5a524339a31dbb59a")
+	kdbxKDFAES         = mustDecodeHex("c9d9f39a628a4460bf740d08c18a4fea")
+	kdbxKDFArgon2d     = mustDecodeHex("ef636ddf8c29444b91f7a9a403e30a0c")
+	kdbxKDFArgon2id    = mustDecodeHex("9e298b1956db4773b23dfc3ec6f0a1e6")
+
+	kdbxSalsa20Nonce = []byte{0xE8, 0x30, 0x09, 0x4B, 0x97, 0x20, 0x5D, 0x2A}
+)
+
+var errKDBXKey = errors.New("wrong keepass password or key file")
+
+func mustDecodeHex(s string) []byte {
+	byt, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return byt
+}
+
+// kdbxHeader holds the outer header fields needed to decrypt a database.
+type kdbxHeader struct {
+	major      uint16
+	cipherID   []byte
+	compressed bool
+	masterSeed []byte
+	iv         []byte
+
+	// KDBX 4
+	kdf map[string][]byte
+
+	// KDBX 3.1
+	transformSeed   []byte
+	transformRounds uint64
+	streamKey       []byte
+	streamStart     []byte
+	streamID        uint32
+}
+
+// kdbxCompositeKey combines the password and optional key file contents into
+// the database's composite key.
+func kdbxCompositeKey(password, keyFile []byte) ([]byte, error) {
+	h := sha256.New()
+	if len(password) > 0 || keyFile == nil {
+		sum := sha256.Sum256(password)
+		h.Write(sum[:])
+	}
+	if keyFile != nil {
+		key, err := kdbxKeyFileKey(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("key file: %w", err)
+		}
+		h.Write(key)
+	}
+	return h.Sum(nil), nil
+}
+
+// kdbxKeyFileKey reads an XML key file, a 32-byte or hex-encoded key, or
+// hashes any other file.
+func kdbxKeyFileKey(byt []byte) ([]byte, error) {
+	var kf struct {
+		Meta struct {
+			Version string `xml:"Version"`
+		} `xml:"Meta"`
+		Key struct {
+			Data string `xml:"Data"`
+		} `xml:"Key"`
+	}
+	if xml.Unmarshal(byt, &kf) == nil && kf.Key.Data != "" {
+		if strings.HasPrefix(kf.Meta.Version, "2.") {
+			return hex.DecodeString(strings.Join(strings.Fields(kf.Key.Data), ""))
+		}
+		return base64.StdEncoding.DecodeString(strings.TrimSpace(kf.Key.Data))
+	}
+	if len(byt) == 32 {
+		return byt, nil
+	}
+	if len(byt) == 64 {
+		if key, err := hex.DecodeString(string(byt)); err == nil {
+			return key, nil
+		}
+	}
+	sum := sha256.Sum256(byt)
+	return sum[:], nil
+}
+
+// readKDBX decrypts a KeePass database, returning its entries as items.
+// Groups become folders, excluding the root group and the recycle bin.
+func readKDBX(byt, compositeKey []byte) ([]managerItem, error) {
+	if len(byt) < 12 ||
+		binary.LittleEndian.Uint32(byt[0:]) != kdbxSignature1 ||
+		binary.LittleEndian.Uint32(byt[4:]) != kdbxSignature2 {
+		return nil, errors.New("not a keepass database")
+	}
+	hdr := &kdbxHeader{major: binary.LittleEndian.Uint16(byt[10:])}
+	if hdr.major != 3 && hdr.major != 4 {
+		return nil, fmt.Errorf("unsupported kdbx version %d", hdr.major)
+	}
+	n, err := hdr.parse(byt[12:])
+	if err != nil {
+		return nil, fmt.Errorf("header: %w", err)
+	}
+	headerBytes, rest := byt[:12+n], byt[12+n:]
+
+	transformed, err := hdr.transformKey(compositeKey)
+	if err != nil {
+		return nil, err
+	}
+	masterKey := sha256.Sum256(concat(hdr.masterSeed, transformed))
+
+	var payload []byte
+	if hdr.major == 4 {
+		payload, err = readKDBX4Blocks(hdr, headerBytes, rest, transformed, masterKey[:])
+	} else {
+		payload, err = readKDBX3Blocks(hdr, rest, masterKey[:])
+	}
+	if err != nil {
+		return nil, err
+	}
+	if hdr.compressed {
+		zr, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, fmt.Errorf("gzip: %w", err)
+		}
+		payload, err = ioutil.ReadAll(zr)
+		if err != nil {
+			return nil, fmt.Errorf("gzip: %w", err)
+		}
+	}
+
+	streamID, streamKey := hdr.streamID, hdr.streamKey
+	if hdr.major == 4 {
+		streamID, streamKey, payload, err = parseKDBXInnerHeader(payload)
+		if err != nil {
+			return nil, fmt.Errorf("inner header: %w", err)
+		}
+	}
+	stream, err := newKDBXStream(streamID, streamKey)
+	if err != nil {
+		return nil, err
+	}
+	return parseKDBXML(payload, stream)
+}
+
+// parse the outer header fields, returning the number of bytes read.
+func (hdr *kdbxHeader) parse(byt []byte) (int, error) {
+	sizeLen := 2
+	if hdr.major == 4 {
+		sizeLen = 4
+	}
+	pos := 0
+	for {
+		if len(byt) < pos+1+sizeLen {
+			return 0, io.ErrUnexpectedEOF
+		}
+		id := byt[pos]
+		var size int
+		if sizeLen == 2 {
+			size = int(binary.LittleEndian.Uint16(byt[pos+1:]))
+		} else {
+			size = int(binary.LittleEndian.Uint32(byt[pos+1:]))
+		}
+		pos += 1 + sizeLen
+		if size < 0 || len(byt) < pos+size {
+			return 0, io.ErrUnexpectedEOF
+		}
+		data := byt[pos : pos+size]
+		pos += size
+		switch id {
+		case kdbxEndOfHeader:
+			if hdr.cipherID == nil || len(hdr.masterSeed) != 32 {
+				return 0, errors.New("missing fields")
+			}
+			return pos, nil
+		case kdbxCipherID:
+			hdr.cipherID = data
+		case kdbxCompressionFlags:
+			if len(data) != 4 {
+				return 0, errors.New("bad compression flags")
+			}
+			hdr.compressed = binary.LittleEndian.Uint32(data) == 1
+		case kdbxMasterSeed:
+			hdr.masterSeed = data
+		case kdbxTransformSeed:
+			hdr.transformSeed = data
+		case kdbxTransformRounds:
+			if len(data) != 8 {
+				return 0, errors.New("bad transform rounds")
+			}
+			hdr.transformRounds = binary.LittleEndian.Uint64(data)
+		case kdbxEncryptionIV:
+			hdr.iv = data
+		case kdbxProtectedStreamKey:
+			hdr.streamKey = data
+		case kdbxStreamStartBytes:
+			hdr.streamStart = data
+		case kdbxInnerRandomStreamID:
+			if len(data) != 4 {
+				return 0, errors.New("bad stream id")
+			}
+			hdr.streamID = binary.LittleEndian.Uint32(data)
+		case kdbxKDFParameters:
+			var err error
+			if hdr.kdf, err = parseKDBXVariants(data); err != nil {
+				return 0, fmt.Errorf("kdf parameters: %w", err)
+			}
+		}
+	}
+}
+
+// parseKDBXVariants parses a variant dictionary, keeping the raw values.
+func parseKDBXVariants(byt []byte) (map[string][]byte, error) {
+	if len(byt) < 2 || byt[1] != 0x01 {
+		return nil, errors.New("unsupported version")
+	}
+	vars := map[string][]byte{}
+	pos := 2
+	for pos < len(byt) {
+		typ := byt[pos]
+		pos++
+		if typ == 0 {
+			return vars, nil
+		}
+		var fields [2][]byte
+		for i := range fields {
+			if len(byt) < pos+4 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			size := int(binary.LittleEndian.Uint32(byt[pos:]))
+			pos += 4
+			if size < 0 || len(byt) < pos+size {
+				return nil, io.ErrUnexpectedEOF
+			}
+			fields[i] = byt[pos : pos+size]
+			pos += size
+		}
+		vars[string(fields[0])] = fields[1]
+	}
+	return nil, io.ErrUnexpectedEOF
+}
+
+// transformKey runs the composite key through the database's KDF.
+func (hdr *kdbxHeader) transformKey(compositeKey []byte) ([]byte, error) {
+	if hdr.major == 3 {
+		return kdbxAESKDF(compositeKey, hdr.transformSeed, hdr.transformRounds)
+	}
+	uint32Param := func(key string) (uint32, error) {
+		if v := hdr.kdf[key]; len(v) == 4 {
+			return binary.LittleEndian.Uint32(v), nil
+		}
+		return 0, fmt.Errorf("kdf parameter %s missing", key)
+	}
+	uint64Param := func(key string) (uint64, error) {
+		if v := hdr.kdf[key]; len(v) == 8 {
+			return binary.LittleEndian.Uint64(v), nil
+		}
+		return 0, fmt.Errorf("kdf parameter %s missing", key)
+	}
+	switch uuid := hdr.kdf["$UUID"]; {
+	case bytes.Equal(uuid, kdbxKDFAES):
+		rounds, err := uint64Param("R")
+		if err != nil {
+			return nil, err
+		}
+		return kdbxAESKDF(compositeKey, hdr.kdf["S"], rounds)
+	case bytes.Equal(uuid, kdbxKDFArgon2id):
+		iterations, err := uint64Param("I")
+		if err != nil {
+			return nil, err
+		}
+		memory, err := uint64Param("M")
+		if err != nil {
+			return nil, err
+		}
+		parallelism, err := uint32Param("P")
+		if err != nil {
+			return nil, err
+		}
+		version, err := uint32Param("V")
+		if err != nil {
+			return nil, err
+		}
+		if version != argon2.Version {
+			return nil, fmt.Errorf("unsupported argon2 version %#x", version)
+		}
+		if len(hdr.kdf["K"]) > 0 || len(hdr.kdf["A"]) > 0 {
+			return nil, errors.New("argon2 secret keys aren't supported")
+		}
+		if iterations > 1<<32-1 || memory/1024 > 1<<32-1 || parallelism > 255 {
+			return nil, errors.New("argon2 parameters out of range")
+		}
+		return argon2.IDKey(compositeKey, hdr.kdf["S"], uint32(iterations),
+			uint32(memory/1024), uint8(parallelism), 32), nil
+	case bytes.Equal(uuid, kdbxKDFArgon2d):
+		return nil, errors.New("argon2d isn't supported. change the key derivation function to argon2id or aes-kdf in keepass")
+	default:
+		return nil, errors.New("unknown key derivation function")
+	}
+}
+
+// kdbxAESKDF encrypts the key with AES-256 for the given number of rounds.
+func kdbxAESKDF(key, seed []byte, rounds uint64) ([]byte, error) {
+	if len(seed) != 32 {
+		return nil, errors.New("bad transform seed")
+	}
+	block, err := aes.NewCipher(seed)
+	if err != nil {
+		return nil, err
+	}
+	out := append([]byte(nil), key...)
+	for i := uint64(0); i < rounds; i++ {
+		block.Encrypt(out[:16], out[:16])
+		block.Encrypt(out[16:], out[16:])
+	}
+	sum := sha256.Sum256(out)
+	return sum[:], nil
+}
+
+// kdbxBlockKey derives the HMAC key for a block. The header uses index
+// 2^64-1.
+func kdbxBlockKey(hmacKey []byte, index uint64) []byte {
+	var idx [8]byte
+	binary.LittleEndian.PutUint64(idx[:], index)
+	sum := sha512.Sum512(concat(idx[:], hmacKey))
+	return sum[:]
+}
+
+func kdbxBlockHMAC(hmacKey []byte, index uint64, data []byte) []byte {
+	mac := hmac.New(sha256.New, kdbxBlockKey(hmacKey, index))
+	var buf [12]byte
+	binary.LittleEndian.PutUint64(buf[0:], index)
+	binary.LittleEndian.PutUint32(buf[8:], uint32(len(data)))
+	mac.Write(buf[:])
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// readKDBX4Blocks verifies the header and each HMAC block, returning the
+// decrypted payload.
+func readKDBX4Blocks(hdr *kdbxHeader, headerBytes, rest, transformed, masterKey []byte) ([]byte, error) {
+	if len(rest) < 64 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	sum := sha256.Sum256(headerBytes)
+	if !bytes.Equal(sum[:], rest[:32]) {
+		return nil, errors.New("header is corrupt")
+	}
+	hmacKey := sha512.Sum512(concat(hdr.masterSeed, transformed, []byte{1}))
+	if !hmac.Equal(kdbxBlockHMAC(hmacKey[:], ^uint64(0), headerBytes), rest[32:64]) {
+		return nil, errKDBXKey
+	}
+	rest = rest[64:]
+
+	var ciphertext []byte
+	for index := uint64(0); ; index++ {
+		if len(rest) < 36 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		size := int(binary.LittleEndian.Uint32(rest[32:]))
+		if size < 0 || len(rest) < 36+size {
+			return nil, io.ErrUnexpectedEOF
+		}
+		data := rest[36 : 36+size]
+		if !hmac.Equal(kdbxBlockHMAC(hmacKey[:], index, data), rest[:32]) {
+			return nil, fmt.Errorf("block %d is corrupt", index)
+		}
+		rest = rest[36+size:]
+		if size == 0 {
+			break
+		}
+		ciphertext = append(ciphertext, data...)
+	}
+	return kdbxDecrypt(hdr, masterKey, ciphertext)
+}
+
+// readKDBX3Blocks decrypts the payload and reads its hashed blocks.
+func readKDBX3Blocks(hdr *kdbxHeader, rest, masterKey []byte) ([]byte, error) {
+	plaintext, err := kdbxDecrypt(hdr, masterKey, rest)
+	if err != nil {
+		return nil, err
+	}
+	if len(plaintext) < 32 || !bytes.Equal(plaintext[:32], hdr.streamStart) {
+		return nil, errKDBXKey
+	}
+	rest = plaintext[32:]
+
+	var payload []byte
+	for {
+		if len(rest) < 40 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		hash := rest[4:36]
+		size := int(binary.LittleEndian.Uint32(rest[36:]))
+		if size < 0 || len(rest) < 40+size {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if size == 0 {
+			return payload, nil
+		}
+		data := rest[40 : 40+size]
+		if sum := sha256.Sum256(data); !bytes.Equal(sum[:], hash) {
+			return nil, errors.New("block is corrupt")
+		}
+		payload = append(payload, data...)
+		rest = rest[40+size:]
+	}
+}
+
+func kdbxDecrypt(hdr *kdbxHeader, key, ciphertext []byte) ([]byte, error) {
+	switch {
+	case bytes.Equal(hdr.cipherID, kdbxCipherAES):
+		if len(hdr.iv) != aes.BlockSize || len(ciphertext)%aes.BlockSize != 0 ||
+			len(ciphertext) == 0 {
+			return nil, errors.New("bad ciphertext")
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		plaintext := make([]byte, len(ciphertext))
+		cipher.NewCBCDecrypter(block, hdr.iv).CryptBlocks(plaintext, ciphertext)
+		pad := int(plaintext[len(plaintext)-1])
+		if pad == 0 || pad > aes.BlockSize {
+			return nil, errKDBXKey
+		}
+		return plaintext[:len(plaintext)-pad], nil
+	case bytes.Equal(hdr.cipherID, kdbxCipherChaCha20):
+		c, err := chacha20.NewUnauthenticatedCipher(key, hdr.iv)
+		if err != nil {
+			return nil, err
+		}
+		plaintext := make([]byte, len(ciphertext))
+		c.XORKeyStream(plaintext, ciphertext)
+		return plaintext, nil
+	}
+	return nil, errors.New("unsupported cipher. use aes or chacha20")
+}
+
+// parseKDBXInnerHeader returns the inner random stream and the XML which
+// follows the header.
+func parseKDBXInnerHeader(byt []byte) (uint32, []byte, []byte, error) {
+	var streamID uint32
+	var streamKey []byte
+	for {
+		if len(byt) < 5 {
+			return 0, nil, nil, io.ErrUnexpectedEOF
+		}
+		id := byt[0]
+		size := int(binary.LittleEndian.Uint32(byt[1:]))
+		if size < 0 || len(byt) < 5+size {
+			return 0, nil, nil, io.ErrUnexpectedEOF
+		}
+		data := byt[5 : 5+size]
+		byt = byt[5+size:]
+		switch id {
+		case kdbxInnerEnd:
+			return streamID, streamKey, byt, nil
+		case kdbxInnerStreamID:
+			if len(data) != 4 {
+				return 0, nil, nil, errors.New("bad stream id")
+			}
+			streamID = binary.LittleEndian.Uint32(data)
+		case kdbxInnerStreamKey:
+			streamKey = data
+		}
+	}
+}
+
+// newKDBXStream creates the inner random stream for protected values.
+func newKDBXStream(id uint32, key []byte) (cipher.Stream, error) {
+	switch id {
+	case kdbxStreamChaCha20:
+		h := sha512.Sum512(key)
+		return chacha20.NewUnauthenticatedCipher(h[:32], h[32:44])
+	case kdbxStreamSalsa20:
+		s := &salsaStream{key: sha256.Sum256(key)}
+		copy(s.counter[:8], kdbxSalsa20Nonce)
+		return s, nil
+	}
+	return nil, fmt.Errorf("unsupported inner stream %d", id)
+}
+
+// salsaStream is a Salsa20 cipher.Stream which, unlike the salsa20 package,
+// continues the keystream across calls.
+type salsaStream struct {
+	key     [32]byte
+	counter [16]byte
+	buf     []byte
+}
+
+func (s *salsaStream) XORKeyStream(dst, src []byte) {
+	for i := range src {
+		if len(s.buf) == 0 {
+			s.buf = make([]byte, 64)
+			salsa.XORKeyStream(s.buf, s.buf, &s.counter, &s.key)
+			binary.LittleEndian.PutUint64(s.counter[8:],
+				binary.LittleEndian.Uint64(s.counter[8:])+1)
+		}
+		dst[i] = src[i] ^ s.buf[0]
+		s.buf = s.buf[1:]
+	}
+}
+
+// parseKDBXML reads entries from the database XML. Protected values are
+// decrypted with the stream in document order, including those in entry
+// history and the recycle bin, which are otherwise skipped.
+func parseKDBXML(byt []byte, stream cipher.Stream) ([]managerItem, error) {
+	type group struct {
+		name string
+		skip bool
+	}
+	var (
+		items      []managerItem
+		stack      []string
+		groups     []group
+		entry      *managerItem
+		key        string
+		recycleBin string
+		history    int
+	)
+	dec := xml.NewDecoder(bytes.NewReader(byt))
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return items, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("xml: %w", err)
+		}
+		parent := ""
+		if len(stack) > 0 {
+			parent = stack[len(stack)-1]
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			switch tok.Name.Local {
+			case "RecycleBinUUID", "UUID", "Name", "Key":
+				var text string
+				if err = dec.DecodeElement(&text, &tok); err != nil {
+					return nil, fmt.Errorf("xml: %w", err)
+				}
+				switch {
+				case tok.Name.Local == "RecycleBinUUID" && parent == "Meta":
+					if text != "AAAAAAAAAAAAAAAAAAAAAA==" {
+						recycleBin = text
+					}
+				case tok.Name.Local == "UUID" && parent == "Group":
+					g := &groups[len(groups)-1]
+					g.skip = g.skip || (text != "" && text == recycleBin)
+				case tok.Name.Local == "Name" && parent == "Group":
+					groups[len(groups)-1].name = text
+				case tok.Name.Local == "Key" && parent == "String":
+					key = text
+				}
+				continue
+			case "Value":
+				if parent != "String" {
+					break
+				}
+				var val struct {
+					Protected string `xml:"Protected,attr"`
+					Text      string `xml:",chardata"`
+				}
+				if err = dec.DecodeElement(&val, &tok); err != nil {
+					return nil, fmt.Errorf("xml: %w", err)
+				}
+				text := val.Text
+				if strings.EqualFold(val.Protected, "true") {
+					ct, err := base64.StdEncoding.DecodeString(val.Text)
+					if err != nil {
+						return nil, fmt.Errorf("protected value: %w", err)
+					}
+					stream.XORKeyStream(ct, ct)
+					text = string(ct)
+				}
+				if entry != nil && history == 0 {
+					entry.Fields[key] = text
+				}
+				continue
+			case "Group":
+				skip := len(groups) > 0 && groups[len(groups)-1].skip
+				groups = append(groups, group{skip: skip})
+			case "Entry":
+				if history == 0 {
+					entry = &managerItem{Fields: map[string]string{}}
+				}
+			case "History":
+				history++
+			}
+			stack = append(stack, tok.Name.Local)
+		case xml.EndElement:
+			if len(stack) == 0 {
+				return nil, errors.New("xml: unbalanced elements")
+			}
+			stack = stack[:len(stack)-1]
+			switch tok.Name.Local {
+			case "Group":
+				groups = groups[:len(groups)-1]
+			case "History":
+				history--
+			case "Entry":
+				if history > 0 || entry == nil {
+					break
+				}
+				if len(groups) > 0 && !groups[len(groups)-1].skip {
+					var folder []string
+					for _, g := range groups[1:] {
+						folder = append(folder, g.name)
+					}
+					items = append(items, kdbxItem(strings.Join(folder, "/"), entry.Fields))
+				}
+				entry = nil
+			}
+		}
+	}
+}
+
+// kdbxFields maps KeePass's standard string fields to item fields.
+var kdbxFields = map[string]string{
+	"UserName": "username",
+	"Password": "password",
+	"URL":      "url",
+	"Notes":    "notes",
+	"otp":      "totp",
+}
+
+// kdbxKeys is the inverse of kdbxFields.
+var kdbxKeys = func() map[string]string {
+	keys := make(map[string]string, len(kdbxFields))
+	for k, field := range kdbxFields {
+		keys[field] = k
+	}
+	return keys
+}()
+
+// kdbxItem converts an entry's strings to an item.
+func kdbxItem(folder string, strs map[string]string) managerItem {
+	item := managerItem{
+		Folder: folder,
+		Name:   strings.TrimSpace(strs["Title"]),
+		Fields: map[string]string{},
+	}
+	if item.Name == "" {
+		item.Name = "untitled"
+	}
+	for k, v := range strs {
+		if k == "Title" {
+			continue
+		}
+		if field, ok := kdbxFields[k]; ok {
+			k = field
+		}
+		item.Fields[k] = v
+	}
+	return item
+}
+
+// XML written to KDBX 4 databases. Entries precede subgroups, which fixes the
+// order protected values are encrypted in.
+type (
+	kdbxXMLFile struct {
+		XMLName xml.Name `xml:"KeePassFile"`
+		Meta    struct {
+			Generator        string
+			DatabaseName     string
+			MemoryProtection struct {
+				ProtectPassword string
+			}
+		}
+		Root struct {
+			Group          kdbxXMLGroup
+			DeletedObjects struct{}
+		}
+	}
+	kdbxXMLGroup struct {
+		UUID    string
+		Name    string
+		IconID  int
+		Entries []kdbxXMLEntry `xml:"Entry"`
+		Groups  []kdbxXMLGroup `xml:"Group"`
+	}
+	kdbxXMLEntry struct {
+		UUID    string
+		IconID  int
+		Strings []kdbxXMLString `xml:"String"`
+	}
+	kdbxXMLString struct {
+		Key   string
+		Value struct {
+			Protected string `xml:"Protected,attr,omitempty"`
+			Text      string `xml:",chardata"`
+		}
+	}
+)
+
+// kdbxTree groups items by folder for writing.
+type kdbxTree struct {
+	groups map[string]*kdbxTree
+	items  []managerItem
+}
+
+// writeKDBX writes the items to a new KDBX 4 database using AES-256,
+// Argon2id, and gzip, with passwords protected by ChaCha20.
+func writeKDBX(w io.Writer, compositeKey []byte, items []managerItem) error {
+	random := func(n int) ([]byte, error) {
+		byt := make([]byte, n)
+		if _, err := rand.Read(byt); err != nil {
+			return nil, fmt.Errorf("read rand: %w", err)
+		}
+		return byt, nil
+	}
+	masterSeed, err := random(32)
+	if err != nil {
+		return err
+	}
+	iv, err := random(aes.BlockSize)
+	if err != nil {
+		return err
+	}
+	salt, err := random(32)
+	if err != nil {
+		return err
+	}
+	streamKey, err := random(64)
+	if err != nil {
+		return err
+	}
+
+	// Build the XML, encrypting passwords in document order
+	h := sha512.Sum512(streamKey)
+	stream, err := chacha20.NewUnauthenticatedCipher(h[:32], h[32:44])
+	if err != nil {
+		return err
+	}
+	root := &kdbxTree{groups: map[string]*kdbxTree{}}
+	for _, item := range items {
+		t := root
+		if item.Folder != "" {
+			for _, name := range strings.Split(item.Folder, "/") {
+				child, ok := t.groups[name]
+				if !ok {
+					child = &kdbxTree{groups: map[string]*kdbxTree{}}
+					t.groups[name] = child
+				}
+				t = child
+			}
+		}
+		t.items = append(t.items, item)
+	}
+	var doc kdbxXMLFile
+	doc.Meta.Generator = "shh"
+	doc.Meta.DatabaseName = "shh"
+	doc.Meta.MemoryProtection.ProtectPassword = "True"
+	doc.Root.Group, err = root.xml("Root", stream)
+	if err != nil {
+		return err
+	}
+	xmlBytes, err := xml.MarshalIndent(doc, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	// Inner header, then the XML, compressed and encrypted
+	var inner bytes.Buffer
+	writeKDBXField(&inner, kdbxInnerStreamID, uint32Bytes(kdbxStreamChaCha20))
+	writeKDBXField(&inner, kdbxInnerStreamKey, streamKey)
+	writeKDBXField(&inner, kdbxInnerEnd, nil)
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	for _, b := range [][]byte{inner.Bytes(), []byte(xml.Header), xmlBytes} {
+		if _, err = zw.Write(b); err != nil {
+			return err
+		}
+	}
+	if err = zw.Close(); err != nil {
+		return err
+	}
+	wipe(xmlBytes)
+
+	const (
+		argonIterations  = 10
+		argonMemory      = 64 << 20
+		argonParallelism = 2
+	)
+	var kdf bytes.Buffer
+	kdf.Write([]byte{0x00, 0x01})
+	writeKDBXVariant(&kdf, kdbxVariantByteArray, "$UUID", kdbxKDFArgon2id)
+	writeKDBXVariant(&kdf, kdbxVariantByteArray, "S", salt)
+	writeKDBXVariant(&kdf, kdbxVariantUint32, "P", uint32Bytes(argonParallelism))
+	writeKDBXVariant(&kdf, kdbxVariantUint64, "M", uint64Bytes(argonMemory))
+	writeKDBXVariant(&kdf, kdbxVariantUint64, "I", uint64Bytes(argonIterations))
+	writeKDBXVariant(&kdf, kdbxVariantUint32, "V", uint32Bytes(argon2.Version))
+	kdf.WriteByte(0)
+
+	var header bytes.Buffer
+	header.Write(uint32Bytes(kdbxSignature1))
+	header.Write(uint32Bytes(kdbxSignature2))
+	header.Write(uint32Bytes(4 << 16)) // 4.0
+	writeKDBXField(&header, kdbxCipherID, kdbxCipherAES)
+	writeKDBXField(&header, kdbxCompressionFlags, uint32Bytes(1))
+	writeKDBXField(&header, kdbxMasterSeed, masterSeed)
+	writeKDBXField(&header, kdbxEncryptionIV, iv)
+	writeKDBXField(&header, kdbxKDFParameters, kdf.Bytes())
+	writeKDBXField(&header, kdbxEndOfHeader, []byte("\r\n\r\n"))
+
+	transformed := argon2.IDKey(compositeKey, salt, argonIterations,
+		argonMemory/1024, argonParallelism, 32)
+	masterKey := sha256.Sum256(concat(masterSeed, transformed))
+	hmacKey := sha512.Sum512(concat(masterSeed, transformed, []byte{1}))
+
+	block, err := aes.NewCipher(masterKey[:])
+	if err != nil {
+		return err
+	}
+	pad := aes.BlockSize - compressed.Len()%aes.BlockSize
+	ciphertext := append(compressed.Bytes(), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, ciphertext)
+
+	var out bytes.Buffer
+	sum := sha256.Sum256(header.Bytes())
+	out.Write(header.Bytes())
+	out.Write(sum[:])
+	out.Write(kdbxBlockHMAC(hmacKey[:], ^uint64(0), header.Bytes()))
+	for index := uint64(0); ; index++ {
+		n := len(ciphertext)
+		if n > kdbxBlockSize {
+			n = kdbxBlockSize
+		}
+		out.Write(kdbxBlockHMAC(hmacKey[:], index, ciphertext[:n]))
+		out.Write(uint32Bytes(uint32(n)))
+		out.Write(ciphertext[:n])
+		ciphertext = ciphertext[n:]
+		if n == 0 {
+			break
+		}
+	}
+	_, err = w.Write(out.Bytes())
+	return err
+}
+
+// xml converts the tree to a group, encrypting passwords with the stream.
+func (t *kdbxTree) xml(name string, stream cipher.Stream) (kdbxXMLGroup, error) {
+	uuid := make([]byte, 16)
+	if _, err := rand.Read(uuid); err != nil {
+		return kdbxXMLGroup{}, fmt.Errorf("read rand: %w", err)
+	}
+	g := kdbxXMLGroup{
+		UUID:   base64.StdEncoding.EncodeToString(uuid),
+		Name:   name,
+		IconID: 48,
+	}
+	for _, item := range t.items {
+		e := kdbxXMLEntry{}
+		if _, err := rand.Read(uuid); err != nil {
+			return kdbxXMLGroup{}, fmt.Errorf("read rand: %w", err)
+		}
+		e.UUID = base64.StdEncoding.EncodeToString(uuid)
+
+		// Standard fields first, then custom fields by name
+		keys := []string{"Title", "UserName", "Password", "URL", "Notes", "otp"}
+		vals := map[string]string{"Title": item.Name}
+		var custom []string
+		for field, val := range item.Fields {
+			k, ok := kdbxKeys[field]
+			if !ok {
+				k = field
+				custom = append(custom, k)
+			}
+			vals[k] = val
+		}
+		sort.Strings(custom)
+		for _, k := range append(keys, custom...) {
+			val, ok := vals[k]
+			if !ok {
+				continue
+			}
+			if !kdbxText(val) {
+				return kdbxXMLGroup{}, fmt.Errorf("%s/%s: can't store binary values in keepass", item.Name, k)
+			}
+			s := kdbxXMLString{Key: k}
+			s.Value.Text = val
+			if k == "Password" {
+				ct := []byte(val)
+				stream.XORKeyStream(ct, ct)
+				s.Value.Protected = "True"
+				s.Value.Text = base64.StdEncoding.EncodeToString(ct)
+			}
+			e.Strings = append(e.Strings, s)
+		}
+		g.Entries = append(g.Entries, e)
+	}
+	names := make([]string, 0, len(t.groups))
+	for name := range t.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		child, err := t.groups[name].xml(name, stream)
+		if err != nil {
+			return kdbxXMLGroup{}, err
+		}
+		g.Groups = append(g.Groups, child)
+	}
+	return g, nil
+}
+
+// kdbxText reports whether the value can be stored in XML.
+func kdbxText(s string) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+	for _, r := range s {
+		if r < 0x20 && r != '\t' && r != '\n' && r != '\r' {
+			return false
+		}
+	}
+	return true
+}
+
+func writeKDBXField(buf *bytes.Buffer, id byte, data []byte) {
+	buf.WriteByte(id)
+	buf.Write(uint32Bytes(uint32(len(data))))
+	buf.Write(data)
+}
+
+func writeKDBXVariant(buf *bytes.Buffer, typ byte, key string, val []byte) {
+	buf.WriteByte(typ)
+	buf.Write(uint32Bytes(uint32(len(key))))
+	buf.WriteString(key)
+	buf.Write(uint32Bytes(uint32(len(val))))
+	buf.Write(val)
+}
+
+func uint32Bytes(n uint32) []byte {
+	byt := make([]byte, 4)
+	binary.LittleEndian.PutUint32(byt, n)
+	return byt
+}
+
+func uint64Bytes(n uint64) []byte {
+	byt := make([]byte, 8)
+	binary.LittleEndian.PutUint64(byt, n)
+	return byt
+}
+
+func concat(parts ...[]byte) []byte {
+	var out []byte
+	for _, p := range parts {
+		out = append(out, p...)
+	}
+	return out
+}
+
+// requestKDBXPassword from $SHH_KDBX_PASSWORD, or from the user if unset.
+// New databases confirm the password.
+func requestKDBXPassword(confirm bool) ([]byte, error) {
+	if pass := os.Getenv("SHH_KDBX_PASSWORD"); pass != "" {
+		return []byte(pass), nil
+	}
+	password, err := readPassword("keepass password")
+	if err != nil || !confirm {
+		return password, err
+	}
+	password2, err := readPassword("confirm keepass password")
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(password2)
+	if !bytes.Equal(password, password2) {
+		return nil, errors.New("passwords do not match")
+	}
+	return password, nil
+}
+
+// kdbxKey requests the password and reads the optional key file to form the
+// composite key.
+func kdbxKey(keyFile string, confirm bool) ([]byte, error) {
+	var keyFileBytes []byte
+	if keyFile != "" {
+		var err error
+		keyFileBytes, err = ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	password, err := requestKDBXPassword(confirm)
+	if err != nil {
+		return nil, fmt.Errorf("request password: %w", err)
+	}
+	defer wipe(password)
+	return kdbxCompositeKey(password, keyFileBytes)
+}
+
+// importKDBX creates secrets from a KeePass database. Groups become path
+// prefixes and each entry's fields become secrets, as with password manager
+// exports.
+func importKDBX(args []string) error {
+	fs := flag.NewFlagSet("import-kdbx", flag.ContinueOnError)
+	keyFile := fs.String("key-file", "", "keepass key file")
+	var opts importOptions
+	opts.flags(fs)
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return errors.New("bad args: expected `import-kdbx $file`")
+	}
+
+	const (
+		promises     = "stdio rpath wpath cpath tty proc exec inet dns"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	configPath, err := getConfigPath()
+	if err != nil {
+		return err
+	}
+	user, err := getUser(configPath)
+	if err != nil {
+		return fmt.Errorf("get user: %w", err)
+	}
+	shh, err := shhFromPath(".shh")
+	if err != nil {
+		return err
+	}
+	byt, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	key, err := kdbxKey(*keyFile, false)
+	if err != nil {
+		return err
+	}
+	defer wipe(key)
+	items, err := readKDBX(byt, key)
+	if err != nil {
+		return fmt.Errorf("read %s: %w", args[0], err)
+	}
+	values, err := managerValues(items)
+	if err != nil {
+		return err
+	}
+	return addImported(shh, user.Username, values, opts)
+}
+
+// exportKDBX writes the user's secrets to a new KeePass database, grouping
+// them as in `export`.
+func exportKDBX(nonInteractive bool, args []string) error {
+	fs := flag.NewFlagSet("export-kdbx", flag.ContinueOnError)
+	keyFile := fs.String("key-file", "", "keepass key file")
+	out := fs.String("o", "", "output file")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	glob := "*"
+	switch len(args) {
+	case 0:
+	case 1:
+		glob = args[0]
+	default:
+		return errors.New("bad args: expected `export-kdbx -o $file [$glob]`")
+	}
+	if *out == "" {
+		return errors.New("bad args: missing -o $file")
+	}
+
+	const (
+		promises     = "stdio rpath wpath cpath tty proc exec inet dns"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	configPath, err := getConfigPath()
+	if err != nil {
+		return err
+	}
+	user, err := getUser(configPath)
+	if err != nil {
+		return fmt.Errorf("get user: %w", err)
+	}
+	shh, err := shhFromPathFor(".shh", user.Username)
+	if err != nil {
+		return err
+	}
+	secrets, err := shh.GetSecretsForUser(glob, user.Username)
+	if err != nil {
+		return err
+	}
+	dec, err := user.decrypterFor(configPath, nonInteractive, secrets)
+	if err != nil {
+		return err
+	}
+	values := make(map[string]string, len(secrets))
+	err = decryptEach(dec, secrets, func(name string, plaintext secureBytes) error {
+		values[name] = string(plaintext)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	key, err := kdbxKey(*keyFile, true)
+	if err != nil {
+		return err
+	}
+	defer wipe(key)
+
+	// Never overwrite an existing database
+	fi, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if err = writeKDBX(fi, key, managerItems(values)); err != nil {
+		fi.Close()
+		_ = os.Remove(*out)
+		return err
+	}
+	if err = fi.Close(); err != nil {
+		return err
+	}
+	notef(os.Stdout, "exported %d secrets to %s\n", len(values), *out)
+	return nil
+}
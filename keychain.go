@@ -0,0 +1,16 @@
+package main
+
+// keychainCache holds the password in the macOS login Keychain. The item is
+// created by shh itself through the Security framework, so only the shh
+// binary may read it without the Keychain asking. The item is locked whenever
+// the Keychain is locked, so no server or open port is needed.
+type keychainCache struct {
+	account    username
+	configPath string
+}
+
+// service names the generic password item for the config directory, so
+// profiles with the same username don't share one.
+func (c keychainCache) service() string {
+	return "shh:" + c.configPath
+}
@@ -0,0 +1,133 @@
+//go:build darwin && cgo
+// +build darwin,cgo
+
+package main
+
+/*
+#cgo LDFLAGS: -framework CoreFoundation -framework Security
+
+#include <stdlib.h>
+#include <string.h>
+#include <CoreFoundation/CoreFoundation.h>
+#include <Security/Security.h>
+
+static CFMutableDictionaryRef shhKeychainQuery(const char *service,
+	const char *account) {
+	CFMutableDictionaryRef query = CFDictionaryCreateMutable(NULL, 0,
+		&kCFTypeDictionaryKeyCallBacks, &kCFTypeDictionaryValueCallBacks);
+	CFStringRef s = CFStringCreateWithCString(NULL, service,
+		kCFStringEncodingUTF8);
+	CFStringRef a = CFStringCreateWithCString(NULL, account,
+		kCFStringEncodingUTF8);
+	CFDictionarySetValue(query, kSecClass, kSecClassGenericPassword);
+	CFDictionarySetValue(query, kSecAttrService, s);
+	CFDictionarySetValue(query, kSecAttrAccount, a);
+	CFRelease(s);
+	CFRelease(a);
+	return query;
+}
+
+static OSStatus shhKeychainGet(const char *service, const char *account,
+	void **data, size_t *length) {
+	CFMutableDictionaryRef query = shhKeychainQuery(service, account);
+	CFDictionarySetValue(query, kSecReturnData, kCFBooleanTrue);
+	CFDictionarySetValue(query, kSecMatchLimit, kSecMatchLimitOne);
+	CFTypeRef result = NULL;
+	OSStatus status = SecItemCopyMatching(query, &result);
+	CFRelease(query);
+	if (status != errSecSuccess) {
+		return status;
+	}
+	*length = CFDataGetLength((CFDataRef)result);
+	*data = malloc(*length + 1);
+	memcpy(*data, CFDataGetBytePtr((CFDataRef)result), *length);
+	CFRelease(result);
+	return status;
+}
+
+// shhKeychainSet replaces any existing item, so its access list is always
+// the default: only the application which created it, shh.
+static OSStatus shhKeychainSet(const char *service, const char *account,
+	const void *data, size_t length) {
+	CFMutableDictionaryRef query = shhKeychainQuery(service, account);
+	SecItemDelete(query);
+	CFDataRef value = CFDataCreate(NULL, data, length);
+	CFDictionarySetValue(query, kSecValueData, value);
+	OSStatus status = SecItemAdd(query, NULL);
+	CFRelease(value);
+	CFRelease(query);
+	return status;
+}
+
+static OSStatus shhKeychainDelete(const char *service, const char *account) {
+	CFMutableDictionaryRef query = shhKeychainQuery(service, account);
+	OSStatus status = SecItemDelete(query);
+	CFRelease(query);
+	return status;
+}
+
+static void shhFree(void *data, size_t length) {
+	volatile unsigned char *p = data;
+	while (length--) {
+		*p++ = 0;
+	}
+	free(data);
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+)
+
+// errSecItemNotFound is returned by the Security framework when there's no
+// matching item.
+const errSecItemNotFound = -25300
+
+func (c keychainCache) Get() ([]byte, error) {
+	service, account := C.CString(c.service()), C.CString(string(c.account))
+	defer C.free(unsafe.Pointer(service))
+	defer C.free(unsafe.Pointer(account))
+
+	var data unsafe.Pointer
+	var length C.size_t
+	if C.shhKeychainGet(service, account, &data, &length) != 0 {
+		return nil, errors.New(tr("cached password not available. run `shh login`"))
+	}
+	defer C.shhFree(data, length)
+	return C.GoBytes(data, C.int(length)), nil
+}
+
+func (c keychainCache) Set(password []byte) error {
+	if len(password) == 0 {
+		return errors.New("empty password")
+	}
+	service, account := C.CString(c.service()), C.CString(string(c.account))
+	defer C.free(unsafe.Pointer(service))
+	defer C.free(unsafe.Pointer(account))
+
+	status := C.shhKeychainSet(service, account, unsafe.Pointer(&password[0]),
+		C.size_t(len(password)))
+	if status != 0 {
+		return fmt.Errorf("add keychain password: status %d", int(status))
+	}
+	return nil
+}
+
+func (c keychainCache) Clear() error {
+	service, account := C.CString(c.service()), C.CString(string(c.account))
+	defer C.free(unsafe.Pointer(service))
+	defer C.free(unsafe.Pointer(account))
+
+	status := C.shhKeychainDelete(service, account)
+	if status == errSecItemNotFound {
+		// The item was not found, so there's nothing to clear
+		return nil
+	}
+	if status != 0 {
+		return fmt.Errorf("delete keychain password: status %d", int(status))
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+//go:build !darwin || !cgo
+// +build !darwin !cgo
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// Without cgo, shh can't use the Security framework, so the Keychain is used
+// through security(1). The item's access is still limited to the shh binary,
+// so macOS asks before security(1) reads it.
+
+func (c keychainCache) Get() ([]byte, error) {
+	cmd := exec.Command("/usr/bin/security", "find-generic-password",
+		"-a", string(c.account), "-s", c.service(), "-w")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.New(tr("cached password not available. run `shh login`"))
+	}
+	return bytes.TrimSuffix(out, []byte("\n")), nil
+}
+
+// Set the password in the Keychain. Commands are passed to security(1) over
+// stdin rather than as arguments, so the password is never visible to other
+// processes.
+func (c keychainCache) Set(password []byte) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("executable: %w", err)
+	}
+	cmd := exec.Command("/usr/bin/security", "-i")
+	cmd.Stdin = bytes.NewBufferString(fmt.Sprintf(
+		"add-generic-password -U -a %q -s %q -T %q -X %s\n",
+		c.account, c.service(), exe, hex.EncodeToString(password)))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("add keychain password: %w: %s", err, out)
+	}
+	return nil
+}
+
+func (c keychainCache) Clear() error {
+	cmd := exec.Command("/usr/bin/security", "delete-generic-password",
+		"-a", string(c.account), "-s", c.service())
+	err := cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 44 {
+		// The item was not found, so there's nothing to clear
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("delete keychain password: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// gpgBlockType marks a gpg user in the project file. The block holds their
+// exported public key, with its fingerprint in the Fingerprint header.
+const gpgBlockType = "PGP PUBLIC KEY"
+
+// keyProvider holds users' private keys outside of shh, such as in KMS, gpg,
+// or on a PKCS#11 token, and wraps and unwraps their secrets' AES keys.
+// Users choose one with key=$provider:$id in their config. Users without one
+// have an RSA key in id_rsa, decrypted with their password or by the server.
+type keyProvider interface {
+	// blockType marks the provider's keys in the project, or is empty if
+	// they're RSA public keys.
+	blockType() string
+
+	// publicBlock is the key with the id, as saved in the project.
+	publicBlock(id string) (*pem.Block, error)
+
+	// wrapper for a key saved by publicBlock.
+	wrapper(block *pem.Block) (keyWrapper, error)
+
+	// decrypter unwraps AES keys with the private key with the id.
+	decrypter(id string) (crypto.Decrypter, error)
+}
+
+var keyProviders = map[string]keyProvider{
+	"kms":    kmsProvider{},
+	"gpg":    gpgProvider{},
+	"pkcs11": pkcs11Provider{},
+}
+
+// parseKeyRef parses $provider:$id.
+func parseKeyRef(ref string) (keyProvider, string, error) {
+	parts := strings.SplitN(ref, ":", 2)
+	p, ok := keyProviders[parts[0]]
+	if !ok || len(parts) != 2 || parts[1] == "" {
+		names := make([]string, 0, len(keyProviders))
+		for name := range keyProviders {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, "", fmt.Errorf("invalid key %s, expected $provider:$id with a provider of %s",
+			ref, strings.Join(names, ", "))
+	}
+	return p, parts[1], nil
+}
+
+// providerForBlock returns the name of the provider whose keys have the block
+// type, and the provider, or nil for RSA public keys.
+func providerForBlock(typ string) (string, keyProvider) {
+	for name, p := range keyProviders {
+		if typ != "" && p.blockType() == typ {
+			return name, p
+		}
+	}
+	return "", nil
+}
+
+// localKeyBlock is the key of the identity in configPath, as saved in the
+// project.
+func localKeyBlock(configPath string, conf *config) (*pem.Block, error) {
+	if conf.Key != "" {
+		p, id, err := parseKeyRef(conf.Key)
+		if err != nil {
+			return nil, err
+		}
+		return p.publicBlock(id)
+	}
+	keys, err := getPublicKey(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("get public keys: %w", err)
+	}
+	return keys.PublicKeyBlock, nil
+}
+
+// publicBlock is the user's key as saved in the project.
+func (u *user) publicBlock() (*pem.Block, error) {
+	switch {
+	case u.Keys != nil:
+		return u.Keys.PublicKeyBlock, nil
+	case u.Key != "":
+		p, id, err := parseKeyRef(u.Key)
+		if err != nil {
+			return nil, err
+		}
+		return p.publicBlock(id)
+	}
+	return nil, errKMSUser
+}
+
+type kmsProvider struct{}
+
+func (kmsProvider) blockType() string { return kmsBlockType }
+
+func (kmsProvider) publicBlock(arn string) (*pem.Block, error) {
+	key, err := newKMSKey(arn)
+	if err != nil {
+		return nil, err
+	}
+	return key.kmsBlock(), nil
+}
+
+func (kmsProvider) wrapper(block *pem.Block) (keyWrapper, error) {
+	key, err := newKMSKey(string(block.Bytes))
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (kmsProvider) decrypter(arn string) (crypto.Decrypter, error) {
+	key, err := newKMSKey(arn)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// gpgProvider uses keys in gpg. Secrets are encrypted to the public key saved
+// in the project, so teammates needn't import it, and decrypted by gpg-agent,
+// which asks for the passphrase itself.
+type gpgProvider struct{}
+
+func (gpgProvider) blockType() string { return gpgBlockType }
+
+func (gpgProvider) publicBlock(id string) (*pem.Block, error) {
+	out, err := gpgOutput(nil, "--with-colons", "--fingerprint", id)
+	if err != nil {
+		return nil, err
+	}
+	var fp string
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Split(line, ":")
+		if fields[0] == "fpr" && len(fields) > 9 {
+			fp = fields[9]
+			break
+		}
+	}
+	if fp == "" {
+		return nil, fmt.Errorf("gpg: no key %s", id)
+	}
+	key, err := gpgOutput(nil, "--export", fp)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) == 0 {
+		return nil, fmt.Errorf("gpg: no public key %s", fp)
+	}
+	return &pem.Block{Type: gpgBlockType,
+		Headers: map[string]string{"Fingerprint": fp}, Bytes: key}, nil
+}
+
+func (gpgProvider) wrapper(block *pem.Block) (keyWrapper, error) {
+	if block.Headers["Fingerprint"] == "" || len(block.Bytes) == 0 {
+		return nil, errors.New("gpg key missing its fingerprint or key")
+	}
+	return gpgKey{block: block}, nil
+}
+
+func (gpgProvider) decrypter(id string) (crypto.Decrypter, error) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		return nil, fmt.Errorf("gpg: %w", err)
+	}
+	return gpgKey{id: id}, nil
+}
+
+// gpgKey wraps AES keys for the public key in block, or unwraps them with
+// the private key with the id.
+type gpgKey struct {
+	block *pem.Block
+	id    string
+}
+
+// gpgMu serializes decryption, so gpg-agent asks for the passphrase once
+// rather than for each secret at the same time.
+var gpgMu sync.Mutex
+
+func (k gpgKey) WrapKey(aesKey []byte) ([]byte, error) {
+	fi, err := ioutil.TempFile("", "shh-gpg")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(fi.Name())
+	_, err = fi.Write(k.block.Bytes)
+	if cerr := fi.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return gpgOutput(aesKey, "--recipient-file", fi.Name(), "--encrypt")
+}
+
+func (k gpgKey) Public() crypto.PublicKey {
+	return nil
+}
+
+// Decrypt the AES key in msg. opts are ignored, since the message names its
+// algorithm.
+func (k gpgKey) Decrypt(_ io.Reader, msg []byte, _ crypto.DecrypterOpts) ([]byte, error) {
+	gpgMu.Lock()
+	defer gpgMu.Unlock()
+	return gpgOutput(msg, "--decrypt")
+}
+
+// gpgOutput runs gpg with the input, returning its stdout.
+func gpgOutput(stdin []byte, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("gpg", append([]string{"--batch", "--quiet",
+		"--no-tty"}, args...)...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("gpg: %s", msg)
+		}
+		return nil, fmt.Errorf("gpg: %w", err)
+	}
+	return stdout.Bytes(), nil
+}
+
+// pkcs11Provider uses RSA keys on a smart card or HSM, with the id of the
+// key's object on the token, using OpenSC's pkcs11-tool.
+// $SHH_PKCS11_MODULE chooses the module, and $SHH_PKCS11_PIN gives the PIN,
+// which is otherwise asked for once. Secrets are encrypted for the public key
+// like any RSA user's.
+type pkcs11Provider struct{}
+
+func (pkcs11Provider) blockType() string { return "" }
+
+func (pkcs11Provider) publicBlock(id string) (*pem.Block, error) {
+	der, err := pkcs11Output(nil, nil, "--read-object", "--type", "pubkey",
+		"--id", id)
+	if err != nil {
+		return nil, err
+	}
+	// Older versions of pkcs11-tool write PKCS#1
+	rsaPub, err := x509.ParsePKCS1PublicKey(der)
+	if err != nil {
+		pub, perr := x509.ParsePKIXPublicKey(der)
+		if perr != nil {
+			return nil, fmt.Errorf("pkcs11: parse public key: %w", perr)
+		}
+		var ok bool
+		if rsaPub, ok = pub.(*rsa.PublicKey); !ok {
+			return nil, errors.New("pkcs11: only rsa keys are supported")
+		}
+	}
+	return &pem.Block{Type: "RSA PUBLIC KEY",
+		Bytes: x509.MarshalPKCS1PublicKey(rsaPub)}, nil
+}
+
+func (pkcs11Provider) wrapper(block *pem.Block) (keyWrapper, error) {
+	pubKey, err := parsePublicKey(block)
+	if err != nil {
+		return nil, err
+	}
+	return rsaKeyWrapper{PublicKey: pubKey}, nil
+}
+
+func (pkcs11Provider) decrypter(id string) (crypto.Decrypter, error) {
+	if _, err := exec.LookPath("pkcs11-tool"); err != nil {
+		return nil, fmt.Errorf("pkcs11: %w", err)
+	}
+	return &pkcs11Key{id: id}, nil
+}
+
+// pkcs11Key unwraps AES keys on the token, which never reveals the private
+// key.
+type pkcs11Key struct {
+	id  string
+	mu  sync.Mutex
+	pin secureBytes
+}
+
+func (k *pkcs11Key) Public() crypto.PublicKey {
+	return nil
+}
+
+// Decrypt the AES key in msg with RSA-OAEP and SHA-256, as it was wrapped.
+func (k *pkcs11Key) Decrypt(_ io.Reader, msg []byte, _ crypto.DecrypterOpts) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.pin == nil {
+		if pin := os.Getenv("SHH_PKCS11_PIN"); pin != "" {
+			k.pin = newSecureBytes([]byte(pin))
+		} else {
+			pin, err := readPassword("PIN: ")
+			if err != nil {
+				return nil, err
+			}
+			k.pin = newSecureBytes(pin)
+		}
+	}
+	return pkcs11Output(msg, k.pin, "--decrypt", "--id", k.id, "--login",
+		"--pin", "env:SHH_PKCS11_PIN", "--mechanism", "RSA-PKCS-OAEP",
+		"--hash-algorithm", "SHA256", "--mgf", "MGF1-SHA256")
+}
+
+// pkcs11Output runs pkcs11-tool with the input, returning its output. The
+// PIN is passed in the environment, never the arguments, which other users
+// can see.
+func pkcs11Output(stdin, pin []byte, args ...string) ([]byte, error) {
+	if module := os.Getenv("SHH_PKCS11_MODULE"); module != "" {
+		args = append([]string{"--module", module}, args...)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("pkcs11-tool", args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if pin != nil {
+		cmd.Env = append(os.Environ(), "SHH_PKCS11_PIN="+string(pin))
+	}
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("pkcs11: %s", msg)
+		}
+		return nil, fmt.Errorf("pkcs11: %w", err)
+	}
+	return stdout.Bytes(), nil
+}
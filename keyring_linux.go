@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// keyringTimeout matches how long `shh serve` holds the password.
+const keyringTimeout = 60 * 60
+
+// keyringCache holds the password in the kernel session keyring, where it's
+// never swapped to disk and is discarded automatically when the session ends
+// or the timeout expires. Each key is named for the config directory as well
+// as the account, so profiles with the same username don't share one.
+type keyringCache struct {
+	account    username
+	configPath string
+}
+
+func (c keyringCache) description() string {
+	return "shh:" + string(c.account) + ":" + c.configPath
+}
+
+func (c keyringCache) Get() ([]byte, error) {
+	id, err := unix.KeyctlSearch(unix.KEY_SPEC_SESSION_KEYRING, "user",
+		c.description(), 0)
+	if err != nil {
+		return nil, errors.New(tr("cached password not available. run `shh login`"))
+	}
+	size, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, nil, 0)
+	if err != nil {
+		return nil, fmt.Errorf("read key size: %w", err)
+	}
+	password := make([]byte, size)
+	if _, err = unix.KeyctlBuffer(unix.KEYCTL_READ, id, password, 0); err != nil {
+		return nil, fmt.Errorf("read key: %w", err)
+	}
+	return password, nil
+}
+
+func (c keyringCache) Set(password []byte) error {
+	id, err := unix.AddKey("user", c.description(), password,
+		unix.KEY_SPEC_SESSION_KEYRING)
+	if err != nil {
+		return fmt.Errorf("add key: %w", err)
+	}
+	_, err = unix.KeyctlInt(unix.KEYCTL_SET_TIMEOUT, id, keyringTimeout, 0, 0)
+	if err != nil {
+		return fmt.Errorf("set key timeout: %w", err)
+	}
+	return nil
+}
+
+func (c keyringCache) Clear() error {
+	id, err := unix.KeyctlSearch(unix.KEY_SPEC_SESSION_KEYRING, "user",
+		c.description(), 0)
+	if err != nil {
+		// Nothing is cached, so there's nothing to clear
+		return nil
+	}
+	_, err = unix.KeyctlInt(unix.KEYCTL_UNLINK, id,
+		unix.KEY_SPEC_SESSION_KEYRING, 0, 0)
+	if err != nil {
+		return fmt.Errorf("unlink key: %w", err)
+	}
+	return nil
+}
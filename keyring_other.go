@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+// keyringCache is only supported on Linux.
+type keyringCache struct {
+	account    username
+	configPath string
+}
+
+func (c keyringCache) Get() ([]byte, error) {
+	return nil, errors.New("keyring cache is only supported on linux")
+}
+
+func (c keyringCache) Set(password []byte) error {
+	return errors.New("keyring cache is only supported on linux")
+}
+
+func (c keyringCache) Clear() error {
+	return errors.New("keyring cache is only supported on linux")
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// kmsKeyPrefix starts the names of users which are AWS KMS keys
+	// rather than people with RSA keys.
+	kmsKeyPrefix = "arn:aws:kms:"
+
+	// kmsBlockType marks a KMS user in the project file. The block holds
+	// the key's ARN in place of a public key.
+	kmsBlockType = "AWS KMS KEY"
+
+	awsIMDS = "http://169.254.169.254"
+)
+
+// errKMSUser is returned by commands which need the user's own keys.
+var errKMSUser = errors.New("kms users have no keys of their own. add them with `shh add-user $arn`")
+
+// isKMSKey reports whether the user is an AWS KMS key.
+func isKMSKey(u username) bool {
+	return strings.HasPrefix(string(u), kmsKeyPrefix)
+}
+
+// kmsKey wraps and unwraps AES keys using AWS KMS, so machines such as EC2
+// instances and Lambda functions can read secrets using their IAM role
+// instead of a long-lived private key. It implements crypto.Decrypter, so it
+// can be used wherever a user's private key is.
+type kmsKey struct {
+	arn    string
+	region string
+	client *http.Client
+
+	// creds are found on first use.
+	creds *awsCredentials
+}
+
+// newKMSKey for a key or alias ARN, such as
+// arn:aws:kms:us-east-1:111122223333:key/1234abcd-12ab-34cd-56ef-1234567890ab.
+func newKMSKey(arn string) (*kmsKey, error) {
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) != 6 || !isKMSKey(username(arn)) || parts[3] == "" ||
+		(!strings.HasPrefix(parts[5], "key/") &&
+			!strings.HasPrefix(parts[5], "alias/")) {
+		return nil, fmt.Errorf("%s: expected a kms key or alias arn", arn)
+	}
+	return &kmsKey{
+		arn:    arn,
+		region: parts[3],
+		client: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// kmsBlock stores the KMS key in the project's keys.
+func (k *kmsKey) kmsBlock() *pem.Block {
+	return &pem.Block{Type: kmsBlockType, Bytes: []byte(k.arn)}
+}
+
+func (k *kmsKey) WrapKey(aesKey []byte) ([]byte, error) {
+	var resp struct {
+		CiphertextBlob []byte
+	}
+	req := map[string]interface{}{"KeyId": k.arn, "Plaintext": aesKey}
+	if err := k.call("Encrypt", req, &resp); err != nil {
+		return nil, err
+	}
+	return resp.CiphertextBlob, nil
+}
+
+func (k *kmsKey) Public() crypto.PublicKey {
+	return nil
+}
+
+// Decrypt the AES key in msg. opts are ignored, since KMS chooses the
+// algorithm.
+func (k *kmsKey) Decrypt(_ io.Reader, msg []byte, _ crypto.DecrypterOpts) ([]byte, error) {
+	var resp struct {
+		Plaintext []byte
+	}
+	req := map[string]interface{}{"KeyId": k.arn, "CiphertextBlob": msg}
+	if err := k.call("Decrypt", req, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Plaintext, nil
+}
+
+// call a KMS action, signing the request with the ambient credentials.
+// $AWS_ENDPOINT_URL_KMS or $AWS_ENDPOINT_URL override the endpoint.
+func (k *kmsKey) call(action string, in, out interface{}) error {
+	if k.creds == nil {
+		creds, err := ambientAWSCredentials(k.client)
+		if err != nil {
+			return fmt.Errorf("aws credentials: %w", err)
+		}
+		k.creds = creds
+	}
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	defer wipe(body)
+	endpoint := os.Getenv("AWS_ENDPOINT_URL_KMS")
+	if endpoint == "" {
+		endpoint = os.Getenv("AWS_ENDPOINT_URL")
+	}
+	if endpoint == "" {
+		endpoint = "https://kms." + k.region + ".amazonaws.com"
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint+"/",
+		bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+	k.creds.sign(req, body, k.region, "kms", time.Now())
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("kms %s: %w", action, err)
+	}
+	defer resp.Body.Close()
+	byt, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	defer wipe(byt)
+	if resp.StatusCode != http.StatusOK {
+		var kerr struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		_ = json.Unmarshal(byt, &kerr)
+		kerr.Type = kerr.Type[strings.LastIndex(kerr.Type, "#")+1:]
+		return fmt.Errorf("kms %s: %s: %s %s", action, resp.Status,
+			kerr.Type, kerr.Message)
+	}
+	if err = json.Unmarshal(byt, out); err != nil {
+		return fmt.Errorf("kms %s: decode: %w", action, err)
+	}
+	return nil
+}
+
+// awsCredentials sign requests to AWS.
+type awsCredentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string
+	Token           string
+}
+
+// ambientAWSCredentials finds credentials the way AWS SDKs do: from the
+// environment, as in Lambda, then the shared credentials file, then the ECS
+// container endpoint, then the EC2 instance metadata service.
+func ambientAWSCredentials(client *http.Client) (*awsCredentials, error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return &awsCredentials{
+			AccessKeyID:     id,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			Token:           os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+	creds, err := sharedAWSCredentials()
+	if err != nil || creds != nil {
+		return creds, err
+	}
+	if rel := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); rel != "" {
+		return containerAWSCredentials(client, "http://169.254.170.2"+rel)
+	}
+	if full := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI"); full != "" {
+		return containerAWSCredentials(client, full)
+	}
+	creds, err = instanceAWSCredentials()
+	if err != nil {
+		return nil, fmt.Errorf("none in env or shared credentials file, and instance metadata: %w", err)
+	}
+	return creds, nil
+}
+
+// sharedAWSCredentials reads static keys for $AWS_PROFILE from
+// $AWS_SHARED_CREDENTIALS_FILE or ~/.aws/credentials. It returns nil
+// credentials if there are none.
+func sharedAWSCredentials() (*awsCredentials, error) {
+	pth := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if pth == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil
+		}
+		pth = filepath.Join(home, ".aws", "credentials")
+	}
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+	fi, err := os.Open(pth)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+	creds := &awsCredentials{}
+	section := ""
+	scn := bufio.NewScanner(fi)
+	for scn.Scan() {
+		line := strings.TrimSpace(scn.Text())
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if section != profile || len(parts) != 2 {
+			continue
+		}
+		val := strings.TrimSpace(parts[1])
+		switch strings.TrimSpace(parts[0]) {
+		case "aws_access_key_id":
+			creds.AccessKeyID = val
+		case "aws_secret_access_key":
+			creds.SecretAccessKey = val
+		case "aws_session_token":
+			creds.Token = val
+		}
+	}
+	if err = scn.Err(); err != nil {
+		return nil, fmt.Errorf("scan %s: %w", pth, err)
+	}
+	if creds.AccessKeyID == "" {
+		return nil, nil
+	}
+	return creds, nil
+}
+
+// containerAWSCredentials fetches an ECS task role's credentials.
+func containerAWSCredentials(client *http.Client, u string) (*awsCredentials, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if tok := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"); tok != "" {
+		req.Header.Set("Authorization", tok)
+	}
+	creds := &awsCredentials{}
+	if err = getJSON(client, req, creds); err != nil {
+		return nil, fmt.Errorf("container credentials: %w", err)
+	}
+	return creds, nil
+}
+
+// instanceAWSCredentials fetches an EC2 instance role's credentials using
+// IMDSv2.
+func instanceAWSCredentials() (*awsCredentials, error) {
+	// Fail fast when not on EC2
+	client := &http.Client{Timeout: 2 * time.Second}
+	req, err := http.NewRequest(http.MethodPut, awsIMDS+"/latest/api/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	tok, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token: %s", resp.Status)
+	}
+	get := func(pth string) (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, awsIMDS+pth, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-aws-ec2-metadata-token", string(tok))
+		return req, nil
+	}
+	const rolesPath = "/latest/meta-data/iam/security-credentials/"
+	req, err = get(rolesPath)
+	if err != nil {
+		return nil, err
+	}
+	resp, err = client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	roles, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	role := strings.TrimSpace(strings.SplitN(string(roles), "\n", 2)[0])
+	if resp.StatusCode != http.StatusOK || role == "" {
+		return nil, errors.New("no instance role")
+	}
+	req, err = get(rolesPath + url.PathEscape(role))
+	if err != nil {
+		return nil, err
+	}
+	creds := &awsCredentials{}
+	if err = getJSON(client, req, creds); err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+// getJSON sends the request and decodes a successful response into out.
+func getJSON(client *http.Client, req *http.Request, out interface{}) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+	if err = json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decode: %w", err)
+	}
+	return nil
+}
+
+// sign the request using AWS Signature Version 4.
+func (c *awsCredentials) sign(req *http.Request, body []byte, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if c.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", c.Token)
+	}
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+	bodyHash := sha256.Sum256(body)
+	canonReq := strings.Join([]string{req.Method, req.URL.EscapedPath(),
+		req.URL.RawQuery, canonHeaders.String(), signed,
+		hex.EncodeToString(bodyHash[:])}, "\n")
+	reqHash := sha256.Sum256([]byte(canonReq))
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" +
+		hex.EncodeToString(reqHash[:])
+
+	mac := func(key []byte, data string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(data))
+		return h.Sum(nil)
+	}
+	key := mac([]byte("AWS4"+c.SecretAccessKey), date)
+	key = mac(key, region)
+	key = mac(key, service)
+	key = mac(key, "aws4_request")
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.AccessKeyID, scope, signed, hex.EncodeToString(mac(key, toSign))))
+}
+
+// unveilNetwork allows reading what requests to KMS or a remote project
+// store need: DNS and TLS configuration, shared AWS credentials, and whatever
+// else the store needs.
+func (s *shh) unveilNetwork() {
+	needed := s.store != nil || s.sealKMS != ""
+	for _, block := range s.Keys {
+		if block.Type == kmsBlockType {
+			needed = true
+		}
+	}
+	if !needed {
+		return
+	}
+	if u, ok := s.store.(interface{ unveil() }); ok {
+		u.unveil()
+	}
+	unveil("/etc/resolv.conf", "r")
+	unveil("/etc/hosts", "r")
+	unveil("/etc/ssl", "r")
+	if pth := os.Getenv("AWS_SHARED_CREDENTIALS_FILE"); pth != "" {
+		unveil(pth, "r")
+	} else if home, err := os.UserHomeDir(); err == nil {
+		unveil(filepath.Join(home, ".aws"), "r")
+	}
+}
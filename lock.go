@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// lockTimeout is how long to wait for another shh command to finish with the
+// project file.
+const lockTimeout = 10 * time.Second
+
+// lockMode is how a command locks the project file for as long as it runs.
+type lockMode int
+
+const (
+	// lockExclusive commands modify the project file, so concurrent
+	// writes can't be lost. Commands lock exclusively unless they say
+	// otherwise.
+	lockExclusive lockMode = iota
+
+	// lockShared commands only read the project file, releasing the lock
+	// as soon as it's read.
+	lockShared
+
+	// lockNone commands don't use the project file, or lock it
+	// themselves.
+	lockNone
+)
+
+// projectLock is the lock held by this process, if any, and the release of
+// its remote store's lock.
+var projectLock struct {
+	fi           *os.File
+	exclusive    bool
+	releaseStore func()
+}
+
+// lockProject locks the project file in the mode, waiting up to lockTimeout
+// for other commands to release it. The lock is kept in a separate file,
+// since the project file itself is replaced on every write. Closing the file
+// releases the lock, which needs no pledge. Commands which change a remote
+// project lock its store too.
+func lockProject(mode lockMode) error {
+	if mode == lockNone {
+		return nil
+	}
+	exclusive := mode == lockExclusive
+	pth, err := findShhRecursive(".shh")
+	switch {
+	case os.IsNotExist(err) && exclusive:
+		pth = projectPath(".shh") // Being created by init
+	case err != nil:
+		return nil
+	}
+	lockPth, err := projectLockPath(pth)
+	if err != nil {
+		err = fmt.Errorf("lock: %w", err)
+	}
+	var fi *os.File
+	if err == nil {
+		fi, err = lockFile(pth, lockPth, exclusive)
+	}
+	if errors.Is(err, os.ErrPermission) && !exclusive {
+		// Reading a project we can't write, such as another user's,
+		// doesn't need to wait for anyone
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	projectLock.fi, projectLock.exclusive = fi, exclusive
+	if !exclusive {
+		return nil
+	}
+	store, err := remoteStoreOf(pth)
+	if err != nil || store == nil {
+		return err
+	}
+	projectLock.releaseStore, err = store.lock()
+	if err != nil {
+		unlockProject()
+		return fmt.Errorf("lock remote: %w", err)
+	}
+	return nil
+}
+
+// projectLockPath is where the project file at pth is locked, in a directory
+// beside it named like its backups, such as .shh.lock, which ignores itself
+// in git. Symlinks are resolved first, so every path to the project file,
+// and every user sharing it, takes the same lock.
+func projectLockPath(pth string) (string, error) {
+	if real, err := filepath.EvalSymlinks(pth); err == nil {
+		pth = real
+	}
+	dir, name := filepath.Split(pth)
+	dir = filepath.Join(dir, "."+strings.TrimPrefix(name, ".")+".lock")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	ignore := filepath.Join(dir, ".gitignore")
+	if _, err := os.Stat(ignore); os.IsNotExist(err) {
+		if err = ioutil.WriteFile(ignore, []byte("*\n"), 0644); err != nil {
+			return "", err
+		}
+	}
+	return filepath.Join(dir, "lock"), nil
+}
+
+// lockFile takes a lock on pth in lockPth, waiting up to lockTimeout. The
+// lock file is only opened for reading, which is all locking needs, so users
+// who can't write a lock file someone else created can still take it.
+func lockFile(pth, lockPth string, exclusive bool) (*os.File, error) {
+	fi, err := os.OpenFile(lockPth, os.O_CREATE|os.O_RDONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("lock: %w", err)
+	}
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		locked, err := tryLockFile(fi, exclusive)
+		if err != nil {
+			fi.Close()
+			return nil, fmt.Errorf("lock: %w", err)
+		}
+		if locked {
+			return fi, nil
+		}
+		if time.Now().After(deadline) {
+			fi.Close()
+			return nil, fmt.Errorf("%s is in use by another shh command, try again", pth)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// remoteStoreOf the project file, if it points to one. Only small files are
+// read, since pointers are.
+func remoteStoreOf(pth string) (projectStore, error) {
+	fi, err := os.Open(pth)
+	if err != nil {
+		return nil, nil
+	}
+	defer fi.Close()
+	byt, err := ioutil.ReadAll(io.LimitReader(fi, 4096))
+	if err != nil || len(byt) == 4096 {
+		return nil, nil
+	}
+	outer, err := parseOuterLayer(byt)
+	if err != nil || outer.Remote == "" {
+		return nil, nil
+	}
+	return newProjectStore(outer.Remote)
+}
+
+// unlockProject releases the locks taken by lockProject.
+func unlockProject() {
+	if projectLock.releaseStore != nil {
+		projectLock.releaseStore()
+		projectLock.releaseStore = nil
+	}
+	if projectLock.fi != nil {
+		projectLock.fi.Close()
+		projectLock.fi = nil
+	}
+}
+
+// releaseSharedLock once the project file has been read.
+func releaseSharedLock() {
+	if !projectLock.exclusive {
+		unlockProject()
+	}
+}
@@ -2,115 +2,169 @@ package main
 
 import (
 	"bytes"
-	"crypto/aes"
-	"crypto/cipher"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
 	"crypto/sha256"
-	"crypto/x509"
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
 	"sort"
-	"sync"
+	"strings"
 	"time"
 
 	"github.com/awnumar/memguard"
+	"golang.org/x/crypto/ssh/terminal"
 )
 
 func main() {
+	if err := disableCoreDumps(); err != nil {
+		fmt.Println("error: disable core dumps: " + err.Error())
+		os.Exit(1)
+	}
 	err := run()
-	if err != nil {
-		switch err.(type) {
-		case *emptyArgError:
-			usage()
-		case *badArgError:
-			fmt.Println("error: " + err.Error())
+	if err == nil {
+		return
+	}
+	exit, code := exitCode(err)
+	if jsonOutput {
+		_ = printJSON(errorJSON{Error: err.Error(), Code: code})
+		os.Exit(exit)
+	}
+	switch err.(type) {
+	case *emptyArgError:
+		usage()
+	case *badArgError:
+		fmt.Println(tr("error: ") + err.Error())
+		if !quiet {
 			usage()
-		default:
-			fmt.Println("error: " + err.Error())
 		}
-		os.Exit(1)
+	default:
+		fmt.Println(tr("error: ") + err.Error())
 	}
+	os.Exit(exit)
 }
 
 func run() error {
 	nonInteractive := flag.Bool("n", false,
 		"Non-interactive mode. Fail if shh would prompt for the password")
-	flag.Parse()
+	flag.StringVar(&passwordSource.file, "password-file", "",
+		"Read the password from a file")
+	flag.IntVar(&passwordSource.fd, "password-fd", 0,
+		"Read the password from a file descriptor")
+	fixPerms := flag.Bool("fix-perms", false,
+		"Remove other users' access to keys, config, and .shh")
+	flag.BoolVar(&jsonOutput, "json", false,
+		"Print JSON from show, get, and status, and for errors")
+	flag.BoolVar(&quiet, "q", false,
+		"Quiet mode. Print only requested output, prompts, and errors")
+	flag.StringVar(&environment, "e", environment,
+		"Environment of the secrets named, such as prod")
+	flag.StringVar(&environment, "env", environment, "Alias for -e")
+	flag.StringVar(&profile, "profile", profile,
+		"Use the keys and config of a profile, such as work")
+	flag.StringVar(&projectFile, "file", projectFile,
+		"Use the project file at the path, rather than finding .shh")
+	flag.BoolVar(&debugEnabled, "verbose", debugEnabled,
+		"Log what shh is doing to stderr, redacting secrets")
+	global, args := splitGlobalFlags(flag.CommandLine, os.Args[1:])
+	if err := flag.CommandLine.Parse(global); err != nil {
+		return err
+	}
+	if debugEnabled {
+		os.Setenv("SHH_DEBUG", "1")
+	}
+	if err := validateEnvironment(environment); err != nil {
+		return err
+	}
+	if err := validateProfile(profile); err != nil {
+		return err
+	}
+	if profile != "" {
+		os.Setenv("SHH_PROFILE", profile)
+	}
+	if projectFile != "" {
+		// Commands run with secrets, and shh's own subprocesses, use the
+		// same project file
+		abs, err := filepath.Abs(projectFile)
+		if err != nil {
+			return err
+		}
+		projectFile = abs
+		os.Setenv("SHH_FILE", abs)
+	}
 
-	arg, tail := parseArg(flag.Args())
-	if arg == "" || arg == "help" {
+	arg, tail := parseArg(args)
+	switch arg {
+	case "":
 		return &emptyArgError{}
+	case "help", "-h", "-help", "--help":
+		return help(tail)
+	}
+	cmd := findCommand(arg)
+	if cmd == nil {
+		return &badArgError{Arg: arg}
+	}
+	if wantsHelp(tail) {
+		commandUsage(cmd)
+		return nil
 	}
+	runningCommand = cmd.name
 
-	// Enforce that a .shh file exists for anything for most commands
-	switch arg {
-	case "init", "gen-keys", "serve", "version": // Do nothing
-	default:
+	// Enforce that a .shh file exists for most commands
+	if !cmd.noProject {
 		_, err := findShhRecursive(".shh")
 		if os.IsNotExist(err) {
-			return errors.New("missing .shh, run `shh init`")
+			return &noProjectError{}
 		}
 		if err != nil {
 			return err
 		}
+		if err = useDefaultEnv(); err != nil {
+			return err
+		}
 	}
-	switch arg {
-	case "init":
-		if tail != nil {
-			return fmt.Errorf("unknown args: %v", tail)
-		}
-		return initShh()
-	case "gen-keys":
-		return genKeys(tail)
-	case "get":
-		return get(*nonInteractive, tail)
-	case "set":
-		return set(tail)
-	case "del":
-		return del(tail)
-	case "edit":
-		return edit(*nonInteractive, tail)
-	case "allow":
-		return allow(*nonInteractive, tail)
-	case "deny":
-		return deny(tail)
-	case "add-user":
-		return addUser(tail)
-	case "rm-user":
-		return rmUser(tail)
-	case "rotate":
-		return rotate(tail)
-	case "serve":
-		return serve(tail)
-	case "login":
-		return login(tail)
-	case "show":
-		return show(tail)
-	case "search":
-		return search(tail)
-	case "rename":
-		return rename(tail)
-	case "copy":
-		return copySecret(tail)
-	case "version":
-		fmt.Println("1.5.2")
+	if (cmd.name != "doctor" && cmd.name != "__complete") || *fixPerms {
+		if err := checkPerms(*fixPerms); err != nil {
+			return err
+		}
+	}
+	if err := lockProject(cmd.lock); err != nil {
+		return err
+	}
+	defer unlockProject()
+
+	// Log only the number of args, since they may include values
+	debug("run", "command", cmd.name, "args", len(tail))
+	return cmd.run(*nonInteractive, tail)
+}
+
+// useDefaultEnv enters the project's default environment, unless -e or
+// $SHH_ENV chose one.
+func useDefaultEnv() error {
+	if environmentChosen() {
 		return nil
-	default:
-		return &badArgError{Arg: arg}
 	}
+	set, err := readSettings()
+	if err != nil {
+		return fmt.Errorf("read settings: %w", err)
+	}
+	if set != nil && set.DefaultEnv != "" {
+		environment = set.DefaultEnv
+		debug("default environment", "env", environment)
+	}
+	return nil
 }
 
 // parseArg splits the arguments into a head and tail.
@@ -125,14 +179,70 @@ func parseArg(args []string) (string, []string) {
 	}
 }
 
+// parseFlags parses args using the flag set, allowing flags to appear before or
+// after positional arguments, e.g. `get $name --flag`. The positional
+// arguments are returned in order. Everything after "--" is positional. Flag
+// errors are reported as bad args.
+func parseFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, fmt.Errorf("bad args: %w", err)
+		}
+		rest := fs.Args()
+		if len(rest) == 0 {
+			return positional, nil
+		}
+		if consumed := len(args) - len(rest); consumed > 0 &&
+			args[consumed-1] == "--" {
+			return append(positional, rest...), nil
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+// confirm asks the user to confirm an action unless yes is set. Without a
+// terminal to ask on, --yes is required.
+func confirm(yes bool, format string, args ...interface{}) error {
+	if yes {
+		return nil
+	}
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return errors.New(tr("not a terminal, pass --yes to confirm"))
+	}
+	fmt.Printf(tr(format)+tr(" [y/N]: "), args...)
+	var answer string
+	_, _ = fmt.Scanln(&answer)
+	if !isYes(answer) {
+		return errors.New(tr("cancelled"))
+	}
+	return nil
+}
+
+// isYes reports whether the answer to a [y/N] question is yes, in English or
+// the user's language.
+func isYes(answer string) bool {
+	switch strings.ToLower(answer) {
+	case "y", "yes", tr("y"), tr("yes"):
+		return true
+	}
+	return false
+}
+
 // genKeys for self in ~/.config/shh.
 func genKeys(args []string) error {
-	if len(args) != 0 {
-		return errors.New("bad args: expected none")
+	fs := flag.NewFlagSet("gen-keys", flag.ContinueOnError)
+	bits := fs.Int("bits", defaultKeyBits, "RSA key size in bits")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errors.New("bad args: expected `gen-keys [--bits $n]`")
 	}
 
 	const (
-		promises     = "stdio rpath wpath cpath tty"
+		promises     = "stdio rpath wpath cpath tty proc exec"
 		execPromises = ""
 	)
 	pledge(promises, execPromises)
@@ -145,7 +255,7 @@ func genKeys(args []string) error {
 	if err == nil {
 		return errors.New("keys exist at ~/.config/shh, run `shh rotate` to change keys")
 	}
-	if _, err = createUser(configPath); err != nil {
+	if _, err = createUser(configPath, *bits); err != nil {
 		return err
 	}
 	backupReminder(true)
@@ -158,15 +268,47 @@ func genKeys(args []string) error {
 // This can't easily have unveil applied to it because shh looks recursively up
 // directories. Unveil only applies after the .shh file is found, however
 // almost no logic exists after that point in this function.
-func initShh() error {
+func initShh(args []string) error {
+	fs := flag.NewFlagSet("init", flag.ContinueOnError)
+	minBits := fs.Int("min-bits", 0, "minimum RSA key size for project users")
+	remote := fs.String("remote", "", "keep the project in s3://, gs://, file://, or https://")
+	gitURL := fs.String("git", "", "keep the project in a dedicated git repo")
+	fromTemplate := fs.String("from-template", "",
+		"add the users, environments, and secrets declared in a file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	switch {
+	case *remote != "" && *gitURL != "":
+		return errors.New("--remote and --git are exclusive")
+	case *gitURL != "":
+		if !isGitRemote(*gitURL) {
+			return fmt.Errorf("%s: expected a git url, e.g. git@host:team/secrets.git", *gitURL)
+		}
+		*remote = *gitURL
+	}
+	if fs.NArg() != 0 {
+		return fmt.Errorf("unknown args: %v", fs.Args())
+	}
+	if *minBits != 0 && *minBits < minKeyBits {
+		return fmt.Errorf("min bits must be >= %d", minKeyBits)
+	}
+	var tmpl *projectTemplate
+	if *fromTemplate != "" {
+		var err error
+		if tmpl, err = readTemplate(*fromTemplate); err != nil {
+			return fmt.Errorf("read template: %w", err)
+		}
+	}
+
 	const (
-		promises     = "stdio rpath wpath cpath"
+		promises     = "stdio rpath wpath cpath inet dns proc exec"
 		execPromises = ""
 	)
 	pledge(promises, execPromises)
 
-	if _, err := os.Stat(".shh"); err == nil {
-		return errors.New(".shh exists")
+	if _, err := os.Stat(projectPath(".shh")); err == nil {
+		return fmt.Errorf("%s exists", projectPath(".shh"))
 	}
 	configPath, err := getConfigPath()
 	if err != nil {
@@ -176,27 +318,80 @@ func initShh() error {
 	if err != nil {
 		return fmt.Errorf("get user: %w", err)
 	}
+	block, err := user.publicBlock()
+	if err != nil {
+		return err
+	}
+	if *remote != "" {
+		if _, err = newProjectStore(*remote); err != nil {
+			return err
+		}
+		byt, err := json.Marshal(outerLayer{Remote: *remote})
+		if err != nil {
+			return err
+		}
+		err = writeFileAtomic(projectPath(".shh"), append(byt, '\n'), 0644)
+		if err != nil {
+			return err
+		}
+	}
 	shh, err := shhFromPath(".shh")
 	if err != nil {
 		return fmt.Errorf("shh from path: %w", err)
 	}
-	shh.Keys[user.Username] = user.Keys.PublicKeyBlock
-	return shh.EncodeToFile()
+	if _, exist := shh.Keys[user.Username]; exist {
+		// Joining an existing remote project
+		if tmpl != nil {
+			return errors.New("--from-template only applies to new projects")
+		}
+		return rememberProfile(shh.path)
+	}
+	if *minBits != 0 {
+		shh.MinKeyBits = *minBits
+	}
+	shh.Keys[user.Username] = block
+	if _, err = shh.wrapperFor(user.Username); err != nil {
+		return err
+	}
+	if tmpl != nil {
+		if err = shh.applyTemplate(tmpl, user); err != nil {
+			return fmt.Errorf("apply template: %w", err)
+		}
+	}
+	if err = shh.EncodeToFile(); err != nil {
+		return err
+	}
+	return rememberProfile(shh.path)
 }
 
 // get a secret value by name.
 func get(nonInteractive bool, args []string) error {
-	if len(args) != 1 {
-		return errors.New("bad args: expected `get $name`")
+	fs := flag.NewFlagSet("get", flag.ContinueOnError)
+	asJWE := fs.Bool("as-jwe", false, "output the secret as a JWE token")
+	recipient := fs.String("recipient", "",
+		"public key file to encrypt the JWE token for")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) > 1 || (len(args) == 0 && !canPick(nonInteractive)) {
+		return errors.New("bad args: expected `get [$name] [--as-jwe --recipient $pubkey]`")
+	}
+	if *asJWE && *recipient == "" {
+		return errors.New("--as-jwe requires --recipient")
+	}
+	if !nonInteractive {
+		if err := offerServer(); err != nil {
+			return err
+		}
 	}
 
 	const (
-		promises     = "stdio rpath wpath cpath tty inet unveil"
+		promises     = "stdio rpath wpath cpath tty proc exec inet dns unveil"
 		execPromises = ""
 	)
 	pledge(promises, execPromises)
 
-	secretName := args[0]
 	configPath, err := getConfigPath()
 	if err != nil {
 		return err
@@ -205,71 +400,129 @@ func get(nonInteractive bool, args []string) error {
 	if err != nil {
 		return fmt.Errorf("get user: %w", err)
 	}
-	shh, err := shhFromPath(".shh")
+	shh, err := shhFromPathFor(".shh", user.Username)
 	if err != nil {
 		return err
 	}
+	var recipientKey *rsa.PublicKey
+	if *asJWE {
+		recipientKey, err = publicKeyFromFile(*recipient)
+		if err != nil {
+			return fmt.Errorf("read recipient: %w", err)
+		}
+	}
 
 	// Now that we have our files, restrict further access
 	unveil(configPath, "r")
+	unveil(filepath.Join(configPath, failuresFile), "rwc")
 	unveil(shh.path, "r")
+	unveilPinentry()
+	shh.unveilNetwork()
 	unveilBlock()
 
+	secretName, err := pickSecretName(shh, user.Username, args,
+		nonInteractive)
+	if err != nil {
+		return err
+	}
 	secrets, err := shh.GetSecretsForUser(secretName, user.Username)
 	if err != nil {
 		return err
 	}
-	if nonInteractive {
-		user.Password, err = requestPasswordFromServer(user.Port, false)
-		if err != nil {
-			return err
-		}
-	} else {
-		user.Password, err = requestPassword(user.Port, defaultPasswordPrompt)
-		if err != nil {
-			return err
-		}
+	if *asJWE && len(secrets) > 1 {
+		return errors.New("multiple secrets found, cannot use * with --as-jwe")
 	}
-	keys, err := getKeys(configPath, user.Password)
+	shh.warnStale(secrets)
+	dec, err := user.decrypterFor(configPath, nonInteractive, secrets)
 	if err != nil {
 		return err
 	}
-	for _, secret := range secrets {
-		// Decrypt the AES key using the private key
-		aesKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader,
-			keys.PrivateKey, []byte(secret.AESKey), nil)
-		if err != nil {
-			return fmt.Errorf("decrypt secret: %w", err)
+	return decryptEach(dec, secrets, func(name string, plaintext secureBytes) error {
+		if *asJWE {
+			token, err := encodeJWE(recipientKey, plaintext)
+			if err != nil {
+				return fmt.Errorf("encode jwe: %w", err)
+			}
+			if jsonOutput {
+				return printJSON(secretJSON{Name: name, Value: token})
+			}
+			fmt.Println(token)
+			return nil
 		}
-
-		// Use the decrypted AES key to decrypt the secret
-		aesBlock, err := aes.NewCipher(aesKey)
-		if err != nil {
-			return err
+		if jsonOutput {
+			return printJSON(newSecretJSON(name, plaintext))
 		}
+		_, err := os.Stdout.Write(plaintext)
+		return err
+	})
+}
 
-		if len(secret.Encrypted) < aes.BlockSize {
-			return errors.New("encrypted secret too short")
+// pickSecretName returns the secret named in args. When none is given, or
+// it's part of a name rather than a name or glob, the user picks from their
+// matching secrets. A partial name matching only one secret picks it.
+func pickSecretName(shh *shh, u username, args []string,
+	nonInteractive bool) (string, error) {
+	var query string
+	if len(args) > 0 {
+		query = args[0]
+		_, ok := shh.Secrets[u][inEnv(query)]
+		if ok || strings.Contains(query, "*") {
+			return inEnv(query), nil
 		}
-		ciphertext := []byte(secret.Encrypted)
-		iv := ciphertext[:aes.BlockSize]
-		ciphertext = ciphertext[aes.BlockSize:]
-		stream := cipher.NewCFBDecrypter(aesBlock, iv)
-		plaintext := make([]byte, len(ciphertext))
-		stream.XORKeyStream(plaintext, []byte(ciphertext))
-		fmt.Print(string(plaintext))
 	}
-	return nil
+	matches := fuzzyFilter(envNames(shh.userNames(u)), query)
+	switch {
+	case len(matches) == 0 && query == "":
+		return "", &notFoundError{"no secrets which you can access"}
+	case len(matches) == 0:
+		return "", &notFoundError{"no secret found"}
+	case len(matches) == 1 && query != "":
+		return inEnv(matches[0]), nil
+	case !canPick(nonInteractive):
+		return "", &notFoundError{
+			trf("no secret found, did you mean %s?", matches[0])}
+	}
+	name, err := pick(matches, query)
+	return inEnv(name), err
 }
 
 // set a secret value.
 func set(args []string) error {
-	if len(args) != 2 {
-		return errors.New("bad args: expected `set $name $val`")
+	fs := flag.NewFlagSet("set", flag.ContinueOnError)
+	sensitive := fs.Bool("sensitive", false,
+		"always require the password to decrypt")
+	var ageRecipients stringsFlag
+	fs.Var(&ageRecipients, "age", "also encrypt for an age recipient (repeatable)")
+	fs.SetOutput(ioutil.Discard)
+	fs.Usage = func() {}
+
+	// Flags may come before the name or after the value but never between
+	// them, so a value starting with a dash, such as a PEM key or a negative
+	// number, is taken verbatim. Errors never include the value.
+	const usage = "bad args: expected `set $name $val [--sensitive] [--age $recipient]`"
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("bad args: %w", err)
+	}
+	args = fs.Args()
+	if len(args) < 2 {
+		return errors.New(usage)
+	}
+	rest, err := parseFlags(fs, args[2:])
+	if err != nil {
+		return err
+	}
+	if len(rest) != 0 {
+		return errors.New(usage)
+	}
+	args = args[:2]
+	for _, r := range ageRecipients {
+		if _, err = parseAgeRecipient(r); err != nil {
+			return err
+		}
 	}
 
 	const (
-		promises     = "stdio rpath wpath cpath unix unveil"
+		promises     = "stdio rpath wpath cpath unix inet dns proc exec unveil"
 		execPromises = ""
 	)
 	pledge(promises, execPromises)
@@ -288,67 +541,52 @@ func set(args []string) error {
 	}
 
 	// Now that we have our files, restrict further access
-	unveil(shh.path, "rwc")
+	shh.unveilWrite()
+	shh.unveilNetwork()
 	unveilBlock()
 
 	if _, exist := shh.Secrets[user.Username]; !exist {
 		shh.Secrets[user.Username] = map[string]secret{}
 	}
-	key := args[0]
-	plaintext := args[1]
+	key := inEnv(args[0])
+	plaintext := newSecureBytes([]byte(args[1]))
+	defer plaintext.Destroy()
 
 	// Confirm that a secret under this name is not already in the global
 	// namespace
 	if _, exists := shh.namespace[key]; exists {
-		return errors.New("key exists")
+		return errors.New(tr("key exists"))
+	}
+	if err = shh.checkValue(key, plaintext); err != nil {
+		return err
 	}
 
 	// Encrypt content for each user with access to the secret
+	var users []username
 	for username, secrets := range shh.Secrets {
 		if username != user.Username {
 			if _, ok := secrets[key]; !ok {
 				continue
 			}
 		}
-
-		// Generate an AES key to encrypt the data. We use AES-256
-		// which requires a 32-byte key
-		aesKey := make([]byte, 32)
-		if _, err := rand.Read(aesKey); err != nil {
-			return err
-		}
-		aesBlock, err := aes.NewCipher(aesKey)
-		if err != nil {
-			return err
-		}
-
-		// Encrypt the secret using the new AES key
-		encrypted := make([]byte, aes.BlockSize+len(plaintext))
-		iv := encrypted[:aes.BlockSize]
-		if _, err := io.ReadFull(rand.Reader, iv); err != nil {
-			return fmt.Errorf("read iv: %w", err)
-		}
-		stream := cipher.NewCFBEncrypter(aesBlock, iv)
-		stream.XORKeyStream(encrypted[aes.BlockSize:], []byte(plaintext))
-
-		// Encrypt the AES key using the public key
-		pubKey, err := x509.ParsePKCS1PublicKey(shh.Keys[username].Bytes)
-		if err != nil {
-			return fmt.Errorf("parse public key: %w", err)
-		}
-		encryptedAES, err := rsa.EncryptOAEP(sha256.New(), rand.Reader,
-			pubKey, aesKey, nil)
-		if err != nil {
-			return fmt.Errorf("reencrypt secret: %w", err)
+		users = append(users, username)
+	}
+	for _, member := range shh.envMembers() {
+		if member != user.Username {
+			users = append(users, member)
 		}
-
-		// We base64 encode all encrypted data before passing it into
-		// the .shh file
-		sec := secret{
-			AESKey:    base64.StdEncoding.EncodeToString(encryptedAES),
-			Encrypted: base64.StdEncoding.EncodeToString(encrypted),
+	}
+	for _, r := range ageRecipients {
+		users = append(users, username(r))
+	}
+	err = shh.encryptForUsers(users, key, plaintext, func(u username) secret {
+		if isAgeRecipient(u) {
+			return secret{}
 		}
-		shh.Secrets[username][key] = sec
+		return secret{Sensitive: *sensitive}
+	})
+	if err != nil {
+		return err
 	}
 	return shh.EncodeToFile()
 }
@@ -357,17 +595,26 @@ func set(args []string) error {
 // user can manually delete secrets belonging to others, but this prevents
 // accidentally deleting secrets belonging to others.
 func del(args []string) error {
+	fs := flag.NewFlagSet("del", flag.ContinueOnError)
+	var yes bool
+	fs.BoolVar(&yes, "yes", false, "delete without confirmation")
+	fs.BoolVar(&yes, "f", false, "alias for --yes")
+	force := fs.Bool("force", false, "delete protected secrets")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
 	if len(args) != 1 {
-		return errors.New("bad args: expected `del $secret`")
+		return errors.New("bad args: expected `del [--yes] $secret`")
 	}
 
 	const (
-		promises     = "stdio rpath wpath cpath unveil"
+		promises     = "stdio rpath wpath cpath inet dns proc exec unveil"
 		execPromises = ""
 	)
 	pledge(promises, execPromises)
 
-	secret := args[0]
+	secret := inEnv(args[0])
 	configPath, err := getConfigPath()
 	if err != nil {
 		return err
@@ -382,12 +629,13 @@ func del(args []string) error {
 	}
 
 	// Now that we have our files, restrict further access
-	unveil(shh.path, "rwc")
+	shh.unveilWrite()
+	shh.unveilNetwork()
 	unveilBlock()
 
 	// Confirm that the secret exists at all
-	if _, exists := shh.namespace[secret]; !exists {
-		return errors.New("secret does not exist")
+	if _, exists := shh.namespace[secret]; !exists && !strings.HasSuffix(secret, "*") {
+		return &notFoundError{"secret does not exist"}
 	}
 
 	// Get all secrets matching a search term. This throws an error if no
@@ -396,16 +644,29 @@ func del(args []string) error {
 	if err != nil {
 		return err
 	}
+	if len(secretsToDelete) == 0 {
+		return &notFoundError{"no matching secrets"}
+	}
+	access := secretAccess(shh)
+	names := make([]string, 0, len(secretsToDelete))
+	for name := range secretsToDelete {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("- %s (%s)\n", name, joinUsernames(accessUsers(access[name])))
+	}
+	if err = confirm(yes, "move %d secrets to the trash?", len(names)); err != nil {
+		return err
+	}
+	if err = confirmProtected(shh, names, *force); err != nil {
+		return err
+	}
 
-	// Delete all matching secrets across every user in the project
-	for username := range shh.Keys {
-		userSecrets := shh.Secrets[username]
-		for key := range secretsToDelete {
-			delete(userSecrets, key)
-		}
-		if len(userSecrets) == 0 {
-			delete(shh.Secrets, username)
-		}
+	// Move all matching secrets across every user in the project into the
+	// trash
+	for key := range secretsToDelete {
+		shh.trashSecret(key, user.Username)
 	}
 	if err = shh.EncodeToFile(); err != nil {
 		return fmt.Errorf("encode to file: %w", err)
@@ -415,18 +676,31 @@ func del(args []string) error {
 
 // allow a user to access a secret. You must have access yourself.
 func allow(nonInteractive bool, args []string) error {
-	if len(args) != 2 {
-		return errors.New("bad args: expected `allow $user $secret`")
+	fs := flag.NewFlagSet("allow", flag.ContinueOnError)
+	days := fs.Int("expires", -1, "days until access expires, or 0 for never")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	// Allowing a user an environment grants them all of its secrets,
+	// including those set later
+	joinEnv := len(args) == 1 && environment != ""
+	if len(args) != 2 && !joinEnv {
+		return errors.New("bad args: expected `allow [--expires $days] $user $secret`, or `allow -e $env $user`")
 	}
 
 	const (
-		promises     = "stdio rpath wpath cpath tty inet unveil"
+		promises     = "stdio rpath wpath cpath tty proc exec inet dns unveil"
 		execPromises = ""
 	)
 	pledge(promises, execPromises)
 
 	username := username(args[0])
-	secretKey := args[1]
+	secretKey := inEnv("*")
+	if !joinEnv {
+		secretKey = inEnv(args[1])
+	}
 
 	configPath, err := getConfigPath()
 	if err != nil {
@@ -445,119 +719,109 @@ func allow(nonInteractive bool, args []string) error {
 
 	// Now that we have our files, prevent further unveils
 	unveil(configPath, "r")
-	unveil(shh.path, "rwc")
+	unveil(filepath.Join(configPath, failuresFile), "rwc")
+	shh.unveilWrite()
+	unveilPinentry()
+	shh.unveilNetwork()
 	unveilBlock()
 
-	block, exist := shh.Keys[username]
-	if !exist {
-		return fmt.Errorf("%q is not a user in the project. try `shh add-user %s $PUBKEY`", username, username)
-	}
-	pubKey, err := x509.ParsePKCS1PublicKey(block.Bytes)
-	if err != nil {
-		return fmt.Errorf("parse public key: %w", err)
-	}
-
-	// Decrypt all matching secrets
-	if nonInteractive {
-		user.Password, err = requestPasswordFromServer(user.Port, false)
-		if err != nil {
+	if isAgeRecipient(username) {
+		if joinEnv {
+			return errors.New("age recipients can't be allowed an environment")
+		}
+		if _, err = parseAgeRecipient(string(username)); err != nil {
 			return err
 		}
 	} else {
-		user.Password, err = requestPassword(user.Port, defaultPasswordPrompt)
-		if err != nil {
+		if _, exist := shh.Keys[username]; !exist {
+			return fmt.Errorf("%q is not a user in the project. try `shh add-user %s $PUBKEY`", username, username)
+		}
+		if _, err = shh.wrapperFor(username); err != nil {
 			return err
 		}
 	}
-	keys, err := getKeys(configPath, user.Password)
-	if err != nil {
-		return fmt.Errorf("get keys: %w", err)
-	}
+
+	// Decrypt all matching secrets
 	secrets, err := shh.GetSecretsForUser(secretKey, user.Username)
 	if err != nil {
 		return err
 	}
+	if joinEnv {
+		shh.joinEnvironment(username)
+		if len(secrets) == 0 {
+			return shh.EncodeToFile()
+		}
+	}
 	if len(secrets) == 0 {
-		return errors.New("no matching secrets which you can access")
+		return &notFoundError{"no matching secrets which you can access"}
+	}
+	dec, err := user.decrypterFor(configPath, nonInteractive, secrets)
+	if err != nil {
+		return err
 	}
 	if _, exist := shh.Secrets[username]; !exist {
 		shh.Secrets[username] = map[string]secret{}
 	}
-	for key, sec := range secrets {
-		// Decrypt AES key using personal RSA key
-		aesKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader,
-			keys.PrivateKey, []byte(sec.AESKey), nil)
-		if err != nil {
-			return fmt.Errorf("decrypt secret: %w", err)
-		}
-		aesBlock, err := aes.NewCipher(aesKey)
-		if err != nil {
-			return err
-		}
-		ciphertext := []byte(sec.Encrypted)
-		iv := ciphertext[:aes.BlockSize]
-		ciphertext = ciphertext[aes.BlockSize:]
-		stream := cipher.NewCFBDecrypter(aesBlock, iv)
-		plaintext := make([]byte, len(ciphertext))
-		stream.XORKeyStream(plaintext, []byte(ciphertext))
-
-		// Generate an AES key to encrypt the data. We use AES-256
-		// which requires a 32-byte key
-		aesKey = make([]byte, 32)
-		if _, err := rand.Read(aesKey); err != nil {
-			return err
-		}
-		aesBlock, err = aes.NewCipher(aesKey)
+	keys := make([]string, 0, len(secrets))
+	for key := range secrets {
+		keys = append(keys, key)
+	}
+	expires := shh.grantExpiry(*days)
+	granted := time.Now().UTC().Truncate(time.Second)
+	encs := make([]secret, len(keys))
+	err = parallel(len(keys), func(i int) error {
+		sec := secrets[keys[i]]
+		plaintext, err := decryptSecret(dec, sec)
 		if err != nil {
 			return err
 		}
 
-		// Encrypt the secret using the new AES key
-		encrypted := make([]byte, aes.BlockSize+len(plaintext))
-		iv = encrypted[:aes.BlockSize]
-		if _, err := io.ReadFull(rand.Reader, iv); err != nil {
-			return fmt.Errorf("read iv: %w", err)
-		}
-		stream = cipher.NewCFBEncrypter(aesBlock, iv)
-		stream.XORKeyStream(encrypted[aes.BlockSize:], []byte(plaintext))
-
-		// Encrypt the AES key using the public key
-		encryptedAES, err := rsa.EncryptOAEP(sha256.New(), rand.Reader,
-			pubKey, aesKey, nil)
+		// Add encrypted data and key to .shh
+		enc, err := shh.encryptFor(username, plaintext)
+		plaintext.Destroy()
 		if err != nil {
-			return fmt.Errorf("reencrypt secret: %w", err)
-		}
-
-		// We base64 encode all encrypted data before passing it into
-		// the .shh file
-		sec := secret{
-			AESKey:    base64.StdEncoding.EncodeToString(encryptedAES),
-			Encrypted: base64.StdEncoding.EncodeToString(encrypted),
+			return err
 		}
-
-		// Add encrypted data and key to .shh
-		shh.Secrets[username][key] = sec
+		enc.Sensitive, enc.Protected = sec.Sensitive, sec.Protected
+		enc.Expires, enc.Modified, enc.Granted = expires, sec.Modified, &granted
+		encs[i] = enc
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i, key := range keys {
+		shh.Secrets[username][key] = encs[i]
 	}
 	return shh.EncodeToFile()
 }
 
 // deny a user from accessing secrets.
 func deny(args []string) error {
-	if len(args) > 2 {
-		return errors.New("bad args: expected `deny $user [$secret]`")
+	fs := flag.NewFlagSet("deny", flag.ContinueOnError)
+	var yes bool
+	fs.BoolVar(&yes, "yes", false, "deny without confirmation")
+	fs.BoolVar(&yes, "f", false, "alias for --yes")
+	force := fs.Bool("force", false, "deny access to protected secrets")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("bad args: expected `deny [--yes] $user [$secret]`")
 	}
 
 	const (
-		promises     = "stdio rpath wpath cpath inet"
+		promises     = "stdio rpath wpath cpath inet dns proc exec"
 		execPromises = ""
 	)
 	pledge(promises, execPromises)
 
 	var secretKey string
 	if len(args) == 1 {
-		secretKey = "*"
+		secretKey = inEnv("*")
 	} else {
-		secretKey = args[1]
+		secretKey = inEnv(args[1])
 	}
 	username := username(args[0])
 	shh, err := shhFromPath(".shh")
@@ -568,6 +832,40 @@ func deny(args []string) error {
 	if err != nil {
 		return err
 	}
+
+	// Denying a whole environment, or everything, also revokes the user's
+	// grants, so later secrets aren't given back to them
+	var left bool
+	if len(args) == 1 {
+		for env := range shh.Environments {
+			if (environment == "" || env == environment) &&
+				shh.isMember(env, username) {
+				shh.leaveEnvironment(env, username)
+				left = true
+			}
+		}
+	}
+	if left && len(secrets) == 0 {
+		return shh.EncodeToFile()
+	}
+	if len(secrets) == 0 {
+		return &notFoundError{trf("%s has no matching secrets", username)}
+	}
+	names := make([]string, 0, len(secrets))
+	for name := range secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("- %s\n", name)
+	}
+	if err = confirm(yes, "deny %s access to %d secrets?", username,
+		len(names)); err != nil {
+		return err
+	}
+	if err = confirmProtected(shh, names, *force); err != nil {
+		return err
+	}
 	userSecrets := shh.Secrets[username]
 	for key := range secrets {
 		delete(userSecrets, key)
@@ -586,7 +884,7 @@ func search(args []string) error {
 	}
 
 	const (
-		promises     = "stdio rpath wpath cpath tty inet"
+		promises     = "stdio rpath wpath cpath tty proc exec inet dns"
 		execPromises = ""
 	)
 	pledge(promises, execPromises)
@@ -595,11 +893,6 @@ func search(args []string) error {
 	if err != nil {
 		return fmt.Errorf("bad regular expression: %w", err)
 	}
-	shh, err := shhFromPath(".shh")
-	if err != nil {
-		return err
-	}
-
 	// Decrypt all secrets belonging to current user
 	configPath, err := getConfigPath()
 	if err != nil {
@@ -609,44 +902,38 @@ func search(args []string) error {
 	if err != nil {
 		return fmt.Errorf("get user: %w", err)
 	}
-	user.Password, err = requestPasswordFromServer(user.Port, true)
+	shh, err := shhFromPathFor(".shh", user.Username)
 	if err != nil {
 		return err
 	}
-	keys, err := getKeys(configPath, user.Password)
+	dec, err := user.decrypter(configPath, true)
 	if err != nil {
-		return fmt.Errorf("get keys: %w", err)
+		return err
 	}
 	secrets, err := shh.GetSecretsForUser("*", user.Username)
 	if err != nil {
 		return fmt.Errorf("get secrets: %w", err)
 	}
 	if len(secrets) == 0 {
-		return errors.New("no matching secrets which you can access")
+		return &notFoundError{"no matching secrets which you can access"}
 	}
 	var matches []string
 	for key, sec := range secrets {
-		// Decrypt AES key using personal RSA key
-		aesKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader,
-			keys.PrivateKey, []byte(sec.AESKey), nil)
-		if err != nil {
-			return fmt.Errorf("decrypt secret: %w", err)
+		// Sensitive secrets require a password prompt each time, so
+		// they're never searched
+		if sec.Sensitive {
+			continue
 		}
-		aesBlock, err := aes.NewCipher(aesKey)
+		plaintext, err := decryptSecret(dec, sec)
 		if err != nil {
 			return err
 		}
-		ciphertext := []byte(sec.Encrypted)
-		iv := ciphertext[:aes.BlockSize]
-		ciphertext = ciphertext[aes.BlockSize:]
-		stream := cipher.NewCFBDecrypter(aesBlock, iv)
-		plaintext := make([]byte, len(ciphertext))
-		stream.XORKeyStream(plaintext, []byte(ciphertext))
 
 		// Search for the term
 		if regex.Match(plaintext) {
 			matches = append(matches, key)
 		}
+		plaintext.Destroy()
 	}
 
 	// Output secret names containing the term in separate lines (can then
@@ -664,12 +951,12 @@ func rename(args []string) error {
 	}
 
 	const (
-		promises     = "stdio rpath wpath cpath tty unveil"
+		promises     = "stdio rpath wpath cpath tty inet dns proc exec unveil"
 		execPromises = ""
 	)
 	pledge(promises, execPromises)
 
-	oldName, newName := args[0], args[1]
+	oldName, newName := inEnv(args[0]), inEnv(args[1])
 	if oldName == newName {
 		return errors.New("names are identical")
 	}
@@ -679,11 +966,12 @@ func rename(args []string) error {
 	}
 
 	// Now that we have our files, restrict further access
-	unveil(shh.path, "rwc")
+	shh.unveilWrite()
+	shh.unveilNetwork()
 	unveilBlock()
 
 	if _, ok := shh.namespace[oldName]; !ok {
-		return errors.New("secret does not exist")
+		return &notFoundError{"secret does not exist"}
 	}
 	if _, ok := shh.namespace[newName]; ok {
 		return errors.New("secret already exists by that name")
@@ -705,12 +993,12 @@ func copySecret(args []string) error {
 	}
 
 	const (
-		promises     = "stdio rpath wpath cpath tty unveil"
+		promises     = "stdio rpath wpath cpath tty inet dns proc exec unveil"
 		execPromises = ""
 	)
 	pledge(promises, execPromises)
 
-	oldName, newName := args[0], args[1]
+	oldName, newName := inEnv(args[0]), inEnv(args[1])
 	if oldName == newName {
 		return errors.New("names are identical")
 	}
@@ -720,11 +1008,12 @@ func copySecret(args []string) error {
 	}
 
 	// Now that we have our files, restrict further access
-	unveil(shh.path, "rwc")
+	shh.unveilWrite()
+	shh.unveilNetwork()
 	unveilBlock()
 
 	if _, ok := shh.namespace[oldName]; !ok {
-		return errors.New("secret does not exist")
+		return &notFoundError{"secret does not exist"}
 	}
 	if _, ok := shh.namespace[newName]; ok {
 		return errors.New("secret already exists by that name")
@@ -738,12 +1027,13 @@ func copySecret(args []string) error {
 	return shh.EncodeToFile()
 }
 
-// show users and secrets which they can access.
+// show users and secrets which they can access. In an environment, only its
+// secrets are shown.
 func show(args []string) error {
 	if len(args) > 1 {
 		return errors.New("bad args: expected `show [$user]`")
 	}
-	shh, err := shhFromPath(".shh")
+	shh, err := shhNamesFromPath(".shh")
 	if err != nil {
 		return err
 	}
@@ -755,29 +1045,33 @@ func show(args []string) error {
 
 // showAll users and sorted secrets alongside a summary.
 func showAll(shh *shh) error {
-	secrets := shh.AllSecrets()
-	fmt.Println("====== SUMMARY ======")
-	fmt.Printf("%d users\n", len(shh.Keys))
-	fmt.Printf("%d secrets\n", len(secrets))
-	fmt.Printf("\n")
-	fmt.Printf("======= USERS =======")
 	usernames := []string{}
 	for uname := range shh.Keys {
 		usernames = append(usernames, string(uname))
 	}
 	sort.Strings(usernames)
-	for _, uname := range usernames {
-		// Sort secrets to give consistent output
-		var i int
-		userSecrets := shh.Secrets[username(uname)]
-		secrets := make([]string, len(userSecrets))
-		for secretName := range userSecrets {
-			secrets[i] = secretName
-			i++
+	names := shh.envSecretNames()
+	if jsonOutput {
+		project := projectJSON{Users: []userJSON{}, Secrets: names}
+		for _, uname := range usernames {
+			u := username(uname)
+			project.Users = append(project.Users,
+				userJSON{Name: u, Secrets: shh.envUserNames(u)})
 		}
-		sort.Strings(secrets)
-
-		fmt.Printf("\n%s (%d secrets)\n", uname, len(userSecrets))
+		return printJSON(project)
+	}
+	if isTerminalOutput() {
+		showAllTable(shh, usernames, len(names))
+		return nil
+	}
+	fmt.Println("====== SUMMARY ======")
+	fmt.Printf("%d users\n", len(shh.Keys))
+	fmt.Printf("%d secrets\n", len(names))
+	fmt.Printf("\n")
+	fmt.Printf("======= USERS =======")
+	for _, uname := range usernames {
+		secrets := shh.envUserNames(username(uname))
+		fmt.Printf("\n%s (%d secrets)\n", uname, len(secrets))
 		for _, secret := range secrets {
 			fmt.Printf("> %s\n", secret)
 		}
@@ -785,19 +1079,87 @@ func showAll(shh *shh) error {
 	return nil
 }
 
+// showAllTable prints the users in an aligned table, with their keys, then
+// their secrets, for a terminal.
+func showAllTable(shh *shh, usernames []string, secrets int) {
+	fmt.Printf("%d users, %d secrets\n\n", len(shh.Keys), secrets)
+	rows := [][]cell{{
+		{text: "USER", style: styleBold},
+		{text: "SECRETS", style: styleBold},
+		{text: "KEY", style: styleBold},
+	}}
+	for _, uname := range usernames {
+		u := username(uname)
+		count := cell{text: fmt.Sprint(len(shh.envUserNames(u)))}
+		if count.text == "0" {
+			count.style = styleDim
+		}
+		rows = append(rows, []cell{{text: uname}, count, keyCell(shh, u)})
+	}
+	printTable(os.Stdout, rows)
+	for _, uname := range usernames {
+		secrets := shh.envUserNames(username(uname))
+		if len(secrets) == 0 {
+			continue
+		}
+		fmt.Printf("\n%s\n", styled(styleBold, uname))
+		for _, secret := range secrets {
+			fmt.Println("  " + styledSecretName(secret))
+		}
+	}
+}
+
+// keyCell describes a user's key, warning when it's below the project's
+// minimum size.
+func keyCell(shh *shh, u username) cell {
+	if isKMSKey(u) {
+		return cell{text: "aws kms"}
+	}
+	block := shh.Keys[u]
+	if block == nil {
+		return cell{text: "missing", style: styleRed}
+	}
+	if name, p := providerForBlock(block.Type); p != nil {
+		return cell{text: name}
+	}
+	key, err := parsePublicKey(block)
+	if err != nil {
+		return cell{text: "invalid", style: styleRed}
+	}
+	bits := key.N.BitLen()
+	if bits < shh.MinKeyBits {
+		return cell{text: fmt.Sprintf("rsa %d, below %d", bits,
+			shh.MinKeyBits), style: styleYellow}
+	}
+	return cell{text: fmt.Sprintf("rsa %d", bits), style: styleGreen}
+}
+
+// styledSecretName dims the directories of a secret's name, so the last
+// part stands out.
+func styledSecretName(name string) string {
+	i := strings.LastIndex(name, "/")
+	if i < 0 {
+		return name
+	}
+	return styled(styleDim, name[:i+1]) + name[i+1:]
+}
+
 // showUser secrets, sorted.
 func showUser(shh *shh, username username) error {
-	userSecrets, ok := shh.Secrets[username]
-	if !ok {
+	_, decoded := shh.Secrets[username]
+	if _, encoded := shh.encoded[username]; !decoded && !encoded {
 		return fmt.Errorf("unknown user: %s", username)
 	}
-	var i int
-	secrets := make([]string, len(userSecrets))
-	for secretName := range userSecrets {
-		secrets[i] = secretName
-		i++
+	secrets := shh.envUserNames(username)
+	if jsonOutput {
+		return printJSON(userJSON{Name: username, Secrets: secrets})
+	}
+	if isTerminalOutput() {
+		for _, secret := range secrets {
+			fmt.Println(styledSecretName(secret))
+		}
+		return nil
 	}
-	sort.Strings(secrets)
 	for _, secret := range secrets {
 		fmt.Printf("> %s\n", secret)
 	}
@@ -812,9 +1174,14 @@ func edit(nonInteractive bool, args []string) error {
 	if os.Getenv("EDITOR") == "" {
 		return errors.New("must set $EDITOR")
 	}
+	if !nonInteractive {
+		if err := offerServer(); err != nil {
+			return err
+		}
+	}
 
 	const (
-		promises     = "stdio rpath wpath cpath tty proc exec inet unveil"
+		promises     = "stdio rpath wpath cpath tty proc exec inet dns unveil"
 		execPromises = "stdio rpath wpath cpath tty proc exec error"
 	)
 	pledge(promises, execPromises)
@@ -827,35 +1194,24 @@ func edit(nonInteractive bool, args []string) error {
 	if err != nil {
 		return fmt.Errorf("get user: %w", err)
 	}
-	if nonInteractive {
-		user.Password, err = requestPasswordFromServer(user.Port, false)
-		if err != nil {
-			return err
-		}
-	} else {
-		user.Password, err = requestPassword(user.Port, defaultPasswordPrompt)
-		if err != nil {
-			return err
-		}
-	}
-	keys, err := getKeys(configPath, user.Password)
-	if err != nil {
-		return err
-	}
 
 	shh, err := shhFromPath(".shh")
 	if err != nil {
 		return err
 	}
-	unveil(shh.path, "rwc")
+	shh.unveilWrite()
 
-	secrets, err := shh.GetSecretsForUser(args[0], user.Username)
+	secrets, err := shh.GetSecretsForUser(inEnv(args[0]), user.Username)
 	if err != nil {
 		return err
 	}
 	if len(secrets) > 1 {
 		return errors.New("mulitple secrets found, cannot use *")
 	}
+	dec, err := user.decrypterFor(configPath, nonInteractive, secrets)
+	if err != nil {
+		return err
+	}
 
 	// Expose /tmp for creating a tmp file, a shell to run commands, our
 	// configured editor, as well as necessary libraries.
@@ -864,42 +1220,26 @@ func edit(nonInteractive bool, args []string) error {
 	unveil("/var/run", "r")
 	unveil("/bin/sh", "x")
 	unveil(os.Getenv("EDITOR"), "rx")
+	shh.unveilNetwork()
 	unveilBlock()
 
-	// Create tmp file
+	// Create tmp file, overwriting and removing it when done
 	fi, err := ioutil.TempFile("", "shh")
 	if err != nil {
 		return fmt.Errorf("temp file: %w", err)
 	}
+	defer func() { _ = wipeFile(fi.Name()) }()
 	defer fi.Close()
 
 	// Copy decrypted secret into tmp file
-	var plaintext, aesKey []byte
+	var plaintext secureBytes
 	var key string
 	for k, sec := range secrets {
 		key = k
-
-		// Decrypt the AES key using the private key
-		aesKey, err = rsa.DecryptOAEP(sha256.New(), rand.Reader,
-			keys.PrivateKey, []byte(sec.AESKey), nil)
-		if err != nil {
-			return fmt.Errorf("decrypt secret: %w", err)
-		}
-
-		// Use the decrypted AES key to decrypt the secret
-		aesBlock, err := aes.NewCipher(aesKey)
+		plaintext, err = decryptSecret(dec, sec)
 		if err != nil {
 			return err
 		}
-		if len(sec.Encrypted) < aes.BlockSize {
-			return errors.New("encrypted secret too short")
-		}
-		ciphertext := []byte(sec.Encrypted)
-		iv := ciphertext[:aes.BlockSize]
-		ciphertext = ciphertext[aes.BlockSize:]
-		stream := cipher.NewCFBDecrypter(aesBlock, iv)
-		plaintext = make([]byte, len(ciphertext))
-		stream.XORKeyStream(plaintext, []byte(ciphertext))
 	}
 	if _, err = io.Copy(fi, bytes.NewReader(plaintext)); err != nil {
 		return fmt.Errorf("copy: %w", err)
@@ -913,8 +1253,14 @@ func edit(nonInteractive bool, args []string) error {
 	}
 	origHash := hex.EncodeToString(h.Sum(nil))
 
+	// Close the tmp file before opening it in the editor, since Windows
+	// won't allow the editor to write to a file we hold open
+	if err = fi.Close(); err != nil {
+		return fmt.Errorf("close: %w", err)
+	}
+
 	// Open tmp file in vim
-	cmd := exec.Command("/bin/sh", "-c", "$EDITOR "+fi.Name())
+	cmd := editorCommand(fi.Name())
 	cmd.Stdout = os.Stdout
 	cmd.Stdin = os.Stdin
 	if err = cmd.Start(); err != nil {
@@ -925,10 +1271,13 @@ func edit(nonInteractive bool, args []string) error {
 	}
 
 	// Check if the contents have changed. If not, we can exit early
-	plaintext, err = ioutil.ReadFile(fi.Name())
+	plaintext.Destroy()
+	byt, err := ioutil.ReadFile(fi.Name())
 	if err != nil {
 		return fmt.Errorf("read all: %w", err)
 	}
+	plaintext = newSecureBytes(byt)
+	defer plaintext.Destroy()
 	h = sha1.New()
 	if _, err = h.Write(plaintext); err != nil {
 		return fmt.Errorf("write hash: %w", err)
@@ -939,68 +1288,50 @@ func edit(nonInteractive bool, args []string) error {
 	}
 
 	// Re-encrypt content for each user with access to the secret
-	for username, secrets := range shh.Secrets {
-		if _, ok := secrets[key]; !ok {
-			continue
-		}
-
-		// Generate an AES key to encrypt the data. We use AES-256
-		// which requires a 32-byte key
-		aesKey = make([]byte, 32)
-		if _, err := rand.Read(aesKey); err != nil {
-			return err
-		}
-		aesBlock, err := aes.NewCipher(aesKey)
-		if err != nil {
-			return err
-		}
-
-		// Encrypt the secret using the new AES key
-		encrypted := make([]byte, aes.BlockSize+len(plaintext))
-		iv := encrypted[:aes.BlockSize]
-		if _, err := io.ReadFull(rand.Reader, iv); err != nil {
-			return fmt.Errorf("read iv: %w", err)
-		}
-		stream := cipher.NewCFBEncrypter(aesBlock, iv)
-		stream.XORKeyStream(encrypted[aes.BlockSize:], []byte(plaintext))
-
-		// Encrypt the AES key using the public key
-		pubKey, err := x509.ParsePKCS1PublicKey(shh.Keys[username].Bytes)
-		if err != nil {
-			return fmt.Errorf("parse public key: %w", err)
-		}
-		encryptedAES, err := rsa.EncryptOAEP(sha256.New(), rand.Reader,
-			pubKey, aesKey, nil)
-		if err != nil {
-			return fmt.Errorf("reencrypt secret: %w", err)
-		}
-
-		// We base64 encode all encrypted data before passing it into
-		// the .shh file
-		sec := secret{
-			AESKey:    base64.StdEncoding.EncodeToString(encryptedAES),
-			Encrypted: base64.StdEncoding.EncodeToString(encrypted),
-		}
-		shh.Secrets[username][key] = sec
+	if err = shh.checkValue(key, plaintext); err != nil {
+		return err
+	}
+	if err = shh.updateSecret(key, plaintext); err != nil {
+		return err
 	}
 	return shh.EncodeToFile()
 }
 
 // rotate generates new keys and re-encrypts all secrets using the new keys.
 // You should also use this to change your password.
-func rotate(args []string) error {
-	if len(args) != 0 {
-		return errors.New("bad args: expected none")
+func rotate(nonInteractive bool, args []string) error {
+	fs := flag.NewFlagSet("rotate", flag.ContinueOnError)
+	bits := fs.Int("bits", defaultKeyBits, "RSA key size in bits")
+	all := fs.Bool("all", false, "re-key every secret you can access")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errors.New("bad args: expected `rotate [--bits $n | --all]`")
+	}
+	if *all {
+		if *bits != defaultKeyBits {
+			return errors.New("--bits can't be used with --all")
+		}
+		return rotateAll(nonInteractive)
 	}
 
 	const (
-		promises     = "stdio rpath wpath cpath tty"
+		promises     = "stdio rpath wpath cpath tty proc exec inet dns"
 		execPromises = ""
 	)
 	pledge(promises, execPromises)
 
+	shh, err := shhFromPath(".shh")
+	if err != nil {
+		return err
+	}
+	if *bits < shh.MinKeyBits {
+		return fmt.Errorf("project requires keys of at least %d bits", shh.MinKeyBits)
+	}
+
 	// Allow changing the password
-	oldPass, err := requestPassword(-1, "old password")
+	oldPass, err := requestPassword(nil, "old password")
 	if err != nil {
 		return fmt.Errorf("request old password: %w", err)
 	}
@@ -1018,13 +1349,13 @@ func rotate(args []string) error {
 	// because we'll be renaming the files later, and we can't rename files
 	// across partitions (common for Linux)
 	tmpDir := filepath.Join(configPath, "tmp")
-	if err = os.Mkdir(tmpDir, 0777); err != nil {
+	if err = os.Mkdir(tmpDir, 0700); err != nil {
 		return fmt.Errorf("make tmp dir: %w", err)
 	}
 	defer func() {
 		os.RemoveAll(tmpDir)
 	}()
-	keys, err := createKeys(tmpDir, newPass)
+	keys, err := createKeys(tmpDir, newPass, *bits)
 	if err != nil {
 		return fmt.Errorf("create keys: %w", err)
 	}
@@ -1032,43 +1363,81 @@ func rotate(args []string) error {
 	if err != nil {
 		return fmt.Errorf("get user: %w", err)
 	}
+	if user.Key != "" {
+		return fmt.Errorf("keys in %s are rotated there",
+			strings.SplitN(user.Key, ":", 2)[0])
+	}
+	if user.Keys == nil {
+		return errors.New("kms keys are rotated in aws")
+	}
 
 	// Decrypt all AES secrets for user, re-encrypt with new key
 	oldKeys, err := getKeys(configPath, oldPass)
 	if err != nil {
 		return err
 	}
-	shh, err := shhFromPath(".shh")
-	if err != nil {
-		return err
-	}
-	secrets := shh.Secrets[user.Username]
-	for key, sec := range secrets {
+	reencrypt := func(sec secret) (secret, error) {
 		// Decrypt AES key using old key
 		byt, err := base64.StdEncoding.DecodeString(sec.AESKey)
 		if err != nil {
-			return fmt.Errorf("decode base64: %w", err)
+			return sec, fmt.Errorf("decode base64: %w", err)
 		}
 		aesKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader,
 			oldKeys.PrivateKey, byt, nil)
 		if err != nil {
-			return fmt.Errorf("decrypt secret: %w", err)
+			return sec, fmt.Errorf("decrypt secret: %w", err)
 		}
 
 		// Re-encrypt using new public key
 		encryptedAES, err := rsa.EncryptOAEP(sha256.New(), rand.Reader,
 			keys.PublicKey, aesKey, nil)
 		if err != nil {
-			return fmt.Errorf("reencrypt secret: %w", err)
+			return sec, fmt.Errorf("reencrypt secret: %w", err)
 		}
-		shh.Secrets[user.Username][key] = secret{
-			AESKey:    base64.StdEncoding.EncodeToString(encryptedAES),
-			Encrypted: sec.Encrypted,
+		sec.AESKey = base64.StdEncoding.EncodeToString(encryptedAES)
+		return sec, nil
+	}
+	// Re-encrypt deleted secrets too, so they can still be restored
+	type entry struct {
+		sec  secret
+		save func(secret)
+	}
+	var copies []entry
+	for key, sec := range shh.Secrets[user.Username] {
+		key := key
+		copies = append(copies, entry{sec, func(enc secret) {
+			shh.Secrets[user.Username][key] = enc
+		}})
+	}
+	for _, trashed := range shh.Trash {
+		if sec, ok := trashed.Secrets[user.Username]; ok {
+			secrets := trashed.Secrets
+			copies = append(copies, entry{sec, func(enc secret) {
+				secrets[user.Username] = enc
+			}})
 		}
 	}
+	encs := make([]secret, len(copies))
+	bar := newProgress("re-encrypting", len(copies))
+	err = parallel(len(copies), func(i int) error {
+		enc, err := reencrypt(copies[i].sec)
+		encs[i] = enc
+		bar.add(1)
+		return err
+	})
+	bar.finish()
+	if err != nil {
+		return err
+	}
+	for i, c := range copies {
+		c.save(encs[i])
+	}
 
-	// Update public key in project file
+	// Update public key in project file, and its pin
 	shh.Keys[user.Username] = keys.PublicKeyBlock
+	if _, ok := shh.Pins[user.Username]; ok {
+		shh.Pins[user.Username] = keyFingerprint(keys.PublicKeyBlock)
+	}
 
 	// First create backups of our existing keys
 	err = copyFile(
@@ -1122,12 +1491,12 @@ func rotate(args []string) error {
 
 // addUser to project file.
 func addUser(args []string) error {
-	if len(args) != 0 && len(args) != 2 {
-		return errors.New("bad args: expected `add-user [$user $pubkey]`")
+	if len(args) > 2 || (len(args) == 1 && !isKMSKey(username(args[0]))) {
+		return errors.New("bad args: expected `add-user [$user $pubkey | $kms_arn]`")
 	}
 
 	const (
-		promises     = "stdio rpath wpath cpath unveil"
+		promises     = "stdio rpath wpath cpath inet dns proc exec unveil"
 		execPromises = ""
 	)
 	pledge(promises, execPromises)
@@ -1138,9 +1507,10 @@ func addUser(args []string) error {
 	}
 
 	// Now that we have our files, restrict further access
-	unveil(shh.path, "rwc")
+	shh.unveilWrite()
 
 	var u *user
+	var self *pem.Block
 	if len(args) == 0 {
 		// Default to self
 		configPath, err := getConfigPath()
@@ -1152,35 +1522,62 @@ func addUser(args []string) error {
 		if err != nil {
 			return fmt.Errorf("get user: %w", err)
 		}
+		if self, err = u.publicBlock(); err != nil {
+			return err
+		}
 	} else {
 		u = &user{Username: username(args[0])}
 	}
 
 	// We're done reading files
+	shh.unveilNetwork()
 	unveilBlock()
 
 	if _, exist := shh.Keys[u.Username]; exist {
 		return nil
 	}
-	if len(args) == 0 {
-		shh.Keys[u.Username] = u.Keys.PublicKeyBlock
-	} else {
+	switch len(args) {
+	case 0:
+		shh.Keys[u.Username] = self
+	case 1:
+		key, err := newKMSKey(args[0])
+		if err != nil {
+			return err
+		}
+		shh.Keys[u.Username] = key.kmsBlock()
+	default:
 		shh.Keys[u.Username], _ = pem.Decode([]byte(args[1]))
 		if shh.Keys[u.Username] == nil {
 			return errors.New("bad public key")
 		}
 	}
+	if pin, ok := shh.Pins[u.Username]; ok {
+		if fp := keyFingerprint(shh.Keys[u.Username]); fp != pin {
+			return fmt.Errorf("%s is pinned to %s, not %s", u.Username, pin, fp)
+		}
+	}
+	if _, err = shh.wrapperFor(u.Username); err != nil {
+		return err
+	}
 	return shh.EncodeToFile()
 }
 
 // rmUser from project file.
 func rmUser(args []string) error {
+	fs := flag.NewFlagSet("rm-user", flag.ContinueOnError)
+	var yes bool
+	fs.BoolVar(&yes, "yes", false, "remove without confirmation")
+	fs.BoolVar(&yes, "f", false, "alias for --yes")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
 	if len(args) != 1 {
-		return errors.New("bad args: expected `rm-user $user`")
+		return errors.New("bad args: expected `rm-user [--yes] $user`")
 	}
 
 	const (
-		promises     = "stdio rpath wpath cpath unveil"
+		promises     = "stdio rpath wpath cpath inet dns proc exec unveil"
 		execPromises = ""
 	)
 	pledge(promises, execPromises)
@@ -1190,99 +1587,109 @@ func rmUser(args []string) error {
 		return err
 	}
 
-	unveil(shh.path, "rwc")
+	shh.unveilWrite()
 
 	username := username(args[0])
 	if _, exist := shh.Keys[username]; !exist {
-		return errors.New("user not found")
+		return &notFoundError{"user not found"}
+	}
+	fmt.Printf("- %s (%s, %d secrets)\n", username,
+		describeKey(username, shh.Keys[username]), len(shh.Secrets[username]))
+	if err = confirm(yes, "remove %s from the project?", username); err != nil {
+		return err
 	}
 	delete(shh.Keys, username)
 	delete(shh.Secrets, username)
+	for _, trashed := range shh.Trash {
+		delete(trashed.Secrets, username)
+	}
+	for env := range shh.Environments {
+		shh.leaveEnvironment(env, username)
+	}
 	return shh.EncodeToFile()
 }
 
-// serve maintains the password in memory for an hour. serve cannot be pledged
-// because mlock is not allowed, but we are able to unveil.
+// serve maintains the private key in memory for an hour, decrypting AES keys
+// on behalf of clients which can prove they're the user. serve cannot be
+// pledged because mlock is not allowed, but we are able to unveil. With
+// --systemd, serve accepts a socket passed by systemd socket activation and
+// notifies systemd when it's ready. With --api, it instead serves the
+// project's secrets to local applications.
 func serve(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	systemd := fs.Bool("systemd", false, "run under systemd")
+	api := fs.Bool("api", false, "serve secrets to local applications")
+	socket := fs.String("socket", "", "unix socket for --api")
+	addr := fs.String("addr", "", "loopback address for --api (default "+
+		defaultAPIAddr+")")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
 	if len(args) != 0 {
 		return errors.New("bad args: expected none")
 	}
+	if *api {
+		return serveAPI(*systemd, *socket, *addr)
+	}
+	if *socket != "" || *addr != "" {
+		return errors.New("--socket and --addr require --api")
+	}
 
 	configPath, err := getConfigPath()
 	if err != nil {
 		return err
 	}
-	unveil(configPath, "r")
+	base, err := baseConfigPath()
+	if err != nil {
+		return err
+	}
+
+	// Allow every identity the agent may hold: the base config directory
+	// and its profiles, and their runtime directories
+	unveil(base, "rwc")
+	if rt := runtimePath(configPath); rt != configPath {
+		if err = os.MkdirAll(rt, 0700); err != nil {
+			return err
+		}
+		unveil(filepath.Dir(rt), "rwc")
+	}
 	unveilBlock()
 
 	user, err := getUser(configPath)
 	if err != nil {
 		return fmt.Errorf("get user: %w", err)
 	}
-	const tickTime = time.Hour
-	var mu sync.Mutex
 
 	// Clear secrets when exiting
 	memguard.CatchInterrupt()
 	defer memguard.Purge()
 
-	var pwEnclave *memguard.Enclave
-	resetTicker := make(chan struct{})
-	ticker := time.NewTicker(tickTime)
-	go func() {
-		for {
-			select {
-			case <-resetTicker:
-				ticker.Stop()
-				ticker = time.NewTicker(tickTime)
-			case <-ticker.C:
-				mu.Lock()
-				pwEnclave = nil
-				mu.Unlock()
-			}
-		}
-	}()
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path == "/ping" {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-		mu.Lock()
-		defer mu.Unlock()
-		if r.URL.Path == "/reset-timer" {
-			resetTicker <- struct{}{}
-		}
-		if r.Method == "GET" {
-			if pwEnclave == nil {
-				w.WriteHeader(http.StatusOK)
-				return
-			}
-			b, err := pwEnclave.Open()
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			defer b.Destroy()
-			_, _ = w.Write(b.Bytes())
-			return
-		}
-		byt, err := ioutil.ReadAll(r.Body)
-		if len(byt) == 0 && err == nil {
-			err = errors.New("empty body")
+	var l net.Listener
+	if *systemd {
+		if l, err = systemdListener(); err != nil {
+			return err
 		}
+	}
+	if l == nil {
+		l, err = net.Listen("tcp", fmt.Sprint("127.0.0.1:", user.Port))
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			_, _ = w.Write([]byte(err.Error()))
-			return
+			return err
 		}
-		pwEnclave = memguard.NewEnclave(byt)
-		w.WriteHeader(http.StatusOK)
-	})
-	return http.ListenAndServe(fmt.Sprint(":", user.Port), mux)
+	}
+	if *systemd {
+		if err = sdNotify("READY=1"); err != nil {
+			return err
+		}
+	}
+	a := newAgent(base, user.Port, time.Hour)
+	if user.Autolock {
+		go autolock(a)
+	}
+	return http.Serve(l, a)
 }
 
-// login to the server, caching the password in memory for 1 hour.
+// login to the server, caching the private key in memory for 1 hour.
 func login(args []string) error {
 	if len(args) != 0 {
 		return errors.New("bad args: expected none")
@@ -1299,25 +1706,27 @@ func login(args []string) error {
 		return err
 	}
 	unveil(configPath, "r")
+	unveil(filepath.Join(configPath, failuresFile), "rwc")
+	unveil(runtimePath(configPath), "r")
 
 	user, err := getUser(configPath)
 	if err != nil {
 		return fmt.Errorf("get user: %w", err)
 	}
 
-	// Ensure the server is available
-	url := fmt.Sprint("http://127.0.0.1:", user.Port)
-	if err = pingServer(url); err != nil {
-		return err
+	// Attempt to use cached password before asking again. When using the
+	// server, ensure it's available and reset its timer.
+	cache := user.passwordCache()
+	if _, ok := cache.(serverCache); ok {
+		err = resetServerTimer(user.Port, configPath)
+	} else {
+		_, err = cache.Get()
 	}
-
-	// Attempt to use cached password before asking again
-	user.Password, err = requestPasswordFromServer(user.Port, true)
 	if err == nil {
 		return nil
 	}
 
-	user.Password, err = requestPassword(-1, defaultPasswordPrompt)
+	user.Password, err = requestPassword(nil, defaultPasswordPrompt)
 	if err != nil {
 		return fmt.Errorf("request password: %w", err)
 	}
@@ -1326,19 +1735,207 @@ func login(args []string) error {
 	if _, err = getKeys(configPath, user.Password); err != nil {
 		return err
 	}
-	buf := bytes.NewBuffer(user.Password)
-	resp, err := http.Post(url, "plaintext", buf)
+	return cache.Set(user.Password)
+}
+
+// logout of the server, clearing the cached password from memory immediately.
+// With --all, every identity held by the server is cleared. This is suitable
+// for running from screen-lock hooks.
+func logout(args []string) error {
+	fs := flag.NewFlagSet("logout", flag.ContinueOnError)
+	all := fs.Bool("all", false, "clear all identities held by the server")
+	args, err := parseFlags(fs, args)
 	if err != nil {
-		return fmt.Errorf("new request: %w", err)
+		return err
 	}
-	defer func() { _ = resp.Body.Close() }()
-	if resp.StatusCode != 200 {
-		body, _ := ioutil.ReadAll(resp.Body)
-		return fmt.Errorf("expected 200, got %d: %s", resp.StatusCode, body)
+	if len(args) != 0 {
+		return errors.New("bad args: expected none")
 	}
+
+	const (
+		promises     = "stdio rpath inet unveil"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	configPath, err := getConfigPath()
+	if err != nil {
+		return err
+	}
+	base, err := baseConfigPath()
+	if err != nil {
+		return err
+	}
+	unveil(base, "r")
+	if rt := runtimePath(configPath); rt != configPath {
+		unveil(filepath.Dir(rt), "r")
+	}
+	unveilBlock()
+
+	user, err := getUser(configPath)
+	if err != nil {
+		return fmt.Errorf("get user: %w", err)
+	}
+	if *all {
+		// The server only clears everything for a client which can
+		// authenticate as one of its identities, so try each profile
+		configPaths := []string{configPath, base}
+		infos, err := ioutil.ReadDir(filepath.Join(base, "profiles"))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, info := range infos {
+			if info.IsDir() {
+				configPaths = append(configPaths,
+					profilePath(base, info.Name()))
+			}
+		}
+		return clearServer(user.Port, configPaths)
+	}
+	return user.passwordCache().Clear()
+}
+
+// status reports the state of the server, the current identity, and the
+// project file to help debug why shh is prompting for a password.
+func status(args []string) error {
+	if len(args) != 0 {
+		return errors.New("bad args: expected none")
+	}
+
+	const (
+		promises     = "stdio rpath inet"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	stat, err := getStatus()
+	if err != nil {
+		return err
+	}
+	if jsonOutput {
+		return printJSON(stat)
+	}
+	fmt.Printf("identity:\t%s\n", stat.Identity)
+	fmt.Printf("config:\t\t%s\n", stat.Config)
+	for _, f := range stat.Files {
+		if f.Error != "" {
+			fmt.Printf("%s:\t%s\n", f.Name, f.Error)
+			continue
+		}
+		fmt.Printf("%s:\t%s\n", f.Name, f.Mode)
+	}
+	if stat.Project == "" {
+		fmt.Printf("project:\tno .shh found, searched to %s\n", stat.SearchedTo)
+	} else {
+		fmt.Printf("project:\t%s (%s)\n", stat.Project, stat.ProjectSource)
+	}
+	if stat.Remote != "" {
+		fmt.Printf("remote:\t\t%s\n", stat.Remote)
+	}
+
+	srv := stat.Server
+	switch {
+	case stat.Cache != "":
+		fmt.Printf("cache:\t\t%s\n", stat.Cache)
+		return nil
+	case srv == nil:
+		fmt.Printf("server:\t\tno port configured\n")
+		return nil
+	case !srv.Running:
+		fmt.Printf("server:\t\tnot running on port %d\n", srv.Port)
+		return nil
+	}
+	fmt.Printf("server:\t\trunning on port %d\n", srv.Port)
+	if len(srv.Identities) > 0 {
+		fmt.Printf("identities:\t%s\n", joinUsernames(srv.Identities))
+	}
+	if srv.PID != "" {
+		fmt.Printf("pid:\t\t%s\n", srv.PID)
+	}
+	if !srv.LoggedIn {
+		fmt.Printf("password:\tnot cached. run `shh login`\n")
+		return nil
+	}
+	fmt.Printf("password:\tcached, expires in %ds\n", srv.ExpiresIn)
 	return nil
 }
 
+// getStatus of the identity, project, and server for `status`.
+func getStatus() (*statusJSON, error) {
+	configPath, err := getConfigPath()
+	if err != nil {
+		return nil, err
+	}
+	conf, err := configFromPath(configPath)
+	if err != nil {
+		return nil, err
+	}
+	stat := &statusJSON{Identity: conf.Username, Config: configPath}
+	for _, name := range []string{"id_rsa", "id_rsa.pub"} {
+		pth := filepath.Join(configPath, name)
+		fi, err := os.Stat(pth)
+		if err != nil {
+			stat.Files = append(stat.Files,
+				fileStatusJSON{Name: name, Error: err.Error()})
+			continue
+		}
+		stat.Files = append(stat.Files, fileStatusJSON{Name: name,
+			Mode: fmt.Sprintf("%04o", fi.Mode().Perm())})
+	}
+
+	pth, err := findShhRecursive(".shh")
+	switch {
+	case os.IsNotExist(err):
+		stat.SearchedTo = projectPath(".shh")
+		if stat.SearchedTo == ".shh" {
+			if stat.SearchedTo, err = searchBoundary(); err != nil {
+				return nil, err
+			}
+		}
+	case err != nil:
+		return nil, err
+	default:
+		stat.Project, err = filepath.Abs(pth)
+		if err != nil {
+			return nil, fmt.Errorf("abs: %w", err)
+		}
+		stat.ProjectSource = projectSource(pth)
+		var outer outerLayer
+		byt, err := ioutil.ReadFile(pth)
+		if err == nil && json.Unmarshal(byt, &outer) == nil {
+			stat.Remote = outer.Remote
+		}
+	}
+
+	if conf.Cache != "" && conf.Cache != cacheServer {
+		stat.Cache = conf.Cache
+		return stat, nil
+	}
+	if conf.Port == 0 {
+		return stat, nil
+	}
+	stat.Server = &serverJSON{Port: conf.Port}
+	agent, err := statusFromServer(conf.Port, configPath)
+	if err != nil {
+		return stat, nil
+	}
+	stat.Server = &serverJSON{
+		Port:       agent.Port,
+		Running:    true,
+		Identities: agent.Identities,
+		LoggedIn:   agent.LoggedIn,
+	}
+	if agent.LoggedIn {
+		stat.Server.ExpiresIn = agent.ExpiresIn
+	}
+	pid, err := ioutil.ReadFile(filepath.Join(runtimePath(configPath),
+		serverPidFile))
+	if err == nil {
+		stat.Server.PID = string(pid)
+	}
+	return stat, nil
+}
+
 func copyFile(dst, src string) error {
 	srcFi, err := os.Open(src)
 	if err != nil {
@@ -1352,7 +1949,8 @@ func copyFile(dst, src string) error {
 	if err != nil {
 		return err
 	}
-	dstFi, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE, srcStat.Mode())
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	dstFi, err := os.OpenFile(dst, flags, srcStat.Mode())
 	if err != nil {
 		return err
 	}
@@ -1361,46 +1959,17 @@ func copyFile(dst, src string) error {
 	if _, err = io.Copy(dstFi, srcFi); err != nil {
 		return fmt.Errorf("copy: %w", err)
 	}
-	return nil
-}
-
-func usage() {
-	fmt.Println(`usage:
-
-	shh [flags] [command]
-
-global commands:
-	init			initialize store or add self to existing store
-	get $name		get secret
-	set $name $val		set secret
-	del $name		delete a secret
-	copy $old $new          copy a secret, maintaining the same team access
-	rename $old $new        rename a secret
-	allow $user $secret	allow user access to a secret
-	deny $user $secret	deny user access to a secret
-	add-user $user $pubkey  add user to project given their public key
-	rm-user $user		remove user from project
-	search $regex		list all secrets containing the regex
-	show [$user]		show user's allowed and denied keys
-	edit			edit a secret using $EDITOR
-	rotate			rotate key
-	serve			start server to maintain password in memory
-	login			login to server to maintain password in memory
-	version			version information
-	help			usage info
-
-flags:
-	-n			Non-interactive mode. Fail if shh would prompt for the password`)
+	return dstFi.Sync()
 }
 
 func backupReminder(withConfig bool) {
 	if withConfig {
-		fmt.Println("> generated ~/.config/shh/config")
+		notef(os.Stdout, "> generated ~/.config/shh/config\n")
 	}
-	fmt.Println("> generated ~/.config/shh/id_rsa")
-	fmt.Println("> generated ~/.config/shh/id_rsa.pub")
+	notef(os.Stdout, "> generated ~/.config/shh/id_rsa\n")
+	notef(os.Stdout, "> generated ~/.config/shh/id_rsa.pub\n")
 	fmt.Println(">")
-	fmt.Println("> be sure to back up your ~/.config/shh/id_rsa and")
-	fmt.Println("> remember your password, or you may lose access to your")
-	fmt.Println("> secrets!")
+	fmt.Print(tr("> be sure to back up your ~/.config/shh/id_rsa and\n" +
+		"> remember your password, or you may lose access to your\n" +
+		"> secrets!\n"))
 }
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Password manager formats supported by import and export.
+const (
+	formatOnePassword = "1password"
+	formatBitwarden   = "bitwarden"
+	formatLastPass    = "lastpass"
+)
+
+// managerFields are the item fields which become secrets named
+// $folder/$item/$field. Anything else in an item, such as a Bitwarden custom
+// field, is kept under its own name.
+var managerFields = []string{"username", "password", "url", "totp", "notes"}
+
+// redacted replaces values in exports made without --reveal.
+const redacted = "REDACTED"
+
+// managerItem is a login or note in a password manager.
+type managerItem struct {
+	Folder string
+	Name   string
+
+	// Fields maps a field name, usually one of managerFields, to its value.
+	Fields map[string]string
+}
+
+// parseManagerExport parses a 1Password, Bitwarden, or LastPass export into
+// secrets named $folder/$item/$field.
+func parseManagerExport(format string, byt []byte) (map[string]string, error) {
+	var items []managerItem
+	var err error
+	switch format {
+	case formatOnePassword:
+		items, err = parseManagerCSV(byt, map[string][]string{
+			"name":     {"title"},
+			"url":      {"url", "website"},
+			"username": {"username"},
+			"password": {"password"},
+			"totp":     {"otpauth", "one-time password"},
+			"notes":    {"notes"},
+			"folder":   {"vault", "tags"},
+		})
+	case formatLastPass:
+		items, err = parseManagerCSV(byt, map[string][]string{
+			"name":     {"name"},
+			"url":      {"url"},
+			"username": {"username"},
+			"password": {"password"},
+			"totp":     {"totp"},
+			"notes":    {"extra"},
+			"folder":   {"grouping"},
+		})
+	case formatBitwarden:
+		if trimmed := bytes.TrimSpace(byt); len(trimmed) > 0 && trimmed[0] == '{' {
+			items, err = parseBitwardenJSON(byt)
+			break
+		}
+		items, err = parseManagerCSV(byt, map[string][]string{
+			"name":     {"name"},
+			"url":      {"login_uri"},
+			"username": {"login_username"},
+			"password": {"login_password"},
+			"totp":     {"login_totp"},
+			"notes":    {"notes"},
+			"folder":   {"folder"},
+			"fields":   {"fields"},
+		})
+	default:
+		return nil, fmt.Errorf("unknown format %s", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return managerValues(items)
+}
+
+// managerValues converts items to secrets named $folder/$item/$field.
+func managerValues(items []managerItem) (map[string]string, error) {
+	// Items with the same name, such as two logins for one site, are
+	// numbered to keep them apart
+	values := map[string]string{}
+	seen := map[string]int{}
+	for _, item := range items {
+		if item.Name == "" {
+			return nil, errors.New("item without a name")
+		}
+		prefix := item.Name
+		if item.Folder != "" {
+			prefix = strings.Trim(item.Folder, "/") + "/" + prefix
+		}
+		seen[prefix]++
+		if n := seen[prefix]; n > 1 {
+			prefix = fmt.Sprintf("%s %d", prefix, n)
+		}
+		for field, val := range item.Fields {
+			if val != "" {
+				values[prefix+"/"+field] = val
+			}
+		}
+	}
+	return values, nil
+}
+
+// parseManagerCSV parses a CSV export with a header row. columns maps each
+// item field, plus "name" and "folder", to the header names which may hold
+// it. Bitwarden's "fields" column holds custom fields as `name: value` lines.
+func parseManagerCSV(byt []byte, columns map[string][]string) ([]managerItem, error) {
+	r := csv.NewReader(bytes.NewReader(byt))
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+	index := map[string]int{}
+	for i, h := range header {
+		h = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(h, "\ufeff")))
+		for field, names := range columns {
+			for _, name := range names {
+				if _, ok := index[field]; !ok && h == name {
+					index[field] = i
+				}
+			}
+		}
+	}
+	if _, ok := index["name"]; !ok {
+		return nil, errors.New("no name column. is this the right --format?")
+	}
+
+	var items []managerItem
+	for line := 2; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			return items, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		get := func(field string) string {
+			if i, ok := index[field]; ok && i < len(record) {
+				return record[i]
+			}
+			return ""
+		}
+		item := managerItem{
+			Name:   strings.TrimSpace(get("name")),
+			Folder: strings.TrimSpace(get("folder")),
+			Fields: map[string]string{},
+		}
+		if item.Name == "" {
+			return nil, fmt.Errorf("line %d: missing name", line)
+		}
+		for _, field := range managerFields {
+			item.Fields[field] = get(field)
+		}
+		for _, kv := range strings.Split(get("fields"), "\n") {
+			parts := strings.SplitN(kv, ": ", 2)
+			if len(parts) == 2 && parts[0] != "" {
+				item.Fields[parts[0]] = parts[1]
+			}
+		}
+		items = append(items, item)
+	}
+}
+
+// parseBitwardenJSON parses an unencrypted Bitwarden JSON export.
+func parseBitwardenJSON(byt []byte) ([]managerItem, error) {
+	var export struct {
+		Encrypted bool `json:"encrypted"`
+		Folders   []struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"folders"`
+		Items []struct {
+			FolderID string `json:"folderId"`
+			Name     string `json:"name"`
+			Notes    string `json:"notes"`
+			Login    struct {
+				Username string `json:"username"`
+				Password string `json:"password"`
+				TOTP     string `json:"totp"`
+				URIs     []struct {
+					URI string `json:"uri"`
+				} `json:"uris"`
+			} `json:"login"`
+			Fields []struct {
+				Name  string `json:"name"`
+				Value string `json:"value"`
+			} `json:"fields"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(byt, &export); err != nil {
+		return nil, err
+	}
+	if export.Encrypted {
+		return nil, errors.New("encrypted exports aren't supported")
+	}
+	folders := map[string]string{}
+	for _, f := range export.Folders {
+		folders[f.ID] = f.Name
+	}
+	items := make([]managerItem, 0, len(export.Items))
+	for _, it := range export.Items {
+		item := managerItem{
+			Name:   strings.TrimSpace(it.Name),
+			Folder: folders[it.FolderID],
+			Fields: map[string]string{
+				"username": it.Login.Username,
+				"password": it.Login.Password,
+				"totp":     it.Login.TOTP,
+				"notes":    it.Notes,
+			},
+		}
+		if len(it.Login.URIs) > 0 {
+			item.Fields["url"] = it.Login.URIs[0].URI
+		}
+		for _, f := range it.Fields {
+			if f.Name != "" {
+				item.Fields[f.Name] = f.Value
+			}
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// managerItems groups secrets into items, reversing parseManagerExport.
+// Secrets named $item/$field, where $field is one of managerFields, share an
+// item. Any other secret becomes an item holding only a password.
+func managerItems(values map[string]string) []managerItem {
+	isField := map[string]bool{}
+	for _, f := range managerFields {
+		isField[f] = true
+	}
+	byName := map[string]*managerItem{}
+	var names []string
+	for name, val := range values {
+		itemName, field := name, "password"
+		if dir, base := path.Split(name); dir != "" && isField[base] {
+			itemName, field = strings.TrimSuffix(dir, "/"), base
+		}
+		item, ok := byName[itemName]
+		if !ok {
+			folder, base := path.Split(itemName)
+			item = &managerItem{
+				Folder: strings.TrimSuffix(folder, "/"),
+				Name:   base,
+				Fields: map[string]string{},
+			}
+			byName[itemName] = item
+			names = append(names, itemName)
+		}
+		item.Fields[field] = val
+	}
+	sort.Strings(names)
+	items := make([]managerItem, 0, len(names))
+	for _, name := range names {
+		items = append(items, *byName[name])
+	}
+	return items
+}
+
+// writeManagerCSV writes items in the CSV format each manager imports.
+func writeManagerCSV(w io.Writer, format string, items []managerItem) error {
+	var header []string
+	var row func(it managerItem) []string
+	switch format {
+	case formatOnePassword:
+		header = []string{"Title", "Url", "Username", "Password", "OTPAuth",
+			"Favorite", "Archived", "Tags", "Notes"}
+		row = func(it managerItem) []string {
+			f := it.Fields
+			return []string{it.Name, f["url"], f["username"],
+				f["password"], f["totp"], "false", "false", it.Folder,
+				f["notes"]}
+		}
+	case formatBitwarden:
+		header = []string{"folder", "favorite", "type", "name", "notes",
+			"fields", "reprompt", "login_uri", "login_username",
+			"login_password", "login_totp"}
+		row = func(it managerItem) []string {
+			f := it.Fields
+			return []string{it.Folder, "", "login", it.Name, f["notes"],
+				"", "0", f["url"], f["username"], f["password"],
+				f["totp"]}
+		}
+	case formatLastPass:
+		header = []string{"url", "username", "password", "totp", "extra",
+			"name", "grouping", "fav"}
+		row = func(it managerItem) []string {
+			f := it.Fields
+			return []string{f["url"], f["username"], f["password"],
+				f["totp"], f["notes"], it.Name, it.Folder, "0"}
+		}
+	default:
+		return fmt.Errorf("unknown format %s", format)
+	}
+	cw := csv.NewWriter(w)
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, it := range items {
+		if err := cw.Write(row(it)); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// exportSecrets writes the user's secrets as a password manager CSV for teams
+// moving off shh. Values are redacted unless --reveal is passed, so the
+// mapping can be reviewed first. Revealed exports must go to a file, which is
+// created with 0600 permissions.
+func exportSecrets(nonInteractive bool, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := fs.String("format", "", "1password, bitwarden, or lastpass")
+	reveal := fs.Bool("reveal", false, "include plaintext values")
+	out := fs.String("o", "", "output file")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	glob := "*"
+	switch len(args) {
+	case 0:
+	case 1:
+		glob = args[0]
+	default:
+		return errors.New("bad args: expected `export --format $fmt [$glob]`")
+	}
+	switch *format {
+	case formatOnePassword, formatBitwarden, formatLastPass:
+	default:
+		return errors.New("bad args: --format must be 1password, bitwarden, or lastpass")
+	}
+	if *reveal && *out == "" && terminal.IsTerminal(int(os.Stdout.Fd())) {
+		return errors.New("refusing to reveal secrets to a terminal. use -o")
+	}
+
+	const (
+		promises     = "stdio rpath wpath cpath tty proc exec inet dns"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	configPath, err := getConfigPath()
+	if err != nil {
+		return err
+	}
+	user, err := getUser(configPath)
+	if err != nil {
+		return fmt.Errorf("get user: %w", err)
+	}
+	shh, err := shhFromPathFor(".shh", user.Username)
+	if err != nil {
+		return err
+	}
+	secrets, err := shh.GetSecretsForUser(glob, user.Username)
+	if err != nil {
+		return err
+	}
+	values := make(map[string]string, len(secrets))
+	if *reveal {
+		dec, err := user.decrypterFor(configPath, nonInteractive, secrets)
+		if err != nil {
+			return err
+		}
+		err = decryptEach(dec, secrets, func(name string, plaintext secureBytes) error {
+			values[name] = string(plaintext)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		for name := range secrets {
+			values[name] = redacted
+		}
+	}
+
+	var buf bytes.Buffer
+	defer func() { wipe(buf.Bytes()) }()
+	if err = writeManagerCSV(&buf, *format, managerItems(values)); err != nil {
+		return err
+	}
+	if *out == "" {
+		_, err = os.Stdout.Write(buf.Bytes())
+		return err
+	}
+	fi, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = fi.Write(buf.Bytes()); err != nil {
+		fi.Close()
+		return err
+	}
+	return fi.Close()
+}
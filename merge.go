@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const (
+	preferOurs   = "ours"
+	preferTheirs = "theirs"
+)
+
+// mergeShh merges the changes made in ours and theirs since base. Each
+// user's key and each secret, meaning who can access it and their
+// ciphertext, are merged independently, so changes to different users or
+// secrets never conflict. When both sides changed the same item differently,
+// it's reported as a conflict and resolve decides whether to use theirs.
+// Otherwise ours is kept.
+func mergeShh(base, ours, theirs *shh, resolve func(what string) bool) (*shh, []string) {
+	merged := newShh(ours.path)
+	merged.binary = ours.binary
+	merged.sealKey, merged.sealSalt = ours.sealKey, ours.sealSalt
+	merged.sealKMS, merged.sealWrapped = ours.sealKMS, ours.sealWrapped
+	if ours.sealKey == nil && base.sealKey == nil {
+		// They sealed the file
+		merged.sealKey, merged.sealSalt = theirs.sealKey, theirs.sealSalt
+		merged.sealKMS, merged.sealWrapped = theirs.sealKMS, theirs.sealWrapped
+	}
+	var conflicts []string
+	take := func(what, b, o, t string) bool {
+		useTheirs, conflict := merge3(b, o, t)
+		if conflict {
+			conflicts = append(conflicts, what)
+			return resolve(what)
+		}
+		return useTheirs
+	}
+
+	if take("min_key_bits", strconv.Itoa(base.MinKeyBits),
+		strconv.Itoa(ours.MinKeyBits), strconv.Itoa(theirs.MinKeyBits)) {
+		merged.MinKeyBits = theirs.MinKeyBits
+	} else {
+		merged.MinKeyBits = ours.MinKeyBits
+	}
+	if take("publish", mergeKey(base.Publish), mergeKey(ours.Publish),
+		mergeKey(theirs.Publish)) {
+		merged.Publish = theirs.Publish
+	} else {
+		merged.Publish = ours.Publish
+	}
+
+	if take("trash_days", strconv.Itoa(base.TrashDays),
+		strconv.Itoa(ours.TrashDays), strconv.Itoa(theirs.TrashDays)) {
+		merged.TrashDays = theirs.TrashDays
+	} else {
+		merged.TrashDays = ours.TrashDays
+	}
+
+	if take("environments", mergeKey(base.Environments),
+		mergeKey(ours.Environments), mergeKey(theirs.Environments)) {
+		merged.Environments = theirs.Environments
+	} else {
+		merged.Environments = ours.Environments
+	}
+
+	if take("pins", mergeKey(base.Pins), mergeKey(ours.Pins),
+		mergeKey(theirs.Pins)) {
+		merged.Pins = theirs.Pins
+	} else {
+		merged.Pins = ours.Pins
+	}
+
+	if take("settings", mergeKey(base.Settings), mergeKey(ours.Settings),
+		mergeKey(theirs.Settings)) {
+		merged.Settings = theirs.Settings
+	} else {
+		merged.Settings = ours.Settings
+	}
+
+	users := map[username]struct{}{}
+	for _, s := range []*shh{base, ours, theirs} {
+		for u := range s.Keys {
+			users[u] = struct{}{}
+		}
+	}
+	for _, u := range sortedUsernames(users) {
+		from := ours
+		if take("user "+string(u), mergeKey(base.Keys[u]),
+			mergeKey(ours.Keys[u]), mergeKey(theirs.Keys[u])) {
+			from = theirs
+		}
+		if block, ok := from.Keys[u]; ok {
+			merged.Keys[u] = block
+		}
+	}
+
+	baseAccess := secretAccess(base)
+	oursAccess := secretAccess(ours)
+	theirsAccess := secretAccess(theirs)
+	names := map[string]struct{}{}
+	for _, access := range []map[string]map[username]secret{
+		baseAccess, oursAccess, theirsAccess} {
+		for name := range access {
+			names[name] = struct{}{}
+		}
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	for _, name := range sorted {
+		from := oursAccess
+		if take("secret "+name, mergeKey(baseAccess[name]),
+			mergeKey(oursAccess[name]), mergeKey(theirsAccess[name])) {
+			from = theirsAccess
+		}
+		for u, sec := range from[name] {
+			if _, ok := merged.Secrets[u]; !ok {
+				merged.Secrets[u] = map[string]secret{}
+			}
+			merged.Secrets[u][name] = sec
+			merged.namespace[name] = struct{}{}
+		}
+	}
+
+	trashed := map[string]struct{}{}
+	for _, s := range []*shh{base, ours, theirs} {
+		for name := range s.Trash {
+			trashed[name] = struct{}{}
+		}
+	}
+	sorted = sorted[:0]
+	for name := range trashed {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	for _, name := range sorted {
+		from := ours
+		if take("trash "+name, mergeKey(base.Trash[name]),
+			mergeKey(ours.Trash[name]), mergeKey(theirs.Trash[name])) {
+			from = theirs
+		}
+		t, ok := from.Trash[name]
+		if !ok {
+			continue
+		}
+		if _, restored := merged.namespace[name]; restored {
+			// A secret can't be both live and in the trash
+			continue
+		}
+		if merged.Trash == nil {
+			merged.Trash = map[string]trashedSecret{}
+		}
+		merged.Trash[name] = t
+	}
+	return merged, conflicts
+}
+
+// merge3 decides between two changes to an item given their common base,
+// where an empty string means the item is absent.
+func merge3(base, ours, theirs string) (useTheirs, conflict bool) {
+	switch {
+	case ours == theirs, theirs == base:
+		return false, false
+	case ours == base:
+		return true, false
+	}
+	return false, true
+}
+
+// mergeKey serializes an item for comparison. Maps are encoded with sorted
+// keys, so equal items always compare equal.
+func mergeKey(v interface{}) string {
+	// Keys, secrets, and publish targets always encode
+	byt, _ := json.Marshal(v)
+	switch string(byt) {
+	case "null", "{}", "[]":
+		return ""
+	}
+	return string(byt)
+}
+
+// mergeCmd resolves a .shh file left with conflict markers by git. Each side
+// is decoded and merged with mergeShh, so only changes to the same user or
+// secret conflict. Those are resolved with --ours or --theirs, or else by
+// asking for each one.
+func mergeCmd(nonInteractive bool, args []string) error {
+	fs := flag.NewFlagSet("merge", flag.ContinueOnError)
+	ours := fs.Bool("ours", false, "resolve conflicts using our version")
+	theirs := fs.Bool("theirs", false, "resolve conflicts using their version")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if *ours && *theirs {
+		return errors.New("--ours and --theirs are exclusive")
+	}
+	if len(args) > 1 {
+		return errors.New("bad args: expected `merge [$path]`")
+	}
+
+	const (
+		promises     = "stdio rpath wpath cpath tty proc exec"
+		execPromises = "stdio rpath proc exec"
+	)
+	pledge(promises, execPromises)
+
+	var pth string
+	if len(args) == 1 {
+		pth = args[0]
+	} else if pth, err = findShhRecursive(".shh"); err != nil {
+		return err
+	}
+	byt, err := ioutil.ReadFile(pth)
+	if err != nil {
+		return err
+	}
+	sides, err := conflictSides(pth, byt)
+	if err != nil {
+		return err
+	}
+	var passphrase []byte
+	versions := make([]*shh, len(sides))
+	for i, side := range sides {
+		versions[i], err = decodeShhBytes(pth, side, &passphrase)
+		if err != nil {
+			return fmt.Errorf("%s: %w", []string{"base", "ours", "theirs"}[i], err)
+		}
+	}
+	base, local, other := versions[0], versions[1], versions[2]
+
+	interactive := !nonInteractive && terminal.IsTerminal(int(os.Stdin.Fd()))
+	var unresolved []string
+	merged, _ := mergeShh(base, local, other, func(what string) bool {
+		switch {
+		case *ours:
+			return false
+		case *theirs:
+			return true
+		case !interactive:
+			unresolved = append(unresolved, what)
+			return false
+		}
+		fmt.Printf("conflict in %s\n  ours:   %s\n  theirs: %s\n",
+			what, describeMergeItem(local, what),
+			describeMergeItem(other, what))
+		for {
+			fmt.Print("keep [o]urs or [t]heirs? ")
+			var answer string
+			_, _ = fmt.Scanln(&answer)
+			switch answer {
+			case "o", "ours":
+				return false
+			case "t", "theirs":
+				return true
+			}
+		}
+	})
+	if len(unresolved) > 0 {
+		return fmt.Errorf("conflicts, use --ours or --theirs:\n\t%s",
+			strings.Join(unresolved, "\n\t"))
+	}
+	for _, change := range shhChanges(local, merged, "*") {
+		fmt.Println(change)
+	}
+	if err = merged.EncodeToFile(); err != nil {
+		return err
+	}
+	notef(os.Stdout, "merged, run `git add %s` to mark it resolved\n", pth)
+	return nil
+}
+
+// conflictSides returns the base, our, and their versions of a file with
+// conflict markers. They're read from git's index when it has them, since
+// conflict markers only include the base in diff3 style. A side missing from
+// both is empty.
+func conflictSides(pth string, byt []byte) ([][]byte, error) {
+	if !bytes.Contains(byt, []byte("\n<<<<<<< ")) &&
+		!bytes.HasPrefix(byt, []byte("<<<<<<< ")) {
+		return nil, fmt.Errorf("%s has no conflicts", pth)
+	}
+	dir, name := filepath.Split(pth)
+	if dir == "" {
+		dir = "."
+	}
+	sides := make([][]byte, 3)
+	staged := false
+	for i := range sides {
+		out, err := gitOutput(dir, "show", fmt.Sprintf(":%d:./%s", i+1, name))
+		if err == nil {
+			sides[i] = out
+			staged = staged || i > 0
+		}
+	}
+	if staged {
+		return sides, nil
+	}
+
+	// Not merging in git, e.g. after `git stash pop` was committed, so
+	// split the markers
+	sides = make([][]byte, 3)
+	const (
+		both = iota
+		inOurs
+		inBase
+		inTheirs
+	)
+	state := both
+	for _, line := range strings.SplitAfter(string(byt), "\n") {
+		switch {
+		case strings.HasPrefix(line, "<<<<<<<") && state == both:
+			state = inOurs
+			continue
+		case strings.HasPrefix(line, "|||||||") && state == inOurs:
+			state = inBase
+			continue
+		case strings.HasPrefix(line, "=======") &&
+			(state == inOurs || state == inBase):
+			state = inTheirs
+			continue
+		case strings.HasPrefix(line, ">>>>>>>") && state == inTheirs:
+			state = both
+			continue
+		}
+		for i, in := range []int{inBase, inOurs, inTheirs} {
+			if state == both || state == in {
+				sides[i] = append(sides[i], line...)
+			}
+		}
+	}
+	if state != both {
+		return nil, fmt.Errorf("%s has an unterminated conflict", pth)
+	}
+	if !bytes.Contains(byt, []byte("\n|||||||")) {
+		// Without a base every difference conflicts
+		sides[0] = nil
+	}
+	return sides, nil
+}
+
+// describeMergeItem summarizes one side of a conflict reported by mergeShh.
+func describeMergeItem(s *shh, what string) string {
+	switch {
+	case what == "min_key_bits":
+		return strconv.Itoa(s.MinKeyBits)
+	case what == "publish":
+		return fmt.Sprintf("%d targets", len(s.Publish))
+	case strings.HasPrefix(what, "user "):
+		u := username(strings.TrimPrefix(what, "user "))
+		block, ok := s.Keys[u]
+		if !ok && !isAgeRecipient(u) {
+			return "removed"
+		}
+		return describeKey(u, block)
+	case strings.HasPrefix(what, "secret "):
+		access := secretAccess(s)[strings.TrimPrefix(what, "secret ")]
+		if len(access) == 0 {
+			return "deleted"
+		}
+		return fmt.Sprintf("%s for %s", shortHash(mergeKey(access)),
+			joinUsernames(accessUsers(access)))
+	}
+	return ""
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto"
+	"crypto/aes"
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// secretFS presents the user's secrets as a read-only tree of files, one per
+// secret, with / in secret names creating directories. Secrets are decrypted
+// lazily when opened. The tree is a snapshot of .shh taken when mounted.
+type secretFS struct {
+	dec   crypto.Decrypter
+	nodes []*fsNode
+}
+
+// fsNode is a file or directory. Inode numbers are the index into
+// secretFS.nodes plus one, so the root is inode 1.
+type fsNode struct {
+	ino      uint64
+	name     string
+	parent   *fsNode
+	children map[string]*fsNode
+
+	// secret is nil for directories.
+	secret *secret
+}
+
+func (n *fsNode) isDir() bool { return n.secret == nil }
+
+// size of the plaintext, which is the ciphertext less its IV.
+func (n *fsNode) size() uint64 {
+	if n.isDir() || len(n.secret.Encrypted) < aes.BlockSize {
+		return 0
+	}
+	return uint64(len(n.secret.Encrypted) - aes.BlockSize)
+}
+
+// sortedChildren returns the children in a stable order for readdir.
+func (n *fsNode) sortedChildren() []*fsNode {
+	children := make([]*fsNode, 0, len(n.children))
+	for _, c := range n.children {
+		children = append(children, c)
+	}
+	sort.Slice(children, func(i, j int) bool {
+		return children[i].name < children[j].name
+	})
+	return children
+}
+
+func newSecretFS(dec crypto.Decrypter, secrets map[string]secret) (*secretFS, error) {
+	fsys := &secretFS{dec: dec}
+	root := fsys.newNode("", nil, nil)
+	for name, sec := range secrets {
+		sec := sec
+		parts := strings.Split(name, "/")
+		dir := root
+		for i, part := range parts {
+			if part == "" || part == "." || part == ".." {
+				return nil, fmt.Errorf("%s: cannot be represented as a path", name)
+			}
+			child, ok := dir.children[part]
+			if i == len(parts)-1 {
+				if ok {
+					return nil, fmt.Errorf("%s: conflicts with a directory", name)
+				}
+				fsys.newNode(part, dir, &sec)
+				break
+			}
+			if !ok {
+				child = fsys.newNode(part, dir, nil)
+			}
+			if !child.isDir() {
+				return nil, fmt.Errorf("%s: conflicts with a secret", name)
+			}
+			dir = child
+		}
+	}
+	return fsys, nil
+}
+
+func (fsys *secretFS) newNode(name string, parent *fsNode, sec *secret) *fsNode {
+	n := &fsNode{
+		ino:    uint64(len(fsys.nodes) + 1),
+		name:   name,
+		parent: parent,
+		secret: sec,
+	}
+	if sec == nil {
+		n.children = map[string]*fsNode{}
+	}
+	if parent != nil {
+		parent.children[name] = n
+	}
+	fsys.nodes = append(fsys.nodes, n)
+	return n
+}
+
+// node by inode number, or nil if it doesn't exist.
+func (fsys *secretFS) node(ino uint64) *fsNode {
+	if ino == 0 || ino > uint64(len(fsys.nodes)) {
+		return nil
+	}
+	return fsys.nodes[ino-1]
+}
+
+// mount the user's secrets as a read-only filesystem until interrupted, so
+// programs which read credentials from files (e.g. the *_FILE convention) can
+// use them directly.
+func mount(nonInteractive bool, args []string) error {
+	fs := flag.NewFlagSet("mount", flag.ContinueOnError)
+	only := fs.String("only", "*", "glob of secrets to expose")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return errors.New("bad args: expected `mount $dir [--only $glob]`")
+	}
+
+	configPath, err := getConfigPath()
+	if err != nil {
+		return err
+	}
+	user, err := getUser(configPath)
+	if err != nil {
+		return fmt.Errorf("get user: %w", err)
+	}
+	shh, err := shhFromPathFor(".shh", user.Username)
+	if err != nil {
+		return err
+	}
+	secrets, err := shh.GetSecretsForUser(*only, user.Username)
+	if err != nil {
+		return err
+	}
+
+	// Sensitive secrets require the password on every use, which a
+	// long-lived mount can't honor
+	for name, sec := range secrets {
+		if sec.Sensitive {
+			delete(secrets, name)
+		}
+	}
+	dec, err := user.decrypter(configPath, nonInteractive)
+	if err != nil {
+		return err
+	}
+	fsys, err := newSecretFS(dec, secrets)
+	if err != nil {
+		return err
+	}
+	return serveFS(args[0], fsys)
+}
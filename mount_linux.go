@@ -0,0 +1,414 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// FUSE kernel protocol opcodes and constants. See linux/fuse.h.
+const (
+	fuseLookup      = 1
+	fuseForget      = 2
+	fuseGetattr     = 3
+	fuseOpen        = 14
+	fuseRead        = 15
+	fuseStatfs      = 17
+	fuseRelease     = 18
+	fuseFlush       = 25
+	fuseInit        = 26
+	fuseOpendir     = 27
+	fuseReaddir     = 28
+	fuseReleasedir  = 29
+	fuseAccess      = 34
+	fuseInterrupt   = 36
+	fuseDestroy     = 38
+	fuseBatchForget = 42
+
+	fuseKernelVersion      = 7
+	fuseKernelMinorVersion = 26
+
+	// fuseOpenDirectIO stops the kernel caching plaintext in the page
+	// cache.
+	fuseOpenDirectIO = 1 << 0
+
+	fuseMaxWrite     = 128 * 1024
+	fuseInHeaderSize = 40
+	fuseAttrValid    = 1
+)
+
+var le = binary.LittleEndian
+
+// fuseServer answers FUSE requests for a secretFS.
+type fuseServer struct {
+	fsys    *secretFS
+	dev     *os.File
+	uid     uint32
+	gid     uint32
+	handles map[uint64]secureBytes
+	nextFh  uint64
+}
+
+// serveFS mounts the filesystem at dir and serves it until it's unmounted or
+// shh is interrupted.
+func serveFS(dir string, fsys *secretFS) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	dev, err := fuseMount(dir)
+	if err != nil {
+		return fmt.Errorf("mount: %w", err)
+	}
+	defer dev.Close()
+
+	// Unmount on ^C, which causes the next read from the device to fail
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	go func() {
+		<-sigs
+		_ = fuseUnmount(dir)
+	}()
+
+	srv := &fuseServer{
+		fsys:    fsys,
+		dev:     dev,
+		uid:     uint32(os.Getuid()),
+		gid:     uint32(os.Getgid()),
+		handles: map[uint64]secureBytes{},
+	}
+	defer func() {
+		for _, b := range srv.handles {
+			b.Destroy()
+		}
+	}()
+	notef(os.Stdout, "mounted secrets at %s. press ^C to unmount\n", dir)
+	return srv.serve()
+}
+
+// fuseMount opens /dev/fuse and mounts it at dir. As root this uses mount(2)
+// directly, otherwise the setuid fusermount helper mounts it and passes back
+// the device over a socket.
+func fuseMount(dir string) (*os.File, error) {
+	if os.Geteuid() == 0 {
+		fd, err := unix.Open("/dev/fuse", unix.O_RDWR|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return nil, fmt.Errorf("open /dev/fuse: %w", err)
+		}
+		opts := fmt.Sprintf("fd=%d,rootmode=40000,user_id=0,group_id=0", fd)
+		err = unix.Mount("shh", dir, "fuse.shh",
+			unix.MS_NOSUID|unix.MS_NODEV|unix.MS_RDONLY, opts)
+		if err != nil {
+			unix.Close(fd)
+			return nil, err
+		}
+		return os.NewFile(uintptr(fd), "/dev/fuse"), nil
+	}
+
+	helper, err := fusermount()
+	if err != nil {
+		return nil, err
+	}
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, fmt.Errorf("socketpair: %w", err)
+	}
+	local := os.NewFile(uintptr(fds[0]), "fusermount")
+	remote := os.NewFile(uintptr(fds[1]), "fusermount")
+	defer local.Close()
+	defer remote.Close()
+
+	cmd := exec.Command(helper, "-o", "ro,nosuid,nodev,fsname=shh,subtype=shh",
+		"--", dir)
+	cmd.ExtraFiles = []*os.File{remote}
+	cmd.Env = append(os.Environ(), "_FUSE_COMMFD=3")
+	cmd.Stderr = os.Stderr
+	if err = cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %w", helper, err)
+	}
+
+	buf := make([]byte, 4)
+	oob := make([]byte, unix.CmsgSpace(4))
+	_, oobn, _, _, err := unix.Recvmsg(fds[0], buf, oob, 0)
+	if err != nil {
+		return nil, fmt.Errorf("receive fd: %w", err)
+	}
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) != 1 {
+		return nil, errors.New("receive fd: bad control message")
+	}
+	rights, err := unix.ParseUnixRights(&msgs[0])
+	if err != nil || len(rights) != 1 {
+		return nil, errors.New("receive fd: bad rights")
+	}
+	return os.NewFile(uintptr(rights[0]), "/dev/fuse"), nil
+}
+
+func fuseUnmount(dir string) error {
+	if os.Geteuid() == 0 {
+		return unix.Unmount(dir, unix.MNT_DETACH)
+	}
+	helper, err := fusermount()
+	if err != nil {
+		return err
+	}
+	return exec.Command(helper, "-u", "-z", dir).Run()
+}
+
+func fusermount() (string, error) {
+	for _, name := range []string{"fusermount3", "fusermount"} {
+		if pth, err := exec.LookPath(name); err == nil {
+			return pth, nil
+		}
+	}
+	return "", errors.New("fusermount not found. install fuse")
+}
+
+func (s *fuseServer) serve() error {
+	buf := make([]byte, fuseMaxWrite+4096)
+	for {
+		n, err := syscall.Read(int(s.dev.Fd()), buf)
+		switch {
+		case err == syscall.EINTR || err == syscall.EAGAIN ||
+			err == syscall.ENOENT:
+			// ENOENT means the request was interrupted
+			continue
+		case err == syscall.ENODEV:
+			// Unmounted
+			return nil
+		case err != nil:
+			return fmt.Errorf("read request: %w", err)
+		case n < fuseInHeaderSize:
+			return errors.New("short request")
+		}
+		opcode := le.Uint32(buf[4:])
+		unique := le.Uint64(buf[8:])
+		nodeid := le.Uint64(buf[16:])
+		body := buf[fuseInHeaderSize:n]
+		if opcode == fuseDestroy {
+			s.reply(unique, 0, nil)
+			return nil
+		}
+		out, errno := s.handle(opcode, nodeid, body)
+		switch opcode {
+		case fuseForget, fuseBatchForget, fuseInterrupt:
+			// These never get replies
+			continue
+		}
+		s.reply(unique, errno, out)
+	}
+}
+
+// reply writes a response. Errors are ignored, since they only occur if the
+// request was interrupted or the filesystem was unmounted.
+func (s *fuseServer) reply(unique uint64, errno syscall.Errno, out []byte) {
+	hdr := make([]byte, 16, 16+len(out))
+	le.PutUint32(hdr[0:], uint32(16+len(out)))
+	le.PutUint32(hdr[4:], uint32(-int32(errno)))
+	le.PutUint64(hdr[8:], unique)
+	_, _ = syscall.Write(int(s.dev.Fd()), append(hdr, out...))
+	wipe(out)
+}
+
+func (s *fuseServer) handle(opcode uint32, nodeid uint64, body []byte) ([]byte, syscall.Errno) {
+	switch opcode {
+	case fuseInit:
+		if len(body) < 16 {
+			return nil, syscall.EINVAL
+		}
+		if le.Uint32(body[0:]) < fuseKernelVersion {
+			return nil, syscall.EPROTO
+		}
+		out := make([]byte, 64)
+		le.PutUint32(out[0:], fuseKernelVersion)
+		le.PutUint32(out[4:], fuseKernelMinorVersion)
+		le.PutUint32(out[8:], le.Uint32(body[8:])) // max_readahead
+		le.PutUint32(out[20:], fuseMaxWrite)
+		le.PutUint32(out[24:], 1) // time_gran
+		return out, 0
+	case fuseForget, fuseBatchForget, fuseInterrupt:
+		return nil, 0
+	case fuseLookup:
+		dir := s.fsys.node(nodeid)
+		if dir == nil || !dir.isDir() {
+			return nil, syscall.ENOENT
+		}
+		name := string(body)
+		if i := indexByte(body, 0); i >= 0 {
+			name = string(body[:i])
+		}
+		child, ok := dir.children[name]
+		if !ok {
+			return nil, syscall.ENOENT
+		}
+		out := make([]byte, 40, 128)
+		le.PutUint64(out[0:], child.ino)
+		le.PutUint64(out[16:], fuseAttrValid) // entry_valid
+		le.PutUint64(out[24:], fuseAttrValid) // attr_valid
+		return append(out, s.attr(child)...), 0
+	case fuseGetattr:
+		n := s.fsys.node(nodeid)
+		if n == nil {
+			return nil, syscall.ENOENT
+		}
+		out := make([]byte, 16, 104)
+		le.PutUint64(out[0:], fuseAttrValid)
+		return append(out, s.attr(n)...), 0
+	case fuseOpen:
+		n := s.fsys.node(nodeid)
+		if n == nil {
+			return nil, syscall.ENOENT
+		}
+		if n.isDir() {
+			return nil, syscall.EISDIR
+		}
+		if len(body) >= 4 && le.Uint32(body)&syscall.O_ACCMODE != syscall.O_RDONLY {
+			return nil, syscall.EROFS
+		}
+		plaintext, err := decryptSecret(s.fsys.dec, *n.secret)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "shh: decrypt:", err)
+			return nil, syscall.EIO
+		}
+		s.nextFh++
+		s.handles[s.nextFh] = plaintext
+		out := make([]byte, 16)
+		le.PutUint64(out[0:], s.nextFh)
+		le.PutUint32(out[8:], fuseOpenDirectIO)
+		return out, 0
+	case fuseRead:
+		if len(body) < 24 {
+			return nil, syscall.EINVAL
+		}
+		plaintext, ok := s.handles[le.Uint64(body[0:])]
+		if !ok {
+			return nil, syscall.EBADF
+		}
+		off, size := le.Uint64(body[8:]), uint64(le.Uint32(body[16:]))
+		if off >= uint64(len(plaintext)) {
+			return nil, 0
+		}
+		end := off + size
+		if end > uint64(len(plaintext)) {
+			end = uint64(len(plaintext))
+		}
+		out := make([]byte, end-off)
+		copy(out, plaintext[off:end])
+		return out, 0
+	case fuseRelease:
+		if len(body) < 8 {
+			return nil, syscall.EINVAL
+		}
+		fh := le.Uint64(body[0:])
+		if plaintext, ok := s.handles[fh]; ok {
+			plaintext.Destroy()
+			delete(s.handles, fh)
+		}
+		return nil, 0
+	case fuseOpendir:
+		n := s.fsys.node(nodeid)
+		if n == nil {
+			return nil, syscall.ENOENT
+		}
+		if !n.isDir() {
+			return nil, syscall.ENOTDIR
+		}
+		return make([]byte, 16), 0
+	case fuseReaddir:
+		n := s.fsys.node(nodeid)
+		if n == nil || !n.isDir() {
+			return nil, syscall.ENOENT
+		}
+		if len(body) < 24 {
+			return nil, syscall.EINVAL
+		}
+		return s.readdir(n, le.Uint64(body[8:]), le.Uint32(body[16:])), 0
+	case fuseReleasedir, fuseFlush, fuseAccess:
+		return nil, 0
+	case fuseStatfs:
+		out := make([]byte, 80)
+		le.PutUint64(out[24:], uint64(len(s.fsys.nodes))) // files
+		le.PutUint32(out[40:], 4096)                      // bsize
+		le.PutUint32(out[44:], 255)                       // namelen
+		le.PutUint32(out[48:], 4096)                      // frsize
+		return out, 0
+	}
+	return nil, syscall.ENOSYS
+}
+
+// attr encodes fuse_attr for the node. Files are readable only by the user
+// who mounted them.
+func (s *fuseServer) attr(n *fsNode) []byte {
+	out := make([]byte, 88)
+	le.PutUint64(out[0:], n.ino)
+	le.PutUint64(out[8:], n.size())
+	le.PutUint64(out[16:], (n.size()+511)/512)
+	mode, nlink := uint32(syscall.S_IFREG|0400), uint32(1)
+	if n.isDir() {
+		mode, nlink = syscall.S_IFDIR|0500, 2
+	}
+	le.PutUint32(out[60:], mode)
+	le.PutUint32(out[64:], nlink)
+	le.PutUint32(out[68:], s.uid)
+	le.PutUint32(out[72:], s.gid)
+	le.PutUint32(out[80:], 4096) // blksize
+	return out
+}
+
+// readdir encodes fuse_dirent entries starting at offset, which is the index
+// of the next entry, until size bytes are used.
+func (s *fuseServer) readdir(n *fsNode, offset uint64, size uint32) []byte {
+	type entry struct {
+		ino  uint64
+		name string
+		typ  uint32
+	}
+	parent := n
+	if n.parent != nil {
+		parent = n.parent
+	}
+	entries := []entry{
+		{ino: n.ino, name: ".", typ: syscall.DT_DIR},
+		{ino: parent.ino, name: "..", typ: syscall.DT_DIR},
+	}
+	for _, c := range n.sortedChildren() {
+		typ := uint32(syscall.DT_REG)
+		if c.isDir() {
+			typ = syscall.DT_DIR
+		}
+		entries = append(entries, entry{ino: c.ino, name: c.name, typ: typ})
+	}
+	var out []byte
+	for i := offset; i < uint64(len(entries)); i++ {
+		e := entries[i]
+		reclen := (24 + len(e.name) + 7) &^ 7
+		if len(out)+reclen > int(size) {
+			break
+		}
+		rec := make([]byte, reclen)
+		le.PutUint64(rec[0:], e.ino)
+		le.PutUint64(rec[8:], i+1)
+		le.PutUint32(rec[16:], uint32(len(e.name)))
+		le.PutUint32(rec[20:], e.typ)
+		copy(rec[24:], e.name)
+		out = append(out, rec...)
+	}
+	return out
+}
+
+func indexByte(b []byte, c byte) int {
+	for i := range b {
+		if b[i] == c {
+			return i
+		}
+	}
+	return -1
+}
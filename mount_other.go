@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+func serveFS(dir string, fsys *secretFS) error {
+	return errors.New("mount is only supported on linux")
+}
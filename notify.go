@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxListedSecrets are named in a chat message before the rest are counted.
+const maxListedSecrets = 5
+
+// webhookFormat returns the chat service a webhook posts messages to, if
+// any, and its URL. Slack and Teams are found by their hosts, or chosen with
+// a slack: or teams: prefix, such as for a proxy. Other webhooks are sent
+// the JSON events.
+func webhookFormat(u string) (string, string) {
+	for _, format := range []string{"slack", "teams"} {
+		if strings.HasPrefix(u, format+":http") {
+			return format, strings.TrimPrefix(u, format+":")
+		}
+	}
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return "", u
+	}
+	host := parsed.Hostname()
+	switch {
+	case host == "hooks.slack.com":
+		return "slack", u
+	case strings.HasSuffix(host, ".webhook.office.com"),
+		host == "outlook.office.com":
+		return "teams", u
+	}
+	return "", u
+}
+
+// postMessage sends the events as a chat message, one line for each change.
+func postMessage(client *http.Client, format, u string, payload webhookPayload) error {
+	lines := describeEvents(payload)
+	if len(lines) == 0 {
+		return nil
+	}
+	var msg interface{}
+	switch format {
+	case "slack":
+		msg = map[string]string{"text": strings.Join(lines, "\n")}
+	case "teams":
+		msg = map[string]string{
+			"@type":    "MessageCard",
+			"@context": "https://schema.org/extensions",
+			"summary":  lines[0],
+
+			// Teams needs a blank line to break a line
+			"text": strings.Join(lines, "\n\n"),
+		}
+	}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return postWebhook(client, u, body, "", "", "")
+}
+
+// describeEvents describes the changes in a sentence each, such as "alice
+// granted bob access to prod/db/url". Grants and revocations are grouped by
+// user.
+func describeEvents(payload webhookPayload) []string {
+	actor := string(payload.User)
+	if actor == "" {
+		actor = "someone"
+	}
+	prefix := "[" + payload.Project + "] " + actor + " "
+	var lines []string
+	granted := map[username][]string{}
+	revoked := map[username][]string{}
+	for _, e := range payload.Events {
+		switch e.Type {
+		case "test":
+			lines = append(lines, prefix+"sent a test notification")
+		case "secret.added":
+			lines = append(lines, prefix+"added "+e.Secret)
+		case "secret.changed":
+			lines = append(lines, prefix+"changed "+e.Secret)
+		case "secret.deleted":
+			lines = append(lines, prefix+"deleted "+e.Secret)
+		case "access.granted":
+			granted[e.User] = append(granted[e.User], e.Secret)
+		case "access.revoked":
+			revoked[e.User] = append(revoked[e.User], e.Secret)
+		case "user.added":
+			lines = append(lines, prefix+"added user "+string(e.User))
+		case "user.removed":
+			lines = append(lines, prefix+"removed user "+string(e.User))
+		case "user.key_changed":
+			if e.User == payload.User {
+				lines = append(lines, prefix+"changed their key")
+			} else {
+				lines = append(lines, prefix+"changed the key of "+string(e.User))
+			}
+		}
+	}
+	for _, u := range sortedGroupUsers(granted) {
+		lines = append(lines, fmt.Sprintf("%sgranted %s access to %s", prefix,
+			u, listSecrets(granted[u])))
+	}
+	for _, u := range sortedGroupUsers(revoked) {
+		lines = append(lines, fmt.Sprintf("%srevoked %s's access to %s",
+			prefix, u, listSecrets(revoked[u])))
+	}
+	return lines
+}
+
+func sortedGroupUsers(m map[username][]string) []username {
+	users := map[username]struct{}{}
+	for u := range m {
+		users[u] = struct{}{}
+	}
+	return sortedUsernames(users)
+}
+
+func listSecrets(names []string) string {
+	sort.Strings(names)
+	if len(names) <= maxListedSecrets {
+		return strings.Join(names, ", ")
+	}
+	return fmt.Sprintf("%s and %d more",
+		strings.Join(names[:maxListedSecrets], ", "),
+		len(names)-maxListedSecrets)
+}
+
+// notify sends notifications to the project's webhooks.
+func notify(args []string) error {
+	arg, tail := parseArg(args)
+	switch arg {
+	case "test":
+		if len(tail) != 0 {
+			return errors.New("bad args: expected `notify test`")
+		}
+		return notifyTest()
+	case "":
+		return errors.New("bad args: expected `notify test`")
+	default:
+		return &badArgError{Arg: arg}
+	}
+}
+
+// notifyTest sends a test event to each webhook, so their setup can be
+// checked without changing the project.
+func notifyTest() error {
+	const (
+		promises     = "stdio rpath wpath cpath tty unix inet dns proc exec"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	shh, err := shhNamesFromPath(".shh")
+	if err != nil {
+		return err
+	}
+	if shh.Settings == nil || len(shh.Settings.Webhooks) == 0 {
+		return errors.New("no webhooks. use `shh settings set webhooks $url`")
+	}
+	payload := webhookPayload{
+		Project: projectName(shh.path),
+		Time:    time.Now().UTC().Truncate(time.Second),
+		Command: runningCommand,
+		Events:  []webhookEvent{{Type: "test"}},
+	}
+	errs := sendWebhooks(shh.Settings.Webhooks, payload)
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "webhook %v\n", err)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed webhooks: %d", len(errs))
+	}
+	notef(os.Stdout, "sent to %d webhooks\n", len(shh.Settings.Webhooks))
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"unicode/utf8"
+)
+
+// jsonOutput is set by the global -json flag. Commands which support it print
+// one of the types below rather than text, and errors are printed as
+// errorJSON. These are a stable interface for scripts: fields may be added,
+// but won't be renamed or removed.
+var jsonOutput bool
+
+// quiet is set by the global -q flag, which leaves out notes about what shh
+// did, such as "up to date", printing only what was asked for, prompts, and
+// errors.
+var quiet bool
+
+// notef prints a translated note to w unless -q is set.
+func notef(w io.Writer, format string, args ...interface{}) {
+	if !quiet {
+		fmt.Fprintf(w, tr(format), args...)
+	}
+}
+
+// errorJSON is printed in place of "error: ..." with -json. Code identifies
+// the kind of error, as listed with the exit statuses in error.go.
+type errorJSON struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+// userJSON is a user and the sorted names of the secrets they can access,
+// printed by `show $user`.
+type userJSON struct {
+	Name    username `json:"name"`
+	Secrets []string `json:"secrets"`
+}
+
+// MarshalJSON lists no secrets as [] rather than null.
+func (u userJSON) MarshalJSON() ([]byte, error) {
+	type plain userJSON
+	if u.Secrets == nil {
+		u.Secrets = []string{}
+	}
+	return json.Marshal(plain(u))
+}
+
+// projectJSON is printed by `show`.
+type projectJSON struct {
+	Users   []userJSON `json:"users"`
+	Secrets []string   `json:"secrets"`
+}
+
+// secretJSON is a decrypted secret, printed by `get`, one per line. Values
+// which aren't valid UTF-8 are base64-encoded, with Base64 set.
+type secretJSON struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Base64 bool   `json:"base64,omitempty"`
+}
+
+// statusJSON is printed by `status`. Server is omitted when no server is
+// configured, such as when another cache is used.
+type statusJSON struct {
+	Identity username         `json:"identity"`
+	Config   string           `json:"config"`
+	Files    []fileStatusJSON `json:"files"`
+	Project  string           `json:"project,omitempty"`
+
+	// ProjectSource is how the project was found, or if there's none,
+	// SearchedTo is where the search stopped.
+	ProjectSource string `json:"project_source,omitempty"`
+	SearchedTo    string `json:"searched_to,omitempty"`
+
+	Remote string      `json:"remote,omitempty"`
+	Cache  string      `json:"cache,omitempty"`
+	Server *serverJSON `json:"server,omitempty"`
+}
+
+// fileStatusJSON is the permissions of a file in the config directory, as
+// octal, or why it couldn't be read.
+type fileStatusJSON struct {
+	Name  string `json:"name"`
+	Mode  string `json:"mode,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+type serverJSON struct {
+	Port       int        `json:"port"`
+	Running    bool       `json:"running"`
+	PID        string     `json:"pid,omitempty"`
+	Identities []username `json:"identities,omitempty"`
+	LoggedIn   bool       `json:"logged_in"`
+	ExpiresIn  int        `json:"expires_in,omitempty"`
+}
+
+func newSecretJSON(name string, plaintext []byte) secretJSON {
+	if utf8.Valid(plaintext) {
+		return secretJSON{Name: name, Value: string(plaintext)}
+	}
+	return secretJSON{
+		Name:   name,
+		Value:  base64.StdEncoding.EncodeToString(plaintext),
+		Base64: true,
+	}
+}
+
+// printJSON prints v on one line to stdout.
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	return enc.Encode(v)
+}
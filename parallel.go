@@ -0,0 +1,49 @@
+package main
+
+import (
+	"runtime"
+	"sync"
+)
+
+// parallel calls fn for each index from 0 to n, using a worker per CPU, and
+// returns the first error. After an error, no more indexes are started. RSA
+// operations dominate the time taken by commands which encrypt or decrypt
+// many secrets, and they're independent, so this is where they're spread
+// across cores.
+func parallel(n int, fn func(i int) error) error {
+	workers := runtime.GOMAXPROCS(0)
+	if workers > n {
+		workers = n
+	}
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		next     int
+		firstErr error
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				mu.Lock()
+				i := next
+				next++
+				stop := firstErr != nil || i >= n
+				mu.Unlock()
+				if stop {
+					return
+				}
+				if err := fn(i); err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
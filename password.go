@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// passwordSource lets CI jobs and provisioning scripts supply the password
+// without a terminal or server. It's set by the global --password-file and
+// --password-fd flags, falling back to $SHH_PASSWORD, $SHH_PASSWORD_FILE,
+// and $SHH_PASSWORD_FD.
+var passwordSource struct {
+	file string
+	fd   int
+
+	once     sync.Once
+	password secureBytes
+	err      error
+}
+
+// providedPassword reports the password supplied by flag or environment, if
+// any. The password is only read once, since a file descriptor can't be
+// re-read, and a copy is returned which the caller should destroy.
+func providedPassword() ([]byte, bool, error) {
+	src := &passwordSource
+	src.once.Do(func() {
+		src.password, src.err = readProvidedPassword(src.file, src.fd)
+	})
+	if src.err != nil {
+		return nil, true, src.err
+	}
+	if src.password == nil {
+		return nil, false, nil
+	}
+	password := newSecureBytes(make([]byte, len(src.password)))
+	copy(password, src.password)
+	return password, true, nil
+}
+
+// providedNewPassword reads the password for new keys from
+// $SHH_NEW_PASSWORD_FILE, so gen-keys and rotate can run in scripts. It's
+// kept apart from the provided password, which only unlocks keys.
+func providedNewPassword() ([]byte, bool, error) {
+	file := os.Getenv("SHH_NEW_PASSWORD_FILE")
+	if file == "" {
+		return nil, false, nil
+	}
+	byt, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, true, fmt.Errorf("read new password file: %w", err)
+	}
+	password := newSecureBytes(bytes.TrimRight(byt, "\r\n"))
+	if len(password) == 0 {
+		return nil, true, errors.New("empty new password provided")
+	}
+	return password, true, nil
+}
+
+func readProvidedPassword(file string, fd int) (secureBytes, error) {
+	if file == "" {
+		file = os.Getenv("SHH_PASSWORD_FILE")
+	}
+	if fd == 0 && os.Getenv("SHH_PASSWORD_FD") != "" {
+		var err error
+		fd, err = strconv.Atoi(os.Getenv("SHH_PASSWORD_FD"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid SHH_PASSWORD_FD: %w", err)
+		}
+	}
+	var byt []byte
+	switch {
+	case file != "":
+		var err error
+		byt, err = ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("read password file: %w", err)
+		}
+	case fd > 0:
+		fi := os.NewFile(uintptr(fd), "password")
+		if fi == nil {
+			return nil, fmt.Errorf("invalid password fd %d", fd)
+		}
+		var err error
+		byt, err = ioutil.ReadAll(fi)
+		_ = fi.Close()
+		if err != nil {
+			return nil, fmt.Errorf("read password fd: %w", err)
+		}
+	case os.Getenv("SHH_PASSWORD") != "":
+		byt = []byte(os.Getenv("SHH_PASSWORD"))
+	default:
+		return nil, nil
+	}
+	password := newSecureBytes(bytes.TrimRight(byt, "\r\n"))
+	if len(password) == 0 {
+		return nil, errors.New("empty password provided")
+	}
+	return password, nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// checkPerms refuses to run when the user's keys, their config, or the
+// project file can be changed by other users, or the private key read by
+// them, as OpenSSH does. With fix set, the permissions are tightened instead.
+// Missing files are skipped.
+func checkPerms(fix bool) error {
+	configPath, err := getConfigPath()
+	if err != nil {
+		return err
+	}
+	checks := []struct {
+		pth     string
+		private bool
+	}{
+		{configPath, false},
+		{filepath.Join(configPath, "config"), false},
+		{filepath.Join(configPath, "id_rsa"), true},
+		{filepath.Join(configPath, "id_rsa.pub"), false},
+	}
+	if pth, err := findShhRecursive(".shh"); err == nil {
+		checks = append(checks, struct {
+			pth     string
+			private bool
+		}{pth, false})
+	}
+	for _, c := range checks {
+		if _, err := os.Stat(c.pth); os.IsNotExist(err) {
+			continue
+		}
+		if err := checkFilePerms(c.pth, c.private, fix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// oNoFollow makes opening a file fail if it's a symbolic link.
+const oNoFollow = syscall.O_NOFOLLOW
+
+// checkPrivateKeyPerms requires that only the owner can access the private
+// key.
+func checkPrivateKeyPerms(pth string) error {
+	return checkFilePerms(pth, true, false)
+}
+
+// checkFilePerms refuses a file which others can write, or for a private
+// file, access at all. With fix set, their access is removed instead.
+func checkFilePerms(pth string, private, fix bool) error {
+	fileInfo, err := os.Stat(pth)
+	if err != nil {
+		return err
+	}
+	forbidden := os.FileMode(0022)
+	if private {
+		forbidden = 0077
+	}
+	perm := fileInfo.Mode().Perm()
+	if perm&forbidden == 0 {
+		return nil
+	}
+	if !fix {
+		return fmt.Errorf("permissions %04o for %s are too open. run `chmod %04o %s` or pass --fix-perms",
+			perm, pth, perm&^forbidden, pth)
+	}
+	if err = os.Chmod(pth, perm&^forbidden); err != nil {
+		return err
+	}
+	notef(os.Stderr, "shh: set %s to %04o\n", pth, perm&^forbidden)
+	return nil
+}
+
+// restrictPerms is a no-op, since files are created with the correct mode.
+func restrictPerms(pth string) error { return nil }
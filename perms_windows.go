@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// oNoFollow is unset, since Windows has no such flag. O_EXCL already refuses
+// existing links.
+const oNoFollow = 0
+
+// trustedPrincipals may have access to the private key alongside the current
+// user.
+var trustedPrincipals = []string{
+	`NT AUTHORITY\SYSTEM`,
+	`BUILTIN\Administrators`,
+}
+
+// checkPrivateKeyPerms requires that only the current user (and the system)
+// have access to the private key. Windows ignores unix file modes, so this
+// inspects the file's ACL using icacls.
+func checkPrivateKeyPerms(pth string) error {
+	out, err := exec.Command("icacls", pth).Output()
+	if err != nil {
+		return fmt.Errorf("icacls: %w", err)
+	}
+	owner := currentWindowsUser()
+	scn := bufio.NewScanner(bytes.NewReader(out))
+	for scn.Scan() {
+		line := strings.TrimSpace(strings.TrimPrefix(scn.Text(), pth))
+		idx := strings.Index(line, ":(")
+		if idx == -1 {
+			continue
+		}
+		principal := line[:idx]
+		if strings.EqualFold(principal, owner) {
+			continue
+		}
+		var trusted bool
+		for _, p := range trustedPrincipals {
+			if strings.EqualFold(principal, p) {
+				trusted = true
+				break
+			}
+		}
+		if !trusted {
+			return fmt.Errorf("bad private key permission level. %s can access id_rsa. run `icacls %s /inheritance:r /grant:r %s:F`",
+				principal, pth, owner)
+		}
+	}
+	return scn.Err()
+}
+
+// checkFilePerms checks a private file's ACL, restricting it with fix set.
+// Other files are left to their directory's ACL, since Windows ignores unix
+// file modes.
+func checkFilePerms(pth string, private, fix bool) error {
+	if !private {
+		return nil
+	}
+	err := checkPrivateKeyPerms(pth)
+	if err == nil || !fix {
+		return err
+	}
+	if err = restrictPerms(pth); err != nil {
+		return err
+	}
+	notef(os.Stderr, "shh: restricted %s to %s\n", pth, currentWindowsUser())
+	return nil
+}
+
+// restrictPerms removes inherited permissions, granting access only to the
+// current user.
+func restrictPerms(pth string) error {
+	cmd := exec.Command("icacls", pth, "/inheritance:r", "/grant:r",
+		currentWindowsUser()+":F")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("icacls: %w: %s", err, out)
+	}
+	return nil
+}
+
+func currentWindowsUser() string {
+	return os.Getenv("USERDOMAIN") + `\` + os.Getenv("USERNAME")
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// fuzzyScore reports whether the pattern's characters appear in s in order,
+// ignoring case, and how well they match. Consecutive characters, and those
+// starting a word or a part of a secret's path, score higher, as in fzf.
+func fuzzyScore(pattern, s string) (int, bool) {
+	if pattern == "" {
+		return 0, true
+	}
+	pattern, s = strings.ToLower(pattern), strings.ToLower(s)
+	score, prev, p := 0, -2, 0
+	pr, _ := utf8.DecodeRuneInString(pattern)
+	for i, r := range s {
+		if r != pr {
+			continue
+		}
+		score++
+		if i == prev+1 {
+			score += 4
+		}
+		if i == 0 || strings.ContainsRune("/-_. ", rune(s[i-1])) {
+			score += 3
+		}
+		prev = i
+		p += utf8.RuneLen(pr)
+		if p == len(pattern) {
+			// Prefer shorter names among equal matches
+			return score*100 - len(s), true
+		}
+		pr, _ = utf8.DecodeRuneInString(pattern[p:])
+	}
+	return 0, false
+}
+
+// fuzzyFilter returns the items matching the pattern, best first.
+func fuzzyFilter(items []string, pattern string) []string {
+	if pattern == "" {
+		return items
+	}
+	type match struct {
+		item  string
+		score int
+	}
+	var matches []match
+	for _, item := range items {
+		if score, ok := fuzzyScore(pattern, item); ok {
+			matches = append(matches, match{item, score})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].score > matches[j].score
+	})
+	filtered := make([]string, len(matches))
+	for i, m := range matches {
+		filtered[i] = m.item
+	}
+	return filtered
+}
+
+// picker is a filterable list with a selection, shared by the interactive
+// commands.
+type picker struct {
+	items   []string
+	filter  string
+	matches []string
+	cursor  int
+	offset  int
+}
+
+func newPicker(items []string, filter string) *picker {
+	p := &picker{items: items, filter: filter}
+	p.refilter()
+	return p
+}
+
+func (p *picker) refilter() {
+	p.matches = fuzzyFilter(p.items, p.filter)
+	p.cursor, p.offset = 0, 0
+}
+
+// current returns the highlighted item, if any.
+func (p *picker) current() (string, bool) {
+	if p.cursor >= len(p.matches) {
+		return "", false
+	}
+	return p.matches[p.cursor], true
+}
+
+// handle a key which edits the filter or moves the selection, reporting
+// whether it did. Other keys are left to the caller.
+func (p *picker) handle(k key, height int) bool {
+	switch {
+	case k.text != "":
+		p.filter += k.text
+		p.refilter()
+	case k.name == keyBackspace:
+		if p.filter != "" {
+			_, size := utf8.DecodeLastRuneInString(p.filter)
+			p.filter = p.filter[:len(p.filter)-size]
+			p.refilter()
+		}
+	case k.name == keyClear:
+		p.filter = ""
+		p.refilter()
+	case k.name == keyUp:
+		p.move(-1, height)
+	case k.name == keyDown:
+		p.move(1, height)
+	case k.name == keyPageUp:
+		p.move(-height, height)
+	case k.name == keyPageDown:
+		p.move(height, height)
+	default:
+		return false
+	}
+	return true
+}
+
+// move the cursor, scrolling to keep it within the visible height.
+func (p *picker) move(n, height int) {
+	p.cursor += n
+	if p.cursor >= len(p.matches) {
+		p.cursor = len(p.matches) - 1
+	}
+	if p.cursor < 0 {
+		p.cursor = 0
+	}
+	if p.cursor < p.offset {
+		p.offset = p.cursor
+	}
+	if height > 0 && p.cursor >= p.offset+height {
+		p.offset = p.cursor - height + 1
+	}
+}
+
+// visible returns the matches which fit in the height, and the index of the
+// cursor among them.
+func (p *picker) visible(height int) ([]string, int) {
+	end := p.offset + height
+	if end > len(p.matches) {
+		end = len(p.matches)
+	}
+	return p.matches[p.offset:end], p.cursor - p.offset
+}
+
+// Keys which aren't printable runes.
+const (
+	keyOther = iota
+	keyEnter
+	keyEscape
+	keyTab
+	keyBackspace
+	keyClear
+	keyUp
+	keyDown
+	keyPageUp
+	keyPageDown
+	keyInterrupt
+)
+
+// key is a key read from a terminal in raw mode: printable text, which may
+// be several characters when pasted, a named key, or a control character
+// such as 'Y' for ^Y.
+type key struct {
+	text string
+	name int
+	ctrl byte
+}
+
+// readKey reads one key from the terminal, which must be in raw mode.
+func readKey(fi *os.File) (key, error) {
+	buf := make([]byte, 16)
+	n, err := fi.Read(buf)
+	if err != nil {
+		return key{}, err
+	}
+	b := buf[:n]
+	switch {
+	case string(b) == "\x1b":
+		return key{name: keyEscape}, nil
+	case strings.HasPrefix(string(b), "\x1b"):
+		switch string(b) {
+		case "\x1b[A", "\x1bOA":
+			return key{name: keyUp}, nil
+		case "\x1b[B", "\x1bOB":
+			return key{name: keyDown}, nil
+		case "\x1b[5~":
+			return key{name: keyPageUp}, nil
+		case "\x1b[6~":
+			return key{name: keyPageDown}, nil
+		}
+		return key{name: keyOther}, nil
+	}
+	switch b[0] {
+	case '\r', '\n':
+		return key{name: keyEnter}, nil
+	case '\t':
+		return key{name: keyTab}, nil
+	case 0x7f, 0x08:
+		return key{name: keyBackspace}, nil
+	case 0x15: // ^U
+		return key{name: keyClear}, nil
+	case 0x10: // ^P
+		return key{name: keyUp}, nil
+	case 0x0e: // ^N
+		return key{name: keyDown}, nil
+	case 0x03: // ^C
+		return key{name: keyInterrupt}, nil
+	}
+	if b[0] < 0x20 {
+		return key{name: keyOther, ctrl: b[0] + '@'}, nil
+	}
+	text := strings.Map(func(r rune) rune {
+		if !unicode.IsPrint(r) {
+			return -1
+		}
+		return r
+	}, string(b))
+	if text == "" {
+		return key{name: keyOther}, nil
+	}
+	return key{text: text}, nil
+}
+
+// pickHeight is the most matches shown by pick.
+const pickHeight = 10
+
+// canPick reports whether pick can ask the user to choose, which needs a
+// terminal to read keys from and draw on.
+func canPick(nonInteractive bool) bool {
+	return !nonInteractive && terminal.IsTerminal(int(os.Stdin.Fd())) &&
+		terminal.IsTerminal(int(os.Stderr.Fd()))
+}
+
+// pick one of the items, fzf-style, starting with the query as the filter.
+// The prompt and matches are drawn below the cursor on stderr, so stdout can
+// still be piped, and cleared once one is picked.
+func pick(items []string, query string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	state, err := terminal.MakeRaw(fd)
+	if err != nil {
+		return "", fmt.Errorf("raw mode: %w", err)
+	}
+	defer func() {
+		fmt.Fprint(os.Stderr, "\r\x1b[J")
+		_ = terminal.Restore(fd, state)
+	}()
+	p := newPicker(items, query)
+	for {
+		// Redraw from the prompt line, then return the cursor to its end
+		var buf strings.Builder
+		prompt := fmt.Sprintf("%d/%d > %s", len(p.matches), len(p.items),
+			p.filter)
+		buf.WriteString("\r\x1b[J" + prompt)
+		visible, cursor := p.visible(pickHeight)
+		for i, item := range visible {
+			if i == cursor {
+				buf.WriteString("\r\n" + styled(styleReverse, "> "+item))
+			} else {
+				buf.WriteString("\r\n  " + item)
+			}
+		}
+		if len(visible) > 0 {
+			fmt.Fprintf(&buf, "\x1b[%dA", len(visible))
+		}
+		fmt.Fprintf(&buf, "\r\x1b[%dC", utf8.RuneCountInString(prompt))
+		fmt.Fprint(os.Stderr, buf.String())
+
+		k, err := readKey(os.Stdin)
+		if err != nil {
+			return "", err
+		}
+		if p.handle(k, pickHeight) {
+			continue
+		}
+		switch k.name {
+		case keyEnter:
+			if item, ok := p.current(); ok {
+				return item, nil
+			}
+		case keyEscape, keyInterrupt:
+			return "", errors.New(tr("no secret chosen"))
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// keyFingerprint identifies a public key, like ssh-keygen -l.
+func keyFingerprint(block *pem.Block) string {
+	sum := sha256.Sum256(block.Bytes)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// checkPin reports an error if the project pins the local user to a key
+// other than the one in their config directory.
+func (s *shh) checkPin() error {
+	if len(s.Pins) == 0 || os.Getenv("SHH_KMS_KEY") != "" {
+		return nil
+	}
+	configPath, err := getConfigPath()
+	if err != nil {
+		return nil
+	}
+	conf, err := configFromPath(configPath)
+	if err != nil {
+		// Without an identity there's nothing to check
+		return nil
+	}
+	pin, ok := s.Pins[conf.Username]
+	if !ok {
+		return nil
+	}
+	block, err := localKeyBlock(configPath, conf)
+	if err != nil {
+		return err
+	}
+	fp := keyFingerprint(block)
+	if fp == pin {
+		return nil
+	}
+	debug("pinned key mismatch", "user", conf.Username, "want", pin, "have", fp)
+	return &wrongIdentityError{user: conf.Username, pin: pin,
+		profile: profileWithKey(pin)}
+}
+
+// profileWithKey returns the local profile whose key has the fingerprint, if
+// any.
+func profileWithKey(fp string) string {
+	base, err := baseConfigPath()
+	if err != nil {
+		return ""
+	}
+	names := []string{defaultProfile}
+	infos, _ := ioutil.ReadDir(filepath.Join(base, "profiles"))
+	for _, info := range infos {
+		if info.IsDir() {
+			names = append(names, info.Name())
+		}
+	}
+	for _, name := range names {
+		keys, err := getPublicKey(profilePath(base, name))
+		if err == nil && keyFingerprint(keys.PublicKeyBlock) == fp {
+			return name
+		}
+	}
+	return ""
+}
+
+// pinKey requires a user to use the key with the fingerprint with the
+// project, or unpins them. The fingerprint defaults to that of the user's key
+// in the project, and the user to yourself.
+func pinKey(args []string, pinned bool) error {
+	cmd := "pin-key"
+	if !pinned {
+		cmd = "unpin-key"
+	}
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	switch {
+	case pinned && len(args) > 2:
+		return errors.New("bad args: expected `pin-key [$user] [$fingerprint]`")
+	case !pinned && len(args) != 1:
+		return errors.New("bad args: expected `unpin-key $user`")
+	}
+
+	const (
+		promises     = "stdio rpath wpath cpath tty inet dns proc exec"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	shh, err := shhFromPath(".shh")
+	if err != nil {
+		return err
+	}
+	var u username
+	if len(args) > 0 {
+		u = username(args[0])
+	} else {
+		configPath, err := getConfigPath()
+		if err != nil {
+			return err
+		}
+		user, err := getUser(configPath)
+		if err != nil {
+			return fmt.Errorf("get user: %w", err)
+		}
+		if user.Keys == nil && user.Key == "" {
+			return errKMSUser
+		}
+		u = user.Username
+	}
+	if !pinned {
+		if _, ok := shh.Pins[u]; !ok {
+			return &notFoundError{"user not found"}
+		}
+		delete(shh.Pins, u)
+		if err = shh.EncodeToFile(); err != nil {
+			return err
+		}
+		notef(os.Stdout, "unpinned %s\n", u)
+		return nil
+	}
+
+	var fp string
+	if len(args) == 2 {
+		fp = args[1]
+		if !strings.HasPrefix(fp, "SHA256:") {
+			return fmt.Errorf("invalid fingerprint %s: expected SHA256:...", fp)
+		}
+	} else {
+		block, ok := shh.Keys[u]
+		switch {
+		case !ok:
+			return &notFoundError{"user not found"}
+		case block.Type == kmsBlockType:
+			return errors.New("kms keys can't be pinned")
+		}
+		fp = keyFingerprint(block)
+	}
+	if block, ok := shh.Keys[u]; ok && keyFingerprint(block) != fp {
+		return fmt.Errorf("%s's key in the project is %s, not %s", u,
+			keyFingerprint(block), fp)
+	}
+	if shh.Pins == nil {
+		shh.Pins = map[username]string{}
+	}
+	shh.Pins[u] = fp
+	if err = shh.EncodeToFile(); err != nil {
+		return err
+	}
+	notef(os.Stdout, "pinned %s to %s\n", u, fp)
+	return nil
+}
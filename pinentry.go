@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// readPassword with the prompt, using the pinentry program configured in
+// ~/.config/shh/config if any, or the terminal otherwise.
+func readPassword(prompt string) ([]byte, error) {
+	if program := configuredPinentry(); program != "" {
+		return pinentry(program, tr(prompt))
+	}
+	fmt.Print(tr(prompt) + ": ")
+	password, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	if err != nil {
+		return nil, err
+	}
+	fmt.Print("\n")
+	return password, nil
+}
+
+// configuredPinentry reports the pinentry program, if configured. Errors are
+// ignored since the config may not exist yet, e.g. during gen-keys.
+func configuredPinentry() string {
+	configPath, err := getConfigPath()
+	if err != nil {
+		return ""
+	}
+	conf, err := configFromPath(configPath)
+	if err != nil {
+		return ""
+	}
+	return conf.Pinentry
+}
+
+// unveilPinentry allows executing the configured pinentry program.
+func unveilPinentry() {
+	if program := configuredPinentry(); program != "" {
+		unveil(program, "x")
+	}
+}
+
+// pinentry asks for a password using a pinentry program, as used by gpg. It
+// speaks the Assuan protocol over the program's stdin and stdout.
+func pinentry(program, prompt string) ([]byte, error) {
+	cmd := exec.Command(program)
+	if tty := os.Getenv("GPG_TTY"); tty != "" {
+		cmd.Args = append(cmd.Args, "--ttyname", tty)
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, fmt.Errorf("start pinentry: %w", err)
+	}
+	defer func() {
+		_ = stdin.Close()
+		_ = cmd.Wait()
+	}()
+
+	rd := bufio.NewReader(stdout)
+	if _, err = assuanResponse(rd); err != nil {
+		return nil, fmt.Errorf("pinentry: %w", err)
+	}
+	cmds := []string{
+		"SETTITLE shh",
+		"SETDESC " + assuanEscape("Enter your shh "+prompt),
+		"SETPROMPT " + assuanEscape(prompt+":"),
+	}
+	for _, c := range cmds {
+		if _, err = fmt.Fprintln(stdin, c); err != nil {
+			return nil, fmt.Errorf("pinentry: %w", err)
+		}
+		if _, err = assuanResponse(rd); err != nil {
+			return nil, fmt.Errorf("pinentry: %w", err)
+		}
+	}
+	if _, err = fmt.Fprintln(stdin, "GETPIN"); err != nil {
+		return nil, fmt.Errorf("pinentry: %w", err)
+	}
+	pin, err := assuanResponse(rd)
+	if err != nil {
+		return nil, fmt.Errorf("pinentry: %w", err)
+	}
+	_, _ = fmt.Fprintln(stdin, "BYE")
+	return pin, nil
+}
+
+// assuanResponse reads lines until OK or ERR, returning any data sent.
+func assuanResponse(rd *bufio.Reader) ([]byte, error) {
+	var data []byte
+	for {
+		line, err := rd.ReadString('\n')
+		if err == io.EOF {
+			return nil, errors.New("unexpected eof")
+		}
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "OK" || strings.HasPrefix(line, "OK "):
+			return data, nil
+		case strings.HasPrefix(line, "ERR "):
+			return nil, errors.New(strings.TrimPrefix(line, "ERR "))
+		case strings.HasPrefix(line, "D "):
+			d, err := url.PathUnescape(line[2:])
+			if err != nil {
+				return nil, fmt.Errorf("unescape: %w", err)
+			}
+			data = append(data, d...)
+		}
+	}
+}
+
+// assuanEscape percent-encodes characters which can't appear in a command.
+func assuanEscape(s string) string {
+	r := strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A")
+	return r.Replace(s)
+}
@@ -0,0 +1,219 @@
+package shh
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// Username identifies a user in a project.
+type Username string
+
+// Secret is one user's copy of a secret, as saved in the project file.
+type Secret struct {
+	// AESKey is empty for age recipients, whose value is an armored age
+	// file.
+	AESKey    string `json:"key,omitempty"`
+	Encrypted string `json:"value"`
+
+	// Sensitive secrets always require the password, even when it's
+	// cached.
+	Sensitive bool `json:"sensitive,omitempty"`
+
+	// Protected secrets can only be deleted or denied with --force.
+	Protected bool `json:"protected,omitempty"`
+
+	// Expires is when the user's access ends, if it was given for a time.
+	Expires *time.Time `json:"expires,omitempty"`
+
+	// Modified is when the value was last set, and Granted when the user
+	// was given access. They're unset for secrets set by older versions.
+	Modified *time.Time `json:"modified,omitempty"`
+	Granted  *time.Time `json:"granted,omitempty"`
+}
+
+// KeyWrapper encrypts a secret's AES key for one user.
+type KeyWrapper interface {
+	WrapKey(aesKey []byte) ([]byte, error)
+}
+
+// KeyUnwrapper decrypts a secret's AES key with one user's private key.
+type KeyUnwrapper interface {
+	UnwrapKey(wrapped []byte) ([]byte, error)
+}
+
+// KeyProvider unwraps AES keys for a user, so their secrets can be read.
+type KeyProvider interface {
+	KeyUnwrapper
+	User() Username
+}
+
+// RSAKeyWrapper encrypts AES keys with a user's RSA public key.
+type RSAKeyWrapper struct {
+	*rsa.PublicKey
+}
+
+// WrapKey with RSA-OAEP and SHA-256.
+func (w RSAKeyWrapper) WrapKey(aesKey []byte) ([]byte, error) {
+	return rsa.EncryptOAEP(sha256.New(), rand.Reader, w.PublicKey, aesKey,
+		nil)
+}
+
+// DecrypterKey unwraps AES keys with a private key, such as an
+// *rsa.PrivateKey or one held by an agent.
+type DecrypterKey struct {
+	crypto.Decrypter
+}
+
+// UnwrapKey with RSA-OAEP and SHA-256.
+func (k DecrypterKey) UnwrapKey(wrapped []byte) ([]byte, error) {
+	return k.Decrypt(rand.Reader, wrapped,
+		&rsa.OAEPOptions{Hash: crypto.SHA256})
+}
+
+type keyProvider struct {
+	KeyUnwrapper
+	user Username
+}
+
+func (k keyProvider) User() Username { return k.user }
+
+// NewKeyProvider for the user, whose secrets are read with their private key.
+func NewKeyProvider(user Username, dec crypto.Decrypter) KeyProvider {
+	return keyProvider{KeyUnwrapper: DecrypterKey{dec}, user: user}
+}
+
+// ReadPrivateKey reads a private key saved by `shh gen-keys`, such as
+// ~/.config/shh/id_rsa, decrypting it with the user's password.
+func ReadPrivateKey(pth string, password []byte) (*rsa.PrivateKey, error) {
+	byt, err := ioutil.ReadFile(pth)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(byt)
+	if block == nil || block.Type != "RSA PRIVATE KEY" {
+		return nil, errors.New("failed to decode pem block for encrypted private key")
+	}
+	byt, err = x509.DecryptPEMBlock(block, password)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt private key: %w", err)
+	}
+	defer wipe(byt)
+	return x509.ParsePKCS1PrivateKey(byt)
+}
+
+// EncryptSecret with a new AES-256 key, which is itself encrypted for the
+// user. The result is base64 encoded for the project file.
+func EncryptSecret(w KeyWrapper, plaintext []byte) (Secret, error) {
+	// Generate an AES key to encrypt the data. We use AES-256 which
+	// requires a 32-byte key
+	aesKey := make([]byte, 32)
+	defer wipe(aesKey)
+	if _, err := rand.Read(aesKey); err != nil {
+		return Secret{}, err
+	}
+	return EncryptSecretWithKey(w, aesKey, plaintext)
+}
+
+// EncryptSecretWithKey is EncryptSecret with the caller's random AES-256 key,
+// such as one held in locked memory.
+func EncryptSecretWithKey(w KeyWrapper, aesKey, plaintext []byte) (Secret, error) {
+	aesBlock, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return Secret{}, err
+	}
+
+	// Encrypt the secret using the new AES key
+	encrypted := make([]byte, aes.BlockSize+len(plaintext))
+	iv := encrypted[:aes.BlockSize]
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return Secret{}, fmt.Errorf("read iv: %w", err)
+	}
+	stream := cipher.NewCFBEncrypter(aesBlock, iv)
+	stream.XORKeyStream(encrypted[aes.BlockSize:], plaintext)
+
+	// Encrypt the AES key for the user
+	encryptedAES, err := w.WrapKey(aesKey)
+	if err != nil {
+		return Secret{}, fmt.Errorf("reencrypt secret: %w", err)
+	}
+	return Secret{
+		AESKey:    base64.StdEncoding.EncodeToString(encryptedAES),
+		Encrypted: base64.StdEncoding.EncodeToString(encrypted),
+	}, nil
+}
+
+// DecodeSecret decodes the base64 AES key and value for DecryptSecret.
+func DecodeSecret(sec Secret) (Secret, error) {
+	byt, err := base64.StdEncoding.DecodeString(sec.AESKey)
+	if err != nil {
+		return Secret{}, fmt.Errorf("decode b64 aes key: %w", err)
+	}
+	sec.AESKey = string(byt)
+	byt, err = base64.StdEncoding.DecodeString(sec.Encrypted)
+	if err != nil {
+		return Secret{}, fmt.Errorf("decode b64 encrypted: %w", err)
+	}
+	sec.Encrypted = string(byt)
+	return sec, nil
+}
+
+// DecryptSecret decoded by DecodeSecret. The caller should zero the
+// plaintext when done.
+func DecryptSecret(k KeyUnwrapper, sec Secret) ([]byte, error) {
+	// Decrypt the AES key using the private key
+	aesKey, err := k.UnwrapKey([]byte(sec.AESKey))
+	if err != nil {
+		return nil, fmt.Errorf("decrypt secret: %w", err)
+	}
+	defer wipe(aesKey)
+	if len(sec.Encrypted) < aes.BlockSize {
+		return nil, errors.New("encrypted secret too short")
+	}
+	plaintext := make([]byte, len(sec.Encrypted)-aes.BlockSize)
+	if err = DecryptSecretWithKey(aesKey, sec, plaintext); err != nil {
+		return nil, err
+	}
+	return plaintext, nil
+}
+
+// DecryptSecretWithKey is DecryptSecret with the unwrapped AES key, writing
+// the plaintext to a buffer of the caller's, such as one held in locked
+// memory. It must be aes.BlockSize bytes shorter than sec.Encrypted.
+func DecryptSecretWithKey(aesKey []byte, sec Secret, plaintext []byte) error {
+	aesBlock, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return err
+	}
+	if len(sec.Encrypted) < aes.BlockSize {
+		return errors.New("encrypted secret too short")
+	}
+	ciphertext := []byte(sec.Encrypted)
+	iv := ciphertext[:aes.BlockSize]
+	ciphertext = ciphertext[aes.BlockSize:]
+	if len(plaintext) != len(ciphertext) {
+		return fmt.Errorf("expected a %d-byte buffer, got %d",
+			len(ciphertext), len(plaintext))
+	}
+	stream := cipher.NewCFBDecrypter(aesBlock, iv)
+	stream.XORKeyStream(plaintext, ciphertext)
+	return nil
+}
+
+// wipe zeroes the bytes.
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
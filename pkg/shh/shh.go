@@ -0,0 +1,170 @@
+// Package shh reads shh project files, so Go programs can use a project's
+// secrets without the shh command. It never writes them: changes go through
+// the shh command, which enforces the project's policies and records them in
+// the audit log.
+//
+//	p, err := shh.Open(".shh")
+//	...
+//	key, err := shh.ReadPrivateKey(filepath.Join(home, ".config/shh/id_rsa"), password)
+//	...
+//	value, err := p.Get(shh.NewKeyProvider("alice@example.com", key), "database_url")
+//
+// Only JSON project files are supported. Binary, sealed, and remote projects
+// are read with the shh command.
+package shh
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrUnsupported is returned by Open for projects only the shh command can
+// read.
+var ErrUnsupported = errors.New("unsupported project file")
+
+// Project is an open project file.
+type Project struct {
+	// Secrets maps users -> secret names -> their copy of the secret.
+	Secrets map[Username]map[string]Secret
+
+	// Keys are the public keys of each user.
+	Keys map[Username]*pem.Block
+
+	// MinKeyBits is the project's minimum RSA key size.
+	MinKeyBits int
+
+	// Environments maps each environment to its users. Secrets set in an
+	// environment are named $env:$name.
+	Environments map[string][]Username
+}
+
+// Open reads the project file at pth, such as ".shh".
+func Open(pth string) (*Project, error) {
+	byt, err := ioutil.ReadFile(pth)
+	if err != nil {
+		return nil, err
+	}
+	p := &Project{
+		Secrets: map[Username]map[string]Secret{},
+		Keys:    map[Username]*pem.Block{},
+	}
+	if len(bytes.TrimSpace(byt)) == 0 {
+		return p, nil
+	}
+	if byt[0] == 0 {
+		return nil, fmt.Errorf("%s: binary: %w", pth, ErrUnsupported)
+	}
+	raw := map[string]json.RawMessage{}
+	if err = json.Unmarshal(byt, &raw); err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+	for _, field := range []string{"remote", "sealed"} {
+		if _, ok := raw[field]; ok {
+			return nil, fmt.Errorf("%s: %s: %w", pth, field, ErrUnsupported)
+		}
+	}
+	var fields struct {
+		Secrets      map[Username]map[string]Secret `json:"secrets"`
+		Keys         map[Username]*pem.Block        `json:"keys"`
+		MinKeyBits   int                            `json:"min_key_bits"`
+		Environments map[string][]Username          `json:"environments"`
+	}
+	if err = json.Unmarshal(byt, &fields); err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+	if fields.Secrets != nil {
+		p.Secrets = fields.Secrets
+	}
+	if fields.Keys != nil {
+		p.Keys = fields.Keys
+	}
+	p.MinKeyBits = fields.MinKeyBits
+	p.Environments = fields.Environments
+	return p, nil
+}
+
+// Users in the project, sorted.
+func (p *Project) Users() []Username {
+	users := make([]Username, 0, len(p.Keys))
+	for u := range p.Keys {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i] < users[j] })
+	return users
+}
+
+// Names of the secrets the user can read which match the glob, sorted. Only
+// the last character of a glob may be "*".
+func (p *Project) Names(user Username, glob string) ([]string, error) {
+	if err := ValidateGlob(glob); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var names []string
+	for name, sec := range p.Secrets[user] {
+		if Match(glob, name) && !expired(sec, now) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Readers of the secret, sorted.
+func (p *Project) Readers(name string) []Username {
+	var users []Username
+	for u, secrets := range p.Secrets {
+		if _, ok := secrets[name]; ok {
+			users = append(users, u)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i] < users[j] })
+	return users
+}
+
+// Get the value of the secret for the key's user. The caller should zero it
+// when done.
+func (p *Project) Get(k KeyProvider, name string) ([]byte, error) {
+	sec, ok := p.Secrets[k.User()][name]
+	if !ok || expired(sec, time.Now()) {
+		return nil, fmt.Errorf("%s: secret not found", name)
+	}
+	if sec.AESKey == "" {
+		return nil, fmt.Errorf("%s: age: %w", name, ErrUnsupported)
+	}
+	sec, err := DecodeSecret(sec)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return DecryptSecret(k, sec)
+}
+
+// ValidateGlob reports an error if the glob is used anywhere but as the last
+// character.
+func ValidateGlob(glob string) error {
+	idx := strings.Index(glob, "*")
+	if idx != -1 && idx < len(glob)-1 {
+		return errors.New("invalid glob: must be last character")
+	}
+	return nil
+}
+
+// Match reports whether the secret name matches exactly or, if the glob ends
+// with "*", whether it has the glob's prefix.
+func Match(glob, name string) bool {
+	if strings.HasSuffix(glob, "*") {
+		return strings.HasPrefix(name, glob[:len(glob)-1])
+	}
+	return glob == name
+}
+
+func expired(sec Secret, now time.Time) bool {
+	return sec.Expires != nil && now.After(*sec.Expires)
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// valuePolicy constrains the values of secrets matching a glob, so weak or
+// malformed credentials can't enter the store.
+type valuePolicy struct {
+	Glob string `json:"glob"`
+
+	// MinLength is the fewest characters a value may have.
+	MinLength int `json:"min_length,omitempty"`
+
+	// MinEntropy is the fewest estimated bits of entropy a value may have,
+	// requiring it to look random.
+	MinEntropy int `json:"min_entropy,omitempty"`
+
+	// Match is a regular expression the whole value must match.
+	Match string `json:"match,omitempty"`
+}
+
+func (p valuePolicy) validate() error {
+	if err := validateGlob(p.Glob); err != nil {
+		return err
+	}
+	if p.MinLength < 0 || p.MinEntropy < 0 {
+		return fmt.Errorf("policy %s: limits must be >= 0", p.Glob)
+	}
+	if p.Match != "" {
+		if _, err := regexp.Compile(p.Match); err != nil {
+			return fmt.Errorf("policy %s: %w", p.Glob, err)
+		}
+	}
+	return nil
+}
+
+// applies reports whether the policy covers the secret in the project. A
+// glob without an environment applies in every environment.
+func (p valuePolicy) applies(s *shh, name string) bool {
+	if globMatch(p.Glob, name) {
+		return true
+	}
+	env := s.environmentOf(name)
+	return env != "" && s.environmentOf(p.Glob) == "" &&
+		globMatch(p.Glob, strings.TrimPrefix(name, env+envSep))
+}
+
+// check reports an error if the value breaks the policy. The error never
+// includes the value.
+func (p valuePolicy) check(name string, value []byte) error {
+	if n := len([]rune(string(value))); n < p.MinLength {
+		return fmt.Errorf("%s must be at least %d characters, not %d (policy %s)",
+			name, p.MinLength, n, p.Glob)
+	}
+	if p.MinEntropy > 0 {
+		if bits := estimateEntropy(value); bits < float64(p.MinEntropy) {
+			return fmt.Errorf("%s must have at least %d bits of entropy, not %.0f (policy %s)",
+				name, p.MinEntropy, bits, p.Glob)
+		}
+	}
+	if p.Match != "" {
+		re, err := regexp.Compile("^(?:" + p.Match + ")$")
+		if err != nil {
+			return err
+		}
+		if !re.Match(value) {
+			return fmt.Errorf("%s must match %s (policy %s)", name, p.Match,
+				p.Glob)
+		}
+	}
+	return nil
+}
+
+// checkValue reports an error if a new value for the secret breaks any of
+// the project's policies.
+func (s *shh) checkValue(name string, value []byte) error {
+	if s.Settings == nil {
+		return nil
+	}
+	for _, p := range s.Settings.Policies {
+		if !p.applies(s, name) {
+			continue
+		}
+		if err := p.check(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// estimateEntropy estimates the bits of entropy in a value from its length
+// and the variety of its characters. Each character counts for the smaller of
+// the bits needed to pick from the character classes used, and the Shannon
+// entropy of the value, so repetition is penalized.
+func estimateEntropy(value []byte) float64 {
+	runes := []rune(string(value))
+	if len(runes) == 0 {
+		return 0
+	}
+	var lower, upper, digit, other bool
+	counts := map[rune]int{}
+	for _, r := range runes {
+		counts[r]++
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+	var pool float64
+	for _, class := range []struct {
+		used bool
+		size float64
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {other, 33}} {
+		if class.used {
+			pool += class.size
+		}
+	}
+	var shannon float64
+	n := float64(len(runes))
+	for _, c := range counts {
+		p := float64(c) / n
+		shannon -= p * math.Log2(p)
+	}
+	return n * math.Min(math.Log2(pool), shannon)
+}
+
+// policies lists the project's value policies, or changes one.
+func policies(args []string) error {
+	arg, tail := parseArg(args)
+	switch arg {
+	case "", "list":
+		if len(tail) != 0 {
+			return errors.New("bad args: expected `policy [list]`")
+		}
+		return listPolicies()
+	case "set":
+		return setPolicy(tail)
+	case "unset":
+		if len(tail) != 1 {
+			return errors.New("bad args: expected `policy unset $glob`")
+		}
+		return unsetPolicy(tail[0])
+	default:
+		return &badArgError{Arg: arg}
+	}
+}
+
+func listPolicies() error {
+	const (
+		promises     = "stdio rpath wpath cpath tty inet dns proc exec"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	shh, err := shhNamesFromPath(".shh")
+	if err != nil {
+		return err
+	}
+	if shh.Settings == nil || len(shh.Settings.Policies) == 0 {
+		return errors.New("no policies. use `shh policy set`")
+	}
+	if jsonOutput {
+		return printJSON(shh.Settings.Policies)
+	}
+	rows := make([][]cell, 0, len(shh.Settings.Policies))
+	for _, p := range shh.Settings.Policies {
+		var rules []string
+		if p.MinLength > 0 {
+			rules = append(rules, "min-length "+strconv.Itoa(p.MinLength))
+		}
+		if p.MinEntropy > 0 {
+			rules = append(rules, "min-entropy "+strconv.Itoa(p.MinEntropy))
+		}
+		if p.Match != "" {
+			rules = append(rules, "match "+p.Match)
+		}
+		rows = append(rows, []cell{
+			{text: p.Glob, style: styleBold},
+			{text: strings.Join(rules, ", ")},
+		})
+	}
+	printTable(os.Stdout, rows)
+	return nil
+}
+
+// setPolicy adds a policy, or replaces the one with the same glob. Existing
+// values aren't checked until they're next changed.
+func setPolicy(args []string) error {
+	fs := flag.NewFlagSet("policy set", flag.ContinueOnError)
+	var p valuePolicy
+	fs.IntVar(&p.MinLength, "min-length", 0, "fewest characters")
+	fs.IntVar(&p.MinEntropy, "min-entropy", 0, "fewest estimated bits of entropy")
+	fs.StringVar(&p.Match, "match", "", "regexp the whole value must match")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return errors.New("bad args: expected `policy set [--min-length $n] [--min-entropy $bits] [--match $re] $glob`")
+	}
+	p.Glob = args[0]
+	if p.MinLength == 0 && p.MinEntropy == 0 && p.Match == "" {
+		return errors.New("bad args: expected --min-length, --min-entropy, or --match")
+	}
+	if err = p.validate(); err != nil {
+		return err
+	}
+
+	const (
+		promises     = "stdio rpath wpath cpath tty inet dns proc exec"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	shh, err := shhFromPath(".shh")
+	if err != nil {
+		return err
+	}
+	if shh.Settings == nil {
+		shh.Settings = &projectSettings{}
+	}
+	set := shh.Settings
+	replaced := false
+	for i := range set.Policies {
+		if set.Policies[i].Glob == p.Glob {
+			set.Policies[i], replaced = p, true
+		}
+	}
+	if !replaced {
+		set.Policies = append(set.Policies, p)
+	}
+	return shh.EncodeToFile()
+}
+
+func unsetPolicy(glob string) error {
+	const (
+		promises     = "stdio rpath wpath cpath tty inet dns proc exec"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	shh, err := shhFromPath(".shh")
+	if err != nil {
+		return err
+	}
+	if shh.Settings == nil {
+		return &notFoundError{"no such policy"}
+	}
+	set := shh.Settings
+	kept := set.Policies[:0]
+	for _, p := range set.Policies {
+		if p.Glob != glob {
+			kept = append(kept, p)
+		}
+	}
+	if len(kept) == len(set.Policies) {
+		return &notFoundError{"no such policy"}
+	}
+	set.Policies = kept
+	if set.empty() {
+		shh.Settings = nil
+	}
+	return shh.EncodeToFile()
+}
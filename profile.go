@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// defaultProfile is the identity kept directly in ~/.config/shh.
+const defaultProfile = "default"
+
+// profile is the identity to use, from the global -profile flag or
+// $SHH_PROFILE. Each profile has its own keys and config in
+// ~/.config/shh/profiles/$name. When empty, the project's recorded profile
+// is used, if any.
+var profile = os.Getenv("SHH_PROFILE")
+
+// validateProfile reports an error unless name is a usable profile name.
+func validateProfile(name string) error {
+	if name == "" || name == defaultProfile {
+		return nil
+	}
+	if strings.Trim(name, ".") == "" {
+		return fmt.Errorf("invalid profile %q", name)
+	}
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9',
+			r == '-', r == '_', r == '.':
+		default:
+			return fmt.Errorf("invalid profile %q: use letters, digits, '-', '_', or '.'", name)
+		}
+	}
+	return nil
+}
+
+// profilePath returns the config directory of the named profile.
+func profilePath(base, name string) string {
+	if name == "" || name == defaultProfile {
+		return base
+	}
+	return filepath.Join(base, "profiles", name)
+}
+
+// currentProfile returns the profile in use, and whether it was recorded for
+// the project or a directory holding it, rather than chosen with -profile.
+func currentProfile(base string) (string, bool) {
+	if profile != "" {
+		return profile, false
+	}
+	pth, err := findShhRecursive(".shh")
+	if err != nil {
+		// Not yet created, as by init
+		pth = projectPath(".shh")
+	}
+	abs, err := filepath.Abs(pth)
+	if err != nil {
+		return defaultProfile, false
+	}
+	projects, err := readProjectProfiles(base)
+	if err != nil {
+		debug("read project profiles", "err", err)
+		return defaultProfile, false
+	}
+	if name, ok := projects[abs]; ok {
+		return name, true
+	}
+
+	// Otherwise use the closest directory above the project
+	var best string
+	for dir := range projects {
+		if strings.HasSuffix(dir, string(filepath.Separator)) &&
+			strings.HasPrefix(abs, dir) && len(dir) > len(best) {
+			best = dir
+		}
+	}
+	if best != "" {
+		return projects[best], true
+	}
+	return defaultProfile, false
+}
+
+// projectProfilesPath holds the profile recorded for each project, as
+// `$path=$profile` lines. Paths ending in a separator are directories, whose
+// profile is used by every project within them.
+func projectProfilesPath(base string) string {
+	return filepath.Join(base, "projects")
+}
+
+func readProjectProfiles(base string) (map[string]string, error) {
+	projects := map[string]string{}
+	fi, err := os.Open(projectProfilesPath(base))
+	if os.IsNotExist(err) {
+		return projects, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+	scn := bufio.NewScanner(fi)
+	for scn.Scan() {
+		line := scn.Text()
+		i := strings.LastIndex(line, "=")
+		if i < 0 {
+			continue
+		}
+		projects[line[:i]] = line[i+1:]
+	}
+	if err = scn.Err(); err != nil {
+		return nil, fmt.Errorf("scan: %w", err)
+	}
+	return projects, nil
+}
+
+// recordProfile records the profile to use for the project file at pth, or
+// the directory if pth ends in a separator.
+func recordProfile(base, pth, name string) error {
+	abs, err := filepath.Abs(pth)
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(pth, string(filepath.Separator)) {
+		abs += string(filepath.Separator)
+	}
+	projects, err := readProjectProfiles(base)
+	if err != nil {
+		return err
+	}
+	projects[abs] = name
+	paths := make([]string, 0, len(projects))
+	for p := range projects {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	var b strings.Builder
+	for _, p := range paths {
+		fmt.Fprintf(&b, "%s=%s\n", p, projects[p])
+	}
+	if err = os.MkdirAll(base, 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(projectProfilesPath(base), []byte(b.String()), 0644)
+}
+
+// rememberProfile records the profile chosen with -profile for the project
+// file at pth, so later commands use it without -profile.
+func rememberProfile(pth string) error {
+	if profile == "" {
+		return nil
+	}
+	base, err := baseConfigPath()
+	if err != nil {
+		return err
+	}
+	return recordProfile(base, pth, profile)
+}
+
+// profiles lists the local identities, or records which one the project
+// uses.
+func profiles(args []string) error {
+	arg, tail := parseArg(args)
+	switch arg {
+	case "", "list":
+		if len(tail) != 0 {
+			return errors.New("bad args: expected `profile [list]`")
+		}
+		return listProfiles()
+	case "use":
+		return useProfile(tail)
+	default:
+		return &badArgError{Arg: arg}
+	}
+}
+
+// listProfiles prints each profile and its username, marking the one in
+// use.
+func listProfiles() error {
+	const (
+		promises     = "stdio rpath"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	base, err := baseConfigPath()
+	if err != nil {
+		return err
+	}
+	names := []string{defaultProfile}
+	infos, err := ioutil.ReadDir(filepath.Join(base, "profiles"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, info := range infos {
+		if info.IsDir() {
+			names = append(names, info.Name())
+		}
+	}
+	current, recorded := currentProfile(base)
+	rows := make([][]cell, 0, len(names))
+	for _, name := range names {
+		mark, style := " ", ""
+		if name == current {
+			mark, style = "*", styleBold
+		}
+		uname := "-"
+		if conf, err := configFromPath(profilePath(base, name)); err == nil {
+			uname = string(conf.Username)
+		}
+		if name == current && recorded {
+			uname += " (project)"
+		}
+		rows = append(rows, []cell{
+			{text: mark},
+			{text: name, style: style},
+			{text: uname},
+		})
+	}
+	printTable(os.Stdout, rows)
+	return nil
+}
+
+// useProfile records the profile to use for the current project, or every
+// project in a directory, so it's picked without -profile.
+func useProfile(args []string) error {
+	fs := flag.NewFlagSet("profile use", flag.ContinueOnError)
+	dir := fs.String("dir", "", "use the profile for every project in the directory")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return errors.New("bad args: expected `profile use [--dir $dir] $name`")
+	}
+	name := args[0]
+	if err = validateProfile(name); err != nil {
+		return err
+	}
+
+	const (
+		promises     = "stdio rpath wpath cpath"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	base, err := baseConfigPath()
+	if err != nil {
+		return err
+	}
+	if _, err = configFromPath(profilePath(base, name)); err != nil {
+		var noIdentity *noIdentityError
+		if errors.As(err, &noIdentity) {
+			return fmt.Errorf("no profile %s. run `shh -profile %s gen-keys`",
+				name, name)
+		}
+		return err
+	}
+	var pth string
+	if *dir != "" {
+		abs, err := filepath.Abs(*dir)
+		if err != nil {
+			return err
+		}
+		pth = abs + string(filepath.Separator)
+	} else {
+		pth, err = findShhRecursive(".shh")
+		if os.IsNotExist(err) {
+			return &noProjectError{}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err = recordProfile(base, pth, name); err != nil {
+		return err
+	}
+	notef(os.Stdout, "using profile %s for %s\n", name, pth)
+	return nil
+}
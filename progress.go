@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// progressWidth is the number of cells in a progress bar.
+const progressWidth = 30
+
+// progress draws a progress bar on stderr for long-running commands. It
+// draws nothing unless stderr is a terminal, so scripts and logs stay clean.
+// It's safe for concurrent use.
+type progress struct {
+	label string
+	total int
+
+	mu   sync.Mutex
+	done int
+	tty  bool
+}
+
+func newProgress(label string, total int) *progress {
+	p := &progress{
+		label: label,
+		total: total,
+		tty:   !quiet && terminal.IsTerminal(int(os.Stderr.Fd())),
+	}
+	p.draw()
+	return p
+}
+
+// add n completed items.
+func (p *progress) add(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done += n
+	p.draw()
+}
+
+// finish ends the line, leaving the final state on screen.
+func (p *progress) finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.tty {
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+func (p *progress) draw() {
+	if !p.tty || p.total == 0 {
+		return
+	}
+	filled := progressWidth * p.done / p.total
+	fmt.Fprintf(os.Stderr, "\r%s [%s%s] %d/%d", p.label,
+		strings.Repeat("#", filled),
+		strings.Repeat(" ", progressWidth-filled), p.done, p.total)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// isProtected reports whether the secret is protected from deletion. Every
+// copy is normally marked, but any one is enough, as is matching one of the
+// project's protected settings.
+func (s *shh) isProtected(name string) bool {
+	if s.Settings != nil {
+		for _, glob := range s.Settings.Protected {
+			if globMatch(glob, name) {
+				return true
+			}
+		}
+	}
+	for _, secrets := range s.Secrets {
+		if sec, ok := secrets[name]; ok && sec.Protected {
+			return true
+		}
+	}
+	return false
+}
+
+// confirmProtected requires --force to remove access to protected secrets,
+// then asks for each one's name to be typed. There's no way to skip the
+// question, so scripts must `shh unprotect` first.
+func confirmProtected(shh *shh, names []string, force bool) error {
+	var protected []string
+	for _, name := range names {
+		if shh.isProtected(name) {
+			protected = append(protected, name)
+		}
+	}
+	if len(protected) == 0 {
+		return nil
+	}
+	sort.Strings(protected)
+	if !force {
+		return fmt.Errorf("protected, use --force: %s", strings.Join(protected, ", "))
+	}
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return errors.New("protected secrets need confirming on a terminal, or `shh unprotect` them first")
+	}
+	for _, name := range protected {
+		fmt.Printf("%s is protected. type its name to continue: ", name)
+		var answer string
+		_, _ = fmt.Scanln(&answer)
+		if answer != name {
+			return errors.New(tr("cancelled"))
+		}
+	}
+	return nil
+}
+
+// protect marks secrets as protected, or with unprotect unmarks them, for
+// every user with access. The user must have access to them.
+func protect(args []string, protected bool) error {
+	cmd := "protect"
+	if !protected {
+		cmd = "unprotect"
+	}
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	yes := fs.Bool("yes", false, "unprotect without confirmation")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("bad args: expected `%s $secret`", cmd)
+	}
+	name := inEnv(args[0])
+	if err = validateGlob(name); err != nil {
+		return err
+	}
+
+	const (
+		promises     = "stdio rpath wpath cpath tty inet dns proc exec"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	configPath, err := getConfigPath()
+	if err != nil {
+		return err
+	}
+	user, err := getUser(configPath)
+	if err != nil {
+		return err
+	}
+	shh, err := shhFromPath(".shh")
+	if err != nil {
+		return err
+	}
+	secrets, err := shh.GetSecretsForUser(name, user.Username)
+	if err != nil {
+		return err
+	}
+	if len(secrets) == 0 {
+		return &notFoundError{"no matching secrets"}
+	}
+	names := make([]string, 0, len(secrets))
+	for name := range secrets {
+		if shh.isProtected(name) != protected {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		notef(os.Stdout, "> already %sed\n", cmd)
+		return nil
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("> %s %s\n", cmd, name)
+	}
+	if !protected {
+		err = confirm(*yes, "unprotect %d secrets?", len(names))
+		if err != nil {
+			return err
+		}
+	}
+	for _, name := range names {
+		for _, secrets := range shh.Secrets {
+			if sec, ok := secrets[name]; ok {
+				sec.Protected = protected
+				secrets[name] = sec
+			}
+		}
+	}
+	return shh.EncodeToFile()
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// publishTarget describes a read-only mirror of part of the project. Only the
+// named users' (typically machine keys') existing entries matching the glob
+// are published, so the mirror never contains secrets for anyone else.
+type publishTarget struct {
+	To   string     `json:"to"`
+	Only string     `json:"only"`
+	For  []username `json:"for"`
+}
+
+// stringsFlag is a flag which may be repeated, e.g. `--for a --for b`.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *stringsFlag) Set(val string) error {
+	*f = append(*f, val)
+	return nil
+}
+
+// publish a filtered mirror of the project file to a path or s3:// URL. With
+// no flags, every saved target is published.
+func publish(args []string) error {
+	fs := flag.NewFlagSet("publish", flag.ContinueOnError)
+	to := fs.String("to", "", "destination path or s3:// URL")
+	only := fs.String("only", "*", "glob of secrets to publish")
+	save := fs.Bool("save", false, "save the target to publish again later")
+	var forUsers stringsFlag
+	fs.Var(&forUsers, "for", "user (machine key) to publish for, repeatable")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 0 {
+		return errors.New("bad args: expected `publish [--to $dst --for $user --only $glob [--save]]`")
+	}
+
+	const (
+		promises     = "stdio rpath wpath cpath inet dns proc exec"
+		execPromises = "stdio rpath wpath cpath inet dns proc exec"
+	)
+	pledge(promises, execPromises)
+
+	shh, err := shhFromPath(".shh")
+	if err != nil {
+		return err
+	}
+	targets := shh.Publish
+	if *to != "" {
+		if len(forUsers) == 0 {
+			return errors.New("--to requires at least one --for $user")
+		}
+		target := publishTarget{To: *to, Only: *only}
+		for _, u := range forUsers {
+			target.For = append(target.For, username(u))
+		}
+		targets = []publishTarget{target}
+	}
+	if len(targets) == 0 {
+		return errors.New("no publish targets. use `shh publish --to $dst --for $user`")
+	}
+	for _, target := range targets {
+		if err = publishMirror(shh, target); err != nil {
+			return fmt.Errorf("publish to %s: %w", target.To, err)
+		}
+		notef(os.Stdout, "> published to %s\n", target.To)
+	}
+	if *save && *to != "" {
+		// Every target is current, so saving needn't publish them again
+		shh.Publish = append(shh.Publish, targets[0])
+		shh.published = true
+		return shh.EncodeToFile()
+	}
+	return nil
+}
+
+// publishSaved republishes every saved target once the project is written, so
+// mirrors follow each change. Failures are only reported, since the project
+// itself was saved, and `shh publish` tries again.
+func (s *shh) publishSaved() {
+	if s.published {
+		return
+	}
+	for _, target := range s.Publish {
+		if strings.HasPrefix(target.To, "s3://") &&
+			!(pledged("proc") && pledged("exec")) {
+			fmt.Fprintf(os.Stderr, "shh: not published to %s, run `shh publish`\n",
+				target.To)
+			continue
+		}
+		if err := publishMirror(s, target); err != nil {
+			fmt.Fprintf(os.Stderr, "shh: publish to %s: %v\n", target.To, err)
+		}
+	}
+}
+
+// unveilPublish allows writing the saved targets which are local paths.
+func (s *shh) unveilPublish() {
+	for _, target := range s.Publish {
+		if !strings.Contains(target.To, "://") {
+			unveil(filepath.Dir(target.To), "rwc")
+		}
+	}
+}
+
+// publishMirror builds the filtered project file for the target and writes it
+// to its destination.
+func publishMirror(shh *shh, target publishTarget) error {
+	if err := validateGlob(target.Only); err != nil {
+		return err
+	}
+	mirror := newShh(target.To)
+	for _, uname := range target.For {
+		block, exist := shh.Keys[uname]
+		if !exist {
+			return fmt.Errorf("unknown user: %s", uname)
+		}
+		mirror.Keys[uname] = block
+		secrets := shh.Secrets[uname]
+		if raw, ok := shh.encoded[uname]; ok {
+			// Not decoded when the project was read for someone else
+			if err := json.Unmarshal(raw, &secrets); err != nil {
+				return fmt.Errorf("%s: %w", uname, err)
+			}
+		}
+		for name, sec := range secrets {
+			if !globMatch(target.Only, name) {
+				continue
+			}
+			if _, exist := mirror.Secrets[uname]; !exist {
+				mirror.Secrets[uname] = map[string]secret{}
+			}
+			mirror.Secrets[uname][name] = sec
+		}
+	}
+	buf := &bytes.Buffer{}
+	if err := mirror.Encode(buf); err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+	if strings.HasPrefix(target.To, "s3://") {
+		dst := target.To
+		if strings.Count(strings.TrimPrefix(dst, "s3://"), "/") == 0 {
+			dst += "/.shh"
+		}
+		cmd := exec.Command("aws", "s3", "cp", "-", dst)
+		cmd.Stdin = buf
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("aws s3 cp: %w", err)
+		}
+		return nil
+	}
+	return ioutil.WriteFile(target.To, buf.Bytes(), 0644)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// rotateBatch is how many secrets `rotate --all` re-keys between saves, so
+// an interrupted run loses at most one batch.
+const rotateBatch = 100
+
+// rotateJournal records the secrets re-keyed by an unfinished
+// `rotate --all`, so running it again resumes where it stopped.
+type rotateJournal struct {
+	Started time.Time `json:"started"`
+	Done    []string  `json:"done"`
+}
+
+// rotateJournalPath is kept with the backups, which git ignores.
+func rotateJournalPath(shhPath string) string {
+	return filepath.Join(backupDirFor(shhPath), "rotate.json")
+}
+
+func loadRotateJournal(shhPath string) (*rotateJournal, error) {
+	byt, err := ioutil.ReadFile(rotateJournalPath(shhPath))
+	if os.IsNotExist(err) {
+		return &rotateJournal{Started: time.Now().UTC()}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	journal := &rotateJournal{}
+	if err = json.Unmarshal(byt, journal); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", rotateJournalPath(shhPath), err)
+	}
+	return journal, nil
+}
+
+func (j *rotateJournal) save(shhPath string) error {
+	pth := rotateJournalPath(shhPath)
+	if err := os.MkdirAll(filepath.Dir(pth), 0700); err != nil {
+		return err
+	}
+	byt, err := json.MarshalIndent(j, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(pth, byt, 0600)
+}
+
+// rotateAll re-keys every secret the user can decrypt: each is re-encrypted
+// with a new AES key for everyone with access, as if its value was set
+// again. Secrets are re-keyed in parallel and saved in batches, with the
+// completed ones journaled so an interrupted run can be resumed.
+func rotateAll(nonInteractive bool) error {
+	const (
+		promises     = "stdio rpath wpath cpath tty proc exec inet dns"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	configPath, err := getConfigPath()
+	if err != nil {
+		return err
+	}
+	user, err := getUser(configPath)
+	if err != nil {
+		return fmt.Errorf("get user: %w", err)
+	}
+	shh, err := shhFromPath(".shh")
+	if err != nil {
+		return err
+	}
+	journal, err := loadRotateJournal(shh.path)
+	if err != nil {
+		return err
+	}
+	done := map[string]struct{}{}
+	for _, name := range journal.Done {
+		done[name] = struct{}{}
+	}
+	mine := shh.Secrets[user.Username]
+	pending := map[string]secret{}
+	for name, sec := range mine {
+		if _, ok := done[name]; !ok {
+			pending[name] = sec
+		}
+	}
+	if len(mine) == 0 {
+		return &notFoundError{"no secrets which you can access"}
+	}
+	if len(done) > 0 {
+		notef(os.Stderr, "resuming rotation started %s\n",
+			journal.Started.Local().Format(time.RFC1123))
+	}
+	dec, err := user.decrypterFor(configPath, nonInteractive, pending)
+	if err != nil {
+		return err
+	}
+
+	access := secretAccess(shh)
+	names := sortedSecretNames(pending)
+	bar := newProgress("rotating", len(names))
+	for start := 0; start < len(names); start += rotateBatch {
+		end := start + rotateBatch
+		if end > len(names) {
+			end = len(names)
+		}
+		batch := names[start:end]
+		results := make([]map[username]secret, len(batch))
+		err = parallel(len(batch), func(i int) error {
+			name := batch[i]
+			sec, err := decodeSecret(mine[name])
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			plaintext, err := decryptSecret(dec, sec)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			defer plaintext.Destroy()
+			encs := map[username]secret{}
+			for u, old := range access[name] {
+				enc, err := shh.encryptFor(u, plaintext)
+				if err != nil {
+					return fmt.Errorf("%s: %s: %w", name, u, err)
+				}
+				enc.Sensitive, enc.Protected = old.Sensitive, old.Protected
+				enc.Expires, enc.Modified = old.Expires, old.Modified
+				enc.Granted = old.Granted
+				encs[u] = enc
+			}
+			results[i] = encs
+			bar.add(1)
+			return nil
+		})
+		if err != nil {
+			bar.finish()
+			if len(journal.Done) > 0 {
+				return fmt.Errorf("%w (run `shh rotate --all` again to resume)", err)
+			}
+			return err
+		}
+		for i, name := range batch {
+			for u, enc := range results[i] {
+				shh.Secrets[u][name] = enc
+			}
+		}
+		if err = shh.EncodeToFile(); err != nil {
+			bar.finish()
+			return err
+		}
+		journal.Done = append(journal.Done, batch...)
+		if err = journal.save(shh.path); err != nil {
+			bar.finish()
+			return err
+		}
+	}
+	bar.finish()
+	err = os.Remove(rotateJournalPath(shh.path))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	notef(os.Stdout, "rotated %d secrets\n", len(mine))
+	return nil
+}
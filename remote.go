@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxRemoteSize limits the project file accepted by the remote server.
+const maxRemoteSize = 32 << 20
+
+// remoteState records the last version synced with a remote endpoint, so
+// pulls can merge against it. It's kept under the XDG data directory rather
+// than beside .shh, so a repo ignoring .shh doesn't also have to ignore a copy
+// of it.
+type remoteState struct {
+	URL  string `json:"url"`
+	ETag string `json:"etag,omitempty"`
+
+	// Base is the project file as of ETag.
+	Base []byte `json:"base,omitempty"`
+}
+
+// remoteStatePath is $XDG_DATA_HOME/shh/remotes/$name, which defaults to
+// ~/.local/share/shh, named after the project file's path.
+func remoteStatePath(shhPath string) (string, error) {
+	abs, err := filepath.Abs(shhPath)
+	if err != nil {
+		return "", err
+	}
+	data, err := xdgDir("XDG_DATA_HOME", ".local", "share")
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(data, "shh", "remotes", stateName(abs)), nil
+}
+
+func loadRemoteState(shhPath string) (*remoteState, error) {
+	pth, err := remoteStatePath(shhPath)
+	if err != nil {
+		return nil, err
+	}
+	byt, err := ioutil.ReadFile(pth)
+	if os.IsNotExist(err) {
+		return &remoteState{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	state := &remoteState{}
+	if err = json.Unmarshal(byt, state); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", pth, err)
+	}
+	return state, nil
+}
+
+func (r *remoteState) save(shhPath string) error {
+	pth, err := remoteStatePath(shhPath)
+	if err != nil {
+		return err
+	}
+	byt, err := json.MarshalIndent(r, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(pth), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(pth, byt, 0600)
+}
+
+// remoteURL from the args, or else the last one used.
+func (r *remoteState) remoteURL(args []string) (string, error) {
+	switch {
+	case len(args) == 1:
+		if args[0] != r.URL {
+			// A different remote shares no history with ours
+			*r = remoteState{URL: args[0]}
+		}
+		return args[0], nil
+	case len(args) > 1:
+		return "", errors.New("bad args: expected [$url]")
+	case r.URL == "":
+		return "", errors.New("no remote, pass its url")
+	}
+	return r.URL, nil
+}
+
+// remoteRequest to the endpoint, authenticated with $SHH_REMOTE_TOKEN. Plain
+// http is refused except on this machine, since the token and project would
+// cross the network unencrypted.
+func remoteRequest(method, url string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if req.URL.Scheme == "http" && !isLoopbackHost(req.URL.Hostname()) {
+		return nil, fmt.Errorf("refusing to use %s over http, use https", url)
+	}
+	if token := os.Getenv("SHH_REMOTE_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req, nil
+}
+
+// pushShh uploads the project file to a remote endpoint. The upload only
+// succeeds if the remote hasn't changed since we last synced, otherwise
+// `shh pull` must merge its changes first.
+func pushShh(args []string) error {
+	const (
+		promises     = "stdio rpath wpath cpath inet dns"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	pth, err := findShhRecursive(".shh")
+	if err != nil {
+		return err
+	}
+	byt, err := ioutil.ReadFile(pth)
+	if err != nil {
+		return err
+	}
+	var outer outerLayer
+	if err = json.Unmarshal(byt, &outer); err == nil && outer.Remote != "" {
+		return errRemoteProject
+	}
+	state, err := loadRemoteState(pth)
+	if err != nil {
+		return err
+	}
+	url, err := state.remoteURL(args)
+	if err != nil {
+		return err
+	}
+	if state.ETag != "" && bytes.Equal(byt, state.Base) {
+		notef(os.Stdout, "up to date\n")
+		return nil
+	}
+	req, err := remoteRequest(http.MethodPut, url, byt)
+	if err != nil {
+		return err
+	}
+	if state.ETag != "" {
+		req.Header.Set("If-Match", state.ETag)
+	} else {
+		req.Header.Set("If-None-Match", "*")
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusPreconditionFailed:
+		return errors.New("remote has changed, run `shh pull` first")
+	case resp.StatusCode >= 300:
+		return remoteError(resp)
+	}
+	state.ETag = resp.Header.Get("ETag")
+	state.Base = byt
+	return state.save(pth)
+}
+
+// pullShh fetches the project file from a remote endpoint and merges it with
+// ours, using the last synced version as the common base.
+func pullShh(args []string) error {
+	fs := flag.NewFlagSet("pull", flag.ContinueOnError)
+	ours := fs.Bool("ours", false, "resolve conflicts using our version")
+	theirs := fs.Bool("theirs", false, "resolve conflicts using the remote version")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	var prefer string
+	switch {
+	case *ours && *theirs:
+		return errors.New("--ours and --theirs are exclusive")
+	case *ours:
+		prefer = preferOurs
+	case *theirs:
+		prefer = preferTheirs
+	}
+
+	const (
+		promises     = "stdio rpath wpath cpath tty inet dns proc exec"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	local, err := shhFromPath(".shh")
+	if err != nil {
+		return err
+	}
+	if local.store != nil {
+		return errRemoteProject
+	}
+	state, err := loadRemoteState(local.path)
+	if err != nil {
+		return err
+	}
+	url, err := state.remoteURL(args)
+	if err != nil {
+		return err
+	}
+	req, err := remoteRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if state.ETag != "" {
+		req.Header.Set("If-None-Match", state.ETag)
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		notef(os.Stdout, "up to date\n")
+		return state.save(local.path)
+	case resp.StatusCode == http.StatusNotFound:
+		return errors.New("remote is empty, run `shh push`")
+	case resp.StatusCode >= 300:
+		return remoteError(resp)
+	}
+	byt, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxRemoteSize))
+	if err != nil {
+		return err
+	}
+
+	var passphrase []byte
+	base, err := decodeShhBytes(local.path, state.Base, &passphrase)
+	if err != nil {
+		return fmt.Errorf("base: %w", err)
+	}
+	remote, err := decodeShhBytes(local.path, byt, &passphrase)
+	if err != nil {
+		return fmt.Errorf("remote: %w", err)
+	}
+	merged, conflicts := mergeShh(base, local, remote, func(string) bool {
+		return prefer == preferTheirs
+	})
+	if len(conflicts) > 0 && prefer == "" {
+		return fmt.Errorf("conflicts, use --ours or --theirs:\n\t%s",
+			strings.Join(conflicts, "\n\t"))
+	}
+	for _, change := range shhChanges(local, merged, "*") {
+		fmt.Println(change)
+	}
+	if err = merged.EncodeToFile(); err != nil {
+		return err
+	}
+	state.ETag = resp.Header.Get("ETag")
+	state.Base = byt
+	if err = state.save(local.path); err != nil {
+		return err
+	}
+	if len(shhChanges(remote, merged, "*")) > 0 {
+		notef(os.Stdout, "run `shh push` to upload your changes\n")
+	}
+	return nil
+}
+
+func remoteError(resp *http.Response) error {
+	byt, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("remote: %s: %s", resp.Status, bytes.TrimSpace(byt))
+}
+
+// serveRemote serves a project file for push and pull. Every request must
+// carry $SHH_REMOTE_TOKEN. Writes are conditional on the file's ETag, so
+// concurrent pushes can't overwrite each other. The file is given with the
+// global -file flag.
+func serveRemote(args []string) error {
+	fs := flag.NewFlagSet("serve-remote", flag.ContinueOnError)
+	addr := fs.String("addr", ":8443", "address to listen on")
+	certFile := fs.String("tls-cert", "", "tls certificate")
+	keyFile := fs.String("tls-key", "", "tls key")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 0 || projectFile == "" {
+		return errors.New("bad args: expected `serve-remote --file $path`")
+	}
+	if (*certFile == "") != (*keyFile == "") {
+		return errors.New("--tls-cert and --tls-key must be used together")
+	}
+	if *certFile == "" {
+		host, _, err := net.SplitHostPort(*addr)
+		if err != nil {
+			return err
+		}
+		if !isLoopbackHost(host) {
+			return errors.New("--tls-cert and --tls-key are required unless --addr is a loopback address")
+		}
+	}
+	token := os.Getenv("SHH_REMOTE_TOKEN")
+	if token == "" {
+		return errors.New("missing $SHH_REMOTE_TOKEN")
+	}
+
+	const (
+		promises     = "stdio rpath wpath cpath inet dns unveil"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	abs, err := filepath.Abs(projectFile)
+	if err != nil {
+		return err
+	}
+	unveil(filepath.Dir(abs), "rwc")
+	if *certFile != "" {
+		unveil(*certFile, "r")
+		unveil(*keyFile, "r")
+	}
+	unveilBlock()
+
+	srv := &http.Server{
+		Addr:         *addr,
+		Handler:      &remoteServer{path: abs, token: []byte(token)},
+		ReadTimeout:  30 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	}
+	if *certFile != "" {
+		return srv.ListenAndServeTLS(*certFile, *keyFile)
+	}
+	return srv.ListenAndServe()
+}
+
+type remoteServer struct {
+	path  string
+	token []byte
+	mu    sync.Mutex
+}
+
+func (s *remoteServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := []byte(r.Header.Get("Authorization"))
+	if subtle.ConstantTimeCompare(auth, append([]byte("Bearer "), s.token...)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cur, err := ioutil.ReadFile(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var etag string
+	if err == nil {
+		etag = remoteETag(cur)
+	}
+	switch r.Method {
+	case http.MethodGet:
+		switch {
+		case etag == "":
+			http.NotFound(w, r)
+		case r.Header.Get("If-None-Match") == etag:
+			w.Header().Set("ETag", etag)
+			w.WriteHeader(http.StatusNotModified)
+		default:
+			w.Header().Set("ETag", etag)
+			_, _ = w.Write(cur)
+		}
+	case http.MethodPut:
+		ifMatch := r.Header.Get("If-Match")
+		ifNoneMatch := r.Header.Get("If-None-Match")
+		switch {
+		case ifMatch == "" && ifNoneMatch != "*":
+			http.Error(w, "missing If-Match", http.StatusPreconditionRequired)
+			return
+		case ifMatch != "" && ifMatch != etag,
+			ifNoneMatch == "*" && etag != "":
+			http.Error(w, "remote has changed", http.StatusPreconditionFailed)
+			return
+		}
+		byt, err := ioutil.ReadAll(io.LimitReader(r.Body, maxRemoteSize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err = validateShhFile(byt); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err = writeFileAtomic(s.path, byt, 0644); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("ETag", remoteETag(byt))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// isLoopbackHost reports whether the host name or address is this machine.
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func remoteETag(byt []byte) string {
+	sum := sha256.Sum256(byt)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
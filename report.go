@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// accessReport describes who can read what, for access reviews. It never
+// includes values.
+type accessReport struct {
+	Project   string       `json:"project"`
+	Generated time.Time    `json:"generated"`
+	Users     []reportUser `json:"users"`
+}
+
+type reportUser struct {
+	User username `json:"user"`
+
+	// Key is the kind of key and, for RSA keys, its fingerprint.
+	Key string `json:"key"`
+
+	// Environments are those the user is a member of, and so is given
+	// the secrets set in.
+	Environments []string       `json:"environments"`
+	Secrets      []reportSecret `json:"secrets"`
+}
+
+type reportSecret struct {
+	Name      string     `json:"name"`
+	Granted   *time.Time `json:"granted,omitempty"`
+	GrantDays *int       `json:"grant_age_days,omitempty"`
+	Expires   *time.Time `json:"expires,omitempty"`
+	Sensitive bool       `json:"sensitive,omitempty"`
+}
+
+// reports generates reports about the project.
+func reports(args []string) error {
+	arg, tail := parseArg(args)
+	switch arg {
+	case "access":
+		return reportAccess(tail)
+	case "":
+		return errors.New("bad args: expected `report access`")
+	default:
+		return &badArgError{Arg: arg}
+	}
+}
+
+// reportAccess lists each user's secrets, with their key, environments, and
+// when they were given each secret.
+func reportAccess(args []string) error {
+	fs := flag.NewFlagSet("report access", flag.ContinueOnError)
+	format := fs.String("format", "csv", "csv or json")
+	out := fs.String("o", "", "write to a file")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 0 {
+		return errors.New("bad args: expected `report access [--format csv|json] [-o $file]`")
+	}
+	if jsonOutput {
+		*format = "json"
+	}
+	if *format != "csv" && *format != "json" {
+		return errors.New("bad args: --format must be csv or json")
+	}
+
+	const (
+		promises     = "stdio rpath wpath cpath tty inet dns proc exec"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	shh, err := shhFromPath(".shh")
+	if err != nil {
+		return err
+	}
+	report := newAccessReport(shh, time.Now().UTC().Truncate(time.Second))
+
+	var buf bytes.Buffer
+	if *format == "json" {
+		enc := json.NewEncoder(&buf)
+		enc.SetIndent("", "\t")
+		err = enc.Encode(report)
+	} else {
+		err = report.writeCSV(&buf)
+	}
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		_, err = os.Stdout.Write(buf.Bytes())
+		return err
+	}
+	return writeFileAtomic(*out, buf.Bytes(), 0644)
+}
+
+func newAccessReport(shh *shh, now time.Time) accessReport {
+	report := accessReport{Project: projectName(shh.path), Generated: now}
+	users := map[username]struct{}{}
+	for u := range shh.Keys {
+		users[u] = struct{}{}
+	}
+	for u := range shh.Secrets {
+		users[u] = struct{}{}
+	}
+	for _, u := range sortedUsernames(users) {
+		ru := reportUser{
+			User:         u,
+			Key:          describeKey(u, shh.Keys[u]),
+			Environments: []string{},
+			Secrets:      []reportSecret{},
+		}
+		for env, members := range shh.Environments {
+			for _, m := range members {
+				if m == u {
+					ru.Environments = append(ru.Environments, env)
+				}
+			}
+		}
+		sort.Strings(ru.Environments)
+		for name, sec := range shh.Secrets[u] {
+			rs := reportSecret{Name: name, Granted: sec.Granted,
+				Expires: sec.Expires, Sensitive: sec.Sensitive}
+			if sec.Granted != nil {
+				days := int(now.Sub(*sec.Granted) / (24 * time.Hour))
+				rs.GrantDays = &days
+			}
+			ru.Secrets = append(ru.Secrets, rs)
+		}
+		sort.Slice(ru.Secrets, func(i, j int) bool {
+			return ru.Secrets[i].Name < ru.Secrets[j].Name
+		})
+		report.Users = append(report.Users, ru)
+	}
+	return report
+}
+
+// writeCSV writes a row for each secret each user can read. Users without
+// secrets have a row with an empty secret, so they're still reviewed.
+func (r accessReport) writeCSV(buf *bytes.Buffer) error {
+	w := csv.NewWriter(buf)
+	err := w.Write([]string{"user", "key", "environments", "secret",
+		"granted", "grant_age_days", "expires", "sensitive"})
+	if err != nil {
+		return err
+	}
+	date := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.Format("2006-01-02")
+	}
+	for _, u := range r.Users {
+		envs := strings.Join(u.Environments, ";")
+		if len(u.Secrets) == 0 {
+			err = w.Write([]string{string(u.User), u.Key, envs, "", "", "",
+				"", ""})
+			if err != nil {
+				return err
+			}
+		}
+		for _, sec := range u.Secrets {
+			var days string
+			if sec.GrantDays != nil {
+				days = strconv.Itoa(*sec.GrantDays)
+			}
+			err = w.Write([]string{string(u.User), u.Key, envs, sec.Name,
+				date(sec.Granted), days, date(sec.Expires),
+				strconv.FormatBool(sec.Sensitive)})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
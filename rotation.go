@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"time"
+)
+
+// staleSecret is a secret whose value is older than the project's max age.
+type staleSecret struct {
+	Name     string    `json:"name"`
+	Modified time.Time `json:"modified"`
+	Days     int       `json:"days"`
+}
+
+// lastModified returns when a secret's value was last set, the latest of its
+// copies, or nil if none record it.
+func lastModified(copies map[username]secret) *time.Time {
+	var last *time.Time
+	for _, sec := range copies {
+		if sec.Modified != nil && (last == nil || sec.Modified.After(*last)) {
+			last = sec.Modified
+		}
+	}
+	return last
+}
+
+// staleSecrets returns the secrets matching the glob whose values are older
+// than maxAgeDays, sorted by name, and how many secrets don't record when
+// they were set.
+func staleSecrets(access map[string]map[username]secret, glob string, maxAgeDays int, now time.Time) ([]staleSecret, int) {
+	var stale []staleSecret
+	var unknown int
+	for name, copies := range access {
+		if !globMatch(glob, name) {
+			continue
+		}
+		modified := lastModified(copies)
+		if modified == nil {
+			unknown++
+			continue
+		}
+		days := int(now.Sub(*modified) / (24 * time.Hour))
+		if days > maxAgeDays {
+			stale = append(stale, staleSecret{Name: name,
+				Modified: *modified, Days: days})
+		}
+	}
+	sort.Slice(stale, func(i, j int) bool {
+		return stale[i].Name < stale[j].Name
+	})
+	return stale, unknown
+}
+
+// warnStale warns about each of the secrets being read whose value is due to
+// be rotated.
+func (s *shh) warnStale(secrets map[string]secret) {
+	if s.Settings == nil || s.Settings.MaxAgeDays == 0 {
+		return
+	}
+	access := make(map[string]map[username]secret, len(secrets))
+	for name, sec := range secrets {
+		access[name] = map[username]secret{"": sec}
+	}
+	stale, _ := staleSecrets(access, "*", s.Settings.MaxAgeDays, time.Now())
+	for _, sec := range stale {
+		notef(os.Stderr, "shh: %s is %d days old, rotate it\n", sec.Name,
+			sec.Days)
+	}
+}
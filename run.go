@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// envSpec maps secrets to environment variables. Name is the secret name or a
+// glob. Var is the variable name, which may only be set for a single secret.
+// If Var is empty, names are derived from the secret names using envName.
+type envSpec struct {
+	Name string
+	Var  string
+}
+
+// envVar is a decrypted secret with its environment variable name.
+type envVar struct {
+	Name  string
+	Value secureBytes
+}
+
+// parseEnvSpec parses `$name`, `$glob`, or `$VAR=$name`, in the current
+// environment.
+func parseEnvSpec(s string) envSpec {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) == 2 {
+		return envSpec{Var: parts[0], Name: inEnv(parts[1])}
+	}
+	return envSpec{Name: inEnv(s)}
+}
+
+// envSpecsFromFile reads a manifest with one spec per line, or a shh.yaml.
+// Blank lines and lines starting with # are ignored.
+func envSpecsFromFile(pth string) ([]envSpec, error) {
+	if isYAMLManifest(pth) {
+		m, err := readManifest(pth)
+		if err != nil {
+			return nil, err
+		}
+		return m.Specs, nil
+	}
+	fi, err := os.Open(pth)
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+	var specs []envSpec
+	scn := bufio.NewScanner(fi)
+	for scn.Scan() {
+		line := strings.TrimSpace(scn.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		specs = append(specs, parseEnvSpec(line))
+	}
+	if err = scn.Err(); err != nil {
+		return nil, fmt.Errorf("scan: %w", err)
+	}
+	return specs, nil
+}
+
+// envSpecsFromArgs reads the specs from the manifest, if any, followed by
+// the args.
+func envSpecsFromArgs(manifest string, args []string) ([]envSpec, error) {
+	var specs []envSpec
+	if manifest != "" {
+		var err error
+		specs, err = envSpecsFromFile(manifest)
+		if err != nil {
+			return nil, fmt.Errorf("read manifest: %w", err)
+		}
+	}
+	for _, arg := range args {
+		specs = append(specs, parseEnvSpec(arg))
+	}
+	return specs, nil
+}
+
+// envNaming controls how variable names are derived from secret names.
+type envNaming struct {
+	// Prefix is prepended to every derived name, e.g. APP_.
+	Prefix string
+
+	// KeepCase skips upper-casing derived names.
+	KeepCase bool
+}
+
+// flags registers the naming flags on the flag set.
+func (n *envNaming) flags(fs *flag.FlagSet) {
+	fs.StringVar(&n.Prefix, "prefix", "", "prefix for variable names")
+	fs.BoolVar(&n.KeepCase, "keep-case", false,
+		"don't upper-case variable names")
+}
+
+// envName derives an environment variable name from a secret name. The
+// literal part of a glob is trimmed, so `staging/*` maps
+// `staging/database_url` to DATABASE_URL, while exact names map
+// `staging/database_url` to STAGING_DATABASE_URL. The environment set with
+// -e is always trimmed.
+func (n envNaming) envName(secretName, glob string) string {
+	if strings.HasSuffix(glob, "*") {
+		secretName = strings.TrimPrefix(secretName, glob[:len(glob)-1])
+	}
+	secretName = strings.TrimPrefix(secretName, inEnv(""))
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			if n.KeepCase {
+				return r
+			}
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, n.Prefix+secretName)
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
+
+// decryptEnv decrypts the secrets matching the specs, sorted by variable
+// name. The caller must destroy the values.
+func decryptEnv(nonInteractive bool, specs []envSpec, naming envNaming) ([]envVar, error) {
+	if len(specs) == 0 {
+		return nil, errors.New("no secrets specified")
+	}
+	configPath, err := getConfigPath()
+	if err != nil {
+		return nil, err
+	}
+	user, err := getUser(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("get user: %w", err)
+	}
+	shh, err := shhFromPathFor(".shh", user.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	// Map every matching secret to its variable name
+	all := map[string]secret{}
+	names := map[string]string{}
+	for _, spec := range specs {
+		secrets, err := shh.GetSecretsForUser(spec.Name, user.Username)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", spec.Name, err)
+		}
+		if spec.Var != "" && len(secrets) != 1 {
+			return nil, fmt.Errorf("%s: %s matches %d secrets",
+				spec.Var, spec.Name, len(secrets))
+		}
+		for name, sec := range secrets {
+			v := spec.Var
+			if v == "" {
+				v = naming.envName(name, spec.Name)
+			}
+			if other, ok := names[v]; ok && other != name {
+				return nil, fmt.Errorf("%s and %s both map to %s",
+					other, name, v)
+			}
+			names[v] = name
+			all[name] = sec
+		}
+	}
+
+	dec, err := user.decrypterFor(configPath, nonInteractive, all)
+	if err != nil {
+		return nil, err
+	}
+	varsOf := map[string][]string{}
+	for v, name := range names {
+		varsOf[name] = append(varsOf[name], v)
+	}
+	vars := make([]envVar, 0, len(names))
+	err = decryptEach(dec, all, func(name string, plaintext secureBytes) error {
+		for _, v := range varsOf[name] {
+			value := newSecureBytes(make([]byte, len(plaintext)))
+			copy(value, plaintext)
+			vars = append(vars, envVar{Name: v, Value: value})
+		}
+		return nil
+	})
+	if err != nil {
+		for _, ev := range vars {
+			ev.Value.Destroy()
+		}
+		return nil, err
+	}
+	sort.Slice(vars, func(i, j int) bool { return vars[i].Name < vars[j].Name })
+	return vars, nil
+}
+
+// runCmd runs a command with secrets injected as environment variables, e.g.
+// `shh run 'staging/*' DB=prod/db_url -- ./server`. run isn't pledged, since
+// the command it executes can't be restricted ahead of time.
+func runCmd(nonInteractive bool, args []string) error {
+	args, cmdArgs := splitCommand(args)
+	if len(cmdArgs) == 0 {
+		return errors.New("bad args: expected `run [$secret...] -- $cmd`")
+	}
+
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	manifest := fs.String("manifest", "", "file listing secrets to inject")
+	var naming envNaming
+	naming.flags(fs)
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	specs, err := envSpecsFromArgs(*manifest, args)
+	if err != nil {
+		return err
+	}
+	cmd, err := startWithEnv(nonInteractive, specs, naming, cmdArgs)
+	if err != nil {
+		return err
+	}
+	return waitWithSignals(cmd)
+}
+
+// waitWithSignals forwards signals, such as ^C, to the command and exits with
+// its status.
+func waitWithSignals(cmd *exec.Cmd) error {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		for sig := range sigs {
+			_ = cmd.Process.Signal(sig)
+		}
+	}()
+	err := cmd.Wait()
+	signal.Stop(sigs)
+	return exitWithStatus(err)
+}
+
+// splitCommand splits args at `--` into shh's args and the command to run.
+func splitCommand(args []string) ([]string, []string) {
+	for i, arg := range args {
+		if arg == "--" {
+			return args[:i], args[i+1:]
+		}
+	}
+	return args, nil
+}
+
+// startWithEnv decrypts the secrets and starts the command with them in its
+// environment.
+func startWithEnv(nonInteractive bool, specs []envSpec, naming envNaming, cmdArgs []string) (*exec.Cmd, error) {
+	vars, err := decryptEnv(nonInteractive, specs, naming)
+	if err != nil {
+		return nil, err
+	}
+
+	// Never pass a provided password on to the command
+	var env []string
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, "SHH_PASSWORD") {
+			continue
+		}
+		env = append(env, kv)
+	}
+	for _, v := range vars {
+		env = append(env, v.Name+"="+string(v.Value))
+		v.Value.Destroy()
+	}
+
+	cmd := exec.Command(cmdArgs[0], cmdArgs[1:]...)
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+// exitWithStatus exits with the command's status if it failed, otherwise
+// returning the error.
+func exitWithStatus(err error) error {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		os.Exit(exitErr.ExitCode())
+	}
+	return err
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// projectSchema describes a project without any ciphertext: its users,
+// environments, settings, and who can access each secret. It's safe to
+// commit to public forks or share with auditors.
+type projectSchema struct {
+	Users        map[username]string     `json:"users"`
+	Environments map[string][]username   `json:"environments,omitempty"`
+	Secrets      map[string]schemaSecret `json:"secrets"`
+	MinKeyBits   int                     `json:"min_key_bits,omitempty"`
+	TrashDays    int                     `json:"trash_days,omitempty"`
+	Settings     *projectSettings        `json:"settings,omitempty"`
+}
+
+type schemaSecret struct {
+	Environment string     `json:"environment,omitempty"`
+	Users       []username `json:"users"`
+	Sensitive   bool       `json:"sensitive,omitempty"`
+	Protected   bool       `json:"protected,omitempty"`
+}
+
+// schemaPath is where the schema of the project file at pth is kept by
+// default, such as .shh.example.
+func schemaPath(pth string) string {
+	return pth + ".example"
+}
+
+// newSchema describes the project.
+func newSchema(s *shh) *projectSchema {
+	schema := &projectSchema{
+		Users:        map[username]string{},
+		Environments: s.Environments,
+		Secrets:      map[string]schemaSecret{},
+		MinKeyBits:   s.MinKeyBits,
+		TrashDays:    s.TrashDays,
+		Settings:     s.Settings,
+	}
+	for u, block := range s.Keys {
+		schema.Users[u] = describeKey(u, block)
+	}
+	for name, access := range secretAccess(s) {
+		sec := schemaSecret{
+			Environment: s.environmentOf(name),
+			Users:       accessUsers(access),
+		}
+		for u, c := range access {
+			sec.Sensitive = sec.Sensitive || c.Sensitive
+			sec.Protected = sec.Protected || c.Protected
+			if _, ok := schema.Users[u]; !ok {
+				schema.Users[u] = describeKey(u, nil)
+			}
+		}
+		schema.Secrets[name] = sec
+	}
+	return schema
+}
+
+// lines renders the schema one fact per line, so two schemas can be compared
+// line by line.
+func (p *projectSchema) lines() []string {
+	var lines []string
+	for u, key := range p.Users {
+		lines = append(lines, fmt.Sprintf("user %s %s", u, key))
+	}
+	for env, members := range p.Environments {
+		lines = append(lines, fmt.Sprintf("environment %s %s", env,
+			joinUsernames(members)))
+	}
+	for name, sec := range p.Secrets {
+		line := fmt.Sprintf("secret %s %s", name, joinUsernames(sec.Users))
+		if sec.Sensitive {
+			line += " sensitive"
+		}
+		if sec.Protected {
+			line += " protected"
+		}
+		lines = append(lines, line)
+	}
+	if p.MinKeyBits != 0 {
+		lines = append(lines, fmt.Sprintf("min_key_bits %d", p.MinKeyBits))
+	}
+	if p.TrashDays != 0 {
+		lines = append(lines, fmt.Sprintf("trash_days %d", p.TrashDays))
+	}
+	if set := p.Settings; set != nil {
+		byt, _ := json.Marshal(set)
+		lines = append(lines, "settings "+string(byt))
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// schema exports the project's schema, or checks the project against one.
+func schema(args []string) error {
+	arg, tail := parseArg(args)
+	switch arg {
+	case "export":
+		return exportSchema(tail)
+	case "check":
+		return checkSchema(tail)
+	case "":
+		return errors.New("bad args: expected `schema export|check`")
+	default:
+		return &badArgError{Arg: arg}
+	}
+}
+
+func exportSchema(args []string) error {
+	fs := flag.NewFlagSet("schema export", flag.ContinueOnError)
+	out := fs.String("o", "", "write to a file, such as .shh.example")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 0 {
+		return errors.New("bad args: expected `schema export [-o $file]`")
+	}
+
+	const (
+		promises     = "stdio rpath wpath cpath tty inet dns proc exec"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	shh, err := shhFromPath(".shh")
+	if err != nil {
+		return err
+	}
+	byt, err := json.MarshalIndent(newSchema(shh), "", "\t")
+	if err != nil {
+		return err
+	}
+	byt = append(byt, '\n')
+	if *out == "" {
+		_, err = os.Stdout.Write(byt)
+		return err
+	}
+	if err = writeFileAtomic(*out, byt, 0644); err != nil {
+		return err
+	}
+	notef(os.Stdout, "wrote %s\n", *out)
+	return nil
+}
+
+// checkSchema reports an error if the project doesn't match the schema,
+// printing what was added (+) or removed (-) since it was exported.
+func checkSchema(args []string) error {
+	fs := flag.NewFlagSet("schema check", flag.ContinueOnError)
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) > 1 {
+		return errors.New("bad args: expected `schema check [$file]`")
+	}
+
+	const (
+		promises     = "stdio rpath wpath cpath tty inet dns proc exec"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	shh, err := shhFromPath(".shh")
+	if err != nil {
+		return err
+	}
+	pth := schemaPath(shh.path)
+	if len(args) == 1 {
+		pth = args[0]
+	}
+	byt, err := ioutil.ReadFile(pth)
+	if err != nil {
+		return err
+	}
+	var want projectSchema
+	dec := json.NewDecoder(bytes.NewReader(byt))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(&want); err != nil {
+		return fmt.Errorf("decode %s: %w", pth, err)
+	}
+
+	wantLines := want.lines()
+	have := map[string]bool{}
+	for _, line := range newSchema(shh).lines() {
+		have[line] = true
+	}
+	var diff []string
+	for _, line := range wantLines {
+		if have[line] {
+			delete(have, line)
+			continue
+		}
+		diff = append(diff, "- "+line)
+	}
+	for line := range have {
+		diff = append(diff, "+ "+line)
+	}
+	if len(diff) == 0 {
+		notef(os.Stdout, "%s matches\n", pth)
+		return nil
+	}
+	sort.Slice(diff, func(i, j int) bool { return diff[i][2:] < diff[j][2:] })
+	fmt.Println(strings.Join(diff, "\n"))
+	return fmt.Errorf("project differs from %s", pth)
+}
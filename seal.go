@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// sealed is the outer layer of a .shh file protected by a project passphrase.
+// When present, it hides all metadata including usernames, secret names, and
+// counts, which is useful for public or semi-public repositories. A file
+// sealed with an AWS KMS key instead has no salt, and holds the key which
+// sealed it, wrapped by KMS.
+type sealed struct {
+	Salt  string `json:"salt"`
+	Nonce string `json:"nonce"`
+	Data  string `json:"data"`
+	KMS   string `json:"kms,omitempty"`
+	Key   string `json:"key,omitempty"`
+}
+
+// outerLayer is used to detect whether a .shh file is sealed, or whether it
+// only points to a project kept in an object store.
+type outerLayer struct {
+	Sealed *sealed `json:"sealed,omitempty"`
+	Remote string  `json:"remote,omitempty"`
+}
+
+// deriveSealKey from the project passphrase using scrypt.
+func deriveSealKey(passphrase, salt []byte) ([]byte, error) {
+	return scrypt.Key(passphrase, salt, 1<<15, 8, 1, 32)
+}
+
+// seal the plaintext .shh content using AES-256-GCM.
+func sealData(key, salt, plaintext []byte) (*sealed, error) {
+	aesBlock, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(aesBlock)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("read nonce: %w", err)
+	}
+	return &sealed{
+		Salt:  base64.StdEncoding.EncodeToString(salt),
+		Nonce: base64.StdEncoding.EncodeToString(nonce),
+		Data: base64.StdEncoding.EncodeToString(
+			gcm.Seal(nil, nonce, plaintext, nil)),
+	}, nil
+}
+
+// unseal the outer layer, returning the derived key and salt for re-sealing
+// alongside the plaintext .shh content.
+func unsealData(passphrase []byte, sld *sealed) (key, salt, plaintext []byte, err error) {
+	salt, err = base64.StdEncoding.DecodeString(sld.Salt)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("decode b64 salt: %w", err)
+	}
+	key, err = deriveSealKey(passphrase, salt)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("derive key: %w", err)
+	}
+	plaintext, err = openSealed(key, sld)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return key, salt, plaintext, nil
+}
+
+// unsealKMS unwraps the key which sealed the file using its KMS key,
+// returning the key and its wrapped form for re-sealing alongside the
+// plaintext .shh content.
+func unsealKMS(sld *sealed) (key, wrapped, plaintext []byte, err error) {
+	wrapped, err = base64.StdEncoding.DecodeString(sld.Key)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("decode b64 key: %w", err)
+	}
+	kms, err := newKMSKey(sld.KMS)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	key, err = kms.Decrypt(nil, wrapped, nil)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("unwrap seal key: %w", err)
+	}
+	plaintext, err = openSealed(key, sld)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return key, wrapped, plaintext, nil
+}
+
+// openSealed decrypts the sealed data with the key.
+func openSealed(key []byte, sld *sealed) ([]byte, error) {
+	nonce, err := base64.StdEncoding.DecodeString(sld.Nonce)
+	if err != nil {
+		return nil, fmt.Errorf("decode b64 nonce: %w", err)
+	}
+	data, err := base64.StdEncoding.DecodeString(sld.Data)
+	if err != nil {
+		return nil, fmt.Errorf("decode b64 data: %w", err)
+	}
+	aesBlock, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(aesBlock)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return nil, errors.New("bad nonce size")
+	}
+	plaintext, err := gcm.Open(nil, nonce, data, nil)
+	if err != nil {
+		return nil, &wrongPasswordError{
+			errors.New(tr("wrong project passphrase"))}
+	}
+	return plaintext, nil
+}
+
+// unseal the outer layer of the project, keeping what's needed to seal it
+// again. passphrase is only called if the file wasn't sealed with KMS.
+func (s *shh) unseal(sld *sealed, passphrase func() ([]byte, error)) ([]byte, error) {
+	if sld.KMS != "" {
+		key, wrapped, plaintext, err := unsealKMS(sld)
+		if err != nil {
+			return nil, err
+		}
+		s.sealKey, s.sealKMS, s.sealWrapped = key, sld.KMS, wrapped
+		return plaintext, nil
+	}
+	pass, err := passphrase()
+	if err != nil {
+		return nil, fmt.Errorf("request passphrase: %w", err)
+	}
+	key, salt, plaintext, err := unsealData(pass, sld)
+	if err != nil {
+		return nil, err
+	}
+	s.sealKey, s.sealSalt = key, salt
+	return plaintext, nil
+}
+
+// requestProjectPassphrase from $SHH_PASSPHRASE, or from the user if unset.
+func requestProjectPassphrase() ([]byte, error) {
+	if pass := os.Getenv("SHH_PASSPHRASE"); pass != "" {
+		return []byte(pass), nil
+	}
+	return readPassword("project passphrase")
+}
+
+// sealShh encrypts the entire project file with a project passphrase, or
+// with a key wrapped by AWS KMS, so machines can read it using their IAM role.
+func sealShh(args []string) error {
+	fs := flag.NewFlagSet("seal", flag.ContinueOnError)
+	kmsARN := fs.String("kms", "", "aws kms key arn to seal with")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 0 {
+		return errors.New("bad args: expected `seal [--kms $arn]`")
+	}
+
+	const (
+		promises     = "stdio rpath wpath cpath tty proc exec inet dns unveil"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	shh, err := shhFromPath(".shh")
+	if err != nil {
+		return err
+	}
+	if shh.sealKey != nil {
+		return errors.New(".shh is already sealed")
+	}
+	var kms *kmsKey
+	if *kmsARN != "" {
+		if kms, err = newKMSKey(*kmsARN); err != nil {
+			return err
+		}
+		shh.sealKMS = *kmsARN
+	}
+	shh.unveilWrite()
+	shh.unveilNetwork()
+	unveilBlock()
+
+	if kms != nil {
+		key := make([]byte, 32)
+		if _, err = rand.Read(key); err != nil {
+			return err
+		}
+		if shh.sealWrapped, err = kms.WrapKey(key); err != nil {
+			return fmt.Errorf("wrap seal key: %w", err)
+		}
+		shh.sealKey = key
+		return shh.EncodeToFile()
+	}
+	passphrase, err := requestProjectPassphrase()
+	if err != nil {
+		return fmt.Errorf("request passphrase: %w", err)
+	}
+	if os.Getenv("SHH_PASSPHRASE") == "" {
+		confirm, err := readPassword("confirm project passphrase")
+		if err != nil {
+			return fmt.Errorf("request passphrase: %w", err)
+		}
+		defer wipe(confirm)
+		if !bytes.Equal(passphrase, confirm) {
+			return errors.New(tr("passwords do not match"))
+		}
+	}
+	shh.sealSalt = make([]byte, 32)
+	if _, err = rand.Read(shh.sealSalt); err != nil {
+		return err
+	}
+	shh.sealKey, err = deriveSealKey(passphrase, shh.sealSalt)
+	if err != nil {
+		return fmt.Errorf("derive key: %w", err)
+	}
+	return shh.EncodeToFile()
+}
+
+// unsealShh removes the project passphrase, leaving secrets encrypted
+// individually as usual.
+func unsealShh(args []string) error {
+	if len(args) != 0 {
+		return errors.New("bad args: expected none")
+	}
+
+	const (
+		promises     = "stdio rpath wpath cpath tty proc exec inet dns unveil"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	shh, err := shhFromPath(".shh")
+	if err != nil {
+		return err
+	}
+	shh.unveilWrite()
+	shh.unveilNetwork()
+	unveilBlock()
+
+	if shh.sealKey == nil {
+		return errors.New(".shh is not sealed")
+	}
+	shh.sealKey = nil
+	shh.sealSalt = nil
+	shh.sealKMS = ""
+	shh.sealWrapped = nil
+	return shh.EncodeToFile()
+}
+
+// encodeSealed wraps the encoded project in the sealed outer layer.
+func (s *shh) encodeSealed(w io.Writer, plaintext []byte) error {
+	sld, err := sealData(s.sealKey, s.sealSalt, plaintext)
+	if err != nil {
+		return fmt.Errorf("seal: %w", err)
+	}
+	if s.sealKMS != "" {
+		sld.Salt = ""
+		sld.KMS = s.sealKMS
+		sld.Key = base64.StdEncoding.EncodeToString(s.sealWrapped)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(outerLayer{Sealed: sld})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+)
+
+// secretServiceCache holds the password in the desktop keyring (GNOME
+// Keyring, KWallet, etc.) using the Secret Service API via secret-tool(1),
+// so it's locked and unlocked alongside the user's session. Items are found
+// by the config directory as well as the account, so profiles with the same
+// username don't share one.
+type secretServiceCache struct {
+	account    username
+	configPath string
+}
+
+// attributes identifying the item to secret-tool.
+func (c secretServiceCache) attributes() []string {
+	return []string{"service", "shh", "account", string(c.account),
+		"config", c.configPath}
+}
+
+func (c secretServiceCache) Get() ([]byte, error) {
+	cmd := exec.Command("secret-tool",
+		append([]string{"lookup"}, c.attributes()...)...)
+	out, err := cmd.Output()
+	if err != nil || len(out) == 0 {
+		return nil, errors.New(tr("cached password not available. run `shh login`"))
+	}
+	return out, nil
+}
+
+// Set the password, which secret-tool reads from stdin so it's never visible
+// to other processes.
+func (c secretServiceCache) Set(password []byte) error {
+	cmd := exec.Command("secret-tool",
+		append([]string{"store", "--label=shh"}, c.attributes()...)...)
+	cmd.Stdin = bytes.NewReader(password)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("store secret: %w: %s", err, out)
+	}
+	return nil
+}
+
+func (c secretServiceCache) Clear() error {
+	cmd := exec.Command("secret-tool",
+		append([]string{"clear"}, c.attributes()...)...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("clear secret: %w: %s", err, out)
+	}
+	return nil
+}
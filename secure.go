@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io"
+	"os"
+)
+
+// secureBytes hold sensitive data such as plaintext secrets, AES keys, and
+// passwords. They're locked into memory where supported, so they're never
+// swapped to disk, and they're zeroed when destroyed. Locking is best-effort:
+// if it fails (e.g. due to RLIMIT_MEMLOCK), the bytes are still zeroed.
+type secureBytes []byte
+
+// newSecureBytes locks b in place. The caller must Destroy it when done.
+func newSecureBytes(b []byte) secureBytes {
+	if len(b) > 0 {
+		_ = mlock(b)
+	}
+	return secureBytes(b)
+}
+
+// Destroy zeroes and unlocks the bytes.
+func (s secureBytes) Destroy() {
+	wipe(s)
+	if len(s) > 0 {
+		_ = munlock(s)
+	}
+}
+
+// wipe zeroes the bytes.
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// wipeFile overwrites the file with zeros before removing it, so plaintext
+// isn't trivially recoverable from the filesystem.
+func wipeFile(pth string) error {
+	fi, err := os.OpenFile(pth, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	stat, err := fi.Stat()
+	if err != nil {
+		fi.Close()
+		return err
+	}
+	_, err = io.CopyN(fi, zeroReader{}, stat.Size())
+	if err == nil {
+		err = fi.Sync()
+	}
+	if cerr := fi.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Remove(pth)
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	wipe(p)
+	return len(p), nil
+}
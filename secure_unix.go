@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "golang.org/x/sys/unix"
+
+func mlock(b []byte) error { return unix.Mlock(b) }
+
+func munlock(b []byte) error { return unix.Munlock(b) }
+
+// disableCoreDumps prevents a crash from writing memory (and with it any
+// secrets) to disk.
+func disableCoreDumps() error {
+	return unix.Setrlimit(unix.RLIMIT_CORE, &unix.Rlimit{Cur: 0, Max: 0})
+}
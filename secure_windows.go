@@ -0,0 +1,34 @@
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var (
+	kernel32          = syscall.NewLazyDLL("kernel32.dll")
+	procVirtualLock   = kernel32.NewProc("VirtualLock")
+	procVirtualUnlock = kernel32.NewProc("VirtualUnlock")
+)
+
+func mlock(b []byte) error {
+	ret, _, err := procVirtualLock.Call(uintptr(unsafe.Pointer(&b[0])),
+		uintptr(len(b)))
+	if ret == 0 {
+		return err
+	}
+	return nil
+}
+
+func munlock(b []byte) error {
+	ret, _, err := procVirtualUnlock.Call(uintptr(unsafe.Pointer(&b[0])),
+		uintptr(len(b)))
+	if ret == 0 {
+		return err
+	}
+	return nil
+}
+
+// disableCoreDumps is a no-op, since Windows doesn't write core dumps by
+// default.
+func disableCoreDumps() error { return nil }
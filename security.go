@@ -1,9 +1,17 @@
+//go:build !openbsd
 // +build !openbsd
 
 package main
 
 // pledge is only supported on OpenBSD.
-func pledge(promises, execPromises string) error { return nil }
+func pledge(promises, execPromises string) {}
+
+// pledged reports whether the promise is allowed, which it always is without
+// pledge.
+func pledged(promise string) bool { return true }
 
 // unveil is only supported on OpenBSD.
-func unveil() error { return nil }
+func unveil(filepath string, perm string) {}
+
+// unveilBlock is only supported on OpenBSD.
+func unveilBlock() {}
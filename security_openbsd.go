@@ -1,12 +1,34 @@
 package main
 
-import "golang.org/x/sys/unix"
+import (
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// pledgedPromises are those last pledged, or empty if shh hasn't pledged.
+var pledgedPromises string
 
 // pledge restricts shh to very limited syscalls.
 func pledge(promises, execPromises string) {
 	if err := unix.Pledge(promises, execPromises); err != nil {
 		panic(err)
 	}
+	pledgedPromises = promises
+}
+
+// pledged reports whether the promise is allowed, so optional work needing
+// more than a command pledged can be skipped rather than killing shh.
+func pledged(promise string) bool {
+	if pledgedPromises == "" {
+		return true
+	}
+	for _, p := range strings.Fields(pledgedPromises) {
+		if p == promise {
+			return true
+		}
+	}
+	return false
 }
 
 // unveil restricts shh to very limited (read-only) filesystem access.
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// selftest exercises shh on this platform using temporary keys and projects,
+// so users can validate it before trusting it with real secrets. By default
+// only in-process crypto round trips are run. --full also runs the shh binary
+// end to end against a temporary config, store, and server.
+func selftest(args []string) error {
+	fs := flag.NewFlagSet("selftest", flag.ContinueOnError)
+	full := fs.Bool("full", false, "run the shh binary end to end")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return errors.New("bad args: expected `selftest [--full]`")
+	}
+
+	tmpDir, err := ioutil.TempDir("", "shh-selftest")
+	if err != nil {
+		return fmt.Errorf("temp dir: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	t := &selftester{dir: tmpDir}
+	defer t.stop()
+	t.run("generate keys", t.genKeys)
+	t.run("encrypt and decrypt", t.roundTrip)
+	t.run("seal and unseal", t.seal)
+	if *full {
+		t.run("init", t.initProject)
+		t.run("add-user", t.addUser)
+		t.run("serve and login", t.serve)
+		t.run("set", t.set)
+		t.run("get", t.get)
+		t.run("allow", t.allow)
+		t.run("deny", t.deny)
+		t.run("rename", t.rename)
+		t.run("password file", t.passwordFile)
+		t.run("rotate", t.rotate)
+		t.run("del", t.del)
+	}
+	fmt.Printf("\n%d passed, %d failed\n", t.passed, t.failed)
+	if t.failed > 0 {
+		return errors.New("selftest failed")
+	}
+	return nil
+}
+
+// selftester tracks state between selftest steps. Once any step fails, the
+// remaining steps are skipped, since they depend on earlier ones.
+type selftester struct {
+	dir    string
+	users  []*selftestUser
+	procs  []*exec.Cmd
+	passed int
+	failed int
+}
+
+type selftestUser struct {
+	name     username
+	home     string
+	password []byte
+	keys     *keys
+	port     int
+
+	// env is added to the environment of the user's commands.
+	env []string
+}
+
+func (t *selftester) run(name string, fn func() error) {
+	if t.failed > 0 {
+		fmt.Printf("skip\t%s\n", name)
+		return
+	}
+	if err := fn(); err != nil {
+		t.failed++
+		fmt.Printf("FAIL\t%s: %s\n", name, err)
+		return
+	}
+	t.passed++
+	fmt.Printf("ok\t%s\n", name)
+}
+
+// stop any servers started during the selftest.
+func (t *selftester) stop() {
+	for _, cmd := range t.procs {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}
+}
+
+func (t *selftester) genKeys() error {
+	for _, name := range []string{"alice", "bob"} {
+		u := &selftestUser{
+			name: username(name + "@selftest"),
+			home: filepath.Join(t.dir, name),
+		}
+		byt := make([]byte, 24)
+		if _, err := rand.Read(byt); err != nil {
+			return err
+		}
+		u.password = []byte(hex.EncodeToString(byt))
+		port, err := freePort()
+		if err != nil {
+			return fmt.Errorf("free port: %w", err)
+		}
+		u.port = port
+		configPath := filepath.Join(u.home, ".config", "shh")
+		if err = os.MkdirAll(configPath, 0700); err != nil {
+			return err
+		}
+		u.keys, err = createKeys(configPath, u.password, minKeyBits)
+		if err != nil {
+			return fmt.Errorf("create keys: %w", err)
+		}
+		content := fmt.Sprintf("username=%s\nport=%d\n", u.name, u.port)
+		err = ioutil.WriteFile(filepath.Join(configPath, "config"),
+			[]byte(content), 0644)
+		if err != nil {
+			return err
+		}
+		if _, err = getKeys(configPath, u.password); err != nil {
+			return fmt.Errorf("get keys: %w", err)
+		}
+		t.users = append(t.users, u)
+	}
+	return nil
+}
+
+func (t *selftester) roundTrip() error {
+	alice := t.users[0]
+	shh := newShh(filepath.Join(t.dir, "roundtrip.shh"))
+	shh.Keys[alice.name] = alice.keys.PublicKeyBlock
+	sec, err := encryptSecret(rsaKeyWrapper{PublicKey: alice.keys.PublicKey}, []byte("plaintext"))
+	if err != nil {
+		return fmt.Errorf("encrypt: %w", err)
+	}
+	shh.Secrets[alice.name] = map[string]secret{"a": sec}
+	secrets, err := shh.GetSecretsForUser("a", alice.name)
+	if err != nil {
+		return err
+	}
+	plaintext, err := decryptSecret(alice.keys.PrivateKey, secrets["a"])
+	if err != nil {
+		return fmt.Errorf("decrypt: %w", err)
+	}
+	if string(plaintext) != "plaintext" {
+		return fmt.Errorf("expected %q, got %q", "plaintext", plaintext)
+	}
+	return nil
+}
+
+func (t *selftester) seal() error {
+	alice := t.users[0]
+	pth := filepath.Join(t.dir, "sealed.shh")
+	shh := newShh(pth)
+	shh.Keys[alice.name] = alice.keys.PublicKeyBlock
+	shh.sealSalt = make([]byte, 32)
+	if _, err := rand.Read(shh.sealSalt); err != nil {
+		return err
+	}
+	var err error
+	shh.sealKey, err = deriveSealKey(alice.password, shh.sealSalt)
+	if err != nil {
+		return err
+	}
+	buf := &bytes.Buffer{}
+	if err = shh.Encode(buf); err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+	if bytes.Contains(buf.Bytes(), []byte(alice.name)) {
+		return errors.New("sealed file contains username")
+	}
+	outer := outerLayer{}
+	if err = json.Unmarshal(buf.Bytes(), &outer); err != nil {
+		return err
+	}
+	if outer.Sealed == nil {
+		return errors.New("missing sealed layer")
+	}
+	_, _, plaintext, err := unsealData(alice.password, outer.Sealed)
+	if err != nil {
+		return fmt.Errorf("unseal: %w", err)
+	}
+	if !bytes.Contains(plaintext, []byte(alice.name)) {
+		return errors.New("unsealed file missing username")
+	}
+	return nil
+}
+
+// shh runs the shh binary as the user within the selftest project directory.
+func (t *selftester) shh(u *selftestUser, args ...string) (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	project := filepath.Join(t.dir, "project")
+	if err = os.MkdirAll(project, 0755); err != nil {
+		return "", err
+	}
+	cmd := exec.Command(exe, args...)
+	cmd.Dir = project
+	cmd.Env = append(selftestEnv(u.home), u.env...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("shh %s: %w: %s", strings.Join(args, " "),
+			err, bytes.TrimSpace(out))
+	}
+	return string(out), nil
+}
+
+func (t *selftester) initProject() error {
+	_, err := t.shh(t.users[0], "init")
+	return err
+}
+
+func (t *selftester) addUser() error {
+	bob := t.users[1]
+	pubKey := pem.EncodeToMemory(bob.keys.PublicKeyBlock)
+	_, err := t.shh(t.users[0], "add-user", string(bob.name), string(pubKey))
+	return err
+}
+
+func (t *selftester) serve() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	for _, u := range t.users {
+		cmd := exec.Command(exe, "serve")
+		cmd.Env = selftestEnv(u.home)
+		if err = cmd.Start(); err != nil {
+			return fmt.Errorf("start server: %w", err)
+		}
+		t.procs = append(t.procs, cmd)
+		url := fmt.Sprint("http://127.0.0.1:", u.port)
+		for i := 0; i < 50; i++ {
+			if err = pingServer(url); err == nil {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		if err != nil {
+			return err
+		}
+		if err = sendPasswordToServer(u.port,
+			filepath.Join(u.home, ".config", "shh"), u.password); err != nil {
+			return fmt.Errorf("login: %w", err)
+		}
+	}
+	return nil
+}
+
+func (t *selftester) set() error {
+	_, err := t.shh(t.users[0], "set", "selftest/a", "value")
+	return err
+}
+
+func (t *selftester) get() error {
+	return t.expectGet(t.users[0], "selftest/a", "value")
+}
+
+func (t *selftester) allow() error {
+	_, err := t.shh(t.users[0], "-n", "allow", string(t.users[1].name),
+		"selftest/*")
+	if err != nil {
+		return err
+	}
+	return t.expectGet(t.users[1], "selftest/a", "value")
+}
+
+func (t *selftester) deny() error {
+	_, err := t.shh(t.users[0], "deny", "--yes", string(t.users[1].name), "selftest/a")
+	if err != nil {
+		return err
+	}
+	if _, err = t.shh(t.users[1], "-n", "get", "selftest/a"); err == nil {
+		return errors.New("denied user can still get secret")
+	}
+	return nil
+}
+
+func (t *selftester) rename() error {
+	_, err := t.shh(t.users[0], "rename", "selftest/a", "selftest/b")
+	if err != nil {
+		return err
+	}
+	return t.expectGet(t.users[0], "selftest/b", "value")
+}
+
+func (t *selftester) passwordFile() error {
+	alice := t.users[0]
+	pth := filepath.Join(t.dir, "password")
+	if err := ioutil.WriteFile(pth, alice.password, 0600); err != nil {
+		return err
+	}
+	got, err := t.shh(alice, "-n", "-password-file", pth, "get", "selftest/b")
+	if err != nil {
+		return err
+	}
+	if got != "value" {
+		return fmt.Errorf("expected %q, got %q", "value", got)
+	}
+	return nil
+}
+
+// rotate keys using the same password. The server still holds the old key, so
+// the secret is read using the password instead.
+func (t *selftester) rotate() error {
+	alice := t.users[0]
+	pth := filepath.Join(t.dir, "password")
+	alice.env = []string{"SHH_NEW_PASSWORD_FILE=" + pth}
+	defer func() { alice.env = nil }()
+	if _, err := t.shh(alice, "-password-file", pth, "rotate"); err != nil {
+		return err
+	}
+	return t.passwordFile()
+}
+
+func (t *selftester) del() error {
+	if _, err := t.shh(t.users[0], "del", "--yes", "selftest/b"); err != nil {
+		return err
+	}
+	if _, err := t.shh(t.users[0], "-n", "get", "selftest/b"); err == nil {
+		return errors.New("deleted secret still exists")
+	}
+	return nil
+}
+
+func (t *selftester) expectGet(u *selftestUser, name, want string) error {
+	got, err := t.shh(u, "-n", "get", name)
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return fmt.Errorf("expected %q, got %q", want, got)
+	}
+	return nil
+}
+
+// selftestEnv replaces $HOME (%USERPROFILE% on Windows), so the shh binary uses
+// the selftest config, and removes any shh or XDG variables which could affect
+// the result.
+func selftestEnv(home string) []string {
+	env := []string{"HOME=" + home, "USERPROFILE=" + home}
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, "HOME=") ||
+			strings.HasPrefix(kv, "USERPROFILE=") ||
+			strings.HasPrefix(kv, "SHH_") ||
+			strings.HasPrefix(kv, "XDG_CONFIG_HOME=") ||
+			strings.HasPrefix(kv, "XDG_DATA_HOME=") ||
+			strings.HasPrefix(kv, "XDG_RUNTIME_DIR=") {
+			continue
+		}
+		env = append(env, kv)
+	}
+	return env
+}
+
+// freePort asks the kernel for an unused TCP port.
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// projectSettings are the team's policy for the project. They travel with the
+// project file, and every client reads and enforces them.
+type projectSettings struct {
+	// DefaultEnv is the environment used when -e and $SHH_ENV aren't
+	// given.
+	DefaultEnv string `json:"default_env,omitempty"`
+
+	// KeyAlgorithms limits the kinds of key secrets are encrypted for:
+	// rsa, kms, gpg, or age. Empty allows each of them.
+	KeyAlgorithms []string `json:"key_algorithms,omitempty"`
+
+	// GrantDays is how long access given by allow lasts, unless allow is
+	// given --expires. Zero never expires.
+	GrantDays int `json:"grant_days,omitempty"`
+
+	// Protected names or globs can only be deleted or denied with
+	// --force, as if each secret were protected with `shh protect`.
+	Protected []string `json:"protected,omitempty"`
+
+	// Policies constrain new values of matching secrets.
+	Policies []valuePolicy `json:"policies,omitempty"`
+
+	// MinPasswordScore rejects new passwords and passphrases rated below
+	// it, from 0 (trivially guessable) to 4 (strong).
+	MinPasswordScore int `json:"min_password_score,omitempty"`
+
+	// MaxAgeDays is how old a value may get before `shh get` and `shh
+	// audit` warn that it's due to be rotated. Zero never warns.
+	MaxAgeDays int `json:"max_age_days,omitempty"`
+
+	// Webhooks are URLs sent a signed event for each change to the
+	// project.
+	Webhooks []string `json:"webhooks,omitempty"`
+}
+
+// empty reports whether every setting is unset.
+func (p *projectSettings) empty() bool {
+	return p.DefaultEnv == "" && len(p.KeyAlgorithms) == 0 &&
+		p.GrantDays == 0 && len(p.Protected) == 0 && len(p.Policies) == 0 &&
+		p.MinPasswordScore == 0 && p.MaxAgeDays == 0 && len(p.Webhooks) == 0
+}
+
+// keyAlgorithms are the kinds of key a project may limit itself to.
+var keyAlgorithms = []string{"rsa", "kms", "gpg", "age"}
+
+// settingNames can be changed with `shh settings set`. min-key-bits and
+// trash-days are kept outside the settings block, where older clients read
+// them.
+var settingNames = []string{"default-env", "key-algorithms", "min-key-bits",
+	"grant-days", "protected", "trash-days", "min-password-score",
+	"max-age-days", "webhooks"}
+
+// validate reports an error if settings read from elsewhere, such as a
+// template, couldn't have been set with `shh settings set`.
+func (p *projectSettings) validate() error {
+	if err := validateEnvironment(p.DefaultEnv); err != nil {
+		return err
+	}
+	if _, err := parseKeyAlgorithms(strings.Join(p.KeyAlgorithms, ",")); err != nil {
+		return err
+	}
+	if p.GrantDays < 0 {
+		return errors.New("grant days must be >= 0")
+	}
+	if p.MaxAgeDays < 0 {
+		return errors.New("max age days must be >= 0")
+	}
+	if p.MinPasswordScore < 0 || p.MinPasswordScore > 4 {
+		return errors.New("min password score must be 0 to 4")
+	}
+	for _, glob := range p.Protected {
+		if err := validateGlob(glob); err != nil {
+			return err
+		}
+	}
+	for _, policy := range p.Policies {
+		if err := policy.validate(); err != nil {
+			return err
+		}
+	}
+	for _, u := range p.Webhooks {
+		if err := validateWebhook(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keyAlgorithm returns the kind of the user's key.
+func (s *shh) keyAlgorithm(u username) string {
+	if isAgeRecipient(u) {
+		return "age"
+	}
+	if block := s.Keys[u]; block != nil {
+		if name, _ := providerForBlock(block.Type); name != "" {
+			return name
+		}
+	}
+	return "rsa"
+}
+
+// checkKeyAlgorithm reports an error if the project doesn't allow the kind of
+// the user's key.
+func (s *shh) checkKeyAlgorithm(u username) error {
+	if s.Settings == nil || len(s.Settings.KeyAlgorithms) == 0 {
+		return nil
+	}
+	alg := s.keyAlgorithm(u)
+	for _, allowed := range s.Settings.KeyAlgorithms {
+		if allowed == alg {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s has an %s key, but the project only allows %s keys",
+		u, alg, strings.Join(s.Settings.KeyAlgorithms, ", "))
+}
+
+// grantExpiry returns when access given now expires, or nil if it doesn't.
+// days overrides the project's grant-days, if not negative.
+func (s *shh) grantExpiry(days int) *time.Time {
+	if days < 0 && s.Settings != nil {
+		days = s.Settings.GrantDays
+	}
+	if days <= 0 {
+		return nil
+	}
+	t := time.Now().UTC().Add(time.Duration(days) * 24 * time.Hour).
+		Truncate(time.Second)
+	return &t
+}
+
+// pruneExpired removes access which has expired from the decoded users.
+func (s *shh) pruneExpired() {
+	now := time.Now()
+	for u, secrets := range s.Secrets {
+		for name, sec := range secrets {
+			if sec.Expires != nil && now.After(*sec.Expires) {
+				debug("grant expired", "user", u, "secret", name)
+				delete(secrets, name)
+			}
+		}
+	}
+}
+
+// environmentChosen reports whether -e or $SHH_ENV chose the environment, even
+// if empty, so the project's default doesn't apply.
+func environmentChosen() bool {
+	if _, ok := os.LookupEnv("SHH_ENV"); ok {
+		return true
+	}
+	var chosen bool
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "e" || f.Name == "env" {
+			chosen = true
+		}
+	})
+	return chosen
+}
+
+// readSettings reads the project's settings without decoding its secrets,
+// for use before a command runs. Sealed and remote projects return no
+// settings, since reading them would prompt or reach the network.
+func readSettings() (*projectSettings, error) {
+	pth, err := findShhRecursive(".shh")
+	if err != nil {
+		return nil, err
+	}
+	byt, err := ioutil.ReadFile(pth)
+	if err != nil || len(byt) == 0 {
+		return nil, err
+	}
+	outer, err := parseOuterLayer(byt)
+	if err != nil || outer.Remote != "" || outer.Sealed != nil {
+		return nil, err
+	}
+	if !isBinaryShh(byt) {
+		var top struct {
+			Settings *projectSettings `json:"settings"`
+		}
+		err = json.Unmarshal(byt, &top)
+		return top.Settings, err
+	}
+	shh := newShh(pth)
+	if err = unmarshalShh(byt, shh); err != nil {
+		return nil, err
+	}
+	return shh.Settings, nil
+}
+
+// settings prints the project's settings, or changes one.
+func settings(args []string) error {
+	arg, tail := parseArg(args)
+	switch arg {
+	case "":
+		return showSettings()
+	case "set":
+		if len(tail) != 2 {
+			return errors.New("bad args: expected `settings set $name $value`")
+		}
+		return changeSetting(tail[0], tail[1])
+	case "unset":
+		if len(tail) != 1 {
+			return errors.New("bad args: expected `settings unset $name`")
+		}
+		return changeSetting(tail[0], "")
+	default:
+		return &badArgError{Arg: arg}
+	}
+}
+
+func showSettings() error {
+	const (
+		promises     = "stdio rpath wpath cpath tty inet dns proc exec"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	shh, err := shhNamesFromPath(".shh")
+	if err != nil {
+		return err
+	}
+	set := shh.Settings
+	if set == nil {
+		set = &projectSettings{}
+	}
+	values := map[string]string{
+		"default-env":    set.DefaultEnv,
+		"key-algorithms": strings.Join(set.KeyAlgorithms, ","),
+		"protected":      strings.Join(set.Protected, ","),
+		"webhooks":       strings.Join(set.Webhooks, ","),
+	}
+	if set.GrantDays != 0 {
+		values["grant-days"] = strconv.Itoa(set.GrantDays)
+	}
+	if shh.MinKeyBits != 0 {
+		values["min-key-bits"] = strconv.Itoa(shh.MinKeyBits)
+	}
+	if shh.TrashDays != 0 {
+		values["trash-days"] = strconv.Itoa(shh.TrashDays)
+	}
+	if set.MinPasswordScore != 0 {
+		values["min-password-score"] = strconv.Itoa(set.MinPasswordScore)
+	}
+	if set.MaxAgeDays != 0 {
+		values["max-age-days"] = strconv.Itoa(set.MaxAgeDays)
+	}
+	if jsonOutput {
+		obj := map[string]string{}
+		for name, v := range values {
+			if v != "" {
+				obj[name] = v
+			}
+		}
+		return printJSON(obj)
+	}
+	rows := make([][]cell, 0, len(settingNames))
+	for _, name := range settingNames {
+		v := values[name]
+		if v == "" {
+			v = "-"
+		}
+		rows = append(rows, []cell{{text: name, style: styleBold}, {text: v}})
+	}
+	printTable(os.Stdout, rows)
+	return nil
+}
+
+// changeSetting validates and saves a setting. An empty value unsets it.
+func changeSetting(name, value string) error {
+	known := false
+	for _, n := range settingNames {
+		known = known || n == name
+	}
+	if !known {
+		return fmt.Errorf("unknown setting %s, expected one of: %s", name,
+			strings.Join(settingNames, ", "))
+	}
+
+	const (
+		promises     = "stdio rpath wpath cpath tty inet dns proc exec"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	shh, err := shhFromPath(".shh")
+	if err != nil {
+		return err
+	}
+	if shh.Settings == nil {
+		shh.Settings = &projectSettings{}
+	}
+	set := shh.Settings
+	switch name {
+	case "default-env":
+		if err = validateEnvironment(value); err != nil {
+			return err
+		}
+		set.DefaultEnv = value
+	case "key-algorithms":
+		set.KeyAlgorithms, err = parseKeyAlgorithms(value)
+	case "grant-days":
+		set.GrantDays, err = parseSettingInt(value, 0)
+	case "protected":
+		set.Protected = nil
+		for _, glob := range splitList(value) {
+			if err = validateGlob(glob); err != nil {
+				return err
+			}
+			set.Protected = append(set.Protected, glob)
+		}
+	case "min-key-bits":
+		shh.MinKeyBits, err = parseSettingInt(value, minKeyBits)
+	case "trash-days":
+		shh.TrashDays, err = parseSettingInt(value, 1)
+	case "min-password-score":
+		set.MinPasswordScore, err = parseSettingInt(value, 0)
+		if err == nil && set.MinPasswordScore > 4 {
+			err = errors.New("min password score must be 0 to 4")
+		}
+	case "max-age-days":
+		set.MaxAgeDays, err = parseSettingInt(value, 0)
+	case "webhooks":
+		set.Webhooks = nil
+		for _, u := range splitList(value) {
+			if err = validateWebhook(u); err != nil {
+				return err
+			}
+			set.Webhooks = append(set.Webhooks, u)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if set.empty() {
+		shh.Settings = nil
+	}
+	return shh.EncodeToFile()
+}
+
+func parseKeyAlgorithms(value string) ([]string, error) {
+	var algs []string
+	for _, alg := range splitList(value) {
+		known := false
+		for _, k := range keyAlgorithms {
+			known = known || k == alg
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown key algorithm %s, expected %s",
+				alg, strings.Join(keyAlgorithms, ", "))
+		}
+		algs = append(algs, alg)
+	}
+	sort.Strings(algs)
+	return algs, nil
+}
+
+// parseSettingInt parses a number of at least min, or 0 when unset.
+func parseSettingInt(value string, min int) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < min {
+		return 0, fmt.Errorf("%s: expected a number of at least %d", value, min)
+	}
+	return n, nil
+}
+
+// splitList splits a comma-separated list, dropping empty entries.
+func splitList(value string) []string {
+	var list []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
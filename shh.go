@@ -1,15 +1,27 @@
 package main
 
 import (
-	"encoding/base64"
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
+
+	shhlib "github.com/egtann/shh/pkg/shh"
 )
 
 type shh struct {
@@ -20,20 +32,90 @@ type shh struct {
 	// Keys are public keys used to encrypt secrets for each user.
 	Keys map[username]*pem.Block `json:"keys"`
 
+	// MinKeyBits is the project's minimum RSA key size. Secrets will not
+	// be encrypted for any user whose key falls below it.
+	MinKeyBits int `json:"min_key_bits,omitempty"`
+
+	// Publish targets are read-only mirrors of part of the project, saved
+	// by `shh publish --save`.
+	Publish []publishTarget `json:"publish,omitempty"`
+
+	// Trash holds deleted secrets by name until they're restored or
+	// purged after TrashDays, or defaultTrashDays if unset.
+	Trash     map[string]trashedSecret `json:"trash,omitempty"`
+	TrashDays int                      `json:"trash_days,omitempty"`
+
+	// Environments maps each environment to the users granted it, who are
+	// given each secret set in it. Its secrets are named $env:$name.
+	Environments map[string][]username `json:"environments,omitempty"`
+
+	// Pins are the fingerprints of the keys users must use with the
+	// project, so they can't use another of their identities by mistake.
+	Pins map[username]string `json:"pins,omitempty"`
+
+	// Settings are the team's policy for the project.
+	Settings *projectSettings `json:"settings,omitempty"`
+
 	// namespace to which all secret names are added. This prevents two
 	// users creating their own secrets which have the same name but
 	// resolve to different secrets.
 	namespace map[string]struct{}
 
+	// binary is set when the file is in the binary format, which it's
+	// written back in.
+	binary bool
+
+	// encoded holds the secrets of users not decoded by shhFromPathFor.
+	// They're written back unchanged.
+	encoded map[username]json.RawMessage
+
+	// encodedNames are the secret names of each user in encoded. index is
+	// the cached index of the file as read if it was valid, and sum the
+	// file's checksum for the index.
+	encodedNames map[username][]string
+	index        *secretIndex
+	sum          string
+
+	// loaded holds each decoded user's secrets as read, so users whose
+	// secrets didn't change are written back without re-encoding them.
+	loaded map[username]loadedSecrets
+
 	// path of the .shh file itself.
 	path string
-}
 
-type secret struct {
-	AESKey    string `json:"key"`
-	Encrypted string `json:"value"`
+	// sealKey is derived from the project passphrase when the file is
+	// sealed. sealSalt is kept to re-seal the file using the same key.
+	sealKey  []byte
+	sealSalt []byte
+
+	// sealKMS is the AWS KMS key which wrapped sealKey, if the file was
+	// sealed with one rather than a passphrase, and sealWrapped is the
+	// wrapped key.
+	sealKMS     string
+	sealWrapped []byte
+
+	// store holds the project file when .shh points to a remote, and
+	// version is the version read from it.
+	store   projectStore
+	version string
+
+	// read is the project as read, unsealed, kept only when it has
+	// webhooks so its changes can be sent to them.
+	read []byte
+
+	// published is set when every saved publish target is already
+	// current, so they aren't published again on write.
+	published bool
+
+	// wrappers caches each user's key wrapper, so KMS credentials are
+	// found once.
+	wrappers   map[username]keyWrapper
+	wrappersMu sync.Mutex
 }
 
+// secret is one user's copy of a secret, as saved in the project file.
+type secret = shhlib.Secret
+
 func newShh(path string) *shh {
 	return &shh{
 		Secrets:   map[username]map[string]secret{},
@@ -43,19 +125,93 @@ func newShh(path string) *shh {
 	}
 }
 
-// findShhRecursive checks for a file recursively up the filesystem until it
-// hits an error.
+// projectFile is the project file given by the global -file flag or
+// $SHH_FILE, such as secrets/prod.shh. When empty, commands use the .shh in
+// the current directory or its nearest parent.
+var projectFile = os.Getenv("SHH_FILE")
+
+// projectDir is the directory holding .shh, given by $SHH_PROJECT_DIR. When
+// set, .shh isn't looked for anywhere else.
+var projectDir = os.Getenv("SHH_PROJECT_DIR")
+
+// projectPath returns projectFile, or .shh in projectDir, in place of the
+// default ".shh", if either is set.
+func projectPath(pth string) string {
+	switch {
+	case pth != ".shh":
+		return pth
+	case projectFile != "":
+		return projectFile
+	case projectDir != "":
+		return filepath.Join(projectDir, pth)
+	}
+	return pth
+}
+
+// projectSource describes how the project file at pth, returned by
+// findShhRecursive, was found.
+func projectSource(pth string) string {
+	switch {
+	case projectFile != "":
+		return "-file"
+	case projectDir != "":
+		return "$SHH_PROJECT_DIR"
+	case pth == ".shh":
+		return "current directory"
+	}
+	return "parent directory"
+}
+
+// isSearchBoundary reports whether the search for .shh stops at dir, which
+// is the root of a git repository or $HOME, so commands never use an
+// unrelated project above them.
+func isSearchBoundary(dir string) bool {
+	if home, err := os.UserHomeDir(); err == nil && dir == filepath.Clean(home) {
+		return true
+	}
+	_, err := os.Stat(filepath.Join(dir, ".git"))
+	return err == nil
+}
+
+// searchBoundary returns the directory at which the search for .shh from the
+// current directory stops.
+func searchBoundary() (string, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	for !isSearchBoundary(dir) && dir != filepath.Dir(dir) {
+		dir = filepath.Dir(dir)
+	}
+	return dir, nil
+}
+
+// findShhRecursive checks for a file in the current directory and each
+// parent up to the search boundary. A project file given with -file or
+// $SHH_PROJECT_DIR is used as is.
 func findShhRecursive(pth string) (string, error) {
+	if p := projectPath(pth); p != pth {
+		_, err := os.Stat(p)
+		switch {
+		case os.IsNotExist(err):
+			return "", os.ErrNotExist
+		case err != nil:
+			return "", fmt.Errorf("stat: %w", err)
+		}
+		return p, nil
+	}
 	abs, err := filepath.Abs(pth)
 	if err != nil {
 		return "", fmt.Errorf("abs: %w", err)
 	}
-	if abs == string(filepath.Separator)+filepath.Base(pth) {
-		// We hit the root, we're done
+	if dir := filepath.Dir(abs); dir == filepath.Dir(dir) {
+		// We hit the root (e.g. "/" or "C:\"), we're done
 		return "", os.ErrNotExist
 	}
 	_, err = os.Stat(pth)
 	switch {
+	case os.IsNotExist(err) && isSearchBoundary(filepath.Dir(abs)):
+		return "", os.ErrNotExist
 	case os.IsNotExist(err):
 		return findShhRecursive(filepath.Join("..", pth))
 	case err != nil:
@@ -65,6 +221,12 @@ func findShhRecursive(pth string) (string, error) {
 }
 
 func shhFromPath(pth string) (*shh, error) {
+	return readShh(pth, func(username) bool { return true })
+}
+
+// readShh reads the project file, decoding the secrets of the users for which
+// decode returns true.
+func readShh(pth string, decode func(username) bool) (*shh, error) {
 	recursivePath, err := findShhRecursive(pth)
 	switch {
 	case err == os.ErrNotExist:
@@ -74,6 +236,8 @@ func shhFromPath(pth string) (*shh, error) {
 	}
 	if recursivePath != "" {
 		pth = recursivePath
+	} else {
+		pth = projectPath(pth)
 	}
 	flags := os.O_CREATE | os.O_RDWR
 	fi, err := os.OpenFile(pth, flags, 0644)
@@ -82,13 +246,66 @@ func shhFromPath(pth string) (*shh, error) {
 	}
 	defer fi.Close()
 	shh := newShh(pth)
-	dec := json.NewDecoder(fi)
-	err = dec.Decode(shh)
-	switch {
-	case err == io.EOF:
+
+	// Size the buffer up front, since growing it while reading a large file
+	// allocates several times its size
+	var buf bytes.Buffer
+	if info, err := fi.Stat(); err == nil {
+		buf.Grow(int(info.Size()) + bytes.MinRead)
+	}
+	if _, err = buf.ReadFrom(fi); err != nil {
+		return nil, fmt.Errorf("read all: %w", err)
+	}
+	byt := buf.Bytes()
+	debug("read project", "path", pth, "bytes", len(byt))
+	releaseSharedLock()
+	if len(byt) == 0 {
 		// We newly created the file. Not an error, just an empty .shh
 		return shh, nil
-	case err != nil:
+	}
+	outer, err := parseOuterLayer(byt)
+	if err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+	if outer.Remote != "" {
+		shh.store, err = newProjectStore(outer.Remote)
+		if err != nil {
+			return nil, err
+		}
+		byt, shh.version, err = shh.store.read()
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", outer.Remote, err)
+		}
+		debug("read remote project", "url", outer.Remote, "bytes", len(byt))
+		if len(byt) == 0 {
+			return shh, nil
+		}
+		if outer, err = parseOuterLayer(byt); err != nil {
+			return nil, fmt.Errorf("decode: %w", err)
+		}
+		if outer.Remote != "" {
+			return nil, fmt.Errorf("%s points to another remote", outer.Remote)
+		}
+	}
+	if outer.Sealed != nil {
+		debug("unseal project")
+		byt, err = shh.unseal(outer.Sealed, requestProjectPassphrase)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !isBinaryShh(byt) {
+		if err = shh.decodeFor(byt, decode); err != nil {
+			return nil, fmt.Errorf("decode: %w", err)
+		}
+		if err = shh.checkPin(); err != nil {
+			return nil, err
+		}
+		shh.pruneExpired()
+		shh.keepForWebhooks(byt)
+		return shh, nil
+	}
+	if err = unmarshalShh(byt, shh); err != nil {
 		return nil, fmt.Errorf("decode: %w", err)
 	}
 	for _, secrets := range shh.Secrets {
@@ -96,23 +313,158 @@ func shhFromPath(pth string) (*shh, error) {
 			shh.namespace[secretName] = struct{}{}
 		}
 	}
+	if err = shh.checkPin(); err != nil {
+		return nil, err
+	}
+	shh.pruneExpired()
+	shh.keepForWebhooks(byt)
 	return shh, nil
 }
 
 func (s *shh) EncodeToFile() error {
-	flags := os.O_TRUNC | os.O_CREATE | os.O_WRONLY
-	fi, err := os.OpenFile(s.path, flags, 0644)
+	s.purgeTrash(time.Now())
+	if s.store != nil {
+		var buf bytes.Buffer
+		if err := s.Encode(&buf); err != nil {
+			return err
+		}
+		debug("write remote project", "bytes", buf.Len())
+		version, err := s.store.write(buf.Bytes(), s.version)
+		if err != nil {
+			return err
+		}
+		s.version = version
+		s.notifyWebhooks()
+		s.publishSaved()
+		return nil
+	}
+	if err := backupShh(s.path); err != nil {
+		return fmt.Errorf("back up: %w", err)
+	}
+	debug("write project", "path", s.path)
+	before := fileDigest(s.path)
+	h := sha256.New()
+	var entry []byte
+	err := writeFileAtomicBefore(s.path, 0644, func(w io.Writer) error {
+		return s.Encode(io.MultiWriter(w, h))
+	}, func() (err error) {
+		// Stage the audit entry before the project changes, so the log
+		// never falls behind it
+		entry, err = stageAudit(s.path, before, hex.EncodeToString(h.Sum(nil)))
+		if err != nil {
+			return fmt.Errorf("audit log: %w", err)
+		}
+		return nil
+	})
 	if err != nil {
+		if entry != nil {
+			_ = removePendingAudit(s.path)
+		}
 		return err
 	}
-	defer fi.Close()
-	return s.Encode(fi)
+	sum := hex.EncodeToString(h.Sum(nil))
+	if s.indexable() {
+		s.sum = sum
+		s.index = s.buildIndex(s.sum)
+		_ = s.index.save(s.path)
+	}
+	if err = commitAudit(s.path, entry); err != nil {
+		return fmt.Errorf("audit log: %w", err)
+	}
+	s.notifyWebhooks()
+	s.publishSaved()
+	return nil
 }
 
 func (s *shh) Encode(w io.Writer) error {
-	enc := json.NewEncoder(w)
-	enc.SetIndent("", "\t")
-	return enc.Encode(s)
+	if s.binary {
+		byt, err := s.encodeBinary()
+		if err != nil {
+			return err
+		}
+		if s.sealKey != nil {
+			return s.encodeSealed(w, byt)
+		}
+		_, err = w.Write(byt)
+		return err
+	}
+	if s.sealKey != nil {
+		var buf bytes.Buffer
+		if err := s.encodeJSON(&buf); err != nil {
+			return err
+		}
+		return s.encodeSealed(w, bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+	}
+	return s.encodeJSON(w)
+}
+
+// writeFileAtomic replaces the file at pth, so a crash leaves either the old
+// or the new content and never a partial write. The data is written and
+// synced to a temporary file in the same directory, then renamed over pth.
+// An existing file keeps its mode.
+func writeFileAtomic(pth string, byt []byte, perm os.FileMode) error {
+	return writeFileAtomicFunc(pth, perm, func(w io.Writer) error {
+		_, err := w.Write(byt)
+		return err
+	})
+}
+
+// writeFileAtomicFunc is writeFileAtomic for content written by a function.
+func writeFileAtomicFunc(pth string, perm os.FileMode, write func(io.Writer) error) error {
+	return writeFileAtomicBefore(pth, perm, write, nil)
+}
+
+// writeFileAtomicBefore is writeFileAtomicFunc which calls before, if it's
+// set, once the content is written and synced but before it replaces pth. If
+// before fails, pth is left as it was.
+func writeFileAtomicBefore(pth string, perm os.FileMode, write func(io.Writer) error, before func() error) error {
+	if stat, err := os.Stat(pth); err == nil {
+		perm = stat.Mode().Perm()
+	}
+	dir, name := filepath.Split(pth)
+	if dir == "" {
+		dir = "."
+	}
+	fi, err := ioutil.TempFile(dir, "."+name+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := fi.Name()
+	defer os.Remove(tmp) // Fails harmlessly once renamed
+	err = write(fi)
+	if err == nil {
+		err = fi.Chmod(perm)
+	}
+	if err == nil {
+		err = fi.Sync()
+	}
+	if cerr := fi.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && before != nil {
+		err = before()
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, pth); err != nil {
+		return err
+	}
+
+	// Persist the rename. Directories can't be synced on all platforms,
+	// such as Windows, so this is best-effort
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// unveilWrite allows replacing the project file, which writes a temporary
+// file beside it.
+func (s *shh) unveilWrite() {
+	unveil(filepath.Dir(s.path), "rwc")
+	s.unveilPublish()
 }
 
 // GetSecretsForUser. If there's an exact key match, the secret will be
@@ -133,21 +485,15 @@ func (s *shh) GetSecretsForUser(key string, user username) (map[string]secret, e
 	}
 	sec, exist := userSecrets[key]
 	if exist {
-		tmp, err := base64.StdEncoding.DecodeString(sec.AESKey)
+		sec, err := decodeSecret(sec)
 		if err != nil {
-			return nil, fmt.Errorf("decode b64 aes key: %w", err)
+			return nil, err
 		}
-		sec.AESKey = string(tmp)
-		tmp, err = base64.StdEncoding.DecodeString(sec.Encrypted)
-		if err != nil {
-			return nil, fmt.Errorf("decode b64 secret: %w", err)
-		}
-		sec.Encrypted = string(tmp)
 		return map[string]secret{key: sec}, nil
 	}
 	glob := strings.Index(key, "*")
 	if glob == -1 {
-		return nil, errors.New("no secret found")
+		return nil, &notFoundError{"no secret found"}
 	}
 	if glob < len(key)-1 {
 		return nil, errors.New("invalid glob: must be last character")
@@ -157,32 +503,275 @@ func (s *shh) GetSecretsForUser(key string, user username) (map[string]secret, e
 	for k, v := range userSecrets {
 		match := strings.HasPrefix(k, key)
 		if match {
-			byt, err := base64.StdEncoding.DecodeString(v.AESKey)
-			if err != nil {
-				return nil, fmt.Errorf("decode b64 aes key: %w", err)
-			}
-			v.AESKey = string(byt)
-			byt, err = base64.StdEncoding.DecodeString(v.Encrypted)
+			v, err := decodeSecret(v)
 			if err != nil {
-				return nil, fmt.Errorf("decode b64 encrypted: %w", err)
+				return nil, err
 			}
-			v.Encrypted = string(byt)
 			matches[k] = v
 		}
 	}
 	return matches, nil
 }
 
-func (s *shh) AllSecrets() []string {
-	seen := map[string]struct{}{}
-	for _, userSecrets := range s.Secrets {
-		for name := range userSecrets {
-			seen[name] = struct{}{}
+// decodeSecret decodes the base64 AES key and value. Secrets for age
+// recipients are left as armored text.
+func decodeSecret(sec secret) (secret, error) {
+	if sec.AESKey == "" {
+		return sec, nil
+	}
+	return shhlib.DecodeSecret(sec)
+}
+
+// validateGlob reports an error if the glob is used anywhere but as the last
+// character.
+func validateGlob(glob string) error {
+	return shhlib.ValidateGlob(glob)
+}
+
+// globMatch reports whether the secret name matches exactly or, if the glob
+// ends with "*", whether it has the glob's prefix.
+func globMatch(glob, name string) bool {
+	return shhlib.Match(glob, name)
+}
+
+// updateSecret re-encrypts the secret for each user with access to it,
+// preserving whether it's sensitive or protected.
+func (s *shh) updateSecret(name string, plaintext []byte) error {
+	var users []username
+	for username, secrets := range s.Secrets {
+		if _, ok := secrets[name]; ok {
+			users = append(users, username)
+		}
+	}
+	return s.encryptForUsers(users, name, plaintext, func(u username) secret {
+		return s.Secrets[u][name]
+	})
+}
+
+// encryptForUsers encrypts the plaintext for each user in parallel, saving it
+// under name. Flags are copied from the secret returned by flags.
+func (s *shh) encryptForUsers(users []username, name string, plaintext []byte, flags func(username) secret) error {
+	debug("encrypt", "secret", name, "users", users)
+	modified := time.Now().UTC().Truncate(time.Second)
+	encs := make([]secret, len(users))
+	err := parallel(len(users), func(i int) error {
+		enc, err := s.encryptFor(users[i], plaintext)
+		if err != nil {
+			return err
+		}
+		sec := flags(users[i])
+		enc.Sensitive, enc.Protected = sec.Sensitive, sec.Protected
+		enc.Expires, enc.Modified, enc.Granted = sec.Expires, &modified, sec.Granted
+		if enc.Granted == nil {
+			enc.Granted = &modified
+		}
+		encs[i] = enc
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i, u := range users {
+		if _, exist := s.Secrets[u]; !exist {
+			s.Secrets[u] = map[string]secret{}
 		}
+		s.Secrets[u][name] = encs[i]
+	}
+	if environment != "" && strings.HasPrefix(name, inEnv("")) {
+		s.declareEnvironment(environment)
+	}
+	return nil
+}
+
+// keyWrapper encrypts a secret's AES key for one user.
+type keyWrapper = shhlib.KeyWrapper
+
+// rsaKeyWrapper encrypts AES keys with a user's RSA public key.
+type rsaKeyWrapper = shhlib.RSAKeyWrapper
+
+// encryptSecret with a new AES-256 key, which is itself encrypted for the
+// user. The result is base64 encoded for the .shh file.
+func encryptSecret(w keyWrapper, plaintext []byte) (secret, error) {
+	// Keep the AES key in locked memory
+	aesKey := newSecureBytes(make([]byte, 32))
+	defer aesKey.Destroy()
+	if _, err := rand.Read(aesKey); err != nil {
+		return secret{}, err
+	}
+	return shhlib.EncryptSecretWithKey(w, aesKey, plaintext)
+}
+
+// decryptSecret decoded by GetSecretsForUser using the user's private key,
+// either directly or via the server. The caller must destroy the plaintext.
+func decryptSecret(dec crypto.Decrypter, sec secret) (secureBytes, error) {
+	byt, err := shhlib.DecrypterKey{Decrypter: dec}.UnwrapKey([]byte(sec.AESKey))
+	if err != nil {
+		return nil, fmt.Errorf("decrypt secret: %w", err)
+	}
+	aesKey := newSecureBytes(byt)
+	defer aesKey.Destroy()
+	if len(sec.Encrypted) < aes.BlockSize {
+		return nil, errors.New("encrypted secret too short")
+	}
+	plaintext := newSecureBytes(make([]byte, len(sec.Encrypted)-aes.BlockSize))
+	if err = shhlib.DecryptSecretWithKey(aesKey, sec, plaintext); err != nil {
+		plaintext.Destroy()
+		return nil, err
+	}
+	return plaintext, nil
+}
+
+// decryptEach decrypts the secrets in parallel and calls fn with each one in
+// order of name, as soon as it and those before it are decrypted. Values are
+// destroyed once fn returns. After an error no more secrets are decrypted.
+func decryptEach(dec crypto.Decrypter, secrets map[string]secret, fn func(name string, plaintext secureBytes) error) error {
+	names := sortedSecretNames(secrets)
+	debug("decrypt", "secrets", names)
+	values := make([]secureBytes, len(names))
+	errs := make([]error, len(names))
+	done := make([]chan struct{}, len(names))
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+	stop := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		_ = parallel(len(names), func(i int) error {
+			defer close(done[i])
+			select {
+			case <-stop:
+				errs[i] = errStopped
+			default:
+				values[i], errs[i] = decryptSecret(dec, secrets[names[i]])
+			}
+			return errs[i]
+		})
+	}()
+	defer func() {
+		close(stop)
+		<-finished
+		for _, v := range values {
+			v.Destroy()
+		}
+	}()
+	for i, name := range names {
+		// Workers start indexes in order and stop after an error, so
+		// every index up to the first error is done eventually
+		<-done[i]
+		if errs[i] != nil {
+			return fmt.Errorf("%s: %w", name, errs[i])
+		}
+		err := fn(name, values[i])
+		values[i].Destroy()
+		values[i] = nil
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// errStopped is returned by work skipped after another failure.
+var errStopped = errors.New("stopped")
+
+// PublicKey parses the user's public key from the project file, reporting an
+// error if the key falls below the project's minimum key size.
+func (s *shh) PublicKey(user username) (*rsa.PublicKey, error) {
+	block, exist := s.Keys[user]
+	if !exist {
+		return nil, fmt.Errorf("%q is not a user in the project", user)
+	}
+	pubKey, err := parsePublicKey(block)
+	if err != nil {
+		return nil, fmt.Errorf("parse public key: %w", err)
+	}
+	if err = s.checkKeyBits(user, pubKey); err != nil {
+		return nil, err
+	}
+	return pubKey, nil
+}
+
+// publicKeys caches parsed public keys by the SHA-256 of their DER, so each
+// key is parsed once per run however many secrets are encrypted for it or
+// project files are read.
+var publicKeys sync.Map
+
+// parsePublicKey parses a PKCS#1 public key, using the cache. The key must
+// not be modified.
+func parsePublicKey(block *pem.Block) (*rsa.PublicKey, error) {
+	fp := sha256.Sum256(block.Bytes)
+	if key, ok := publicKeys.Load(fp); ok {
+		return key.(*rsa.PublicKey), nil
+	}
+	key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	publicKeys.Store(fp, key)
+	return key, nil
+}
+
+// encryptFor encrypts the plaintext for a project user or an age recipient.
+func (s *shh) encryptFor(user username, plaintext []byte) (secret, error) {
+	if isAgeRecipient(user) {
+		if err := s.checkKeyAlgorithm(user); err != nil {
+			return secret{}, err
+		}
+		return encryptAgeSecret(string(user), plaintext)
+	}
+	w, err := s.wrapperFor(user)
+	if err != nil {
+		return secret{}, err
+	}
+	return encryptSecret(w, plaintext)
+}
+
+// wrapperFor the user's key: their RSA public key or, for users of a key
+// provider such as KMS, the provider's key.
+func (s *shh) wrapperFor(user username) (keyWrapper, error) {
+	s.wrappersMu.Lock()
+	defer s.wrappersMu.Unlock()
+	if w, ok := s.wrappers[user]; ok {
+		return w, nil
+	}
+	block, exist := s.Keys[user]
+	if !exist {
+		return nil, fmt.Errorf("%q is not a user in the project", user)
+	}
+	if err := s.checkKeyAlgorithm(user); err != nil {
+		return nil, err
+	}
+	var w keyWrapper
+	if _, p := providerForBlock(block.Type); p != nil {
+		var err error
+		if w, err = p.wrapper(block); err != nil {
+			return nil, err
+		}
+	} else {
+		pubKey, err := s.PublicKey(user)
+		if err != nil {
+			return nil, err
+		}
+		w = rsaKeyWrapper{PublicKey: pubKey}
+	}
+	if s.wrappers == nil {
+		s.wrappers = map[username]keyWrapper{}
+	}
+	s.wrappers[user] = w
+	return w, nil
+}
+
+// checkKeyBits ensures the key satisfies the project's key size policy.
+func (s *shh) checkKeyBits(user username, pubKey *rsa.PublicKey) error {
+	bits := pubKey.N.BitLen()
+	min := s.MinKeyBits
+	if min < minKeyBits {
+		min = minKeyBits
 	}
-	secrets := []string{}
-	for name := range seen {
-		secrets = append(secrets, name)
+	if bits < min {
+		return fmt.Errorf("%s has a %d-bit key, below the project minimum of %d bits. they must run `shh rotate --bits %d`",
+			user, bits, min, min)
 	}
-	return secrets
+	return nil
 }
@@ -0,0 +1,893 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// sopsVersion is the SOPS release whose file format is written.
+	sopsVersion = "3.8.1"
+
+	// sopsUnencryptedSuffix marks keys whose values SOPS leaves in
+	// plaintext, though they're still covered by the MAC.
+	sopsUnencryptedSuffix = "_unencrypted"
+
+	// sopsNonceSize is the size of SOPS's AES-GCM nonces, rather than the
+	// usual 12 bytes.
+	sopsNonceSize = 32
+)
+
+// sopsEncRe matches a value encrypted by SOPS.
+var sopsEncRe = regexp.MustCompile(`^ENC\[AES256_GCM,data:(.*),iv:(.+),tag:(.+),type:(.+)\]$`)
+
+// sopsMap is a JSON object or YAML mapping which keeps its order, since the
+// SOPS MAC depends on it. Values are sopsMap, []interface{}, string, int,
+// float64, bool, or nil.
+type sopsMap []sopsItem
+
+type sopsItem struct {
+	Key   string
+	Value interface{}
+}
+
+func (m sopsMap) get(key string) (interface{}, bool) {
+	for _, it := range m {
+		if it.Key == key {
+			return it.Value, true
+		}
+	}
+	return nil, false
+}
+
+// sopsEncryptFile encrypts a JSON or YAML file in the SOPS format. The data
+// key is wrapped for each user in the project: KMS users get standard kms
+// entries, which SOPS itself can decrypt, and others get shh entries for
+// `shh sops-decrypt`.
+func sopsEncryptFile(args []string) error {
+	fs := flag.NewFlagSet("sops-encrypt", flag.ContinueOnError)
+	out := fs.String("o", "", "output file (default stdout)")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return errors.New("bad args: expected `sops-encrypt $file [-o $out]`")
+	}
+	format, err := sopsFormat(args[0])
+	if err != nil {
+		return err
+	}
+
+	const (
+		promises     = "stdio rpath wpath cpath inet dns proc exec"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	byt, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	defer wipe(byt)
+	tree, err := parseSopsTree(format, byt)
+	if err != nil {
+		return err
+	}
+	if _, ok := tree.get("sops"); ok {
+		return fmt.Errorf("%s is already encrypted", args[0])
+	}
+	shh, err := shhFromPath(".shh")
+	if err != nil {
+		return err
+	}
+	if len(shh.Keys) == 0 {
+		return errors.New("no users in the project")
+	}
+
+	dataKey := newSecureBytes(make([]byte, 32))
+	defer dataKey.Destroy()
+	if _, err = rand.Read(dataKey); err != nil {
+		return err
+	}
+	metadata, err := sopsKeys(shh, dataKey)
+	if err != nil {
+		return err
+	}
+	mac := sha512.New()
+	_, err = sopsWalk(tree, nil, func(v interface{}, path []string) (interface{}, error) {
+		mac.Write(sopsMACBytes(v))
+		if sopsUnencrypted(path, sopsUnencryptedSuffix) {
+			return v, nil
+		}
+		return sopsEncryptValue(v, dataKey, strings.Join(path, ":")+":")
+	})
+	if err != nil {
+		return err
+	}
+	lastModified := time.Now().UTC().Format(time.RFC3339)
+	encMAC, err := sopsEncryptValue(fmt.Sprintf("%X", mac.Sum(nil)), dataKey,
+		lastModified)
+	if err != nil {
+		return err
+	}
+	metadata = append(metadata,
+		sopsItem{Key: "lastmodified", Value: lastModified},
+		sopsItem{Key: "mac", Value: encMAC},
+		sopsItem{Key: "unencrypted_suffix", Value: sopsUnencryptedSuffix},
+		sopsItem{Key: "version", Value: sopsVersion})
+	tree = append(tree, sopsItem{Key: "sops", Value: metadata})
+
+	enc := encodeSopsTree(format, tree)
+	if *out == "" {
+		_, err = os.Stdout.Write(enc)
+		return err
+	}
+	return ioutil.WriteFile(*out, enc, 0644)
+}
+
+// sopsDecryptFile decrypts a SOPS file encrypted for the user, to stdout or a
+// file with 0600 permissions.
+func sopsDecryptFile(nonInteractive bool, args []string) error {
+	fs := flag.NewFlagSet("sops-decrypt", flag.ContinueOnError)
+	out := fs.String("o", "", "output file (default stdout)")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return errors.New("bad args: expected `sops-decrypt $file [-o $out]`")
+	}
+	format, err := sopsFormat(args[0])
+	if err != nil {
+		return err
+	}
+
+	const (
+		promises     = "stdio rpath wpath cpath tty proc exec inet dns"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	byt, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	tree, err := parseSopsTree(format, byt)
+	if err != nil {
+		return err
+	}
+	var metadata sopsMap
+	for i, it := range tree {
+		if it.Key == "sops" {
+			metadata, _ = it.Value.(sopsMap)
+			tree = append(tree[:i], tree[i+1:]...)
+			break
+		}
+	}
+	if metadata == nil {
+		return fmt.Errorf("%s is not encrypted with sops", args[0])
+	}
+	for _, key := range []string{"encrypted_suffix", "encrypted_regex",
+		"unencrypted_regex", "encrypted_comment_regex",
+		"unencrypted_comment_regex", "shamir_threshold"} {
+		if _, ok := metadata.get(key); ok {
+			return fmt.Errorf("%s isn't supported", key)
+		}
+	}
+	suffix := sopsUnencryptedSuffix
+	if v, ok := metadata.get("unencrypted_suffix"); ok {
+		suffix = fmt.Sprint(v)
+	}
+	lastModified, _ := metadata.get("lastmodified")
+	encMAC, _ := metadata.get("mac")
+
+	configPath, err := getConfigPath()
+	if err != nil {
+		return err
+	}
+	user, err := getUser(configPath)
+	if err != nil {
+		return fmt.Errorf("get user: %w", err)
+	}
+
+	// Find the data key wrapped for us
+	list, field := "shh", "user"
+	if isKMSKey(user.Username) {
+		list, field = "kms", "arn"
+	}
+	var wrapped string
+	entries, _ := metadata.get(list)
+	items, _ := entries.([]interface{})
+	for _, item := range items {
+		entry, _ := item.(sopsMap)
+		if id, _ := entry.get(field); id == string(user.Username) {
+			enc, _ := entry.get("enc")
+			wrapped, _ = enc.(string)
+		}
+	}
+	if wrapped == "" {
+		return fmt.Errorf("%s isn't encrypted for %s", args[0], user.Username)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return fmt.Errorf("decode data key: %w", err)
+	}
+	dec, err := user.decrypter(configPath, nonInteractive)
+	if err != nil {
+		return err
+	}
+	key, err := dec.Decrypt(rand.Reader, ciphertext,
+		&rsa.OAEPOptions{Hash: crypto.SHA256})
+	if err != nil {
+		return fmt.Errorf("decrypt data key: %w", err)
+	}
+	dataKey := newSecureBytes(key)
+	defer dataKey.Destroy()
+
+	mac := sha512.New()
+	_, err = sopsWalk(tree, nil, func(v interface{}, path []string) (interface{}, error) {
+		if s, ok := v.(string); ok && !sopsUnencrypted(path, suffix) {
+			var err error
+			v, err = sopsDecryptValue(s, dataKey, strings.Join(path, ":")+":")
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", strings.Join(path, "."), err)
+			}
+		}
+		mac.Write(sopsMACBytes(v))
+		return v, nil
+	})
+	if err != nil {
+		return err
+	}
+	s, _ := encMAC.(string)
+	lm, _ := lastModified.(string)
+	want, err := sopsDecryptValue(s, dataKey, lm)
+	if err != nil {
+		return fmt.Errorf("mac: %w", err)
+	}
+	got := fmt.Sprintf("%X", mac.Sum(nil))
+	if w, _ := want.(string); !hmac.Equal([]byte(w), []byte(got)) {
+		return errors.New("mac mismatch: the file was modified")
+	}
+
+	plaintext := encodeSopsTree(format, tree)
+	defer wipe(plaintext)
+	if *out == "" {
+		_, err = os.Stdout.Write(plaintext)
+		return err
+	}
+	fi, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer fi.Close()
+	if err = fi.Chmod(0600); err != nil {
+		return err
+	}
+	if _, err = fi.Write(plaintext); err != nil {
+		return err
+	}
+	return fi.Close()
+}
+
+// sopsKeys wraps the data key for each project user.
+func sopsKeys(shh *shh, dataKey []byte) (sopsMap, error) {
+	names := make([]string, 0, len(shh.Keys))
+	for name := range shh.Keys {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	now := time.Now().UTC().Format(time.RFC3339)
+	var kms, users []interface{}
+	for _, name := range names {
+		w, err := shh.wrapperFor(username(name))
+		if err != nil {
+			return nil, err
+		}
+		enc, err := w.WrapKey(dataKey)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if block := shh.Keys[username(name)]; block.Type == kmsBlockType {
+			kms = append(kms, sopsMap{
+				{Key: "arn", Value: string(block.Bytes)},
+				{Key: "created_at", Value: now},
+				{Key: "enc", Value: base64.StdEncoding.EncodeToString(enc)},
+				{Key: "aws_profile", Value: ""},
+			})
+			continue
+		}
+		users = append(users, sopsMap{
+			{Key: "user", Value: name},
+			{Key: "created_at", Value: now},
+			{Key: "enc", Value: base64.StdEncoding.EncodeToString(enc)},
+		})
+	}
+	var metadata sopsMap
+	if len(kms) > 0 {
+		metadata = append(metadata, sopsItem{Key: "kms", Value: kms})
+	}
+	if len(users) > 0 {
+		metadata = append(metadata, sopsItem{Key: "shh", Value: users})
+	}
+	return metadata, nil
+}
+
+// sopsWalk replaces each non-null leaf with fn's result, in order. path holds
+// the keys leading to the leaf, which list items share with their list.
+func sopsWalk(v interface{}, path []string, fn func(v interface{}, path []string) (interface{}, error)) (interface{}, error) {
+	switch v := v.(type) {
+	case sopsMap:
+		for i := range v {
+			val, err := sopsWalk(v[i].Value,
+				append(path[:len(path):len(path)], v[i].Key), fn)
+			if err != nil {
+				return nil, err
+			}
+			v[i].Value = val
+		}
+		return v, nil
+	case []interface{}:
+		for i := range v {
+			val, err := sopsWalk(v[i], path, fn)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = val
+		}
+		return v, nil
+	case nil:
+		return nil, nil
+	}
+	return fn(v, path)
+}
+
+func sopsUnencrypted(path []string, suffix string) bool {
+	for _, key := range path {
+		if strings.HasSuffix(key, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// sopsPlain converts a leaf to the bytes SOPS encrypts and its type name.
+func sopsPlain(v interface{}) (string, []byte) {
+	switch v := v.(type) {
+	case int:
+		return "int", []byte(strconv.Itoa(v))
+	case float64:
+		return "float", []byte(strconv.FormatFloat(v, 'f', -1, 64))
+	case bool:
+		return "bool", []byte(strconv.FormatBool(v))
+	}
+	return "str", []byte(fmt.Sprint(v))
+}
+
+// sopsMACBytes converts a leaf to the bytes SOPS hashes, which differ from
+// the encrypted bytes only for bools.
+func sopsMACBytes(v interface{}) []byte {
+	if b, ok := v.(bool); ok {
+		if b {
+			return []byte("True")
+		}
+		return []byte("False")
+	}
+	_, byt := sopsPlain(v)
+	return byt
+}
+
+// sopsEncryptValue encrypts a leaf with AES-256-GCM, authenticating aad.
+func sopsEncryptValue(v interface{}, key []byte, aad string) (string, error) {
+	typ, plain := sopsPlain(v)
+	defer wipe(plain)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, sopsNonceSize)
+	if err != nil {
+		return "", err
+	}
+	iv := make([]byte, sopsNonceSize)
+	if _, err = rand.Read(iv); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nil, iv, plain, []byte(aad))
+	tag := len(sealed) - gcm.Overhead()
+	return fmt.Sprintf("ENC[AES256_GCM,data:%s,iv:%s,tag:%s,type:%s]",
+		base64.StdEncoding.EncodeToString(sealed[:tag]),
+		base64.StdEncoding.EncodeToString(iv),
+		base64.StdEncoding.EncodeToString(sealed[tag:]), typ), nil
+}
+
+// sopsDecryptValue reverses sopsEncryptValue.
+func sopsDecryptValue(s string, key []byte, aad string) (interface{}, error) {
+	m := sopsEncRe.FindStringSubmatch(s)
+	if m == nil {
+		return nil, errors.New("not encrypted")
+	}
+	var parts [3][]byte
+	for i := range parts {
+		var err error
+		parts[i], err = base64.StdEncoding.DecodeString(m[i+1])
+		if err != nil {
+			return nil, fmt.Errorf("decode: %w", err)
+		}
+	}
+	data, iv, tag := parts[0], parts[1], parts[2]
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		return nil, err
+	}
+	plain, err := gcm.Open(nil, iv, append(data, tag...), []byte(aad))
+	if err != nil {
+		return nil, errors.New("decryption failed")
+	}
+	defer wipe(plain)
+	switch m[4] {
+	case "str":
+		return string(plain), nil
+	case "int":
+		return strconv.Atoi(string(plain))
+	case "float":
+		return strconv.ParseFloat(string(plain), 64)
+	case "bool":
+		return strconv.ParseBool(string(plain))
+	}
+	return nil, fmt.Errorf("unsupported type %s", m[4])
+}
+
+func sopsFormat(pth string) (string, error) {
+	switch format := importFormatFromPath(pth); format {
+	case importFormatJSON, importFormatYAML:
+		return format, nil
+	}
+	return "", fmt.Errorf("%s: expected a .json, .yaml, or .yml file", pth)
+}
+
+func parseSopsTree(format string, byt []byte) (sopsMap, error) {
+	if format == importFormatJSON {
+		return parseJSONTree(byt)
+	}
+	return parseYAMLTree(byt)
+}
+
+func encodeSopsTree(format string, tree sopsMap) []byte {
+	var buf bytes.Buffer
+	if format == importFormatJSON {
+		writeJSONTree(&buf, tree, "")
+		buf.WriteString("\n")
+	} else if len(tree) == 0 {
+		buf.WriteString("{}\n")
+	} else {
+		writeYAMLTree(&buf, tree, 0)
+	}
+	return buf.Bytes()
+}
+
+// parseJSONTree parses a JSON object, keeping its order.
+func parseJSONTree(byt []byte) (sopsMap, error) {
+	dec := json.NewDecoder(bytes.NewReader(byt))
+	dec.UseNumber()
+	v, err := decodeJSONValue(dec)
+	if err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+	m, ok := v.(sopsMap)
+	if !ok {
+		return nil, errors.New("expected a json object")
+	}
+	return m, nil
+}
+
+func decodeJSONValue(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok := tok.(type) {
+	case json.Delim:
+		switch tok {
+		case '{':
+			m := sopsMap{}
+			for dec.More() {
+				key, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				val, err := decodeJSONValue(dec)
+				if err != nil {
+					return nil, err
+				}
+				m = append(m, sopsItem{Key: key.(string), Value: val})
+			}
+			_, err = dec.Token()
+			return m, err
+		case '[':
+			l := []interface{}{}
+			for dec.More() {
+				val, err := decodeJSONValue(dec)
+				if err != nil {
+					return nil, err
+				}
+				l = append(l, val)
+			}
+			_, err = dec.Token()
+			return l, err
+		}
+		return nil, fmt.Errorf("unexpected %s", tok)
+	case json.Number:
+		if i, err := strconv.Atoi(tok.String()); err == nil {
+			return i, nil
+		}
+		return tok.Float64()
+	}
+	return tok, nil
+}
+
+func writeJSONTree(b *bytes.Buffer, v interface{}, indent string) {
+	switch v := v.(type) {
+	case sopsMap:
+		if len(v) == 0 {
+			b.WriteString("{}")
+			return
+		}
+		b.WriteString("{\n")
+		for i, it := range v {
+			b.WriteString(indent + "\t")
+			writeJSONScalar(b, it.Key)
+			b.WriteString(": ")
+			writeJSONTree(b, it.Value, indent+"\t")
+			if i < len(v)-1 {
+				b.WriteString(",")
+			}
+			b.WriteString("\n")
+		}
+		b.WriteString(indent + "}")
+	case []interface{}:
+		if len(v) == 0 {
+			b.WriteString("[]")
+			return
+		}
+		b.WriteString("[\n")
+		for i, item := range v {
+			b.WriteString(indent + "\t")
+			writeJSONTree(b, item, indent+"\t")
+			if i < len(v)-1 {
+				b.WriteString(",")
+			}
+			b.WriteString("\n")
+		}
+		b.WriteString(indent + "]")
+	default:
+		writeJSONScalar(b, v)
+	}
+}
+
+// writeJSONScalar writes v without escaping HTML characters.
+func writeJSONScalar(b *bytes.Buffer, v interface{}) {
+	var tmp bytes.Buffer
+	enc := json.NewEncoder(&tmp)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(v)
+	b.Write(bytes.TrimSuffix(tmp.Bytes(), []byte("\n")))
+	wipe(tmp.Bytes())
+}
+
+// yamlParser parses the block style YAML used by config files and SOPS:
+// nested mappings and sequences of scalars, with plain, quoted, and block
+// scalars. Flow collections other than [] and {}, anchors, and aliases aren't
+// supported.
+type yamlParser struct {
+	lines []string
+	i     int
+}
+
+func parseYAMLTree(byt []byte) (sopsMap, error) {
+	text := strings.Replace(string(byt), "\r\n", "\n", -1)
+	p := &yamlParser{lines: strings.Split(text, "\n")}
+	indent := p.next()
+	if indent == -1 {
+		return sopsMap{}, nil
+	}
+	v, err := p.block(indent)
+	if err == nil && p.next() != -1 {
+		err = errors.New("bad indentation")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("line %d: %w", p.i+1, err)
+	}
+	m, ok := v.(sopsMap)
+	if !ok {
+		return nil, errors.New("expected a yaml mapping")
+	}
+	return m, nil
+}
+
+// next skips blank lines and comments, returning the indent of the next line
+// or -1 at the end.
+func (p *yamlParser) next() int {
+	for ; p.i < len(p.lines); p.i++ {
+		line := p.lines[p.i]
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || trimmed[0] == '#' || trimmed == "---" {
+			continue
+		}
+		return len(line) - len(strings.TrimLeft(line, " "))
+	}
+	return -1
+}
+
+func isYAMLSeqItem(s string) bool {
+	return s == "-" || strings.HasPrefix(s, "- ")
+}
+
+func isYAMLMapEntry(s string) bool {
+	_, _, err := splitYAMLLine(s)
+	return err == nil
+}
+
+// block parses the mapping or sequence starting at the current line.
+func (p *yamlParser) block(indent int) (interface{}, error) {
+	if isYAMLSeqItem(strings.TrimSpace(p.lines[p.i])) {
+		return p.sequence(indent)
+	}
+	return p.mapping(indent)
+}
+
+func (p *yamlParser) mapping(indent int) (sopsMap, error) {
+	m := sopsMap{}
+	for {
+		ind := p.next()
+		if ind < indent {
+			return m, nil
+		}
+		text := strings.TrimSpace(p.lines[p.i])
+		if ind > indent || isYAMLSeqItem(text) {
+			return nil, errors.New("bad indentation")
+		}
+		key, val, err := splitYAMLLine(text)
+		if err != nil {
+			return nil, err
+		}
+		p.i++
+		if strings.HasPrefix(val, "#") {
+			val = ""
+		}
+		var v interface{}
+		if val == "" {
+			// The value is a nested block, which may be a sequence at
+			// the same indent as the key
+			next := p.next()
+			switch {
+			case next > indent:
+				v, err = p.block(next)
+			case next == indent && isYAMLSeqItem(strings.TrimSpace(p.lines[p.i])):
+				v, err = p.sequence(indent)
+			}
+		} else {
+			v, err = p.inline(indent, val)
+		}
+		if err != nil {
+			return nil, err
+		}
+		m = append(m, sopsItem{Key: key, Value: v})
+	}
+}
+
+func (p *yamlParser) sequence(indent int) ([]interface{}, error) {
+	l := []interface{}{}
+	for {
+		ind := p.next()
+		if ind < indent {
+			return l, nil
+		}
+		text := strings.TrimSpace(p.lines[p.i])
+		if !isYAMLSeqItem(text) {
+			return l, nil
+		}
+		if ind > indent {
+			return nil, errors.New("bad indentation")
+		}
+		rest := strings.TrimSpace(text[1:])
+		var v interface{}
+		var err error
+		switch {
+		case rest == "" || rest[0] == '#':
+			p.i++
+			if next := p.next(); next > indent {
+				v, err = p.block(next)
+			}
+		case isYAMLSeqItem(rest):
+			return nil, errors.New("nested inline sequences are not supported")
+		case isYAMLMapEntry(rest):
+			// The item is a mapping starting on this line, so parse it
+			// as if the dash were indentation
+			itemIndent := ind + len(text) - len(rest)
+			p.lines[p.i] = strings.Repeat(" ", itemIndent) + rest
+			v, err = p.mapping(itemIndent)
+		default:
+			p.i++
+			v, err = p.inline(indent, rest)
+		}
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, v)
+	}
+}
+
+// inline parses a value on the same line as its key or dash.
+func (p *yamlParser) inline(indent int, val string) (interface{}, error) {
+	switch {
+	case val[0] == '|' || val[0] == '>':
+		return p.blockScalar(indent, val), nil
+	case val == "[]":
+		return []interface{}{}, nil
+	case val == "{}":
+		return sopsMap{}, nil
+	}
+	s, err := yamlScalar(val)
+	if err != nil || val[0] == '"' || val[0] == '\'' {
+		return s, err
+	}
+	return yamlResolve(s), nil
+}
+
+// blockScalar reads a literal (|) or folded (>) scalar indented past indent.
+func (p *yamlParser) blockScalar(indent int, header string) string {
+	var block []string
+	blockIndent := -1
+	for ; p.i < len(p.lines); p.i++ {
+		line := p.lines[p.i]
+		lineIndent := len(line) - len(strings.TrimLeft(line, " "))
+		if strings.TrimSpace(line) != "" && lineIndent <= indent {
+			break
+		}
+		if blockIndent == -1 && strings.TrimSpace(line) != "" {
+			blockIndent = lineIndent
+		}
+		if blockIndent >= 0 && len(line) >= blockIndent {
+			line = line[blockIndent:]
+		} else {
+			line = strings.TrimSpace(line)
+		}
+		block = append(block, line)
+	}
+	for len(block) > 0 && block[len(block)-1] == "" {
+		block = block[:len(block)-1]
+	}
+	sep := "\n"
+	if header[0] == '>' {
+		sep = " "
+	}
+	s := strings.Join(block, sep)
+	if !strings.HasSuffix(header, "-") {
+		s += "\n"
+	}
+	return s
+}
+
+var (
+	yamlInt   = regexp.MustCompile(`^[-+]?(0|[1-9][0-9]*)$`)
+	yamlFloat = regexp.MustCompile(`^[-+]?(\.[0-9]+|[0-9]+(\.[0-9]*)?)([eE][-+]?[0-9]+)?$`)
+	yamlPlain = regexp.MustCompile(`^[A-Za-z_./][A-Za-z0-9_./@+=,:\[\]-]*$`)
+)
+
+// yamlResolve types a plain scalar as YAML 1.2's core schema does.
+func yamlResolve(s string) interface{} {
+	switch s {
+	case "~", "null", "Null", "NULL":
+		return nil
+	case "true", "True", "TRUE":
+		return true
+	case "false", "False", "FALSE":
+		return false
+	}
+	if yamlInt.MatchString(s) {
+		if i, err := strconv.Atoi(s); err == nil {
+			return i
+		}
+	}
+	if yamlFloat.MatchString(s) {
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f
+		}
+	}
+	return s
+}
+
+// writeYAMLTree writes a non-empty mapping or sequence with 4-space
+// indentation. The first line isn't indented, so it can follow a dash.
+func writeYAMLTree(b *bytes.Buffer, v interface{}, indent int) {
+	pad := strings.Repeat(" ", indent)
+	switch v := v.(type) {
+	case sopsMap:
+		for i, it := range v {
+			if i > 0 {
+				b.WriteString(pad)
+			}
+			b.WriteString(yamlString(it.Key) + ":")
+			writeYAMLValue(b, it.Value, indent)
+		}
+	case []interface{}:
+		for i, item := range v {
+			if i > 0 {
+				b.WriteString(pad)
+			}
+			b.WriteString("-")
+			if m, ok := item.(sopsMap); ok && len(m) > 0 {
+				b.WriteString(" ")
+				writeYAMLTree(b, m, indent+2)
+				continue
+			}
+			writeYAMLValue(b, item, indent)
+		}
+	}
+}
+
+// writeYAMLValue writes what follows a key or dash, through the newline.
+func writeYAMLValue(b *bytes.Buffer, v interface{}, indent int) {
+	switch v := v.(type) {
+	case sopsMap:
+		if len(v) == 0 {
+			b.WriteString(" {}\n")
+			return
+		}
+		b.WriteString("\n" + strings.Repeat(" ", indent+4))
+		writeYAMLTree(b, v, indent+4)
+	case []interface{}:
+		if len(v) == 0 {
+			b.WriteString(" []\n")
+			return
+		}
+		b.WriteString("\n" + strings.Repeat(" ", indent+4))
+		writeYAMLTree(b, v, indent+4)
+	case nil:
+		b.WriteString(" null\n")
+	case string:
+		b.WriteString(" " + yamlString(v) + "\n")
+	case float64:
+		s := strconv.FormatFloat(v, 'f', -1, 64)
+		if !strings.Contains(s, ".") {
+			s += ".0"
+		}
+		b.WriteString(" " + s + "\n")
+	default:
+		b.WriteString(fmt.Sprint(" ", v, "\n"))
+	}
+}
+
+// yamlString writes plain strings as-is, and double-quotes any which would
+// read back as something else.
+func yamlString(s string) string {
+	if yamlPlain.MatchString(s) && !strings.HasSuffix(s, ":") &&
+		yamlResolve(s) == s {
+		return s
+	}
+	return strconv.Quote(s)
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// projectStore holds the project file in an object store rather than on
+// the local filesystem. A local .shh then only points to it.
+type projectStore interface {
+	// read the project file and its version. A missing file has no
+	// content and an empty version.
+	read() ([]byte, string, error)
+
+	// write the project file only if it's still at the version read,
+	// returning the new version.
+	write(byt []byte, version string) (string, error)
+
+	// lock the store for a command which changes the project, so others
+	// sharing it wait their turn, returning its release. Stores with
+	// conditional writes needn't lock.
+	lock() (func(), error)
+}
+
+// unlocked stores rely on conditional writes alone.
+type unlocked struct{}
+
+func (unlocked) lock() (func(), error) { return func() {}, nil }
+
+var errStoreConflict = errors.New("project changed remotely, run the command again")
+
+var errRemoteProject = errors.New("project is stored remotely, so it's always in sync")
+
+func newProjectStore(u string) (projectStore, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	switch {
+	case strings.HasPrefix(u, "s3://"):
+		bucket, key := splitBucketURL(u[len("s3://"):])
+		if bucket == "" || key == "" {
+			return nil, fmt.Errorf("%s: expected s3://bucket/key", u)
+		}
+		region := os.Getenv("AWS_REGION")
+		if region == "" {
+			region = os.Getenv("AWS_DEFAULT_REGION")
+		}
+		if region == "" {
+			region = "us-east-1"
+		}
+		return &s3Store{bucket: bucket, key: key, region: region,
+			client: client}, nil
+	case strings.HasPrefix(u, "gs://"):
+		bucket, object := splitBucketURL(u[len("gs://"):])
+		if bucket == "" || object == "" {
+			return nil, fmt.Errorf("%s: expected gs://bucket/object", u)
+		}
+		return &gcsStore{bucket: bucket, object: object,
+			auth: &gcpRemote{client: client}}, nil
+	}
+	if isGitRemote(u) {
+		return newGitStore(u)
+	}
+	switch {
+	case strings.HasPrefix(u, "file://"):
+		pth := filepath.FromSlash(u[len("file://"):])
+		if !filepath.IsAbs(pth) {
+			return nil, fmt.Errorf("%s: expected file:///absolute/path", u)
+		}
+		return &fileStore{path: pth}, nil
+	case strings.HasPrefix(u, "https://"), strings.HasPrefix(u, "http://"):
+		return &httpStore{url: u, client: client}, nil
+	}
+	return nil, fmt.Errorf("unsupported remote %q, expected s3://, gs://, file://, https://, or a git url", u)
+}
+
+func splitBucketURL(s string) (string, string) {
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// s3Store keeps the project file in S3, using conditional writes on the
+// object's ETag. $AWS_ENDPOINT_URL_S3 or $AWS_ENDPOINT_URL override the
+// endpoint, using path-style requests.
+type s3Store struct {
+	unlocked
+	bucket string
+	key    string
+	region string
+	client *http.Client
+	creds  *awsCredentials
+}
+
+func (s *s3Store) read() ([]byte, string, error) {
+	resp, err := s.do(http.MethodGet, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, "", nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", s3Error(resp)
+	}
+	byt, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return byt, resp.Header.Get("ETag"), nil
+}
+
+func (s *s3Store) write(byt []byte, version string) (string, error) {
+	headers := map[string]string{"If-None-Match": "*"}
+	if version != "" {
+		headers = map[string]string{"If-Match": version}
+	}
+	resp, err := s.do(http.MethodPut, byt, headers)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Header.Get("ETag"), nil
+	case http.StatusPreconditionFailed, http.StatusConflict:
+		return "", errStoreConflict
+	}
+	return "", s3Error(resp)
+}
+
+func (s *s3Store) do(method string, body []byte, headers map[string]string) (*http.Response, error) {
+	if s.creds == nil {
+		creds, err := ambientAWSCredentials(s.client)
+		if err != nil {
+			return nil, fmt.Errorf("aws credentials: %w", err)
+		}
+		s.creds = creds
+	}
+	pth := (&url.URL{Path: "/" + s.key}).EscapedPath()
+	endpoint := os.Getenv("AWS_ENDPOINT_URL_S3")
+	if endpoint == "" {
+		endpoint = os.Getenv("AWS_ENDPOINT_URL")
+	}
+	if endpoint != "" {
+		endpoint = strings.TrimSuffix(endpoint, "/") + "/" +
+			url.PathEscape(s.bucket) + pth
+	} else {
+		endpoint = "https://" + s.bucket + ".s3." + s.region +
+			".amazonaws.com" + pth
+	}
+	req, err := http.NewRequest(method, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	sum := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(sum[:]))
+	s.creds.sign(req, body, s.region, "s3", time.Now())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("s3: %w", err)
+	}
+	return resp, nil
+}
+
+func s3Error(resp *http.Response) error {
+	var serr struct {
+		Code    string
+		Message string
+	}
+	_ = xml.NewDecoder(resp.Body).Decode(&serr)
+	return fmt.Errorf("s3: %s: %s %s", resp.Status, serr.Code, serr.Message)
+}
+
+// gcsStore keeps the project file in Google Cloud Storage, using conditional
+// writes on the object's generation. $STORAGE_EMULATOR_HOST overrides the
+// endpoint, without authentication, as Google's libraries do.
+type gcsStore struct {
+	unlocked
+	bucket string
+	object string
+	auth   *gcpRemote
+}
+
+func (s *gcsStore) endpoint() string {
+	if host := os.Getenv("STORAGE_EMULATOR_HOST"); host != "" {
+		if !strings.Contains(host, "://") {
+			host = "http://" + host
+		}
+		return strings.TrimSuffix(host, "/")
+	}
+	return "https://storage.googleapis.com"
+}
+
+func (s *gcsStore) read() ([]byte, string, error) {
+	u := s.endpoint() + "/storage/v1/b/" + url.PathEscape(s.bucket) +
+		"/o/" + url.PathEscape(s.object) + "?alt=media"
+	resp, err := s.do(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, "", nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", gcsError(resp)
+	}
+	byt, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return byt, resp.Header.Get("X-Goog-Generation"), nil
+}
+
+func (s *gcsStore) write(byt []byte, version string) (string, error) {
+	if version == "" {
+		// Generation 0 means the object must not exist
+		version = "0"
+	}
+	q := url.Values{}
+	q.Set("uploadType", "media")
+	q.Set("name", s.object)
+	q.Set("ifGenerationMatch", version)
+	u := s.endpoint() + "/upload/storage/v1/b/" + url.PathEscape(s.bucket) +
+		"/o?" + q.Encode()
+	resp, err := s.do(http.MethodPost, u, byt)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusPreconditionFailed:
+		return "", errStoreConflict
+	default:
+		return "", gcsError(resp)
+	}
+	var obj struct {
+		Generation string `json:"generation"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&obj); err != nil {
+		return "", fmt.Errorf("gcs: decode: %w", err)
+	}
+	return obj.Generation, nil
+}
+
+func (s *gcsStore) do(method, u string, body []byte) (*http.Response, error) {
+	emulated := os.Getenv("STORAGE_EMULATOR_HOST") != ""
+	if s.auth.token == "" && !emulated {
+		if err := s.auth.authenticate(); err != nil {
+			return nil, fmt.Errorf("gcp credentials: %w", err)
+		}
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if !emulated {
+		req.Header.Set("Authorization", "Bearer "+s.auth.token)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.auth.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("gcs: %w", err)
+	}
+	return resp, nil
+}
+
+func gcsError(resp *http.Response) error {
+	var gerr struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&gerr)
+	return fmt.Errorf("gcs: %s: %s", resp.Status, gerr.Error.Message)
+}
+
+// gitStore keeps the project file as .shh in a dedicated git repository,
+// cloned into ~/.local/share/shh. Reads pull first, and writes commit and
+// push, replaying the commit on others' changes if they pushed first.
+type gitStore struct {
+	url string
+	dir string
+}
+
+func isGitRemote(u string) bool {
+	return strings.HasSuffix(u, ".git") || strings.HasPrefix(u, "git@") ||
+		strings.HasPrefix(u, "ssh://") || strings.HasPrefix(u, "git://")
+}
+
+func newGitStore(u string) (*gitStore, error) {
+	dataDir, err := xdgDir("XDG_DATA_HOME", ".local", "share")
+	if err != nil {
+		return nil, err
+	}
+
+	// Name the clone after the repo, made unique by the url
+	name := path.Base(strings.Replace(u, ":", "/", -1))
+	sum := sha256.Sum256([]byte(u))
+	name = strings.TrimSuffix(name, ".git") + "-" + hex.EncodeToString(sum[:4])
+	return &gitStore{url: u, dir: filepath.Join(dataDir, "shh", name)}, nil
+}
+
+func (s *gitStore) read() ([]byte, string, error) {
+	_, err := os.Stat(filepath.Join(s.dir, ".git"))
+	switch {
+	case os.IsNotExist(err):
+		if err = os.MkdirAll(filepath.Dir(s.dir), 0700); err != nil {
+			return nil, "", err
+		}
+		_, err = gitOutput(filepath.Dir(s.dir), "clone", "--quiet", s.url,
+			s.dir)
+		if err != nil {
+			return nil, "", err
+		}
+	case err != nil:
+		return nil, "", err
+	case s.hasUpstream():
+		if _, err = gitOutput(s.dir, "pull", "--rebase", "--quiet"); err != nil {
+			// Work offline with the last version pulled
+			fmt.Fprintf(os.Stderr, "shh: %v\n", err)
+		}
+	}
+	byt, err := ioutil.ReadFile(filepath.Join(s.dir, ".shh"))
+	if os.IsNotExist(err) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	head, err := gitOutput(s.dir, "rev-parse", "HEAD")
+	if err != nil {
+		return nil, "", err
+	}
+	return byt, strings.TrimSpace(string(head)), nil
+}
+
+// write commits the project file, named after the command but never its
+// arguments, which may include values.
+func (s *gitStore) write(byt []byte, version string) (string, error) {
+	if err := writeFileAtomic(filepath.Join(s.dir, ".shh"), byt, 0644); err != nil {
+		return "", err
+	}
+	if _, err := gitOutput(s.dir, "add", ".shh"); err != nil {
+		return "", err
+	}
+	_, err := gitOutput(s.dir, "commit", "--quiet", "-m", "shh "+runningCommand)
+	if err != nil {
+		return "", err
+	}
+	if _, err = gitOutput(s.dir, "push", "--quiet", "-u", "origin", "HEAD"); err != nil {
+		if !s.hasUpstream() {
+			return "", fmt.Errorf("committed, but %w", err)
+		}
+		if _, ferr := gitOutput(s.dir, "fetch", "--quiet"); ferr != nil {
+			return "", fmt.Errorf("committed, but %w", err)
+		}
+
+		// Someone pushed first, so replay our commit on theirs. Text
+		// merges of JSON can go wrong, so check the result too.
+		_, err = gitOutput(s.dir, "rebase", "--quiet", "@{u}")
+		if err == nil {
+			merged, rerr := ioutil.ReadFile(filepath.Join(s.dir, ".shh"))
+			if rerr == nil {
+				err = validateShhFile(merged)
+			} else {
+				err = rerr
+			}
+		}
+		if err != nil {
+			_, _ = gitOutput(s.dir, "rebase", "--abort")
+			_, _ = gitOutput(s.dir, "reset", "--hard", "--quiet", "@{u}")
+			return "", errStoreConflict
+		}
+		if _, err = gitOutput(s.dir, "push", "--quiet", "origin", "HEAD"); err != nil {
+			return "", fmt.Errorf("committed, but %w", err)
+		}
+	}
+	head, err := gitOutput(s.dir, "rev-parse", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(head)), nil
+}
+
+// lock the clone, which every project using the repo shares.
+func (s *gitStore) lock() (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(s.dir), 0700); err != nil {
+		return nil, err
+	}
+	fi, err := lockFile(s.dir, s.dir+".lock", true)
+	if err != nil {
+		return nil, err
+	}
+	return func() { fi.Close() }, nil
+}
+
+func (s *gitStore) hasUpstream() bool {
+	_, err := gitOutput(s.dir, "rev-parse", "--abbrev-ref", "@{u}")
+	return err == nil
+}
+
+// unveil what running git needs: the clone, git and ssh, and their
+// configuration.
+func (s *gitStore) unveil() {
+	unveil(s.dir, "rwc")
+	for _, prog := range []string{"git", "ssh"} {
+		if pth, err := exec.LookPath(prog); err == nil {
+			unveil(pth, "rx")
+		}
+	}
+	if out, err := gitOutput(s.dir, "--exec-path"); err == nil {
+		unveil(strings.TrimSpace(string(out)), "rx")
+	}
+	unveil("/usr/lib", "r")
+	unveil("/usr/local/lib", "r")
+	unveil("/usr/libexec/ld.so", "rx")
+	unveil("/dev/null", "rw")
+	if home, err := os.UserHomeDir(); err == nil {
+		unveil(filepath.Join(home, ".gitconfig"), "r")
+		unveil(filepath.Join(home, ".ssh"), "r")
+	}
+}
+
+// fileStore keeps the project file elsewhere on the filesystem, such as a
+// network share. Its version is its digest, and it's locked like a local
+// project file.
+type fileStore struct {
+	path string
+}
+
+func (s *fileStore) read() ([]byte, string, error) {
+	byt, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return byt, remoteETag(byt), nil
+}
+
+func (s *fileStore) write(byt []byte, version string) (string, error) {
+	cur, err := ioutil.ReadFile(s.path)
+	switch {
+	case os.IsNotExist(err):
+		if version != "" {
+			return "", errStoreConflict
+		}
+	case err != nil:
+		return "", err
+	case remoteETag(cur) != version:
+		return "", errStoreConflict
+	}
+	if err = writeFileAtomic(s.path, byt, 0644); err != nil {
+		return "", err
+	}
+	return remoteETag(byt), nil
+}
+
+func (s *fileStore) lock() (func(), error) {
+	fi, err := lockFile(s.path, s.path+".lock", true)
+	if err != nil {
+		return nil, err
+	}
+	return func() { fi.Close() }, nil
+}
+
+func (s *fileStore) unveil() {
+	unveil(filepath.Dir(s.path), "rwc")
+}
+
+// httpStore keeps the project file on a server run with `shh serve-remote`,
+// authenticated with $SHH_REMOTE_TOKEN. Writes are conditional on its ETag.
+type httpStore struct {
+	unlocked
+	url    string
+	client *http.Client
+}
+
+func (s *httpStore) read() ([]byte, string, error) {
+	req, err := remoteRequest(http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("remote: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, "", nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", remoteError(resp)
+	}
+	byt, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxRemoteSize))
+	if err != nil {
+		return nil, "", err
+	}
+	return byt, resp.Header.Get("ETag"), nil
+}
+
+func (s *httpStore) write(byt []byte, version string) (string, error) {
+	req, err := remoteRequest(http.MethodPut, s.url, byt)
+	if err != nil {
+		return "", err
+	}
+	if version != "" {
+		req.Header.Set("If-Match", version)
+	} else {
+		req.Header.Set("If-None-Match", "*")
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("remote: %w", err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusPreconditionFailed:
+		return "", errStoreConflict
+	case resp.StatusCode >= 300:
+		return "", remoteError(resp)
+	}
+	return resp.Header.Get("ETag"), nil
+}
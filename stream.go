@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// shhFields has the fields of shh without its methods, so it can be embedded
+// by the types below to decode and encode secrets separately.
+type shhFields shh
+
+// shhFromPathFor reads the project file like shhFromPath, but only decodes
+// the user's secrets. The others are kept encoded and written back
+// unchanged, which saves time and memory in large projects. Commands using
+// it must not touch other users' secrets.
+func shhFromPathFor(pth string, u username) (*shh, error) {
+	return readShh(pth, func(other username) bool { return other == u })
+}
+
+// shhNamesFromPath reads the project file without decoding any secrets, for
+// commands which only need their names. Names are read from the index when
+// it's up to date.
+func shhNamesFromPath(pth string) (*shh, error) {
+	return readShh(pth, func(username) bool { return false })
+}
+
+// loadedSecrets are a user's secrets as read from the project file.
+type loadedSecrets struct {
+	raw     json.RawMessage
+	secrets map[string]secret
+}
+
+// rawJSON is like json.RawMessage, but refers to the bytes being decoded
+// rather than copying them, so a large project file isn't held in memory
+// twice. Those bytes must not change afterward.
+type rawJSON []byte
+
+func (r *rawJSON) UnmarshalJSON(byt []byte) error {
+	*r = byt
+	return nil
+}
+
+// decodeFor decodes a JSON project file, leaving the secrets of users for which
+// decode returns false encoded.
+func (s *shh) decodeFor(byt []byte, decode func(username) bool) error {
+	lazy := struct {
+		*shhFields
+		Secrets map[username]rawJSON `json:"secrets"`
+	}{shhFields: (*shhFields)(s)}
+	if err := json.Unmarshal(byt, &lazy); err != nil {
+		return err
+	}
+	if lazy.Secrets == nil {
+		// Keep an explicit null, as json.Unmarshal would
+		s.Secrets = nil
+	}
+	s.loaded = map[username]loadedSecrets{}
+	for u, raw := range lazy.Secrets {
+		if !decode(u) {
+			continue
+		}
+		var secrets map[string]secret
+		if err := json.Unmarshal(raw, &secrets); err != nil {
+			return err
+		}
+		s.Secrets[u] = secrets
+		loaded := loadedSecrets{raw: json.RawMessage(raw),
+			secrets: make(map[string]secret, len(secrets))}
+		for name, sec := range secrets {
+			s.namespace[name] = struct{}{}
+			loaded.secrets[name] = sec
+		}
+		if secrets != nil {
+			s.loaded[u] = loaded
+		}
+		delete(lazy.Secrets, u)
+	}
+	if s.indexable() {
+		s.sum = indexSum(byt)
+		s.index = loadIndex(s.path, s.sum)
+	}
+	s.encoded = make(map[username]json.RawMessage, len(lazy.Secrets))
+	s.encodedNames = make(map[username][]string, len(lazy.Secrets))
+	for other, raw := range lazy.Secrets {
+		s.encoded[other] = json.RawMessage(raw)
+		names, ok := []string(nil), false
+		if s.index != nil {
+			names, ok = s.index.Users[other]
+		}
+		if !ok {
+			var err error
+			if names, err = jsonKeys(raw); err != nil {
+				return fmt.Errorf("%s: %w", other, err)
+			}
+			sort.Strings(names)
+		}
+		for _, name := range names {
+			s.namespace[name] = struct{}{}
+		}
+		s.encodedNames[other] = names
+	}
+	if s.indexable() && s.index == nil && len(lazy.Secrets) > 0 {
+		_ = s.buildIndex(s.sum).save(s.path)
+	}
+	return nil
+}
+
+// jsonKeys lists the keys of a JSON object without decoding its values.
+func jsonKeys(raw []byte) ([]string, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	tok, err := dec.Token()
+	if err != nil || tok == nil {
+		return nil, err
+	}
+	if tok != json.Delim('{') {
+		return nil, fmt.Errorf("expected object, got %v", tok)
+	}
+	var keys []string
+	for dec.More() {
+		tok, err = dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, tok.(string))
+		var skip struct{}
+		if err = dec.Decode(&skip); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// encodeJSON writes the project file one user at a time, so the whole file is
+// never held in memory. Users whose secrets are unchanged since they were
+// read are copied rather than re-encoded. The output is identical to
+// json.Encoder's with tab indents.
+func (s *shh) encodeJSON(w io.Writer) error {
+	users := map[username]struct{}{}
+	for u := range s.Secrets {
+		users[u] = struct{}{}
+	}
+	for u := range s.encoded {
+		if _, ok := s.Secrets[u]; ok {
+			return fmt.Errorf("secrets for %s were not decoded", u)
+		}
+		users[u] = struct{}{}
+	}
+	bw := bufio.NewWriter(w)
+	_, _ = bw.WriteString("{\n\t\"secrets\": ")
+	switch {
+	case s.Secrets == nil && len(users) == 0:
+		_, _ = bw.WriteString("null")
+	case len(users) == 0:
+		_, _ = bw.WriteString("{}")
+	default:
+		_, _ = bw.WriteString("{")
+		var buf bytes.Buffer
+		for i, u := range sortedUsernames(users) {
+			if i > 0 {
+				_, _ = bw.WriteString(",")
+			}
+			name, err := json.Marshal(u)
+			if err != nil {
+				return err
+			}
+			buf.Reset()
+			if raw, ok := s.encoded[u]; ok {
+				err = json.Indent(&buf, raw, "\t\t", "\t")
+			} else if l, ok := s.loaded[u]; ok && sameSecrets(l.secrets, s.Secrets[u]) {
+				err = json.Indent(&buf, l.raw, "\t\t", "\t")
+			} else {
+				fmt.Fprintf(bw, "\n\t\t%s: ", name)
+				if err = writeSecretsJSON(bw, s.Secrets[u]); err != nil {
+					return fmt.Errorf("%s: %w", u, err)
+				}
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %w", u, err)
+			}
+			fmt.Fprintf(bw, "\n\t\t%s: ", name)
+			_, _ = bw.Write(buf.Bytes())
+		}
+		_, _ = bw.WriteString("\n\t}")
+	}
+
+	// Everything after the secrets is small, so encode it at once and
+	// splice it in after them
+	rest, err := json.MarshalIndent(struct {
+		*shhFields
+		Secrets json.RawMessage `json:"secrets,omitempty"`
+	}{shhFields: (*shhFields)(s)}, "", "\t")
+	if err != nil {
+		return err
+	}
+	if len(rest) > 2 {
+		_, _ = bw.WriteString(",")
+		_, _ = bw.Write(rest[1:])
+	} else {
+		_, _ = bw.WriteString("\n}")
+	}
+	_, _ = bw.WriteString("\n")
+	return bw.Flush()
+}
+
+// writeSecretsJSON writes a user's secrets one at a time, as
+// json.MarshalIndent would write the whole map, so they're never all encoded
+// in memory at once.
+func writeSecretsJSON(w *bufio.Writer, secrets map[string]secret) error {
+	switch {
+	case secrets == nil:
+		_, _ = w.WriteString("null")
+		return nil
+	case len(secrets) == 0:
+		_, _ = w.WriteString("{}")
+		return nil
+	}
+	// An Encoder reuses its buffers between secrets, unlike MarshalIndent
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("\t\t\t", "\t")
+	_, _ = w.WriteString("{")
+	for i, name := range sortedSecretNames(secrets) {
+		if i > 0 {
+			_, _ = w.WriteString(",")
+		}
+		buf.Reset()
+		if err := enc.Encode(name); err != nil {
+			return err
+		}
+		_, _ = w.WriteString("\n\t\t\t")
+		_, _ = w.Write(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+		_, _ = w.WriteString(": ")
+		buf.Reset()
+		if err := enc.Encode(secrets[name]); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		_, _ = w.Write(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+	}
+	_, _ = w.WriteString("\n\t\t}")
+	return nil
+}
+
+func sameSecrets(a, b map[string]secret) bool {
+	if len(a) != len(b) || (a == nil) != (b == nil) {
+		return false
+	}
+	for name, sec := range a {
+		if other, ok := b[name]; !ok || other != sec {
+			return false
+		}
+	}
+	return true
+}
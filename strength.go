@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// commonWords are guessed first by attackers, most common first: leaked
+// passwords, then words people build passphrases from.
+var commonWords = []string{
+	"password", "123456", "qwerty", "letmein", "welcome", "admin", "login",
+	"abc123", "iloveyou", "monkey", "dragon", "master", "sunshine",
+	"princess", "football", "baseball", "shadow", "superman", "trustno1",
+	"secret", "passw0rd", "starwars", "whatever", "freedom", "hello",
+	"charlie", "michael", "jordan", "hunter", "ranger", "buster", "soccer",
+	"hockey", "killer", "george", "andrew", "thomas", "jessica", "pepper",
+	"ginger", "summer", "winter", "spring", "autumn", "flower", "orange",
+	"banana", "cheese", "coffee", "cookie", "chicken", "purple", "silver",
+	"golden", "yellow", "love", "money", "computer", "internet", "secure",
+	"access", "change", "default", "root", "user", "guest", "test",
+	"correct", "horse", "battery", "staple", "apple", "google", "github",
+	"company", "office", "server", "database", "private", "public", "team",
+	"shh", "key", "keys", "pass", "word", "my", "the", "and", "you", "me",
+	"one", "two", "three", "four", "five", "day", "night", "blue", "red",
+	"green", "black", "white", "cat", "dog", "sun", "moon", "star", "fire",
+	"water", "earth", "wind", "home", "house", "family", "friend", "baby",
+	"angel", "happy", "lucky", "magic", "music", "rock", "world",
+}
+
+// keyboardRows are runs of adjacent keys people type as passwords.
+var keyboardRows = []string{"qwertyuiop", "asdfghjkl", "zxcvbnm",
+	"1234567890", "qazwsxedc"}
+
+// l33t maps common substitutions back to letters.
+var l33t = strings.NewReplacer("0", "o", "1", "l", "3", "e", "4", "a",
+	"5", "s", "7", "t", "@", "a", "$", "s", "!", "i")
+
+var wordRanks = func() map[string]int {
+	ranks := make(map[string]int, len(commonWords))
+	for i, w := range commonWords {
+		ranks[w] = i + 1
+	}
+	return ranks
+}()
+
+// estimateGuesses estimates the log10 of the guesses needed to find the
+// password, in the manner of zxcvbn: it's split into the cheapest sequence of
+// common words, repeated characters, sequences, keyboard runs, years, and
+// otherwise random characters.
+func estimateGuesses(password []byte) float64 {
+	runes := []rune(string(password))
+	n := len(runes)
+	if n == 0 {
+		return 0
+	}
+	lower := make([]rune, n)
+	for i, r := range runes {
+		lower[i] = unicode.ToLower(r)
+	}
+	defer func() {
+		for i := range runes {
+			runes[i], lower[i] = 0, 0
+		}
+	}()
+	bruteForce := math.Log10(charPool(runes))
+
+	// cost[i] is the cheapest log10 guesses for the first i runes
+	cost := make([]float64, n+1)
+	for i := 1; i <= n; i++ {
+		cost[i] = cost[i-1] + bruteForce
+		for j := 0; j < i; j++ {
+			if g, ok := matchGuesses(runes[j:i], lower[j:i]); ok {
+				if c := cost[j] + math.Log10(g); c < cost[i] {
+					cost[i] = c
+				}
+			}
+		}
+	}
+	return cost[n]
+}
+
+// matchGuesses returns the guesses needed for a token matching one of the
+// patterns people use, if it does.
+func matchGuesses(token, lower []rune) (float64, bool) {
+	s := string(lower)
+	best, ok := math.Inf(1), false
+	try := func(g float64) {
+		if g < best {
+			best, ok = g, true
+		}
+	}
+	if rank, found := wordRanks[s]; found {
+		try(float64(rank) * caseGuesses(token))
+	} else if rank, found := wordRanks[l33t.Replace(s)]; found {
+		try(float64(rank) * caseGuesses(token) * 2)
+	}
+	if len(lower) < 3 {
+		return best, ok
+	}
+	if strings.Count(s, string(lower[0])) == len(lower) {
+		try(charPool(token[:1]) * float64(len(lower)))
+	}
+	if step := lower[1] - lower[0]; step == 1 || step == -1 {
+		seq := true
+		for i := 2; i < len(lower); i++ {
+			seq = seq && lower[i]-lower[i-1] == step
+		}
+		if seq {
+			g := float64(len(lower)) * charPool(token[:1])
+			if strings.ContainsRune("a1z9", lower[0]) {
+				g = float64(len(lower)) * 4
+			}
+			try(g)
+		}
+	}
+	for _, row := range keyboardRows {
+		if strings.Contains(row, s) || strings.Contains(reverse(row), s) {
+			try(float64(len(lower)) * 20)
+		}
+	}
+	if len(lower) == 4 && (strings.HasPrefix(s, "19") ||
+		strings.HasPrefix(s, "20")) && strings.Trim(s, "0123456789") == "" {
+		try(120)
+	}
+	return best, ok
+}
+
+// caseGuesses multiplies a word's guesses by the ways its letters could be
+// capitalized, counting a capital first letter as one of few.
+func caseGuesses(token []rune) float64 {
+	var upper int
+	for _, r := range token {
+		if unicode.IsUpper(r) {
+			upper++
+		}
+	}
+	switch {
+	case upper == 0, upper == len(token):
+		return 1
+	case upper == 1 && unicode.IsUpper(token[0]):
+		return 2
+	}
+	return math.Pow(2, float64(upper))
+}
+
+// charPool returns the size of the character classes used.
+func charPool(runes []rune) float64 {
+	var lower, upper, digit, other bool
+	for _, r := range runes {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+	var pool float64
+	if lower {
+		pool += 26
+	}
+	if upper {
+		pool += 26
+	}
+	if digit {
+		pool += 10
+	}
+	if other {
+		pool += 33
+	}
+	return pool
+}
+
+func reverse(s string) string {
+	runes := []rune(s)
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+	return string(runes)
+}
+
+// passwordScore rates log10 guesses from 0, trivially guessable, to 4,
+// strong, with zxcvbn's thresholds.
+func passwordScore(log10Guesses float64) int {
+	for score, limit := range []float64{3, 6, 8, 10} {
+		if log10Guesses < limit {
+			return score
+		}
+	}
+	return 4
+}
+
+var scoreNames = []string{"very weak", "weak", "fair", "good", "strong"}
+
+// checkPasswordStrength shows the strength of a new password when it was
+// typed, and reports an error if it scores below the project's minimum.
+func checkPasswordStrength(password []byte, typed bool) error {
+	guesses := estimateGuesses(password)
+	score := passwordScore(guesses)
+	if typed {
+		meter := strings.Repeat("#", score) + strings.Repeat("-", 4-score)
+		notef(os.Stderr, "strength: [%s] %s, about 10^%.0f guesses\n",
+			meter, tr(scoreNames[score]), guesses)
+	}
+	set, err := readSettings()
+	if err != nil || set == nil || score >= set.MinPasswordScore {
+		// Outside a project there's no policy to apply
+		return nil
+	}
+	return errors.New(trf("password is too guessable: scored %d of 4, the project requires %d",
+		score, set.MinPasswordScore))
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// syncRemote is an external secret store which shh can push to and pull
+// from. Names are shh-style paths, such as myapp/db_url, which the remote
+// translates to its own naming rules if needed.
+type syncRemote interface {
+	// list the names of all secrets starting with prefix.
+	list(prefix string) ([]string, error)
+
+	// get the current value of a secret.
+	get(name string) ([]byte, error)
+
+	// put creates the secret or updates its value.
+	put(name string, val []byte) error
+}
+
+// syncBackend registers a remote's flags on the flag set and returns a
+// function creating the remote once flags are parsed.
+type syncBackend func(fs *flag.FlagSet) func() (syncRemote, error)
+
+// syncChange is a difference between shh and the remote.
+type syncChange struct {
+	// Op is + for secrets only in the source, ~ for secrets which differ,
+	// and - for secrets only in the destination, which are never deleted.
+	Op     string
+	Local  string
+	Remote string
+}
+
+// syncCommand runs `$cmd push|pull|diff [$glob]` against a remote. Local
+// secrets matching the glob map to remote names by replacing the glob's
+// literal prefix with --prefix, so `push 'prod/*' --prefix myapp/` maps
+// prod/db_url to myapp/db_url and pull maps it back.
+func syncCommand(nonInteractive bool, cmd string, backend syncBackend, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("bad args: expected `%s push|pull|diff [$glob]`", cmd)
+	}
+	op := args[0]
+	switch op {
+	case "push", "pull", "diff":
+	default:
+		return fmt.Errorf("unknown %s command %s", cmd, op)
+	}
+	fs := flag.NewFlagSet(cmd+" "+op, flag.ContinueOnError)
+	prefix := fs.String("prefix", "", "prefix for remote names, e.g. myapp/")
+	dryRun := fs.Bool("dry-run", false, "show changes without making them")
+	yes := fs.Bool("yes", false, "make changes without confirmation")
+	newRemote := backend(fs)
+	args, err := parseFlags(fs, args[1:])
+	if err != nil {
+		return err
+	}
+	glob := "*"
+	switch len(args) {
+	case 0:
+	case 1:
+		glob = args[0]
+	default:
+		return fmt.Errorf("bad args: expected `%s %s [$glob]`", cmd, op)
+	}
+	if err = validateGlob(glob); err != nil {
+		return err
+	}
+
+	const (
+		promises     = "stdio rpath wpath cpath tty proc exec inet dns"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	remote, err := newRemote()
+	if err != nil {
+		return err
+	}
+	configPath, err := getConfigPath()
+	if err != nil {
+		return err
+	}
+	user, err := getUser(configPath)
+	if err != nil {
+		return fmt.Errorf("get user: %w", err)
+	}
+	shh, err := shhFromPath(".shh")
+	if err != nil {
+		return err
+	}
+
+	// Map names in both directions
+	literal := ""
+	if strings.HasSuffix(glob, "*") {
+		literal = glob[:len(glob)-1]
+	}
+	toRemote := func(name string) string {
+		return *prefix + strings.TrimPrefix(name, literal)
+	}
+	toLocal := func(name string) string {
+		return literal + strings.TrimPrefix(name, *prefix)
+	}
+
+	// Decrypt the matching local secrets
+	secrets := map[string]secret{}
+	if _, ok := shh.Secrets[user.Username][glob]; ok || strings.HasSuffix(glob, "*") {
+		secrets, err = shh.GetSecretsForUser(glob, user.Username)
+		if err != nil {
+			return err
+		}
+	}
+	local := make(map[string]secureBytes, len(secrets))
+	defer func() {
+		for _, v := range local {
+			v.Destroy()
+		}
+	}()
+	if len(secrets) > 0 {
+		dec, err := user.decrypterFor(configPath, nonInteractive, secrets)
+		if err != nil {
+			return err
+		}
+		for name, sec := range secrets {
+			local[name], err = decryptSecret(dec, sec)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+	}
+
+	// List the remote, keeping only names which map back to the glob
+	remoteNames, err := remote.list(toRemote(literal))
+	if err != nil {
+		return fmt.Errorf("list: %w", err)
+	}
+	inRemote := map[string]bool{}
+	for _, name := range remoteNames {
+		if strings.HasPrefix(name, *prefix) && globMatch(glob, toLocal(name)) {
+			inRemote[name] = true
+		}
+	}
+
+	// Fetch remote values which could differ from shh, or everything
+	// when pulling
+	remoteVals := map[string][]byte{}
+	defer func() {
+		for _, v := range remoteVals {
+			wipe(v)
+		}
+	}()
+	for name := range inRemote {
+		if _, ok := local[toLocal(name)]; !ok && op == "push" {
+			continue
+		}
+		if remoteVals[name], err = remote.get(name); err != nil {
+			return fmt.Errorf("get %s: %w", name, err)
+		}
+	}
+
+	var changes []syncChange
+	for name, val := range local {
+		r := toRemote(name)
+		switch {
+		case !inRemote[r]:
+			if op != "pull" {
+				changes = append(changes, syncChange{Op: "+", Local: name, Remote: r})
+			}
+		case !bytes.Equal(val, remoteVals[r]):
+			changes = append(changes, syncChange{Op: "~", Local: name, Remote: r})
+		}
+	}
+	for name := range inRemote {
+		if _, ok := local[toLocal(name)]; ok {
+			continue
+		}
+		switch op {
+		case "pull":
+			changes = append(changes, syncChange{Op: "+", Local: toLocal(name), Remote: name})
+		case "diff":
+			changes = append(changes, syncChange{Op: "-", Local: toLocal(name), Remote: name})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Local < changes[j].Local
+	})
+	if len(changes) == 0 {
+		notef(os.Stdout, "up to date\n")
+		return nil
+	}
+	for _, c := range changes {
+		if c.Local == c.Remote {
+			fmt.Println(c.Op, c.Local)
+		} else {
+			fmt.Printf("%s %s -> %s\n", c.Op, c.Local, c.Remote)
+		}
+	}
+	if op == "diff" || *dryRun {
+		return nil
+	}
+	if !*yes {
+		if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+			return fmt.Errorf("refusing to %s without --yes", op)
+		}
+		fmt.Printf(tr("%s %d secrets?")+tr(" [y/N]: "), op, len(changes))
+		var answer string
+		_, _ = fmt.Scanln(&answer)
+		if !isYes(answer) {
+			return errors.New(tr("cancelled"))
+		}
+	}
+
+	if op == "push" {
+		for _, c := range changes {
+			if err = remote.put(c.Remote, local[c.Local]); err != nil {
+				return fmt.Errorf("put %s: %w", c.Remote, err)
+			}
+		}
+		return nil
+	}
+
+	// Pull new secrets for ourselves, and update existing secrets for
+	// everyone with access
+	for _, c := range changes {
+		val := remoteVals[c.Remote]
+		if err = shh.checkValue(c.Local, val); err != nil {
+			return err
+		}
+		if c.Op == "~" {
+			if err = shh.updateSecret(c.Local, val); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, ok := shh.namespace[c.Local]; ok {
+			return fmt.Errorf("%s exists, but you don't have access", c.Local)
+		}
+		enc, err := shh.encryptFor(user.Username, val)
+		if err != nil {
+			return err
+		}
+		now := time.Now().UTC().Truncate(time.Second)
+		enc.Modified, enc.Granted = &now, &now
+		shh.Secrets[user.Username][c.Local] = enc
+	}
+	return shh.EncodeToFile()
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// systemdListenFdsStart is the first file descriptor passed by systemd
+	// socket activation.
+	systemdListenFdsStart = 3
+
+	systemdUnitName = "shh-agent"
+)
+
+// systemdListener returns the socket passed by systemd socket activation, or
+// nil if shh wasn't socket-activated.
+func systemdListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+	if n > 1 {
+		return nil, fmt.Errorf("expected 1 activated socket, got %d", n)
+	}
+
+	// Don't pass the sockets on to any children
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	fi := os.NewFile(systemdListenFdsStart, "LISTEN_FD_3")
+	defer fi.Close()
+	l, err := net.FileListener(fi)
+	if err != nil {
+		return nil, fmt.Errorf("activated socket: %w", err)
+	}
+	return l, nil
+}
+
+// sdNotify sends a state such as "READY=1" to systemd. It does nothing if
+// systemd isn't supervising shh.
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+
+	// Abstract sockets are indicated by a leading @
+	if strings.HasPrefix(addr, "@") {
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil,
+		&net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("dial notify socket: %w", err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("write notify socket: %w", err)
+	}
+	return nil
+}
+
+// agentCmd manages the server as a service, e.g. `shh agent install`.
+func agentCmd(args []string) error {
+	arg, tail := parseArg(args)
+	switch arg {
+	case "install":
+		return agentInstall(tail)
+	case "":
+		return errors.New("bad args: expected `install`")
+	default:
+		return &badArgError{Arg: arg}
+	}
+}
+
+// agentInstall writes systemd user units which start the server on first
+// connection after login and restart it if it fails.
+func agentInstall(args []string) error {
+	fs := flag.NewFlagSet("agent install", flag.ContinueOnError)
+	dir := fs.String("dir", "", "unit directory (default ~/.config/systemd/user)")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 0 {
+		return errors.New("bad args: expected none")
+	}
+
+	const (
+		promises     = "stdio rpath wpath cpath"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	configPath, err := getConfigPath()
+	if err != nil {
+		return err
+	}
+	conf, err := configFromPath(configPath)
+	if err != nil {
+		return err
+	}
+	if conf.Port <= 0 {
+		return errors.New("no port set in ~/.config/shh/config")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("executable: %w", err)
+	}
+	if *dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return err
+		}
+		*dir = filepath.Join(home, ".config", "systemd", "user")
+	}
+	if err = os.MkdirAll(*dir, 0755); err != nil {
+		return err
+	}
+
+	socket := fmt.Sprintf(`[Unit]
+Description=shh agent socket
+
+[Socket]
+ListenStream=127.0.0.1:%d
+
+[Install]
+WantedBy=sockets.target
+`, conf.Port)
+	service := fmt.Sprintf(`[Unit]
+Description=shh agent
+Requires=%s.socket
+
+[Service]
+Type=notify
+ExecStart=%s serve --systemd
+Restart=on-failure
+
+[Install]
+WantedBy=default.target
+`, systemdUnitName, exe)
+
+	units := []struct{ name, content string }{
+		{name: systemdUnitName + ".socket", content: socket},
+		{name: systemdUnitName + ".service", content: service},
+	}
+	for _, u := range units {
+		pth := filepath.Join(*dir, u.name)
+		if err = ioutil.WriteFile(pth, []byte(u.content), 0644); err != nil {
+			return err
+		}
+		notef(os.Stdout, "generated %s\n", pth)
+	}
+	notef(os.Stdout, "\nenable it with:\n\n\tsystemctl --user daemon-reload\n\tsystemctl --user enable --now %s.socket\n",
+		systemdUnitName)
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"text/template"
+)
+
+// renderTemplate renders a Go template, replacing `{{ secret "name" }}` with
+// decrypted values, to stdout or a file with 0600 permissions.
+func renderTemplate(nonInteractive bool, args []string) error {
+	fs := flag.NewFlagSet("template", flag.ContinueOnError)
+	out := fs.String("o", "", "output file (default stdout)")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return errors.New("bad args: expected `template $file [-o $out]`")
+	}
+
+	const (
+		promises     = "stdio rpath wpath cpath tty proc exec inet dns"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	byt, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	configPath, err := getConfigPath()
+	if err != nil {
+		return err
+	}
+	user, err := getUser(configPath)
+	if err != nil {
+		return fmt.Errorf("get user: %w", err)
+	}
+	shh, err := shhFromPathFor(".shh", user.Username)
+	if err != nil {
+		return err
+	}
+
+	// Render once to find which secrets are used, so they can be decrypted
+	// together (and the password requested once)
+	secrets := map[string]secret{}
+	collect := template.FuncMap{"secret": func(name string) (string, error) {
+		name = inEnv(name)
+		found, err := shh.GetSecretsForUser(name, user.Username)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", name, err)
+		}
+		if len(found) != 1 {
+			return "", fmt.Errorf("%s: globs are not supported", name)
+		}
+		secrets[name] = found[name]
+		return "", nil
+	}}
+	tmpl, err := template.New(args[0]).Funcs(collect).Parse(string(byt))
+	if err != nil {
+		return fmt.Errorf("parse template: %w", err)
+	}
+	if err = tmpl.Execute(ioutil.Discard, nil); err != nil {
+		return fmt.Errorf("render: %w", err)
+	}
+
+	dec, err := user.decrypterFor(configPath, nonInteractive, secrets)
+	if err != nil {
+		return err
+	}
+	values := map[string]secureBytes{}
+	defer func() {
+		for _, v := range values {
+			v.Destroy()
+		}
+	}()
+	err = decryptEach(dec, secrets, func(name string, plaintext secureBytes) error {
+		values[name] = newSecureBytes(make([]byte, len(plaintext)))
+		copy(values[name], plaintext)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	render := template.FuncMap{"secret": func(name string) (string, error) {
+		name = inEnv(name)
+		plaintext, ok := values[name]
+		if !ok {
+			// This is only possible when a secret is used in a
+			// branch which depends on another secret's value
+			return "", fmt.Errorf("%s: used conditionally on a secret", name)
+		}
+		return string(plaintext), nil
+	}}
+	buf := &bytes.Buffer{}
+	if err = tmpl.Funcs(render).Execute(buf, nil); err != nil {
+		return fmt.Errorf("render: %w", err)
+	}
+	defer wipe(buf.Bytes())
+	if *out == "" {
+		_, err = os.Stdout.Write(buf.Bytes())
+		return err
+	}
+	fi, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer fi.Close()
+
+	// Tighten permissions on existing files, since OpenFile only applies
+	// the mode on creation
+	if err = fi.Chmod(0600); err != nil {
+		return err
+	}
+	if _, err = fi.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return fi.Close()
+}
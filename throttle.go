@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// failuresFile records failed password attempts in the config
+	// directory, so the count survives across commands and the server.
+	failuresFile = "failures"
+
+	// maxFailures is the number of consecutive failed attempts after
+	// which the user is locked out for lockoutWindow.
+	maxFailures   = 10
+	lockoutWindow = 15 * time.Minute
+)
+
+// errLockedOut is returned when too many passwords have been guessed.
+var errLockedOut = errors.New("too many failed password attempts")
+
+// failures tracks consecutive failed password attempts. Each failure doubles
+// the delay before the next attempt is allowed, starting at one second, until
+// maxFailures is reached and further attempts are refused for lockoutWindow.
+type failures struct {
+	Count int       `json:"count"`
+	Last  time.Time `json:"last"`
+}
+
+func getFailures(configPath string) (*failures, error) {
+	f := &failures{}
+	byt, err := ioutil.ReadFile(filepath.Join(configPath, failuresFile))
+	switch {
+	case os.IsNotExist(err):
+		return f, nil
+	case err != nil:
+		return nil, fmt.Errorf("read failures: %w", err)
+	}
+	if err = json.Unmarshal(byt, f); err != nil {
+		return nil, fmt.Errorf("unmarshal failures: %w", err)
+	}
+	return f, nil
+}
+
+// wait reports how long until another attempt is allowed.
+func (f *failures) wait() time.Duration {
+	if f.Count == 0 {
+		return 0
+	}
+	delay := lockoutWindow
+	if f.Count < maxFailures {
+		delay = time.Second << uint(f.Count-1)
+		if delay > lockoutWindow {
+			delay = lockoutWindow
+		}
+	}
+	return time.Until(f.Last.Add(delay))
+}
+
+// check returns errLockedOut if the user must wait before trying again.
+func (f *failures) check() error {
+	wait := f.wait()
+	if wait <= 0 {
+		return nil
+	}
+	wait = wait.Round(time.Second)
+	if wait < time.Second {
+		wait = time.Second
+	}
+	if f.Count >= maxFailures {
+		return fmt.Errorf("%w: locked out for %s", errLockedOut, wait)
+	}
+	return fmt.Errorf("%w: try again in %s", errLockedOut, wait)
+}
+
+// record a failed attempt, or reset the count after a success.
+func (f *failures) record(configPath string, ok bool) error {
+	pth := filepath.Join(configPath, failuresFile)
+	if ok {
+		if f.Count == 0 {
+			return nil
+		}
+		*f = failures{}
+		if err := os.Remove(pth); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove failures: %w", err)
+		}
+		return nil
+	}
+
+	// After the lockout window passes, start counting again rather than
+	// locking out on every subsequent failure
+	if f.Count >= maxFailures && f.wait() <= 0 {
+		f.Count = 0
+	}
+	f.Count++
+	f.Last = time.Now()
+	byt, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(pth, byt, 0600); err != nil {
+		return fmt.Errorf("write failures: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// defaultTrashDays is how long deleted secrets are kept unless the project
+// sets trash_days.
+const defaultTrashDays = 30
+
+// trashedSecret is a deleted secret, kept encrypted for the users who had
+// access so it can be restored.
+type trashedSecret struct {
+	Deleted time.Time           `json:"deleted"`
+	By      username            `json:"by,omitempty"`
+	Secrets map[username]secret `json:"secrets"`
+}
+
+// trashSecret moves every user's copy of the secret into the trash.
+func (s *shh) trashSecret(name string, by username) {
+	trashed := trashedSecret{
+		Deleted: time.Now().UTC(),
+		By:      by,
+		Secrets: map[username]secret{},
+	}
+	for u, secrets := range s.Secrets {
+		sec, ok := secrets[name]
+		if !ok {
+			continue
+		}
+		trashed.Secrets[u] = sec
+		delete(secrets, name)
+		if len(secrets) == 0 {
+			delete(s.Secrets, u)
+		}
+	}
+	delete(s.namespace, name)
+	if s.Trash == nil {
+		s.Trash = map[string]trashedSecret{}
+	}
+	s.Trash[name] = trashed
+}
+
+// purgeTrash permanently deletes secrets trashed longer than the project's
+// retention.
+func (s *shh) purgeTrash(now time.Time) {
+	days := s.TrashDays
+	if days == 0 {
+		days = defaultTrashDays
+	}
+	for name, trashed := range s.Trash {
+		if now.Sub(trashed.Deleted) > time.Duration(days)*24*time.Hour {
+			delete(s.Trash, name)
+		}
+	}
+	if len(s.Trash) == 0 {
+		s.Trash = nil
+	}
+}
+
+// trashCmd manages deleted secrets, e.g. `shh trash restore $name`.
+func trashCmd(args []string) error {
+	arg, tail := parseArg(args)
+	switch arg {
+	case "list":
+		return trashList(tail)
+	case "restore":
+		return trashRestore(tail)
+	case "purge":
+		return trashPurge(tail)
+	case "retain":
+		return trashRetain(tail)
+	case "":
+		return errors.New("bad args: expected `list`, `restore`, `purge`, or `retain`")
+	default:
+		return &badArgError{Arg: arg}
+	}
+}
+
+func trashList(args []string) error {
+	if len(args) != 0 {
+		return errors.New("bad args: expected none")
+	}
+
+	const (
+		promises     = "stdio rpath wpath cpath tty inet dns proc exec"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	shh, err := shhFromPath(".shh")
+	if err != nil {
+		return err
+	}
+	days := shh.TrashDays
+	if days == 0 {
+		days = defaultTrashDays
+	}
+	names := make([]string, 0, len(shh.Trash))
+	for name := range shh.Trash {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		trashed := shh.Trash[name]
+		expires := trashed.Deleted.Add(time.Duration(days) * 24 * time.Hour)
+		fmt.Printf("%s\tdeleted %s", name, trashed.Deleted.Local().Format("2006-01-02"))
+		if trashed.By != "" {
+			fmt.Printf(" by %s", trashed.By)
+		}
+		fmt.Printf(", purged %s\n", expires.Local().Format("2006-01-02"))
+	}
+	return nil
+}
+
+// trashRestore moves a deleted secret back for the users who had access and
+// are still in the project.
+func trashRestore(args []string) error {
+	if len(args) != 1 {
+		return errors.New("bad args: expected `trash restore $secret`")
+	}
+
+	const (
+		promises     = "stdio rpath wpath cpath tty inet dns proc exec"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	name := args[0]
+	configPath, err := getConfigPath()
+	if err != nil {
+		return err
+	}
+	user, err := getUser(configPath)
+	if err != nil {
+		return err
+	}
+	shh, err := shhFromPath(".shh")
+	if err != nil {
+		return err
+	}
+	trashed, ok := shh.Trash[name]
+	if !ok {
+		return fmt.Errorf("%s is not in the trash", name)
+	}
+	if _, ok = trashed.Secrets[user.Username]; !ok {
+		return fmt.Errorf("you had no access to %s", name)
+	}
+	if _, exists := shh.namespace[name]; exists {
+		return fmt.Errorf("%s exists, rename it first", name)
+	}
+	for u, sec := range trashed.Secrets {
+		if _, isUser := shh.Keys[u]; !isUser && !isAgeRecipient(u) {
+			notef(os.Stdout, "> skipping %s, who was removed from the project\n", u)
+			continue
+		}
+		if _, ok := shh.Secrets[u]; !ok {
+			shh.Secrets[u] = map[string]secret{}
+		}
+		shh.Secrets[u][name] = sec
+	}
+	shh.namespace[name] = struct{}{}
+	delete(shh.Trash, name)
+	return shh.EncodeToFile()
+}
+
+// trashPurge permanently deletes trashed secrets matching the glob, or all
+// of them, which the user had access to.
+func trashPurge(args []string) error {
+	if len(args) > 1 {
+		return errors.New("bad args: expected `trash purge [$glob]`")
+	}
+	glob := "*"
+	if len(args) == 1 {
+		glob = args[0]
+	}
+	if err := validateGlob(glob); err != nil {
+		return err
+	}
+
+	const (
+		promises     = "stdio rpath wpath cpath tty inet dns proc exec"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	configPath, err := getConfigPath()
+	if err != nil {
+		return err
+	}
+	user, err := getUser(configPath)
+	if err != nil {
+		return err
+	}
+	shh, err := shhFromPath(".shh")
+	if err != nil {
+		return err
+	}
+	var purged int
+	for name, trashed := range shh.Trash {
+		if _, ok := trashed.Secrets[user.Username]; !ok || !globMatch(glob, name) {
+			continue
+		}
+		delete(shh.Trash, name)
+		purged++
+	}
+	if purged == 0 {
+		return errors.New("nothing to purge")
+	}
+	notef(os.Stdout, "> purged %d secrets\n", purged)
+	return shh.EncodeToFile()
+}
+
+// trashRetain sets how many days deleted secrets are kept.
+func trashRetain(args []string) error {
+	if len(args) != 1 {
+		return errors.New("bad args: expected `trash retain $days`")
+	}
+	days, err := strconv.Atoi(args[0])
+	if err != nil || days < 1 {
+		return errors.New("days must be a positive number")
+	}
+
+	const (
+		promises     = "stdio rpath wpath cpath tty inet dns proc exec"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	shh, err := shhFromPath(".shh")
+	if err != nil {
+		return err
+	}
+	shh.TrashDays = days
+	if days == defaultTrashDays {
+		shh.TrashDays = 0
+	}
+	return shh.EncodeToFile()
+}
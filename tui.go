@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// tuiDetailLines is the height of the pane describing the selection.
+const tuiDetailLines = 5
+
+// tui is the state of `shh tui`.
+type tui struct {
+	nonInteractive bool
+	fd             int
+	term           *terminal.State
+
+	shh    *shh
+	me     username
+	access map[string]map[username]secret
+
+	// users is true when browsing users rather than secrets. onlyUser
+	// limits the secrets to those of one user.
+	users    bool
+	onlyUser username
+	list     *picker
+
+	// prompt, when set, picks a user for an action on the selection.
+	prompt *tuiPrompt
+
+	// revealed is the name of the secret whose value is shown.
+	revealed string
+	value    []byte
+	message  string
+}
+
+type tuiPrompt struct {
+	label  string
+	list   *picker
+	action func(u username) error
+}
+
+// tuiCmd browses users and secrets in a full-screen terminal UI. Values are
+// revealed, copied, and shared by running shh itself, so each action takes
+// the usual locks and asks for the password as it would on the command
+// line.
+func tuiCmd(nonInteractive bool, args []string) error {
+	if len(args) != 0 {
+		return errors.New("bad args: expected `tui`")
+	}
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) || !isTerminalOutput() {
+		return errors.New("tui requires a terminal")
+	}
+
+	const (
+		promises     = "stdio rpath wpath cpath tty proc exec flock"
+		execPromises = ""
+	)
+	pledge(promises, execPromises)
+
+	configPath, err := getConfigPath()
+	if err != nil {
+		return err
+	}
+	user, err := getUser(configPath)
+	if err != nil {
+		return fmt.Errorf("get user: %w", err)
+	}
+	t := &tui{nonInteractive: nonInteractive, fd: int(os.Stdin.Fd()),
+		me: user.Username}
+	if err = t.load(); err != nil {
+		return err
+	}
+	t.term, err = terminal.MakeRaw(t.fd)
+	if err != nil {
+		return fmt.Errorf("raw mode: %w", err)
+	}
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer func() {
+		t.hide()
+		fmt.Print("\x1b[?25h\x1b[?1049l")
+		_ = terminal.Restore(t.fd, t.term)
+	}()
+	for {
+		t.draw()
+		k, err := readKey(os.Stdin)
+		if err != nil {
+			return err
+		}
+		quit, err := t.handle(k)
+		if err != nil {
+			t.message = styled(styleRed, err.Error())
+		}
+		if quit {
+			return nil
+		}
+	}
+}
+
+// load the project, then rebuild the list, keeping its filter.
+func (t *tui) load() error {
+	if err := lockProject(lockShared); err != nil {
+		return err
+	}
+	shh, err := shhFromPath(".shh")
+	unlockProject()
+	if err != nil {
+		return err
+	}
+	t.shh = shh
+	t.access = secretAccess(shh)
+	t.rebuild()
+	return nil
+}
+
+// rebuild the list for the current view.
+func (t *tui) rebuild() {
+	var items []string
+	switch {
+	case t.users:
+		for u := range t.shh.Keys {
+			items = append(items, string(u))
+		}
+	case t.onlyUser != "":
+		items = t.shh.userNames(t.onlyUser)
+	default:
+		for name := range t.shh.namespace {
+			items = append(items, name)
+		}
+	}
+	sort.Strings(items)
+	filter, current := "", ""
+	if t.list != nil {
+		filter = t.list.filter
+		current, _ = t.list.current()
+	}
+	t.list = newPicker(items, filter)
+	for i, item := range t.list.matches {
+		if item == current {
+			t.list.move(i, t.listHeight())
+			break
+		}
+	}
+}
+
+func (t *tui) size() (int, int) {
+	width, height, err := terminal.GetSize(int(os.Stdout.Fd()))
+	if err != nil || width < 20 || height < tuiDetailLines+6 {
+		return 80, 24
+	}
+	return width, height
+}
+
+// listHeight is the number of list rows which fit on the screen.
+func (t *tui) listHeight() int {
+	_, height := t.size()
+	return height - tuiDetailLines - 5
+}
+
+func (t *tui) draw() {
+	width, height := t.size()
+	var lines []string
+	add := func(plain, style string) {
+		if utf8.RuneCountInString(plain) > width {
+			plain = string([]rune(plain)[:width-1]) + "…"
+		}
+		lines = append(lines, styled(style, plain))
+	}
+
+	title := "[secrets]  users"
+	if t.users {
+		title = " secrets  [users]"
+	}
+	if t.onlyUser != "" {
+		title += fmt.Sprintf("   %s's secrets", t.onlyUser)
+	}
+	add(title, styleBold)
+
+	list := t.list
+	if t.prompt != nil {
+		list = t.prompt.list
+		add(t.prompt.label+" "+list.filter, "")
+	} else {
+		add("> "+list.filter, "")
+	}
+	listHeight := t.listHeight()
+	items, cursor := list.visible(listHeight)
+	for i, item := range items {
+		style := ""
+		if !t.users && t.prompt == nil && !t.canAccess(item) {
+			style = styleDim
+		}
+		if i == cursor {
+			add("> "+item, styleReverse)
+		} else {
+			add("  "+item, style)
+		}
+	}
+	for i := len(items); i < listHeight; i++ {
+		add("", "")
+	}
+	add(fmt.Sprintf("%d/%d", len(list.matches), len(list.items)), styleDim)
+	for _, line := range t.details() {
+		add(line, "")
+	}
+	for len(lines) < height-2 {
+		add("", "")
+	}
+	add(t.help(), styleDim)
+	lines = append(lines, t.message)
+
+	var buf bytes.Buffer
+	buf.WriteString("\x1b[H")
+	for i, line := range lines {
+		buf.WriteString(line + "\x1b[K")
+		if i < len(lines)-1 {
+			buf.WriteString("\r\n")
+		}
+	}
+	_, _ = os.Stdout.Write(buf.Bytes())
+}
+
+func (t *tui) help() string {
+	switch {
+	case t.prompt != nil:
+		return "enter choose  esc cancel"
+	case t.users:
+		return "enter list secrets  tab secrets  ^r reload  esc quit"
+	}
+	return "enter reveal  ^y copy  ^a allow  ^d deny  tab users  ^r reload  esc quit"
+}
+
+// details describes the selection.
+func (t *tui) details() []string {
+	item, ok := t.list.current()
+	if !ok {
+		return nil
+	}
+	if t.users {
+		u := username(item)
+		return []string{
+			item,
+			"key:     " + keyCell(t.shh, u).text,
+			fmt.Sprintf("secrets: %d", len(t.shh.userNames(u))),
+		}
+	}
+	users := accessUsers(t.access[item])
+	flags := []string{}
+	for _, sec := range t.access[item] {
+		if sec.Sensitive {
+			flags = append(flags, "sensitive")
+		}
+		if sec.Protected {
+			flags = append(flags, "protected")
+		}
+		break
+	}
+	if len(flags) == 0 {
+		flags = append(flags, "none")
+	}
+	value := "no access"
+	switch {
+	case item == t.revealed:
+		value = printable(t.value)
+	case t.canAccess(item):
+		value = "•••••••• (enter to reveal)"
+	}
+	return []string{
+		item,
+		"access: " + joinUsernames(users),
+		"flags:  " + strings.Join(flags, ", "),
+		"value:  " + value,
+	}
+}
+
+func (t *tui) canAccess(name string) bool {
+	_, ok := t.access[name][t.me]
+	return ok
+}
+
+// handle a key, reporting whether to quit.
+func (t *tui) handle(k key) (bool, error) {
+	t.message = ""
+	if t.prompt != nil {
+		return false, t.handlePrompt(k)
+	}
+	if t.list.handle(k, t.listHeight()) {
+		t.hide()
+		return false, nil
+	}
+	item, ok := t.list.current()
+	switch {
+	case k.name == keyInterrupt:
+		return true, nil
+	case k.name == keyEscape:
+		if t.onlyUser == "" {
+			return true, nil
+		}
+		t.onlyUser = ""
+		t.rebuild()
+	case k.name == keyTab:
+		t.hide()
+		t.users, t.onlyUser = !t.users, ""
+		t.list.filter = ""
+		t.rebuild()
+	case k.ctrl == 'R':
+		return false, t.load()
+	case !ok:
+		// Nothing selected for the actions below
+	case t.users && k.name == keyEnter:
+		t.users, t.onlyUser = false, username(item)
+		t.list.filter = ""
+		t.rebuild()
+	case t.users:
+		// The actions below are for secrets
+	case k.name == keyEnter:
+		if t.revealed == item {
+			t.hide()
+			return false, nil
+		}
+		return false, t.reveal(item)
+	case k.ctrl == 'Y':
+		if t.revealed != item {
+			if err := t.reveal(item); err != nil {
+				return false, err
+			}
+		}
+		how, err := copyToClipboard(t.value)
+		if err != nil {
+			return false, err
+		}
+		t.message = "copied " + item + how
+	case k.ctrl == 'A':
+		var others []string
+		for u := range t.shh.Keys {
+			if _, ok := t.access[item][u]; !ok {
+				others = append(others, string(u))
+			}
+		}
+		t.choose("allow who?", others, func(u username) error {
+			return t.run(true, "allow", string(u), item)
+		})
+	case k.ctrl == 'D':
+		var users []string
+		for _, u := range accessUsers(t.access[item]) {
+			users = append(users, string(u))
+		}
+		t.choose("deny who?", users, func(u username) error {
+			return t.run(true, "deny", string(u), item)
+		})
+	}
+	return false, nil
+}
+
+// choose a user for an action with a prompt.
+func (t *tui) choose(label string, users []string, action func(username) error) {
+	if len(users) == 0 {
+		t.message = "no users to choose from"
+		return
+	}
+	sort.Strings(users)
+	t.prompt = &tuiPrompt{label: label, list: newPicker(users, ""),
+		action: action}
+}
+
+func (t *tui) handlePrompt(k key) error {
+	p := t.prompt
+	if p.list.handle(k, t.listHeight()) {
+		return nil
+	}
+	switch k.name {
+	case keyEscape, keyInterrupt:
+		t.prompt = nil
+	case keyEnter:
+		choice, ok := p.list.current()
+		if !ok {
+			return nil
+		}
+		t.prompt = nil
+		if err := p.action(username(choice)); err != nil {
+			return err
+		}
+		return t.load()
+	}
+	return nil
+}
+
+// reveal a secret's value by running `shh get`.
+func (t *tui) reveal(name string) error {
+	t.hide()
+	value, err := t.capture("get", name)
+	if err != nil {
+		return err
+	}
+	t.revealed, t.value = name, value
+	return nil
+}
+
+// hide the revealed value, wiping it from memory.
+func (t *tui) hide() {
+	for i := range t.value {
+		t.value[i] = 0
+	}
+	t.revealed, t.value = "", nil
+}
+
+// shhCommand runs shh itself with the given args, passing along the global
+// flags which affect asking for the password.
+func (t *tui) shhCommand(args ...string) (*exec.Cmd, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	var global []string
+	if t.nonInteractive {
+		global = append(global, "-n")
+	}
+	if passwordSource.file != "" {
+		global = append(global, "-password-file", passwordSource.file)
+	}
+	cmd := exec.Command(self, append(global, args...)...)
+	cmd.Stdin, cmd.Stderr = os.Stdin, os.Stderr
+	return cmd, nil
+}
+
+// capture the output of a shh command. The screen is cleared and the
+// terminal restored while it runs, in case it asks for the password.
+func (t *tui) capture(args ...string) ([]byte, error) {
+	cmd, err := t.shhCommand(args...)
+	if err != nil {
+		return nil, err
+	}
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	err = t.suspend(func() error { return cmd.Run() })
+	if err != nil {
+		stdout.Reset()
+		return nil, fmt.Errorf("%s: %w", args[0], err)
+	}
+	return stdout.Bytes(), nil
+}
+
+// run a shh command with its output on screen, then wait for enter if
+// pause is set, so the output can be read.
+func (t *tui) run(pause bool, args ...string) error {
+	cmd, err := t.shhCommand(args...)
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = os.Stdout
+	return t.suspend(func() error {
+		err := cmd.Run()
+		if pause {
+			fmt.Print("\npress enter to continue")
+			_, _ = bufio.NewReader(os.Stdin).ReadString('\n')
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+		return nil
+	})
+}
+
+// suspend the tui while fn runs with the terminal restored.
+func (t *tui) suspend(fn func() error) error {
+	fmt.Print("\x1b[H\x1b[2J\x1b[?25h")
+	if err := terminal.Restore(t.fd, t.term); err != nil {
+		return err
+	}
+	err := fn()
+	if _, rawErr := terminal.MakeRaw(t.fd); rawErr != nil && err == nil {
+		err = rawErr
+	}
+	fmt.Print("\x1b[?25l\x1b[2J")
+	return err
+}
+
+// printable shows a value on one line, replacing control characters.
+func printable(value []byte) string {
+	s := strings.TrimRight(string(value), "\n")
+	if !utf8.ValidString(s) {
+		return fmt.Sprintf("(%d bytes of binary data)", len(value))
+	}
+	return strings.Map(func(r rune) rune {
+		if r == '\n' {
+			return '↵'
+		}
+		if !unicode.IsPrint(r) {
+			return '?'
+		}
+		return r
+	}, s)
+}
+
+// copyToClipboard using the first clipboard program found, or else the
+// terminal's OSC 52 sequence, which most terminals support. It returns how
+// the value was copied.
+func copyToClipboard(value []byte) (string, error) {
+	var candidates [][]string
+	switch runtime.GOOS {
+	case "darwin":
+		candidates = [][]string{{"pbcopy"}}
+	case "windows":
+		candidates = [][]string{{"clip"}}
+	default:
+		if os.Getenv("WAYLAND_DISPLAY") != "" {
+			candidates = append(candidates, []string{"wl-copy"})
+		}
+		if os.Getenv("DISPLAY") != "" {
+			candidates = append(candidates,
+				[]string{"xclip", "-selection", "clipboard"},
+				[]string{"xsel", "--clipboard", "--input"})
+		}
+	}
+	for _, c := range candidates {
+		if _, err := exec.LookPath(c[0]); err != nil {
+			continue
+		}
+		cmd := exec.Command(c[0], c[1:]...)
+		cmd.Stdin = bytes.NewReader(value)
+		if err := cmd.Run(); err != nil {
+			return "", fmt.Errorf("%s: %w", c[0], err)
+		}
+		return "", nil
+	}
+	fmt.Printf("\x1b]52;c;%s\a", base64.StdEncoding.EncodeToString(value))
+	return " through the terminal", nil
+}
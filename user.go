@@ -1,9 +1,12 @@
 package main
 
 import (
+	"bytes"
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
@@ -12,17 +15,33 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
-
-	"golang.org/x/crypto/ssh/terminal"
 )
 
-const defaultPasswordPrompt = "password"
+const (
+	defaultPasswordPrompt = "password"
+
+	// defaultKeyBits is the RSA key size used when none is specified.
+	defaultKeyBits = 4096
+
+	// minKeyBits is the smallest RSA key size shh will generate or accept,
+	// regardless of project policy.
+	minKeyBits = 2048
+)
 
 type user struct {
 	Username username
 	Password []byte
 	Port     int
+	Cache    string
+	Autolock bool
 	Keys     *keys
+
+	// ConfigPath is the directory holding the user's config and keys. It
+	// identifies the user to the server.
+	ConfigPath string
+
+	// Key is the user's key in a keyProvider, if they have no id_rsa.
+	Key string
 }
 
 type username string
@@ -35,27 +54,48 @@ type keys struct {
 }
 
 // getUser from the ~/.config/shh/config file. If the user already exists in
-// the project's shh key, this returns nil User and nil error.
+// the project's shh key, this returns nil User and nil error. $SHH_KMS_KEY or
+// a KMS key ARN as the configured username identifies as a KMS user, which
+// has no keys of its own.
 func getUser(configPath string) (*user, error) {
+	if arn := os.Getenv("SHH_KMS_KEY"); arn != "" {
+		return &user{Username: username(arn), ConfigPath: configPath}, nil
+	}
 	config, err := configFromPath(configPath)
 	if err != nil {
 		return nil, err
 	}
+	if isKMSKey(config.Username) {
+		return &user{Username: config.Username, ConfigPath: configPath}, nil
+	}
+	if config.Key != "" {
+		return &user{
+			Username:   config.Username,
+			Port:       config.Port,
+			Cache:      config.Cache,
+			Autolock:   config.Autolock,
+			Key:        config.Key,
+			ConfigPath: configPath,
+		}, nil
+	}
 
 	keys, err := getPublicKey(configPath)
 	if err != nil {
 		return nil, fmt.Errorf("get public keys: %w", err)
 	}
 	u := &user{
-		Username: config.Username,
-		Port:     config.Port,
-		Keys:     keys,
+		Username:   config.Username,
+		Port:       config.Port,
+		Cache:      config.Cache,
+		Autolock:   config.Autolock,
+		Keys:       keys,
+		ConfigPath: configPath,
 	}
 	return u, nil
 }
 
-func createUser(configPath string) (*user, error) {
-	fmt.Print("username (usually email): ")
+func createUser(configPath string, bits int) (*user, error) {
+	fmt.Print(tr("username (usually email): "))
 	var uname string
 	_, err := fmt.Scan(&uname)
 	if err != nil {
@@ -70,8 +110,9 @@ func createUser(configPath string) (*user, error) {
 		return nil, fmt.Errorf("request password: %w", err)
 	}
 	user := &user{
-		Username: username(uname),
-		Password: password,
+		Username:   username(uname),
+		Password:   password,
+		ConfigPath: configPath,
 	}
 
 	// Create ~/.config/shh folder
@@ -81,7 +122,7 @@ func createUser(configPath string) (*user, error) {
 	}
 
 	// Create public and private keys
-	user.Keys, err = createKeys(configPath, user.Password)
+	user.Keys, err = createKeys(configPath, user.Password, bits)
 	if err != nil {
 		return nil, fmt.Errorf("create keys: %w", err)
 	}
@@ -95,91 +136,378 @@ func createUser(configPath string) (*user, error) {
 	return user, nil
 }
 
-// requestPasswordFromServer and report an error if no password can be
-// retrieved.
-func requestPasswordFromServer(port int, resetTimer bool) ([]byte, error) {
+// passwordCache keeps the user's password between commands, so they aren't
+// prompted every time.
+type passwordCache interface {
+	// Get the cached password, reporting an error if none is cached.
+	Get() ([]byte, error)
+
+	// Set the cached password.
+	Set(password []byte) error
+
+	// Clear the cached password immediately.
+	Clear() error
+}
+
+// passwordCache configured for the user. By default this is the server
+// started by `shh serve`.
+func (u *user) passwordCache() passwordCache {
+	switch u.Cache {
+	case cacheKeychain:
+		return keychainCache{account: u.Username, configPath: u.ConfigPath}
+	case cacheSecretService:
+		return secretServiceCache{account: u.Username,
+			configPath: u.ConfigPath}
+	case cacheKeyring:
+		return keyringCache{account: u.Username, configPath: u.ConfigPath}
+	case cacheCredentialManager:
+		return credentialManagerCache{account: u.Username,
+			configPath: u.ConfigPath}
+	default:
+		return serverCache{port: u.Port, configPath: u.ConfigPath}
+	}
+}
+
+// serverCache holds the private key in the memory of `shh serve`. The server
+// never returns the password, so Get always reports an error. Instead, use
+// the server to decrypt via user.decrypter.
+type serverCache struct {
+	port       int
+	configPath string
+}
+
+func (c serverCache) Get() ([]byte, error) {
+	return nil, errors.New("server does not share passwords")
+}
+
+func (c serverCache) Set(password []byte) error {
+	if c.port <= 0 {
+		return errors.New("no port set in ~/.config/shh/config")
+	}
+	return sendPasswordToServer(c.port, c.configPath, password)
+}
+
+func (c serverCache) Clear() error {
+	if c.port <= 0 {
+		return errors.New("no port set in ~/.config/shh/config")
+	}
+	_, err := logoutFromServer(c.port, c.configPath, "/logout")
+	return err
+}
+
+// clearServer clears every identity the server holds, authenticating as the
+// first of configPaths which is logged in. Nothing is cleared if none are.
+func clearServer(port int, configPaths []string) error {
+	if port <= 0 {
+		return errors.New("no port set in ~/.config/shh/config")
+	}
+	for _, configPath := range configPaths {
+		ok, err := logoutFromServer(port, configPath, "/logout-all")
+		if err != nil || ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// logoutFromServer authenticates as the identity in configPath to clear it,
+// or all identities with /logout-all. It reports whether the identity was
+// logged in.
+func logoutFromServer(port int, configPath, path string) (bool, error) {
 	url := fmt.Sprint("http://127.0.0.1:", port)
 	if err := pingServer(url); err != nil {
+		return false, err
+	}
+	resp, err := agentControl(port, configPath, path)
+	if errors.Is(err, os.ErrNotExist) {
+		// Never logged in, so there's no token
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("new request: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode == http.StatusUnauthorized {
+		// The server no longer holds the identity
+		return false, nil
+	}
+	if resp.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return false, fmt.Errorf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	return true, nil
+}
+
+// decrypter for the user's private key. If a password was provided by flag or
+// environment, it's used directly. If the server holds the key, it decrypts
+// on our behalf. Otherwise the password is retrieved from the cache (or
+// requested, if interactive) and the private key is decrypted locally.
+func (u *user) decrypter(configPath string, nonInteractive bool) (crypto.Decrypter, error) {
+	if isKMSKey(u.Username) {
+		debug("decrypt with kms", "key", u.Username)
+		return newKMSKey(string(u.Username))
+	}
+	if u.Key != "" {
+		p, id, err := parseKeyRef(u.Key)
+		if err != nil {
+			return nil, err
+		}
+		debug("decrypt with key provider", "key", u.Key)
+		return p.decrypter(id)
+	}
+	password, ok, err := providedPassword()
+	if err != nil {
 		return nil, err
 	}
-	if resetTimer {
-		url += "/reset-timer"
+	if ok {
+		debug("decrypt with provided password")
+		keys, err := getKeys(configPath, password)
+		secureBytes(password).Destroy()
+		if err != nil {
+			return nil, err
+		}
+		return keys.PrivateKey, nil
+	}
+	if u.Cache == "" || u.Cache == cacheServer {
+		dec, err := newAgentDecrypter(configPath, u)
+		if err == nil {
+			debug("decrypt with server", "port", u.Port)
+			return dec, nil
+		}
+		debug("server unavailable", "error", err)
+		if nonInteractive {
+			return nil, err
+		}
+	}
+	debug("decrypt with password", "cache", u.Cache)
+	if nonInteractive {
+		u.Password, err = u.passwordCache().Get()
+	} else {
+		u.Password, err = requestPassword(u.passwordCache(),
+			defaultPasswordPrompt)
+	}
+	if err != nil {
+		return nil, err
 	}
-	resp, err := http.Get(url)
+	keys, err := getKeys(configPath, u.Password)
+	secureBytes(u.Password).Destroy()
 	if err != nil {
 		return nil, err
 	}
+	return keys.PrivateKey, nil
+}
+
+// decrypterFor the secrets. If any are sensitive, the password is always
+// requested, ignoring the server and cache. KMS users have no password, so
+// IAM alone controls their access, and other key providers ask for their own.
+func (u *user) decrypterFor(configPath string, nonInteractive bool, secrets map[string]secret) (crypto.Decrypter, error) {
+	if isKMSKey(u.Username) || u.Key != "" {
+		return u.decrypter(configPath, nonInteractive)
+	}
+	for name, sec := range secrets {
+		if !sec.Sensitive {
+			continue
+		}
+		password, ok, err := providedPassword()
+		if err != nil {
+			return nil, err
+		}
+		if !ok && nonInteractive {
+			return nil, fmt.Errorf("%s is sensitive and requires a password", name)
+		}
+		debug("decrypt with password", "sensitive", name)
+		if !ok {
+			password, err = readPassword(defaultPasswordPrompt)
+			if err != nil {
+				return nil, err
+			}
+		}
+		keys, err := getKeys(configPath, password)
+		secureBytes(password).Destroy()
+		if err != nil {
+			return nil, err
+		}
+		return keys.PrivateKey, nil
+	}
+	return u.decrypter(configPath, nonInteractive)
+}
+
+// resetServerTimer extends how long the server holds the private key for the
+// identity in configPath, reporting an error if the server isn't running or
+// holds no key.
+func resetServerTimer(port int, configPath string) error {
+	url := fmt.Sprint("http://127.0.0.1:", port)
+	if err := pingServer(url); err != nil {
+		return err
+	}
+	resp, err := agentControl(port, configPath, "/reset-timer")
+	if err != nil {
+		return err
+	}
 	defer resp.Body.Close()
-	password, err := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(tr("cached password not available. run `shh login`"))
+	}
+	return nil
+}
+
+// sendPasswordToServer so it can decrypt the private key in configPath and
+// hold it in memory.
+func sendPasswordToServer(port int, configPath string, password []byte) error {
+	url := fmt.Sprint("http://127.0.0.1:", port)
+	byt, err := json.Marshal(agentLoginReq{
+		Config:   configPath,
+		Password: password,
+	})
+	if err != nil {
+		return err
+	}
+	defer wipe(byt)
+	resp, err := http.Post(url+"/login", "application/json",
+		bytes.NewReader(byt))
 	if err != nil {
-		return nil, fmt.Errorf("read all: %w", err)
+		return fmt.Errorf("new request: %w", err)
 	}
-	if len(password) == 0 {
-		return nil, errors.New("cached password not available. run `shh login`")
+	defer func() { _ = resp.Body.Close() }()
+	debug("agent call", "path", "/login", "status", resp.StatusCode)
+	if resp.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		err = fmt.Errorf("expected 200, got %d: %s", resp.StatusCode, body)
+		if bytes.Contains(body, []byte(x509.IncorrectPasswordError.Error())) {
+			err = &wrongPasswordError{err}
+		}
+		return err
 	}
-	return password, nil
+	return nil
+}
+
+// agentStatus is reported by the server's /status endpoint. Username and
+// LoggedIn describe the identity requested, while Identities lists all
+// identities the server holds.
+type agentStatus struct {
+	Username   username   `json:"username"`
+	Port       int        `json:"port"`
+	LoggedIn   bool       `json:"logged_in"`
+	Identities []username `json:"identities"`
+
+	// ExpiresIn is the number of seconds until the cached password is
+	// cleared.
+	ExpiresIn int `json:"expires_in"`
+}
+
+// statusFromServer reports the server's status for the identity in configPath
+// or an error if it's not running. The server only reports which identities
+// it holds to a client which authenticates as one of them, so a client which
+// can't is told only that the server is running.
+func statusFromServer(port int, configPath string) (*agentStatus, error) {
+	url := fmt.Sprint("http://127.0.0.1:", port)
+	if err := pingServer(url); err != nil {
+		return nil, err
+	}
+	resp, err := agentControl(port, configPath, "/status")
+	if errors.Is(err, os.ErrNotExist) {
+		resp, err = http.Get(url + "/status")
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return &agentStatus{Port: port}, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad resp code: %d", resp.StatusCode)
+	}
+	stat := &agentStatus{}
+	if err = json.NewDecoder(resp.Body).Decode(stat); err != nil {
+		return nil, fmt.Errorf("decode: %w", err)
+	}
+	return stat, nil
 }
 
 // requestPassword from user using the CLI. If prompt is empty, the default is
-// used. This attempts to retrieve the password from the server if configured.
-func requestPassword(port int, prompt string) ([]byte, error) {
-	// Attempt to use the password from the server, if running. If any
-	// error, just ask for the password.
-	if port > 0 {
-		password, err := requestPasswordFromServer(port, false)
+// used. This attempts to retrieve the password from the cache if not nil.
+func requestPassword(cache passwordCache, prompt string) ([]byte, error) {
+	// Prefer a password provided by flag or environment
+	password, ok, err := providedPassword()
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return password, nil
+	}
+
+	// Attempt to use the cached password, if available. If any error, just
+	// ask for the password.
+	if cache != nil {
+		password, err := cache.Get()
 		if err == nil {
 			return password, nil
 		}
 	}
-	fmt.Print(prompt + ": ")
-	password, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	password, err = readPassword(prompt)
 	if err != nil {
 		return nil, err
 	}
-	fmt.Print("\n")
-	if len(string(password)) < 24 {
+	password = newSecureBytes(password)
+	if len(password) < 24 {
 		// The goal is to make manual entry so inconvenient that it's
 		// never used. Use a password manager and a randomly generated
 		// password instead.
-		return nil, errors.New("password must be >= 24 chars")
+		secureBytes(password).Destroy()
+		return nil, errors.New(tr("password must be >= 24 chars"))
 	}
 	return password, nil
 }
 
 func requestPasswordAndConfirm(prompt string) ([]byte, error) {
-	fmt.Print(prompt + ": ")
-	password, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	// A new password provided by environment needs no confirmation
+	password, ok, err := providedNewPassword()
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		if err = checkPasswordStrength(password, false); err != nil {
+			return nil, err
+		}
+		return password, nil
+	}
+	password, err = readPassword(prompt)
 	if err != nil {
 		return nil, err
 	}
-	fmt.Print("\n")
 	if len(string(password)) < 24 {
 		// The goal is to make manual entry so inconvenient that it's
 		// never used. Use a password manager and a randomly generated
 		// password instead.
-		return nil, errors.New("password must be >= 24 chars")
+		return nil, errors.New(tr("password must be >= 24 chars"))
+	}
+	if err = checkPasswordStrength(password, true); err != nil {
+		return nil, err
 	}
-	fmt.Print("confirm password: ")
-	password2, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	password2, err := readPassword("confirm password")
 	if err != nil {
 		return nil, err
 	}
-	if string(password) != string(password2) {
-		return nil, errors.New("passwords do not match")
+	defer wipe(password2)
+	if !bytes.Equal(password, password2) {
+		return nil, errors.New(tr("passwords do not match"))
 	}
-	fmt.Print("\n")
 	return password, nil
 }
 
 // createKeys at the given path, returning the keys and their pem block for use
 // in the .shh file.
-func createKeys(pth string, password []byte) (*keys, error) {
+func createKeys(pth string, password []byte, bits int) (*keys, error) {
+	if bits < minKeyBits {
+		return nil, fmt.Errorf("key size must be >= %d bits", minKeyBits)
+	}
 	keys := &keys{}
 	keyPath := filepath.Join(pth, "id_rsa")
 
 	// Generate id_rsa (600) and id_rsa.pub (644)
 	var err error
-	keys.PrivateKey, err = rsa.GenerateKey(rand.Reader, 4096)
+	keys.PrivateKey, err = rsa.GenerateKey(rand.Reader, bits)
 	if err != nil {
 		return nil, err
 	}
@@ -189,6 +517,9 @@ func createKeys(pth string, password []byte) (*keys, error) {
 		return nil, err
 	}
 	defer privKeyFile.Close()
+	if err = restrictPerms(keyPath); err != nil {
+		return nil, fmt.Errorf("restrict perms: %w", err)
+	}
 
 	keys.PrivateKeyBlock = &pem.Block{
 		Type:  "RSA PRIVATE KEY",
@@ -208,6 +539,11 @@ func createKeys(pth string, password []byte) (*keys, error) {
 		return nil, err
 	}
 
+	// Keys are renamed into place by rotate, so they must be on disk first
+	if err = privKeyFile.Sync(); err != nil {
+		return nil, err
+	}
+
 	keyPath += ".pub"
 	pubKeyFile, err := os.OpenFile(keyPath, flags, 0644)
 	if err != nil {
@@ -223,11 +559,15 @@ func createKeys(pth string, password []byte) (*keys, error) {
 	if err = pem.Encode(pubKeyFile, keys.PublicKeyBlock); err != nil {
 		return nil, err
 	}
+	if err = pubKeyFile.Sync(); err != nil {
+		return nil, err
+	}
 	return keys, nil
 }
 
 func getPublicKey(pth string) (*keys, error) {
 	keyPath := filepath.Join(pth, "id_rsa.pub")
+	debug("read public key", "path", keyPath)
 	byt, err := ioutil.ReadFile(keyPath)
 	if err != nil {
 		return nil, err
@@ -247,15 +587,12 @@ func getPublicKey(pth string) (*keys, error) {
 func getKeys(pth string, password []byte) (*keys, error) {
 	keyPath := filepath.Join(pth, "id_rsa")
 
-	// Require 600 permission on private key
-	fileInfo, err := os.Stat(keyPath)
-	if err != nil {
+	// Require that only the user can access the private key
+	if err := checkPrivateKeyPerms(keyPath); err != nil {
 		return nil, err
 	}
-	if fileInfo.Mode() != 0600 {
-		return nil, errors.New("bad private key permission level. id_rsa mode must be set to 0600")
-	}
 
+	debug("read private key", "path", keyPath)
 	byt, err := ioutil.ReadFile(keyPath)
 	if err != nil {
 		return nil, err
@@ -266,13 +603,26 @@ func getKeys(pth string, password []byte) (*keys, error) {
 	if keys.PrivateKeyBlock == nil || keys.PrivateKeyBlock.Type != "RSA PRIVATE KEY" {
 		return nil, errors.New("failed to decode pem block for encrypted private key")
 	}
-	byt, err = x509.DecryptPEMBlock(keys.PrivateKeyBlock, password)
+
+	// Slow down password guessing, whether it happens here or through the
+	// server
+	fails, err := getFailures(pth)
 	if err != nil {
-		return nil, fmt.Errorf("decrypt pem: %w", err)
+		return nil, err
+	}
+	if err = fails.check(); err != nil {
+		return nil, err
+	}
+	byt, err = x509.DecryptPEMBlock(keys.PrivateKeyBlock, password)
+	if err == nil {
+		keys.PrivateKey, err = x509.ParsePKCS1PrivateKey(byt)
+		wipe(byt)
+	}
+	if rerr := fails.record(pth, err == nil); rerr != nil {
+		return nil, rerr
 	}
-	keys.PrivateKey, err = x509.ParsePKCS1PrivateKey(byt)
 	if err != nil {
-		return nil, fmt.Errorf("parse private key: %w", err)
+		return nil, fmt.Errorf("%s: %w", tr("decrypt private key"), err)
 	}
 
 	pubkeys, err := getPublicKey(pth)
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// vaultRemote syncs with a HashiCorp Vault KV version 2 mount. Each secret is
+// stored as a single field, "value" by default.
+type vaultRemote struct {
+	addr   string
+	token  string
+	mount  string
+	field  string
+	client *http.Client
+}
+
+// vaultBackend reads the address and token from $VAULT_ADDR and $VAULT_TOKEN,
+// like the vault CLI.
+func vaultBackend(fs *flag.FlagSet) func() (syncRemote, error) {
+	mount := fs.String("mount", "secret/", "kv v2 mount")
+	field := fs.String("field", "value", "field holding each secret")
+	return func() (syncRemote, error) {
+		token := os.Getenv("VAULT_TOKEN")
+		if token == "" {
+			return nil, errors.New("$VAULT_TOKEN not set")
+		}
+		addr := os.Getenv("VAULT_ADDR")
+		if addr == "" {
+			addr = "https://127.0.0.1:8200"
+		}
+		return &vaultRemote{
+			addr:   strings.TrimSuffix(addr, "/"),
+			token:  token,
+			mount:  strings.Trim(*mount, "/"),
+			field:  *field,
+			client: &http.Client{Timeout: 30 * time.Second},
+		}, nil
+	}
+}
+
+// vault syncs secrets with HashiCorp Vault.
+func vault(nonInteractive bool, args []string) error {
+	return syncCommand(nonInteractive, "vault", vaultBackend, args)
+}
+
+// do sends a request to the Vault API, decoding the response into out if
+// non-nil. It reports whether the path was found.
+func (v *vaultRemote) do(method, pth string, body, out interface{}) (bool, error) {
+	var rdr *bytes.Reader
+	if body != nil {
+		byt, err := json.Marshal(body)
+		if err != nil {
+			return false, err
+		}
+		rdr = bytes.NewReader(byt)
+		defer wipe(byt)
+	} else {
+		rdr = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequest(method, v.addr+"/v1/"+v.mount+"/"+pth, rdr)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	byt, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return false, err
+	}
+	defer wipe(byt)
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	case resp.StatusCode >= 300:
+		var verr struct {
+			Errors []string `json:"errors"`
+		}
+		_ = json.Unmarshal(byt, &verr)
+		return false, fmt.Errorf("vault: %s: %s", resp.Status,
+			strings.Join(verr.Errors, ", "))
+	}
+	if out != nil && len(byt) > 0 {
+		if err = json.Unmarshal(byt, out); err != nil {
+			return false, fmt.Errorf("decode: %w", err)
+		}
+	}
+	return true, nil
+}
+
+func (v *vaultRemote) list(prefix string) ([]string, error) {
+	// Vault lists directories, so start from the prefix's directory and
+	// filter
+	dir := ""
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir = prefix[:i+1]
+	}
+	var names []string
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		var resp struct {
+			Data struct {
+				Keys []string `json:"keys"`
+			} `json:"data"`
+		}
+		found, err := v.do("LIST", "metadata/"+escapePath(dir), nil, &resp)
+		if err != nil || !found {
+			return err
+		}
+		for _, k := range resp.Data.Keys {
+			name := dir + k
+			if !strings.HasPrefix(name, prefix) &&
+				!strings.HasPrefix(prefix, name) {
+				continue
+			}
+			if strings.HasSuffix(k, "/") {
+				if err = walk(name); err != nil {
+					return err
+				}
+				continue
+			}
+			names = append(names, name)
+		}
+		return nil
+	}
+	if err := walk(dir); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+func (v *vaultRemote) get(name string) ([]byte, error) {
+	var resp struct {
+		Data struct {
+			Data map[string]interface{} `json:"data"`
+		} `json:"data"`
+	}
+	found, err := v.do(http.MethodGet, "data/"+escapePath(name), nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errors.New("not found")
+	}
+	val, ok := resp.Data.Data[v.field].(string)
+	if !ok {
+		return nil, fmt.Errorf("no string field %q", v.field)
+	}
+	return []byte(val), nil
+}
+
+func (v *vaultRemote) put(name string, val []byte) error {
+	body := map[string]interface{}{
+		"data": map[string]string{v.field: string(val)},
+	}
+	_, err := v.do(http.MethodPost, "data/"+escapePath(name), body, nil)
+	return err
+}
+
+// escapePath escapes each segment of a slash-separated path.
+func escapePath(pth string) string {
+	parts := strings.Split(pth, "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return strings.Join(parts, "/")
+}
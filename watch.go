@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// watch runs a command with secrets in its environment like run, restarting
+// it (or sending it a signal) whenever the matched secrets change, e.g.
+// `shh watch 'db/*' -- ./server`. Changes are found by polling the project
+// file and comparing the user's encrypted secrets, so re-encrypting a secret
+// through edit or rotate counts as a change.
+func watch(nonInteractive bool, args []string) error {
+	args, cmdArgs := splitCommand(args)
+	if len(cmdArgs) == 0 {
+		return errors.New("bad args: expected `watch [$secret...] -- $cmd`")
+	}
+
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	manifest := fs.String("manifest", "", "file listing secrets to inject")
+	sigName := fs.String("signal", "", "signal to send instead of restarting, e.g. HUP")
+	interval := fs.Duration("interval", 2*time.Second, "how often to check for changes")
+	var naming envNaming
+	naming.flags(fs)
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	var reload os.Signal
+	if *sigName != "" {
+		if reload, err = parseSignal(*sigName); err != nil {
+			return err
+		}
+	}
+	specs, err := envSpecsFromArgs(*manifest, args)
+	if err != nil {
+		return err
+	}
+	fingerprint, err := secretsFingerprint(specs)
+	if err != nil {
+		return err
+	}
+	cmd, err := startWithEnv(nonInteractive, specs, naming, cmdArgs)
+	if err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case err = <-done:
+			return exitWithStatus(err)
+		case sig := <-sigs:
+			_ = cmd.Process.Signal(sig)
+		case <-ticker.C:
+			fp, err := secretsFingerprint(specs)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "shh: check secrets:", err)
+				continue
+			}
+			if fp == fingerprint {
+				continue
+			}
+			fingerprint = fp
+			if reload != nil {
+				notef(os.Stderr, "shh: secrets changed, sending %s\n", *sigName)
+				_ = cmd.Process.Signal(reload)
+				continue
+			}
+			notef(os.Stderr, "shh: secrets changed, restarting\n")
+			stopProcess(cmd, done)
+			cmd, err = startWithEnv(nonInteractive, specs, naming, cmdArgs)
+			if err != nil {
+				return err
+			}
+			done = make(chan error, 1)
+			go func(cmd *exec.Cmd) { done <- cmd.Wait() }(cmd)
+		}
+	}
+}
+
+// secretsFingerprint hashes the user's encrypted secrets matching the specs.
+func secretsFingerprint(specs []envSpec) ([sha256.Size]byte, error) {
+	var fp [sha256.Size]byte
+	configPath, err := getConfigPath()
+	if err != nil {
+		return fp, err
+	}
+	conf, err := configFromPath(configPath)
+	if err != nil {
+		return fp, err
+	}
+	shh, err := shhFromPathFor(".shh", conf.Username)
+	if err != nil {
+		return fp, err
+	}
+	all := map[string]secret{}
+	for _, spec := range specs {
+		secrets, err := shh.GetSecretsForUser(spec.Name, conf.Username)
+		if err != nil {
+			return fp, fmt.Errorf("%s: %w", spec.Name, err)
+		}
+		for name, sec := range secrets {
+			all[name] = sec
+		}
+	}
+	names := make([]string, 0, len(all))
+	for name := range all {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(h, "%q %q %q\n", name, all[name].AESKey,
+			all[name].Encrypted)
+	}
+	copy(fp[:], h.Sum(nil))
+	return fp, nil
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+// parseSignal reports an error, since Windows can't send signals other than
+// kill to other processes.
+func parseSignal(name string) (os.Signal, error) {
+	return nil, errors.New("--signal is not supported on windows")
+}
+
+// stopProcess kills the command. done receives the result of cmd.Wait.
+func stopProcess(cmd *exec.Cmd, done <-chan error) {
+	_ = cmd.Process.Kill()
+	<-done
+}
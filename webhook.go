@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// webhookPayload is POSTed to each of the project's webhooks when a command
+// changes it. It names what changed, but never includes values.
+//
+// When the user's key is available without a prompt, the body is signed with
+// RSA-PSS over its SHA-256, and the signature sent in Shh-Signature, with
+// the user and their key's fingerprint in Shh-User and Shh-Key. Receivers
+// verify it with the user's public key from the project.
+type webhookPayload struct {
+	Project string         `json:"project"`
+	Time    time.Time      `json:"time"`
+	User    username       `json:"user"`
+	Command string         `json:"command"`
+	Events  []webhookEvent `json:"events"`
+}
+
+type webhookEvent struct {
+	// Type is one of secret.added, secret.changed, secret.deleted,
+	// access.granted, access.revoked, user.added, user.removed,
+	// user.key_changed, or test, sent by `shh notify test`.
+	Type   string   `json:"type"`
+	Secret string   `json:"secret,omitempty"`
+	User   username `json:"user,omitempty"`
+}
+
+// projectName is the name of the directory holding the project file.
+func projectName(pth string) string {
+	dir, err := filepath.Abs(filepath.Dir(pth))
+	if err != nil {
+		dir = filepath.Dir(pth)
+	}
+	return filepath.Base(dir)
+}
+
+func validateWebhook(u string) error {
+	_, u = webhookFormat(u)
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return fmt.Errorf("webhook: %w", err)
+	}
+	if (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+		return fmt.Errorf("webhook %s: expected an http or https url", u)
+	}
+	return nil
+}
+
+// keepForWebhooks holds onto the project as read if it has webhooks, so
+// changes to it can be found when it's written.
+func (s *shh) keepForWebhooks(byt []byte) {
+	if s.Settings != nil && len(s.Settings.Webhooks) > 0 {
+		s.read = byt
+	}
+}
+
+// notifyWebhooks sends the changes since the project was read to its
+// webhooks. Failures are reported but don't fail the command, since the
+// change has already been saved.
+func (s *shh) notifyWebhooks() {
+	if s.read == nil || s.Settings == nil || len(s.Settings.Webhooks) == 0 {
+		return
+	}
+	var buf bytes.Buffer
+	if s.binary {
+		byt, err := s.encodeBinary()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "shh: webhooks: %v\n", err)
+			return
+		}
+		buf.Write(byt)
+	} else if err := s.encodeJSON(&buf); err != nil {
+		fmt.Fprintf(os.Stderr, "shh: webhooks: %v\n", err)
+		return
+	}
+	old, cur := newShh(s.path), newShh(s.path)
+	if err := unmarshalShh(s.read, old); err != nil {
+		fmt.Fprintf(os.Stderr, "shh: webhooks: %v\n", err)
+		return
+	}
+	if err := unmarshalShh(buf.Bytes(), cur); err != nil {
+		fmt.Fprintf(os.Stderr, "shh: webhooks: %v\n", err)
+		return
+	}
+	s.read = buf.Bytes()
+	events := projectEvents(old, cur)
+	if len(events) == 0 {
+		return
+	}
+	payload := webhookPayload{
+		Project: projectName(s.path),
+		Time:    time.Now().UTC().Truncate(time.Second),
+		Command: runningCommand,
+		Events:  events,
+	}
+	for _, err := range sendWebhooks(s.Settings.Webhooks, payload) {
+		fmt.Fprintf(os.Stderr, "shh: webhook %v\n", err)
+	}
+}
+
+// projectEvents lists the changes between two versions of the project.
+func projectEvents(old, cur *shh) []webhookEvent {
+	var events []webhookEvent
+	users := map[username]struct{}{}
+	for u := range old.Keys {
+		users[u] = struct{}{}
+	}
+	for u := range cur.Keys {
+		users[u] = struct{}{}
+	}
+	for _, u := range sortedUsernames(users) {
+		before, after := old.Keys[u], cur.Keys[u]
+		switch {
+		case before == nil:
+			events = append(events, webhookEvent{Type: "user.added", User: u})
+		case after == nil:
+			events = append(events, webhookEvent{Type: "user.removed", User: u})
+		case !bytes.Equal(before.Bytes, after.Bytes):
+			events = append(events, webhookEvent{Type: "user.key_changed", User: u})
+		}
+	}
+
+	oldAccess, curAccess := secretAccess(old), secretAccess(cur)
+	names := make([]string, 0, len(oldAccess)+len(curAccess))
+	for name := range oldAccess {
+		names = append(names, name)
+	}
+	for name := range curAccess {
+		if _, ok := oldAccess[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		before, after := oldAccess[name], curAccess[name]
+		switch {
+		case before == nil:
+			events = append(events, webhookEvent{Type: "secret.added", Secret: name})
+		case after == nil:
+			events = append(events, webhookEvent{Type: "secret.deleted", Secret: name})
+			continue
+		default:
+			var kept, changed int
+			for u, sec := range after {
+				if prev, ok := before[u]; ok {
+					kept++
+					if prev.Encrypted != sec.Encrypted {
+						changed++
+					}
+				}
+			}
+			if kept > 0 && changed == kept {
+				events = append(events, webhookEvent{Type: "secret.changed",
+					Secret: name})
+			}
+		}
+		for _, u := range accessUsers(after) {
+			if _, had := before[u]; !had && before != nil {
+				events = append(events, webhookEvent{Type: "access.granted",
+					Secret: name, User: u})
+			}
+		}
+		for _, u := range accessUsers(before) {
+			if _, has := after[u]; !has {
+				events = append(events, webhookEvent{Type: "access.revoked",
+					Secret: name, User: u})
+			}
+		}
+	}
+	return events
+}
+
+// sendWebhooks POSTs the signed payload to each URL, returning an error for
+// each which failed.
+func sendWebhooks(urls []string, payload webhookPayload) []error {
+	user, signer, fp, err := localSigner()
+	payload.User = user
+	if err != nil {
+		debug("webhook unsigned", "error", err)
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return []error{err}
+	}
+	var sig string
+	if signer != nil {
+		digest := sha256.Sum256(body)
+		byt, err := signer.Sign(rand.Reader, digest[:],
+			&rsa.PSSOptions{Hash: crypto.SHA256})
+		if err != nil {
+			debug("webhook unsigned", "error", err)
+		} else {
+			sig = base64.StdEncoding.EncodeToString(byt)
+		}
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	errs := make([]error, len(urls))
+	_ = parallel(len(urls), func(i int) error {
+		format, u := webhookFormat(urls[i])
+		if format == "" {
+			errs[i] = postWebhook(client, u, body, user, fp, sig)
+		} else {
+			errs[i] = postMessage(client, format, u, payload)
+		}
+		if errs[i] != nil {
+			errs[i] = fmt.Errorf("%s: %w", urls[i], errs[i])
+		}
+		return nil
+	})
+	failed := errs[:0]
+	for _, err := range errs {
+		if err != nil {
+			failed = append(failed, err)
+		}
+	}
+	return failed
+}
+
+func postWebhook(client *http.Client, u string, body []byte, user username, fp, sig string) error {
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "shh")
+	if sig != "" {
+		req.Header.Set("Shh-User", string(user))
+		req.Header.Set("Shh-Key", fp)
+		req.Header.Set("Shh-Signature", sig)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	debug("webhook", "status", resp.StatusCode)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}